@@ -0,0 +1,72 @@
+package circuit
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned by a Breaker while the circuit is open.
+var ErrOpen = errors.New("circuit open -- service unreachable")
+
+// Breaker function, A closure with same function signature as Circuit. It adds extra error handling
+// logic to the Circuit function, also adds exponential back off in case service
+// is continuosly failing. The returned Circuit is safe for concurrent use.
+// The circuit opening and closing is logged to logger, or to slog.Default()
+// if it is nil.
+func Breaker(circuit Circuit, failureThreshold uint64, logger *slog.Logger) Circuit {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	var mu sync.Mutex
+	var lastStateSuccessul = true
+	var consecutiveFailures uint64 = 0
+	var lastAttempt time.Time = time.Now()
+
+	return func(ctx context.Context) (string, error) {
+
+		mu.Lock()
+		if consecutiveFailures >= failureThreshold {
+			backOffLevel := consecutiveFailures - failureThreshold
+			shouldRetryAt := lastAttempt.Add(time.Second * 2 << backOffLevel)
+			if !time.Now().After(shouldRetryAt) {
+				mu.Unlock()
+				return "", ErrOpen
+			}
+		}
+
+		lastAttempt = time.Now()
+		mu.Unlock()
+
+		response, err := circuit(ctx)
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if err != nil {
+			if !lastStateSuccessul {
+				consecutiveFailures++
+			}
+			lastStateSuccessul = false
+
+			if consecutiveFailures >= failureThreshold {
+				logger.WarnContext(ctx, "circuit open",
+					"failures", consecutiveFailures,
+					"retry_in", time.Second*2<<(consecutiveFailures-failureThreshold),
+					"error", err)
+			}
+			return response, err
+		}
+
+		if consecutiveFailures >= failureThreshold {
+			logger.InfoContext(ctx, "circuit closed")
+		}
+		lastStateSuccessul = true
+		consecutiveFailures = 0
+		return response, nil
+	}
+
+}
@@ -4,43 +4,96 @@ package api
 
 import (
 	"errors"
-	"sync"
+	"time"
 )
 
-var store = struct {
-	sync.RWMutex
-	m map[string]string
-}{m: make(map[string]string)}
-
-// Put the value into the key.
-func Put(key, value string) error {
-	store.Lock()
-	store.m[key] = value
-	store.Unlock()
-	return nil
+// Store is a key value store. Implementations are safe for concurrent use.
+//
+// Every write is assigned a version, greater than any version the store
+// assigned before, which callers use to detect concurrent modification.
+type Store interface {
+	// Put the value into the key.
+	Put(key, value string) error
+	// PutWithExpiry puts the value into the key until expiry and returns
+	// the version of the write. A zero expiry never expires; an expiry in
+	// the past deletes the key.
+	PutWithExpiry(key, value string, expiry time.Time) (uint64, error)
+	// CompareAndSwap is like PutWithExpiry but only writes if the key is
+	// at version, returning ErrorVersionMismatch otherwise. NoVersion
+	// requires the key not to exist, AnyVersion requires it to exist.
+	CompareAndSwap(key string, version uint64, value string, expiry time.Time) (uint64, error)
+	// Get the value for a key. Returns empty string and ErrorNoSuchKey in
+	// case key does not exist or has expired.
+	Get(key string) (string, error)
+	// Lookup is like Get but returns the value together with its metadata.
+	Lookup(key string) (Entry, error)
+	// Delete the key and return the version of the delete.
+	Delete(key string) (uint64, error)
+	// CompareAndDelete is like Delete but only deletes if the key is at
+	// version, returning ErrorVersionMismatch otherwise.
+	CompareAndDelete(key string, version uint64) (uint64, error)
+	// Apply performs the ops of a batch atomically: either every op is
+	// applied, in order, or, if a precondition fails, none is. Readers
+	// never observe part of a batch. Returns the version of each op.
+	Apply(ops []Op) ([]uint64, error)
+	// Restore puts an entry with the version it was originally written
+	// at, as recorded in the transaction log. Entries without a version
+	// get a new one.
+	Restore(key string, e Entry) error
+	// RestoreDelete deletes the key as recorded in the transaction log.
+	RestoreDelete(key string, version uint64) error
+	// RestoreBatch restores the ops of a batch recorded in the transaction
+	// log atomically, puts and deletes alike at their recorded Version, as
+	// Restore and RestoreDelete do. Preconditions are not checked.
+	RestoreBatch(ops []Op) error
+	// List returns, in lexical order, up to limit live keys that start
+	// with prefix and sort at or after start, together with their entries.
+	List(prefix, start string, limit int) []KeyValue
+	// RemoveExpired deletes every expired key and returns how many it found.
+	RemoveExpired() int
+	// Snapshot returns a copy of every live key and entry in the store.
+	Snapshot() map[string]Entry
+	// Stats returns the size of the store.
+	Stats() StoreStats
 }
 
-//ErrorNoSuchKey error value indicating key does not exist.
-var ErrorNoSuchKey = errors.New("no such key")
+// StoreStats is the size of a Store. Keys that expired but were not yet
+// removed count too.
+type StoreStats struct {
+	Keys  int // The number of keys.
+	Bytes int // The size of the keys and values.
+}
 
-// Get the value for a key. Returns empty string and error in case
-// key does not exist.
-func Get(key string) (string, error) {
-	store.RLock()
-	value, ok := store.m[key]
-	store.RUnlock()
+// Entry is a value held by a Store.
+type Entry struct {
+	Value   string
+	Expiry  time.Time // When the key expires; zero means never.
+	Version uint64    // The version of the write that stored the value.
+}
 
-	if !ok {
-		return "", ErrorNoSuchKey
-	}
+// KeyValue is a key together with its entry, as returned by List.
+type KeyValue struct {
+	Key string
+	Entry
+}
 
-	return value, nil
+// expired reports whether the entry has expired at now.
+func (e Entry) expired(now time.Time) bool {
+	return !e.Expiry.IsZero() && !now.Before(e.Expiry)
 }
 
-// Delete the key.
-func Delete(key string) error {
-	store.Lock()
-	delete(store.m, key)
-	store.Unlock()
-	return nil
+// TTL returns the time left until the entry expires, or zero if it never
+// expires.
+func (e Entry) TTL() time.Duration {
+	if e.Expiry.IsZero() {
+		return 0
+	}
+	return time.Until(e.Expiry)
 }
+
+// ErrorNoSuchKey error value indicating key does not exist.
+var ErrorNoSuchKey error = &Error{CodeNotFound, errors.New("no such key")}
+
+// ErrorVersionMismatch error value indicating a conditional write found the
+// key at a different version.
+var ErrorVersionMismatch error = &Error{CodePreconditionFailed, errors.New("version mismatch")}
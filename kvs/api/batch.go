@@ -0,0 +1,124 @@
+package api
+
+import (
+	"fmt"
+	"time"
+)
+
+// OpType is the kind of write an Op performs.
+type OpType byte
+
+const (
+	// OpPut puts a value into a key.
+	OpPut OpType = iota + 1
+	// OpDelete deletes a key.
+	OpDelete
+)
+
+// Op is one write of a batch passed to Store.Apply.
+type Op struct {
+	Type   OpType
+	Key    string
+	Value  string    // The value of an OpPut.
+	Expiry time.Time // When the key of an OpPut expires; zero means never.
+	// Conditional makes the op, and so the whole batch, fail unless the
+	// key is at Version when the op is reached, as with CompareAndSwap.
+	Conditional bool
+	Version     uint64
+}
+
+// CheckOps verifies that ops are valid and that their preconditions hold,
+// each against the state left by the ops before it, without applying them.
+// lookup returns the current entry of a key and whether it exists.
+func CheckOps(ops []Op, lookup func(key string) (Entry, bool)) error {
+	return checkOps(ops, lookup, time.Now())
+}
+
+func checkOps(ops []Op, lookup func(key string) (Entry, bool), now time.Time) error {
+	type state struct {
+		e  Entry
+		ok bool
+	}
+	staged := make(map[string]state)
+
+	for i, op := range ops {
+		if op.Type != OpPut && op.Type != OpDelete {
+			return Errorf(CodeInvalidRequest, "operation %d on %q: unknown type %d", i, op.Key, op.Type)
+		}
+
+		st, seen := staged[op.Key]
+		if !seen {
+			st.e, st.ok = lookup(op.Key)
+		}
+
+		if op.Conditional && !satisfies(st.e, st.ok, op.Version) {
+			return fmt.Errorf("operation %d on %q: %w", i, op.Key, ErrorVersionMismatch)
+		}
+
+		// Versions are only assigned once all preconditions hold, so an
+		// earlier op of the batch leaves the key at a version no
+		// precondition can name.
+		if op.Type == OpPut {
+			e := Entry{Value: op.Value, Expiry: op.Expiry}
+			staged[op.Key] = state{e: e, ok: !e.expired(now)}
+		} else {
+			staged[op.Key] = state{}
+		}
+	}
+
+	return nil
+}
+
+// applyOps applies ops to the tables holding their keys, all or none. The
+// preconditions are checked first; only when all hold are the ops applied,
+// each stamped with a version from next. The caller holds the locks of all
+// tables.
+func applyOps(ops []Op, tableOf func(key string) *table, next func() uint64, now time.Time) ([]uint64, error) {
+	err := checkOps(ops, func(key string) (Entry, bool) {
+		return tableOf(key).lookup(key, now)
+	}, now)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]uint64, len(ops))
+	for i, op := range ops {
+		versions[i] = next()
+
+		var e *Entry
+		if op.Type == OpPut {
+			e = &Entry{Value: op.Value, Expiry: op.Expiry}
+		}
+		tableOf(op.Key).update(op.Key, unconditional, e, versions[i], now)
+	}
+
+	return versions, nil
+}
+
+// restoreOps restores ops with the versions recorded in the transaction
+// log. Puts without a version get one from next; advance raises the
+// revision of the store to a recorded version. Either every op is valid
+// and restored or none is. The caller holds the locks of all tables.
+func restoreOps(ops []Op, tableOf func(key string) *table, next func() uint64, advance func(uint64), now time.Time) error {
+	for i, op := range ops {
+		if op.Type != OpPut && op.Type != OpDelete {
+			return Errorf(CodeInvalidRequest, "operation %d on %q: unknown type %d", i, op.Key, op.Type)
+		}
+	}
+
+	for _, op := range ops {
+		if op.Type == OpDelete {
+			advance(op.Version)
+			tableOf(op.Key).remove(op.Key)
+			continue
+		}
+
+		e := Entry{Value: op.Value, Expiry: op.Expiry, Version: op.Version}
+		if e.Version == NoVersion {
+			e.Version = next()
+		}
+		advance(e.Version)
+		tableOf(op.Key).update(op.Key, unconditional, &e, e.Version, now)
+	}
+	return nil
+}
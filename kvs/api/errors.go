@@ -0,0 +1,93 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxKeyLength and MaxValueSize bound keys and values, in bytes. A service
+// may change them before it starts serving.
+var (
+	MaxKeyLength = 1024
+	MaxValueSize = 1 << 20
+)
+
+// ErrorCode classifies an Error for clients. Codes are stable; messages
+// are not.
+type ErrorCode string
+
+const (
+	CodeInternal           ErrorCode = "internal"
+	CodeInvalidRequest     ErrorCode = "invalid_request"
+	CodeInvalidKey         ErrorCode = "invalid_key"
+	CodeValueTooLarge      ErrorCode = "value_too_large"
+	CodeRequestTooLarge    ErrorCode = "request_too_large"
+	CodeUnauthenticated    ErrorCode = "unauthenticated"
+	CodePermissionDenied   ErrorCode = "permission_denied"
+	CodeNotFound           ErrorCode = "not_found"
+	CodeNotAcceptable      ErrorCode = "not_acceptable"
+	CodePreconditionFailed ErrorCode = "precondition_failed"
+	CodeHistoryUnavailable ErrorCode = "history_unavailable"
+	CodeUnavailable        ErrorCode = "unavailable"
+	CodeBadGateway         ErrorCode = "bad_gateway"
+	CodeGatewayTimeout     ErrorCode = "gateway_timeout"
+)
+
+// Error is an error with a code telling clients how to react to it. The
+// error values of this package are Errors, and frontends map codes to
+// their status codes.
+type Error struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+func (e *Error) Unwrap() error { return e.Err }
+
+// Errorf formats an Error with code. As with fmt.Errorf, a %w verb wraps
+// its operand.
+func Errorf(code ErrorCode, format string, a ...interface{}) error {
+	return &Error{Code: code, Err: fmt.Errorf(format, a...)}
+}
+
+// Code returns the code of the first Error in the chain of err, or
+// CodeInternal if there is none.
+func Code(err error) ErrorCode {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return CodeInternal
+}
+
+// ValidateKey returns an Error with CodeInvalidKey unless key is a
+// non-empty UTF-8 string of at most MaxKeyLength bytes without control
+// characters.
+func ValidateKey(key string) error {
+	switch {
+	case key == "":
+		return Errorf(CodeInvalidKey, "key is empty")
+	case len(key) > MaxKeyLength:
+		return Errorf(CodeInvalidKey, "key is longer than %d bytes", MaxKeyLength)
+	case !utf8.ValidString(key):
+		return Errorf(CodeInvalidKey, "key is not valid UTF-8")
+	}
+
+	for _, r := range key {
+		if unicode.IsControl(r) {
+			return Errorf(CodeInvalidKey, "key contains control character %U", r)
+		}
+	}
+	return nil
+}
+
+// ValidateValue returns an Error with CodeValueTooLarge if value is longer
+// than MaxValueSize bytes.
+func ValidateValue(value string) error {
+	if len(value) > MaxValueSize {
+		return Errorf(CodeValueTooLarge, "value is larger than %d bytes", MaxValueSize)
+	}
+	return nil
+}
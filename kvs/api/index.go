@@ -0,0 +1,102 @@
+package api
+
+import "math/rand"
+
+// maxLevel bounds the height of the skip list, enough for well over 2^32
+// keys at p = 1/4.
+const maxLevel = 16
+
+// index is an ordered set of keys, kept as a skip list so that inserts and
+// deletes stay logarithmic for large key counts. It is not safe for
+// concurrent use; stores guard it with the lock of the map it indexes.
+type index struct {
+	head  node
+	level int
+	rnd   *rand.Rand
+}
+
+type node struct {
+	key  string
+	next []*node
+}
+
+func newIndex() *index {
+	return &index{
+		head:  node{next: make([]*node, maxLevel)},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+// randomLevel picks the height of a new node, each level with probability
+// 1/4 of the one below.
+func (ix *index) randomLevel() int {
+	level := 1
+	for level < maxLevel && ix.rnd.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
+
+// seek fills update with the last node before key on every level and
+// returns the node that follows on the bottom level.
+func (ix *index) seek(key string, update []*node) *node {
+	x := &ix.head
+	for i := ix.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// insert adds key to the index, doing nothing if it is already present.
+func (ix *index) insert(key string) {
+	var update [maxLevel]*node
+	if x := ix.seek(key, update[:]); x != nil && x.key == key {
+		return
+	}
+
+	level := ix.randomLevel()
+	for i := ix.level; i < level; i++ {
+		update[i] = &ix.head
+	}
+	if level > ix.level {
+		ix.level = level
+	}
+
+	x := &node{key: key, next: make([]*node, level)}
+	for i := 0; i < level; i++ {
+		x.next[i] = update[i].next[i]
+		update[i].next[i] = x
+	}
+}
+
+// remove deletes key from the index, doing nothing if it is absent.
+func (ix *index) remove(key string) {
+	var update [maxLevel]*node
+	x := ix.seek(key, update[:])
+	if x == nil || x.key != key {
+		return
+	}
+
+	for i := 0; i < len(x.next); i++ {
+		update[i].next[i] = x.next[i]
+	}
+	for ix.level > 1 && ix.head.next[ix.level-1] == nil {
+		ix.level--
+	}
+}
+
+// ascend calls fn for every key at or after start, in order, until fn
+// returns false.
+func (ix *index) ascend(start string, fn func(key string) bool) {
+	for x := ix.seek(start, nil); x != nil; x = x.next[0] {
+		if !fn(x.key) {
+			return
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// keys returns the keys of ix at or after start, in order.
+func (ix *index) keys(start string) []string {
+	var keys []string
+	ix.ascend(start, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// check verifies that every level of ix is sorted and holds only keys of
+// the level below.
+func (ix *index) check(t *testing.T) {
+	t.Helper()
+
+	below := map[string]bool{}
+	for x := ix.head.next[0]; x != nil; x = x.next[0] {
+		below[x.key] = true
+	}
+
+	for i := 0; i < maxLevel; i++ {
+		if i >= ix.level && ix.head.next[i] != nil {
+			t.Fatalf("level %d is in use above the index level %d", i, ix.level)
+		}
+		prev, level := "", map[string]bool{}
+		for x := ix.head.next[i]; x != nil; x = x.next[i] {
+			if prev != "" && x.key <= prev {
+				t.Fatalf("level %d: %q follows %q", i, x.key, prev)
+			}
+			if !below[x.key] {
+				t.Fatalf("level %d: %q is missing below", i, x.key)
+			}
+			prev, level[x.key] = x.key, true
+		}
+		below = level
+	}
+}
+
+func TestIndexMatchesSortedKeys(t *testing.T) {
+	for _, n := range []int{0, 1, 10, 1000, 100000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			ix := newIndex()
+			r := rand.New(rand.NewSource(int64(n)))
+			want := map[string]bool{}
+
+			// Insert keys, some twice, and remove about a third of them.
+			for i := 0; i < n; i++ {
+				k := fmt.Sprintf("key-%08d", r.Intn(2*n))
+				ix.insert(k)
+				want[k] = true
+				if r.Intn(3) == 0 {
+					k = fmt.Sprintf("key-%08d", r.Intn(2*n))
+					ix.remove(k)
+					delete(want, k)
+				}
+			}
+			ix.check(t)
+
+			sorted := make([]string, 0, len(want))
+			for k := range want {
+				sorted = append(sorted, k)
+			}
+			sort.Strings(sorted)
+
+			if got := ix.keys(""); !reflect.DeepEqual(got, sorted) && len(sorted) > 0 {
+				t.Fatalf("index holds %d keys, want %d in order", len(got), len(sorted))
+			}
+
+			// Ascending from any start begins at the first key not before it.
+			for i := 0; i < 100 && n > 0; i++ {
+				start := fmt.Sprintf("key-%08d", r.Intn(2*n))
+				at := sort.SearchStrings(sorted, start)
+				got := ix.keys(start)
+				if len(got) != len(sorted)-at || (len(got) > 0 && got[0] != sorted[at]) {
+					t.Fatalf("ascend(%q) starts at %v, want %v", start, got[:1], sorted[at:at+1])
+				}
+			}
+		})
+	}
+}
+
+func TestIndexRemoveAll(t *testing.T) {
+	ix := newIndex()
+	for i := 0; i < 10000; i++ {
+		ix.insert(fmt.Sprint(i))
+	}
+	for i := 0; i < 10000; i++ {
+		ix.remove(fmt.Sprint(i))
+		ix.remove(fmt.Sprint(i)) // Removing an absent key does nothing.
+	}
+
+	ix.check(t)
+	if keys := ix.keys(""); len(keys) != 0 {
+		t.Errorf("index holds %v after removing every key", keys)
+	}
+	if ix.level != 1 {
+		t.Errorf("empty index at level %d, want 1", ix.level)
+	}
+}
+
+func TestIndexAscendStops(t *testing.T) {
+	ix := newIndex()
+	for _, k := range []string{"d", "b", "a", "c", "e"} {
+		ix.insert(k)
+	}
+
+	var got []string
+	ix.ascend("b", func(key string) bool {
+		got = append(got, key)
+		return key != "c"
+	})
+	if want := []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ascend visited %v, want %v", got, want)
+	}
+}
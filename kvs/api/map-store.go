@@ -0,0 +1,169 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// MapStore keeps every key in a single map guarded by one lock.
+type MapStore struct {
+	sync.RWMutex
+	t        *table
+	revision uint64 // The last version assigned.
+}
+
+// NewMapStore creates an empty MapStore.
+func NewMapStore() Store {
+	return &MapStore{t: newTable()}
+}
+
+// Put the value into the key.
+func (s *MapStore) Put(key, value string) error {
+	_, err := s.PutWithExpiry(key, value, time.Time{})
+	return err
+}
+
+// PutWithExpiry puts the value into the key until expiry.
+func (s *MapStore) PutWithExpiry(key, value string, expiry time.Time) (uint64, error) {
+	return s.update(key, unconditional, &Entry{Value: value, Expiry: expiry})
+}
+
+// CompareAndSwap puts the value into the key if the key is at version.
+func (s *MapStore) CompareAndSwap(key string, version uint64, value string, expiry time.Time) (uint64, error) {
+	return s.update(key, version, &Entry{Value: value, Expiry: expiry})
+}
+
+// Get the value for a key. Returns empty string and error in case
+// key does not exist.
+func (s *MapStore) Get(key string) (string, error) {
+	e, err := s.Lookup(key)
+	return e.Value, err
+}
+
+// Lookup the entry for a key. Expired keys are reported as missing.
+func (s *MapStore) Lookup(key string) (Entry, error) {
+	s.RLock()
+	e, ok := s.t.lookup(key, time.Now())
+	s.RUnlock()
+
+	if !ok {
+		return Entry{}, ErrorNoSuchKey
+	}
+
+	return e, nil
+}
+
+// Delete the key.
+func (s *MapStore) Delete(key string) (uint64, error) {
+	return s.update(key, unconditional, nil)
+}
+
+// CompareAndDelete deletes the key if it is at version.
+func (s *MapStore) CompareAndDelete(key string, version uint64) (uint64, error) {
+	return s.update(key, version, nil)
+}
+
+func (s *MapStore) update(key string, version uint64, e *Entry) (uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.t.update(key, version, e, s.revision+1, time.Now()); err != nil {
+		return 0, err
+	}
+
+	s.revision++
+	return s.revision, nil
+}
+
+// Apply performs the ops of a batch atomically.
+func (s *MapStore) Apply(ops []Op) ([]uint64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	tableOf := func(string) *table { return s.t }
+	next := func() uint64 { s.revision++; return s.revision }
+
+	return applyOps(ops, tableOf, next, time.Now())
+}
+
+// Restore puts an entry with its recorded version.
+func (s *MapStore) Restore(key string, e Entry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if e.Version == NoVersion {
+		e.Version = s.revision + 1
+	}
+	if e.Version > s.revision {
+		s.revision = e.Version
+	}
+
+	return s.t.update(key, unconditional, &e, e.Version, time.Now())
+}
+
+// RestoreDelete deletes the key as recorded in the transaction log.
+func (s *MapStore) RestoreDelete(key string, version uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if version > s.revision {
+		s.revision = version
+	}
+
+	s.t.remove(key)
+	return nil
+}
+
+// RestoreBatch restores the ops of a batch atomically.
+func (s *MapStore) RestoreBatch(ops []Op) error {
+	s.Lock()
+	defer s.Unlock()
+
+	tableOf := func(string) *table { return s.t }
+	next := func() uint64 { s.revision++; return s.revision }
+	advance := func(version uint64) {
+		if version > s.revision {
+			s.revision = version
+		}
+	}
+
+	return restoreOps(ops, tableOf, next, advance, time.Now())
+}
+
+// List returns live keys in lexical order.
+func (s *MapStore) List(prefix, start string, limit int) []KeyValue {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.t.list(nil, prefix, start, limit, time.Now())
+}
+
+// RemoveExpired deletes every expired key.
+func (s *MapStore) RemoveExpired() int {
+	now := time.Now()
+
+	s.Lock()
+	defer s.Unlock()
+
+	return s.t.removeExpired(now)
+}
+
+// Stats returns the size of the store.
+func (s *MapStore) Stats() StoreStats {
+	s.RLock()
+	defer s.RUnlock()
+
+	var st StoreStats
+	s.t.stats(&st)
+	return st
+}
+
+// Snapshot returns a copy of every live key and entry in the store.
+func (s *MapStore) Snapshot() map[string]Entry {
+	s.RLock()
+	defer s.RUnlock()
+
+	m := make(map[string]Entry, len(s.t.m))
+	s.t.copyLive(m, time.Now())
+	return m
+}
@@ -0,0 +1,22 @@
+package api
+
+import (
+	"context"
+	"time"
+)
+
+// Reap removes expired keys from s every interval until ctx is done. Expired
+// keys are already hidden from Get; reaping releases their memory.
+func Reap(ctx context.Context, s Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.RemoveExpired()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ShardedStore splits keys across a fixed number of shards, each a map with
+// its own lock, so writers to different shards do not contend.
+type ShardedStore struct {
+	revision uint64 // The last version assigned, accessed atomically; first for alignment.
+	shards   []*shard
+}
+
+type shard struct {
+	sync.RWMutex
+	t *table
+}
+
+// NewShardedStore creates an empty ShardedStore with n shards.
+func NewShardedStore(n int) Store {
+	if n < 1 {
+		n = 1
+	}
+
+	s := &ShardedStore{shards: make([]*shard, n)}
+	for i := range s.shards {
+		s.shards[i] = &shard{t: newTable()}
+	}
+	return s
+}
+
+// shard returns the shard responsible for key.
+func (s *ShardedStore) shard(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+func (s *ShardedStore) shardIndex(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+// Put the value into the key.
+func (s *ShardedStore) Put(key, value string) error {
+	_, err := s.PutWithExpiry(key, value, time.Time{})
+	return err
+}
+
+// PutWithExpiry puts the value into the key until expiry.
+func (s *ShardedStore) PutWithExpiry(key, value string, expiry time.Time) (uint64, error) {
+	return s.update(key, unconditional, &Entry{Value: value, Expiry: expiry})
+}
+
+// CompareAndSwap puts the value into the key if the key is at version.
+func (s *ShardedStore) CompareAndSwap(key string, version uint64, value string, expiry time.Time) (uint64, error) {
+	return s.update(key, version, &Entry{Value: value, Expiry: expiry})
+}
+
+// Get the value for a key. Returns empty string and error in case
+// key does not exist.
+func (s *ShardedStore) Get(key string) (string, error) {
+	e, err := s.Lookup(key)
+	return e.Value, err
+}
+
+// Lookup the entry for a key. Expired keys are reported as missing.
+func (s *ShardedStore) Lookup(key string) (Entry, error) {
+	sh := s.shard(key)
+	sh.RLock()
+	e, ok := sh.t.lookup(key, time.Now())
+	sh.RUnlock()
+
+	if !ok {
+		return Entry{}, ErrorNoSuchKey
+	}
+
+	return e, nil
+}
+
+// Delete the key.
+func (s *ShardedStore) Delete(key string) (uint64, error) {
+	return s.update(key, unconditional, nil)
+}
+
+// CompareAndDelete deletes the key if it is at version.
+func (s *ShardedStore) CompareAndDelete(key string, version uint64) (uint64, error) {
+	return s.update(key, version, nil)
+}
+
+// update takes the next version from the shared revision counter while
+// holding the shard lock, so versions of a key increase with every write.
+func (s *ShardedStore) update(key string, version uint64, e *Entry) (uint64, error) {
+	sh := s.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	now := time.Now()
+	if !sh.t.matches(key, version, now) {
+		return 0, ErrorVersionMismatch
+	}
+
+	next := atomic.AddUint64(&s.revision, 1)
+	return next, sh.t.update(key, unconditional, e, next, now)
+}
+
+// Apply performs the ops of a batch atomically. It locks every shard the
+// batch touches.
+func (s *ShardedStore) Apply(ops []Op) ([]uint64, error) {
+	defer s.lock(ops)()
+
+	tableOf := func(key string) *table { return s.shard(key).t }
+	next := func() uint64 { return atomic.AddUint64(&s.revision, 1) }
+
+	return applyOps(ops, tableOf, next, time.Now())
+}
+
+// Restore puts an entry with its recorded version.
+func (s *ShardedStore) Restore(key string, e Entry) error {
+	sh := s.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	if e.Version == NoVersion {
+		e.Version = atomic.AddUint64(&s.revision, 1)
+	}
+	s.advance(e.Version)
+
+	return sh.t.update(key, unconditional, &e, e.Version, time.Now())
+}
+
+// RestoreDelete deletes the key as recorded in the transaction log.
+func (s *ShardedStore) RestoreDelete(key string, version uint64) error {
+	sh := s.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+
+	s.advance(version)
+	sh.t.remove(key)
+	return nil
+}
+
+// RestoreBatch restores the ops of a batch atomically, locking the shards
+// it touches as Apply does.
+func (s *ShardedStore) RestoreBatch(ops []Op) error {
+	defer s.lock(ops)()
+
+	tableOf := func(key string) *table { return s.shard(key).t }
+	next := func() uint64 { return atomic.AddUint64(&s.revision, 1) }
+
+	return restoreOps(ops, tableOf, next, s.advance, time.Now())
+}
+
+// lock locks every shard holding a key of ops, in shard order so
+// concurrent batches cannot deadlock, and returns the function unlocking
+// them.
+func (s *ShardedStore) lock(ops []Op) func() {
+	locked := make([]bool, len(s.shards))
+	for _, op := range ops {
+		locked[s.shardIndex(op.Key)] = true
+	}
+
+	for i, sh := range s.shards {
+		if locked[i] {
+			sh.Lock()
+		}
+	}
+
+	return func() {
+		for i, sh := range s.shards {
+			if locked[i] {
+				sh.Unlock()
+			}
+		}
+	}
+}
+
+// advance raises the revision counter to at least version.
+func (s *ShardedStore) advance(version uint64) {
+	for {
+		current := atomic.LoadUint64(&s.revision)
+		if version <= current || atomic.CompareAndSwapUint64(&s.revision, current, version) {
+			return
+		}
+	}
+}
+
+// List returns live keys in lexical order, merging the first limit matches
+// of every shard. Shards are read one at a time, so a listing reflects each
+// key at some point during the call.
+func (s *ShardedStore) List(prefix, start string, limit int) []KeyValue {
+	now := time.Now()
+
+	var kvs []KeyValue
+	for _, sh := range s.shards {
+		sh.RLock()
+		kvs = sh.t.list(kvs, prefix, start, len(kvs)+limit, now)
+		sh.RUnlock()
+	}
+
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+
+	if len(kvs) > limit {
+		kvs = kvs[:limit]
+	}
+	return kvs
+}
+
+// RemoveExpired deletes every expired key, locking one shard at a time.
+func (s *ShardedStore) RemoveExpired() int {
+	now := time.Now()
+
+	n := 0
+	for _, sh := range s.shards {
+		sh.Lock()
+		n += sh.t.removeExpired(now)
+		sh.Unlock()
+	}
+	return n
+}
+
+// Snapshot returns a copy of every live key and entry in the store. Shards
+// are copied one at a time, so the snapshot is consistent per key, not across
+// shards.
+func (s *ShardedStore) Snapshot() map[string]Entry {
+	now := time.Now()
+
+	m := make(map[string]Entry)
+	for _, sh := range s.shards {
+		sh.RLock()
+		sh.t.copyLive(m, now)
+		sh.RUnlock()
+	}
+	return m
+}
+
+// Stats returns the size of the store, summed over the shards.
+func (s *ShardedStore) Stats() StoreStats {
+	var st StoreStats
+	for _, sh := range s.shards {
+		sh.RLock()
+		sh.t.stats(&st)
+		sh.RUnlock()
+	}
+	return st
+}
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// benchmarkKeys is the number of distinct keys the benchmarks touch.
+const benchmarkKeys = 10000
+
+var stores = []struct {
+	name string
+	new  func() Store
+}{
+	{"MapStore", NewMapStore},
+	{"ShardedStore", func() Store { return NewShardedStore(32) }},
+}
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		name, prefix, start string
+		limit               int
+		want                []string
+	}{
+		{"all", "", "", 10, []string{"a", "a/1", "a/2", "ab", "b", "b/1"}},
+		{"limit", "", "", 2, []string{"a", "a/1"}},
+		{"prefix", "a/", "", 10, []string{"a/1", "a/2"}},
+		{"start", "", "ab", 10, []string{"ab", "b", "b/1"}},
+		{"start between keys", "", "a/10", 10, []string{"a/2", "ab", "b", "b/1"}},
+		{"prefix and start", "a", "a/2", 10, []string{"a/2", "ab"}},
+		{"start after prefix", "a", "b", 10, nil},
+		{"no match", "c", "", 10, nil},
+	}
+
+	for _, s := range stores {
+		store := s.new()
+		for _, k := range []string{"b/1", "a/2", "a", "ab", "b", "a/1"} {
+			store.Put(k, "value of "+k)
+		}
+		store.PutWithExpiry("a/expiring", "gone", time.Now().Add(-time.Second))
+		store.PutWithExpiry("a/3", "expired", time.Now().Add(time.Millisecond))
+		time.Sleep(2 * time.Millisecond)
+
+		for _, tt := range tests {
+			t.Run(s.name+"/"+tt.name, func(t *testing.T) {
+				var got []string
+				for _, kv := range store.List(tt.prefix, tt.start, tt.limit) {
+					if kv.Value != "value of "+kv.Key {
+						t.Errorf("%q listed with value %q", kv.Key, kv.Value)
+					}
+					got = append(got, kv.Key)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("List(%q, %q, %d) = %q, want %q",
+						tt.prefix, tt.start, tt.limit, got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+// TestListPages pages through many keys, each page starting after the
+// last key of the one before.
+func TestListPages(t *testing.T) {
+	const n, pageSize = 20000, 333
+
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			store := s.new()
+			for _, i := range rand.Perm(n) {
+				store.Put(fmt.Sprintf("key-%06d", i), "v")
+			}
+
+			listed, start := 0, ""
+			for {
+				page := store.List("key-", start, pageSize)
+				for _, kv := range page {
+					if want := fmt.Sprintf("key-%06d", listed); kv.Key != want {
+						t.Fatalf("listed %q, want %q", kv.Key, want)
+					}
+					listed++
+				}
+				if len(page) < pageSize {
+					break
+				}
+				start = page[len(page)-1].Key + "\x00"
+			}
+			if listed != n {
+				t.Errorf("listed %d keys, want %d", listed, n)
+			}
+		})
+	}
+}
+
+func TestRestoreBatch(t *testing.T) {
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			store := s.new()
+			store.Put("deleted", "v")
+
+			err := store.RestoreBatch([]Op{
+				{Type: OpPut, Key: "a", Value: "1", Version: 7},
+				{Type: OpDelete, Key: "deleted", Version: 8},
+				{Type: OpPut, Key: "b", Value: "2"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Recorded versions are kept and the store goes on after them.
+			if e, err := store.Lookup("a"); err != nil || e.Value != "1" || e.Version != 7 {
+				t.Errorf("a = %+v, %v, want 1 at version 7", e, err)
+			}
+			if _, err := store.Get("deleted"); err != ErrorNoSuchKey {
+				t.Errorf("deleted key still there: %v", err)
+			}
+			if e, _ := store.Lookup("b"); e.Version != 9 {
+				t.Errorf("b restored at version %d, want 9", e.Version)
+			}
+			if v, _ := store.PutWithExpiry("c", "3", time.Time{}); v != 10 {
+				t.Errorf("next write at version %d, want 10", v)
+			}
+
+			// A batch with an invalid op restores nothing.
+			err = store.RestoreBatch([]Op{{Type: OpPut, Key: "d", Value: "4", Version: 11}, {Key: "e"}})
+			if err == nil {
+				t.Error("invalid op restored")
+			}
+			if _, err := store.Get("d"); err != ErrorNoSuchKey {
+				t.Errorf("part of an invalid batch restored: %v", err)
+			}
+		})
+	}
+}
+
+// benchmarkMixed runs Gets and Puts on random keys from parallel goroutines,
+// reads making up readPercent of the operations.
+func benchmarkMixed(b *testing.B, readPercent int) {
+	keys := make([]string, benchmarkKeys)
+	for i := range keys {
+		keys[i] = "key-" + strconv.Itoa(i)
+	}
+
+	for _, s := range stores {
+		b.Run(s.name, func(b *testing.B) {
+			store := s.new()
+			for _, k := range keys {
+				store.Put(k, "initial value")
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					k := keys[r.Intn(len(keys))]
+					if r.Intn(100) < readPercent {
+						store.Get(k)
+					} else {
+						store.Put(k, "updated value")
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkReadHeavy(b *testing.B)  { benchmarkMixed(b, 90) }
+func BenchmarkBalanced(b *testing.B)   { benchmarkMixed(b, 50) }
+func BenchmarkWriteHeavy(b *testing.B) { benchmarkMixed(b, 10) }
+
+// BenchmarkHotKey has every goroutine read and write the same key, the
+// worst case for both stores.
+func BenchmarkHotKey(b *testing.B) {
+	for _, s := range stores {
+		b.Run(s.name, func(b *testing.B) {
+			store := s.new()
+			store.Put("hot", "initial value")
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if i%2 == 0 {
+						store.Get("hot")
+					} else {
+						store.Put("hot", "updated value")
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			store := s.new()
+			later := time.Now().Add(time.Hour)
+			store.Put("forever", "v")
+			store.PutWithExpiry("later", "v", later)
+			store.PutWithExpiry("soon", "v", time.Now().Add(5*time.Millisecond))
+			store.PutWithExpiry("past", "v", time.Now().Add(-time.Second))
+			time.Sleep(10 * time.Millisecond)
+
+			for _, key := range []string{"soon", "past"} {
+				if _, err := store.Get(key); err != ErrorNoSuchKey {
+					t.Errorf("Get(%q) = %v, want ErrorNoSuchKey", key, err)
+				}
+			}
+			if e, err := store.Lookup("later"); err != nil || !e.Expiry.Equal(later) {
+				t.Errorf("Lookup(later) = %+v, %v, want expiry %v", e, err, later)
+			}
+
+			var listed []string
+			for _, kv := range store.List("", "", 10) {
+				listed = append(listed, kv.Key)
+			}
+			if want := []string{"forever", "later"}; !reflect.DeepEqual(listed, want) {
+				t.Errorf("List() = %q, want %q", listed, want)
+			}
+
+			snapshot := store.Snapshot()
+			if _, ok := snapshot["soon"]; ok || len(snapshot) != 2 {
+				t.Errorf("Snapshot() = %v, want forever and later", snapshot)
+			}
+
+			// An expired key is missing to conditional writes too.
+			if _, err := store.CompareAndSwap("soon", AnyVersion, "v", time.Time{}); err != ErrorVersionMismatch {
+				t.Errorf("CompareAndSwap(soon, AnyVersion) = %v, want ErrorVersionMismatch", err)
+			}
+
+			// A key put already expired is not kept; one that expired
+			// since is, until reaped.
+			if keys := store.Stats().Keys; keys != 3 {
+				t.Errorf("Stats().Keys = %d before reaping, want 3", keys)
+			}
+			if n := store.RemoveExpired(); n != 1 {
+				t.Errorf("RemoveExpired() = %d, want 1", n)
+			}
+			if keys := store.Stats().Keys; keys != 2 {
+				t.Errorf("Stats().Keys = %d after reaping, want 2", keys)
+			}
+		})
+	}
+}
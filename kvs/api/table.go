@@ -0,0 +1,130 @@
+package api
+
+import (
+	"strings"
+	"time"
+)
+
+// table is a map of entries together with an ordered index of its keys. It
+// is not safe for concurrent use; stores guard each table with a lock.
+type table struct {
+	m     map[string]Entry
+	keys  *index
+	bytes int // The size of the keys and values in m.
+}
+
+func newTable() *table {
+	return &table{m: make(map[string]Entry), keys: newIndex()}
+}
+
+// lookup returns the entry of key unless it is missing or expired at now.
+func (t *table) lookup(key string, now time.Time) (Entry, bool) {
+	e, ok := t.m[key]
+	if !ok || e.expired(now) {
+		return Entry{}, false
+	}
+	return e, true
+}
+
+// matches reports whether the entry of key satisfies version.
+func (t *table) matches(key string, version uint64, now time.Time) bool {
+	e, ok := t.lookup(key, now)
+	return satisfies(e, ok, version)
+}
+
+// satisfies reports whether an entry, present if ok, satisfies version.
+func satisfies(e Entry, ok bool, version uint64) bool {
+	switch version {
+	case unconditional:
+		return true
+	case AnyVersion:
+		return ok
+	case NoVersion:
+		return !ok
+	default:
+		return ok && e.Version == version
+	}
+}
+
+// update applies a write if the key satisfies version: it stores e, stamped
+// with next, or deletes the key when e is nil or already expired.
+func (t *table) update(key string, version uint64, e *Entry, next uint64, now time.Time) error {
+	if !t.matches(key, version, now) {
+		return ErrorVersionMismatch
+	}
+
+	if e == nil || e.expired(now) {
+		t.remove(key)
+		return nil
+	}
+
+	e.Version = next
+	t.set(key, *e)
+	return nil
+}
+
+func (t *table) set(key string, e Entry) {
+	if old, ok := t.m[key]; ok {
+		t.bytes -= len(old.Value)
+	} else {
+		t.keys.insert(key)
+		t.bytes += len(key)
+	}
+	t.m[key] = e
+	t.bytes += len(e.Value)
+}
+
+func (t *table) remove(key string) {
+	if e, ok := t.m[key]; ok {
+		delete(t.m, key)
+		t.keys.remove(key)
+		t.bytes -= len(key) + len(e.Value)
+	}
+}
+
+// stats adds the size of t to s.
+func (t *table) stats(s *StoreStats) {
+	s.Keys += len(t.m)
+	s.Bytes += t.bytes
+}
+
+// removeExpired deletes the entries that expired at now.
+func (t *table) removeExpired(now time.Time) int {
+	n := 0
+	for k, e := range t.m {
+		if e.expired(now) {
+			t.remove(k)
+			n++
+		}
+	}
+	return n
+}
+
+// copyLive copies the entries that have not expired at now into dst.
+func (t *table) copyLive(dst map[string]Entry, now time.Time) {
+	for k, e := range t.m {
+		if !e.expired(now) {
+			dst[k] = e
+		}
+	}
+}
+
+// list appends to kvs, in order, up to limit live entries whose keys start
+// with prefix and sort at or after start.
+func (t *table) list(kvs []KeyValue, prefix, start string, limit int, now time.Time) []KeyValue {
+	if start < prefix {
+		start = prefix
+	}
+
+	t.keys.ascend(start, func(key string) bool {
+		if !strings.HasPrefix(key, prefix) || len(kvs) >= limit {
+			return false
+		}
+		if e, ok := t.lookup(key, now); ok {
+			kvs = append(kvs, KeyValue{Key: key, Entry: e})
+		}
+		return true
+	})
+
+	return kvs
+}
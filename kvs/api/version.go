@@ -0,0 +1,13 @@
+package api
+
+const (
+	// NoVersion is the version of a key that does not exist. Passed to
+	// CompareAndSwap it requires the key to be absent.
+	NoVersion uint64 = 0
+	// AnyVersion passed to CompareAndSwap or CompareAndDelete requires the
+	// key to exist, whatever its version.
+	AnyVersion uint64 = ^uint64(0)
+
+	// unconditional marks a write without precondition.
+	unconditional = AnyVersion - 1
+)
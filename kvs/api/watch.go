@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// watchBuffer is how many changes a watcher may fall behind before it is
+// dropped.
+const watchBuffer = 256
+
+// wholeSequence is the index of the last change of any sequence number:
+// resuming after it resumes after all changes sharing the sequence number.
+const wholeSequence = int(^uint(0) >> 1)
+
+// ErrorHistoryUnavailable error value indicating the changes after a
+// sequence number are no longer, or were never, held by a Feed.
+var ErrorHistoryUnavailable error = &Error{CodeHistoryUnavailable,
+	errors.New("change history unavailable")}
+
+// Change is a write to the store, as persisted in the transaction log.
+type Change struct {
+	// Sequence is the position of the change in the transaction log. The
+	// changes of an atomic batch may share a sequence number.
+	Sequence uint64
+	// Index is the position of the change among those sharing its
+	// sequence number, from 0. Publish sets it.
+	Index int
+	Type  OpType
+	Key   string
+	Entry // Value and Expiry are zero for an OpDelete.
+}
+
+// Feed distributes changes to watchers and keeps the most recent ones, so
+// that watchers can resume after the last change they received. It is safe
+// for concurrent use.
+type Feed struct {
+	mu           sync.Mutex
+	history      []Change // The most recent changes, oldest first.
+	size         int      // How many changes history holds at most.
+	horizon      uint64   // WatchFrom needs a sequence number at or after it.
+	horizonIndex int      // The index of the last change of horizon dropped from history.
+	last         uint64   // The sequence number of the last change.
+	lastIndex    int      // The index of the last change.
+	watchers     map[*watcher]struct{}
+	closed       bool
+}
+
+type watcher struct {
+	prefix string
+	ch     chan Change
+}
+
+// NewFeed returns a Feed that keeps the last size changes. sequence is the
+// sequence number of the last change made before the feed was created.
+func NewFeed(size int, sequence uint64) *Feed {
+	return &Feed{
+		size:         size,
+		horizon:      sequence,
+		horizonIndex: wholeSequence,
+		last:         sequence,
+		watchers:     make(map[*watcher]struct{}),
+	}
+}
+
+// Publish passes changes, which must be in sequence order and not precede
+// those published before, to every watcher of their keys, numbering the
+// changes sharing a sequence number, even across calls. A watcher receives
+// either all of the changes it watches or, if it has fallen too far behind,
+// none: its channel is closed instead and it has to resume with WatchFrom.
+func (f *Feed) Publish(changes []Change) {
+	if len(changes) == 0 {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.history = append(f.history, changes...)
+	changes = f.history[len(f.history)-len(changes):]
+	for i := range changes {
+		if changes[i].Sequence == f.last {
+			f.lastIndex++
+		} else {
+			f.last, f.lastIndex = changes[i].Sequence, 0
+		}
+		changes[i].Index = f.lastIndex
+	}
+
+	if n := len(f.history) - f.size; n > 0 {
+		f.horizon, f.horizonIndex = f.history[n-1].Sequence, f.history[n-1].Index
+		f.history = f.history[n:]
+	}
+
+	for w := range f.watchers {
+		matching := w.filter(changes)
+		if len(w.ch)+len(matching) > cap(w.ch) {
+			f.drop(w)
+			continue
+		}
+		for _, c := range matching {
+			w.ch <- c
+		}
+	}
+}
+
+// Watch returns a channel receiving the changes to keys starting with
+// prefix published from now on. The channel is closed when ctx is done,
+// the feed is closed or the watcher falls too far behind.
+func (f *Feed) Watch(ctx context.Context, prefix string) <-chan Change {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.watch(ctx, prefix, nil)
+}
+
+// WatchFrom is like Watch but first delivers the changes with a sequence
+// number after the given one, so that a watcher resuming with the sequence
+// number of the last change it received misses none. It returns
+// ErrorHistoryUnavailable if the feed no longer holds all of them.
+func (f *Feed) WatchFrom(ctx context.Context, prefix string, sequence uint64) (<-chan Change, error) {
+	return f.WatchAfter(ctx, prefix, sequence, wholeSequence)
+}
+
+// WatchAfter is like WatchFrom but resumes after the change at index among
+// those sharing the sequence number, so that a watcher that received part
+// of a batch receives the rest.
+func (f *Feed) WatchAfter(ctx context.Context, prefix string, sequence uint64, index int) (<-chan Change, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if sequence < f.horizon || (sequence == f.horizon && index < f.horizonIndex) ||
+		sequence > f.last {
+		return nil, ErrorHistoryUnavailable
+	}
+
+	var backlog []Change
+	for _, c := range f.history {
+		if c.Sequence > sequence || (c.Sequence == sequence && c.Index > index) {
+			backlog = append(backlog, c)
+		}
+	}
+
+	return f.watch(ctx, prefix, backlog), nil
+}
+
+// watch registers a watcher that starts with the matching changes of
+// backlog. The caller holds the lock.
+func (f *Feed) watch(ctx context.Context, prefix string, backlog []Change) <-chan Change {
+	w := &watcher{prefix: prefix}
+	backlog = w.filter(backlog)
+
+	w.ch = make(chan Change, watchBuffer+len(backlog))
+	for _, c := range backlog {
+		w.ch <- c
+	}
+
+	if f.closed {
+		close(w.ch)
+		return w.ch
+	}
+	f.watchers[w] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+
+		f.mu.Lock()
+		f.drop(w)
+		f.mu.Unlock()
+	}()
+
+	return w.ch
+}
+
+// drop closes the channel of w, unless it was dropped before. The caller
+// holds the lock.
+func (f *Feed) drop(w *watcher) {
+	if _, ok := f.watchers[w]; ok {
+		delete(f.watchers, w)
+		close(w.ch)
+	}
+}
+
+// Last returns the sequence number of the last change published.
+func (f *Feed) Last() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.last
+}
+
+// Reset forgets the history and closes the channels of all watchers, which
+// have to resume after sequence, the sequence number of the state the store
+// was replaced with.
+func (f *Feed) Reset(sequence uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for w := range f.watchers {
+		f.drop(w)
+	}
+	f.history = nil
+	f.horizon, f.horizonIndex = sequence, wholeSequence
+	f.last, f.lastIndex = sequence, 0
+}
+
+// Close closes the channels of all watchers, and those of any watchers
+// added later right away.
+func (f *Feed) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	for w := range f.watchers {
+		f.drop(w)
+	}
+}
+
+// filter returns the changes to keys w watches.
+func (w *watcher) filter(changes []Change) []Change {
+	if w.prefix == "" {
+		return changes
+	}
+
+	var matching []Change
+	for _, c := range changes {
+		if strings.HasPrefix(c.Key, w.prefix) {
+			matching = append(matching, c)
+		}
+	}
+	return matching
+}
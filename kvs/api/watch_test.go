@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// batch returns changes to keys sharing the sequence number.
+func batch(sequence uint64, keys ...string) []Change {
+	changes := make([]Change, len(keys))
+	for i, k := range keys {
+		changes[i] = Change{Sequence: sequence, Type: OpPut, Key: k}
+	}
+	return changes
+}
+
+// received returns the keys and indexes of the changes waiting in ch.
+func received(ch <-chan Change) []string {
+	var got []string
+	for len(ch) > 0 {
+		c := <-ch
+		got = append(got, c.Key+"@"+string(rune('0'+c.Index)))
+	}
+	return got
+}
+
+func TestFeedIndexesBatches(t *testing.T) {
+	f := NewFeed(100, 0)
+	ch := f.Watch(context.Background(), "")
+
+	f.Publish(batch(1, "a"))
+	f.Publish(batch(2, "b", "c", "d"))
+	// A follower publishes the changes of a batch one at a time.
+	f.Publish(batch(3, "e"))
+	f.Publish(batch(3, "f"))
+	f.Publish(batch(4, "g"))
+
+	want := []string{"a@0", "b@0", "c@1", "d@2", "e@0", "f@1", "g@0"}
+	if got := received(ch); !reflect.DeepEqual(got, want) {
+		t.Errorf("received %v, want %v", got, want)
+	}
+}
+
+func TestFeedWatchAfter(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		sequence uint64
+		index    int
+		want     []string
+		err      error
+	}{
+		{"mid batch", 100, 2, 0, []string{"c@1", "d@2", "e@0"}, nil},
+		{"end of batch", 100, 2, 2, []string{"e@0"}, nil},
+		{"whole sequence", 100, 2, wholeSequence, []string{"e@0"}, nil},
+		{"before first", 100, 0, wholeSequence, []string{"a@0", "b@0", "c@1", "d@2", "e@0"}, nil},
+		{"last", 100, 3, 0, nil, nil},
+		{"after last", 100, 4, 0, nil, ErrorHistoryUnavailable},
+		// History holds c, d and e; b was dropped.
+		{"dropped part of batch", 3, 2, 0, []string{"c@1", "d@2", "e@0"}, nil},
+		{"dropped change", 3, 1, wholeSequence, nil, ErrorHistoryUnavailable},
+		// History holds d and e.
+		{"dropped rest of batch", 2, 2, 0, nil, ErrorHistoryUnavailable},
+		{"after dropped", 2, 2, 1, []string{"d@2", "e@0"}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFeed(tt.size, 0)
+			f.Publish(batch(1, "a"))
+			f.Publish(batch(2, "b", "c", "d"))
+			f.Publish(batch(3, "e"))
+
+			ch, err := f.WatchAfter(context.Background(), "", tt.sequence, tt.index)
+			if err != tt.err {
+				t.Fatalf("WatchAfter(%d, %d) = %v, want %v", tt.sequence, tt.index, err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if got := received(ch); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("WatchAfter(%d, %d) sent %v, want %v", tt.sequence, tt.index, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeedResetDropsPartialBatches(t *testing.T) {
+	f := NewFeed(100, 0)
+	f.Publish(batch(1, "a", "b"))
+	f.Reset(1)
+
+	if _, err := f.WatchAfter(context.Background(), "", 1, 0); err != ErrorHistoryUnavailable {
+		t.Errorf("resuming within a batch before a reset: %v, want %v", err, ErrorHistoryUnavailable)
+	}
+	if _, err := f.WatchFrom(context.Background(), "", 1); err != nil {
+		t.Errorf("resuming after the reset: %v", err)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/auth"
+	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// authn identifies the principals making requests. If it is nil, anyone
+// may do anything.
+var authn auth.Authenticator
+
+// acl decides what principals may do.
+var acl *auth.ACL
+
+// audit records the requests refused.
+var audit *auth.AuditLog
+
+// access identifies a request for authorization and auditing.
+type access struct {
+	principal string
+	operation string // E.g. "PUT /v1/key" or a gRPC method.
+	remote    string // The client address.
+}
+
+type accessKey struct{}
+
+// startAuth sets up authentication, the ACL and the audit log. Requests
+// need credentials once static tokens, a JWT key or client certificate
+// permissions are configured; verified client certificates then
+// authenticate too.
+func startAuth(c config) error {
+	grants := c.Auth.ACL
+	for subject, perms := range c.TLS.ClientPermissions {
+		g := auth.Grant{Principal: subject}
+		for _, p := range perms {
+			g.Permissions = append(g.Permissions, auth.Permission(p))
+		}
+		grants = append(grants, g)
+	}
+
+	var chain auth.Chain
+	if len(c.Auth.Tokens) > 0 {
+		tokens := make(map[string]string, len(c.Auth.Tokens))
+		for _, t := range c.Auth.Tokens {
+			tokens[t.Token] = t.Principal
+		}
+		chain = append(chain, auth.NewTokenAuthenticator(tokens))
+	}
+	if c.Auth.JWT.KeyFile != "" {
+		key, err := os.ReadFile(c.Auth.JWT.KeyFile)
+		if err != nil {
+			return fmt.Errorf("cannot read jwt key: %w", err)
+		}
+		chain = append(chain, auth.NewJWTAuthenticator(auth.JWTParams{
+			Key: key, Issuer: c.Auth.JWT.Issuer, Audience: c.Auth.JWT.Audience,
+			Leeway: jwtLeeway}))
+	}
+	if len(c.TLS.ClientPermissions) > 0 || (len(chain) > 0 && c.TLS.ClientCAFile != "") {
+		chain = append(chain, auth.NewCertAuthenticator())
+	}
+
+	if len(chain) == 0 {
+		return nil
+	}
+
+	if c.Auth.AuditLog == "" {
+		audit = auth.NewAuditLog(os.Stderr)
+	} else {
+		var err error
+		if audit, err = auth.OpenAuditLog(c.Auth.AuditLog); err != nil {
+			return fmt.Errorf("cannot open audit log: %w", err)
+		}
+	}
+
+	if c.Auth.PeerToken != "" {
+		peerClient = &http.Client{Transport: &bearerTransport{
+			token: c.Auth.PeerToken, base: peerClient.Transport}}
+	}
+
+	authn, acl = chain, auth.NewACL(grants)
+	return nil
+}
+
+// jwtLeeway tolerates clock skew between the token issuer and this node.
+const jwtLeeway = 30 * time.Second
+
+// bearerTransport authenticates the requests of a node to other nodes with
+// a token, unless they carry credentials already, as forwarded requests do.
+type bearerTransport struct {
+	token string
+	base  http.RoundTripper // http.DefaultTransport if nil.
+}
+
+func (t *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	if r.Header.Get("Authorization") != "" {
+		return base.RoundTrip(r)
+	}
+
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return base.RoundTrip(r)
+}
+
+// authenticate identifies the principal presenting cr, recording failures
+// in the audit log.
+func authenticate(ctx context.Context, cr auth.Credentials, operation, remote string) (context.Context, error) {
+	if authn == nil {
+		return ctx, nil
+	}
+
+	principal, err := authn.Authenticate(cr)
+	if err != nil {
+		audit.Record(auth.AuditRecord{Decision: auth.Unauthenticated,
+			Remote: remote, Operation: operation, Reason: err.Error()})
+		return ctx, api.Errorf(api.CodeUnauthenticated, "authentication required: %v", err)
+	}
+
+	return context.WithValue(ctx, accessKey{}, access{principal, operation, remote}), nil
+}
+
+// authorize checks that the principal of ctx has perm on resource, a key
+// or key prefix, recording refusals in the audit log.
+func authorize(ctx context.Context, perm auth.Permission, resource string) error {
+	if authn == nil {
+		return nil
+	}
+
+	a, _ := ctx.Value(accessKey{}).(access)
+	if acl.Allows(a.principal, perm, resource) {
+		return nil
+	}
+
+	audit.Record(auth.AuditRecord{Decision: auth.Denied, Principal: a.principal,
+		Remote: a.remote, Operation: a.operation, Permission: perm, Resource: resource})
+	return api.Errorf(api.CodePermissionDenied,
+		"%s lacks permission %q on %q", a.principal, perm, resource)
+}
+
+// authenticated wraps the router so that every request but health checks
+// and metrics scrapes needs valid credentials.
+func authenticated(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == metricsPath {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		ctx, err := authenticate(r.Context(), auth.FromRequest(r),
+			r.Method+" "+r.URL.Path, r.RemoteAddr)
+
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="kvs"`)
+			writeError(w, r, err)
+			return
+		}
+
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requires wraps a handler so that it needs perm on the resource of the
+// request.
+func requires(perm auth.Permission, resource func(*http.Request) string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := authorize(r.Context(), perm, resource(r)); err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// keyResource is the key of a "/v1/{key}" request.
+func keyResource(r *http.Request) string { return mux.Vars(r)["key"] }
+
+// prefixResource is the "prefix" query parameter of a listing or watch.
+func prefixResource(r *http.Request) string { return r.URL.Query().Get("prefix") }
+
+// allResource stands for every key, and for requests about none.
+func allResource(*http.Request) string { return "" }
+
+// opPermission returns the permission a batch op needs.
+func opPermission(op api.Op) auth.Permission {
+	if op.Type == api.OpDelete {
+		return auth.Delete
+	}
+	return auth.Write
+}
+
+// authorizeOps checks the permissions of the ops of a batch.
+func authorizeOps(ctx context.Context, ops []api.Op) error {
+	for _, op := range ops {
+		if err := authorize(ctx, opPermission(op), op.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// grpcCredentials returns the credentials of a gRPC call: a bearer token
+// in the "authorization" metadata and the TLS state of its connection.
+func grpcCredentials(ctx context.Context) (auth.Credentials, string) {
+	var cr auth.Credentials
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			cr.Bearer = auth.BearerToken(v[0])
+		}
+	}
+
+	var remote string
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			cr.TLS = &info.State
+		}
+	}
+	return cr, remote
+}
+
+// authUnaryInterceptor authenticates unary gRPC calls.
+func authUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	cr, remote := grpcCredentials(ctx)
+
+	ctx, err := authenticate(ctx, cr, info.FullMethod, remote)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return handler(ctx, req)
+}
+
+// authStreamInterceptor authenticates streaming gRPC calls.
+func authStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	cr, remote := grpcCredentials(ss.Context())
+
+	ctx, err := authenticate(ss.Context(), cr, info.FullMethod, remote)
+	if err != nil {
+		return grpcError(err)
+	}
+	return handler(srv, &contextStream{ss, ctx})
+}
+
+// contextStream is a server stream with the context of an interceptor,
+// which carries the principal or the span of the call.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context { return s.ctx }
@@ -0,0 +1,53 @@
+package auth
+
+import "strings"
+
+// Everyone is the principal of grants that apply to every authenticated
+// principal.
+const Everyone = "*"
+
+// Grant gives a principal permissions on the keys starting with Prefix.
+// An empty prefix covers every key, and the requests not about keys, such
+// as cluster membership changes.
+type Grant struct {
+	Principal   string       `json:"principal"`
+	Prefix      string       `json:"prefix"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// ACL decides which permissions principals have. It is safe for
+// concurrent use, as it never changes.
+type ACL struct {
+	grants map[string][]Grant
+}
+
+// NewACL returns an ACL made of grants.
+func NewACL(grants []Grant) *ACL {
+	a := &ACL{grants: make(map[string][]Grant)}
+	for _, g := range grants {
+		a.grants[g.Principal] = append(a.grants[g.Principal], g)
+	}
+	return a
+}
+
+// Allows reports whether principal has perm on resource: a key, or a key
+// prefix standing for every key that starts with it. A grant covers a
+// prefix if its own prefix is a prefix of it.
+func (a *ACL) Allows(principal string, perm Permission, resource string) bool {
+	return a.allows(a.grants[principal], perm, resource) ||
+		a.allows(a.grants[Everyone], perm, resource)
+}
+
+func (a *ACL) allows(grants []Grant, perm Permission, resource string) bool {
+	for _, g := range grants {
+		if !strings.HasPrefix(resource, g.Prefix) {
+			continue
+		}
+		for _, p := range g.Permissions {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package auth
+
+import "testing"
+
+func TestACL(t *testing.T) {
+	acl := NewACL([]Grant{
+		{Principal: "alice", Prefix: "a/", Permissions: []Permission{Read, Write}},
+		{Principal: "alice", Prefix: "shared/", Permissions: []Permission{Read}},
+		{Principal: "admin", Prefix: "", Permissions: []Permission{Read, Admin}},
+		{Principal: Everyone, Prefix: "public/", Permissions: []Permission{Read}},
+	})
+
+	tests := []struct {
+		principal string
+		perm      Permission
+		resource  string
+		ok        bool
+	}{
+		{"alice", Read, "a/key", true},
+		{"alice", Write, "a/key", true},
+		{"alice", Delete, "a/key", false},
+		{"alice", Read, "a/", true},         // The prefix of the grant.
+		{"alice", Read, "a/sub/", true},     // A narrower prefix.
+		{"alice", Read, "a", false},         // A wider prefix.
+		{"alice", Read, "", false},          // Every key.
+		{"alice", Read, "b/key", false},     // Another prefix.
+		{"alice", Write, "shared/x", false}, // Granted another permission there.
+		{"alice", Read, "public/x", true},   // Granted to everyone.
+		{"admin", Read, "", true},           // The empty prefix covers everything.
+		{"admin", Read, "any/key", true},
+		{"admin", Admin, "", true},
+		{"admin", Write, "any/key", false},
+		{"bob", Read, "public/x", true},
+		{"bob", Read, "public", false},
+		{"bob", Read, "a/key", false},
+		{"", Read, "public/x", true},
+		{"", Read, "", false},
+	}
+
+	for _, tt := range tests {
+		if got := acl.Allows(tt.principal, tt.perm, tt.resource); got != tt.ok {
+			t.Errorf("Allows(%q, %s, %q) = %v, want %v", tt.principal, tt.perm, tt.resource, got, tt.ok)
+		}
+	}
+}
+
+func TestParsePermission(t *testing.T) {
+	for _, s := range []string{"read", "write", "delete", "admin"} {
+		if p, err := ParsePermission(s); err != nil || string(p) != s {
+			t.Errorf("ParsePermission(%q) = %q, %v", s, p, err)
+		}
+	}
+	for _, s := range []string{"", "Read", "all"} {
+		if _, err := ParsePermission(s); err == nil {
+			t.Errorf("ParsePermission(%q) accepted", s)
+		}
+	}
+}
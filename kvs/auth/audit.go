@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Decisions recorded in the audit log.
+const (
+	Unauthenticated = "unauthenticated" // The credentials were missing or invalid.
+	Denied          = "denied"          // The principal lacks the permission.
+)
+
+// AuditRecord describes a refused request.
+type AuditRecord struct {
+	Time       time.Time  `json:"time"`
+	Decision   string     `json:"decision"`
+	Principal  string     `json:"principal,omitempty"`
+	Remote     string     `json:"remote"`    // The client address.
+	Operation  string     `json:"operation"` // E.g. "PUT /v1/key" or a gRPC method.
+	Permission Permission `json:"permission,omitempty"`
+	Resource   string     `json:"resource,omitempty"` // The key or key prefix.
+	Reason     string     `json:"reason,omitempty"`
+}
+
+// AuditLog writes audit records as lines of JSON. It is safe for
+// concurrent use.
+type AuditLog struct {
+	mu  sync.Mutex
+	w   io.Writer
+	enc *json.Encoder
+}
+
+// NewAuditLog returns an AuditLog writing to w.
+func NewAuditLog(w io.Writer) *AuditLog {
+	return &AuditLog{w: w, enc: json.NewEncoder(w)}
+}
+
+// OpenAuditLog returns an AuditLog appending to the file at path.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuditLog(f), nil
+}
+
+// Record writes rec, stamped with the current time if it has none.
+// Records are best effort: write errors are dropped, so that a failing
+// audit log cannot take requests down with it.
+func (l *AuditLog) Record(rec AuditRecord) {
+	if rec.Time.IsZero() {
+		rec.Time = time.Now().UTC()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(rec)
+}
+
+// Close closes the underlying writer, if it is an io.Closer.
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c, ok := l.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Package auth identifies the principals making requests and decides what
+// they may do.
+//
+// An Authenticator turns the credentials of a request, a bearer token or a
+// verified client certificate, into a principal name. An ACL grants
+// principals permissions on key prefixes. An AuditLog records the requests
+// that were refused, apart from the transaction log.
+package auth
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Permission is an operation a principal may be granted.
+type Permission string
+
+const (
+	Read   Permission = "read"   // Get, list and watch keys.
+	Write  Permission = "write"  // Put keys.
+	Delete Permission = "delete" // Delete keys.
+	Admin  Permission = "admin"  // Change the cluster and the ring; move keys.
+)
+
+// ParsePermission returns the permission named s.
+func ParsePermission(s string) (Permission, error) {
+	switch p := Permission(s); p {
+	case Read, Write, Delete, Admin:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown permission %q", s)
+}
+
+// ErrorNoCredentials error value indicating a request carries no
+// credentials an Authenticator recognizes.
+var ErrorNoCredentials = errors.New("no credentials")
+
+// ErrorInvalidCredentials error value indicating a request carries
+// credentials that are unknown, expired or forged.
+var ErrorInvalidCredentials = errors.New("invalid credentials")
+
+// Credentials are what a request presents to prove who makes it.
+type Credentials struct {
+	Bearer string               // The bearer token, if any.
+	TLS    *tls.ConnectionState // The TLS connection, if any.
+}
+
+// FromRequest returns the credentials of an HTTP request.
+func FromRequest(r *http.Request) Credentials {
+	return Credentials{Bearer: BearerToken(r.Header.Get("Authorization")), TLS: r.TLS}
+}
+
+// BearerToken returns the token of an Authorization header value using
+// the Bearer scheme, or "".
+func BearerToken(authorization string) string {
+	const prefix = "bearer "
+	if len(authorization) > len(prefix) && strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return strings.TrimSpace(authorization[len(prefix):])
+	}
+	return ""
+}
+
+// Authenticator identifies the principal presenting credentials. It
+// returns ErrorNoCredentials if the credentials are not of its kind.
+type Authenticator interface {
+	Authenticate(c Credentials) (principal string, err error)
+}
+
+// Chain is an Authenticator trying several in order. It returns the first
+// principal identified, otherwise ErrorInvalidCredentials if any of them
+// rejected the credentials, or ErrorNoCredentials.
+type Chain []Authenticator
+
+// Authenticate implements Authenticator.
+func (c Chain) Authenticate(cr Credentials) (string, error) {
+	err := ErrorNoCredentials
+	for _, a := range c {
+		principal, aerr := a.Authenticate(cr)
+		if aerr == nil {
+			return principal, nil
+		}
+		if !errors.Is(aerr, ErrorNoCredentials) {
+			err = aerr
+		}
+	}
+	return "", err
+}
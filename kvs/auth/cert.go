@@ -0,0 +1,20 @@
+package auth
+
+// certAuthenticator identifies principals by their verified client
+// certificate.
+type certAuthenticator struct{}
+
+// NewCertAuthenticator returns an Authenticator accepting client
+// certificates the TLS server verified. The principal is the certificate
+// subject as formatted by pkix.Name.String, e.g. "CN=reader,O=Example".
+func NewCertAuthenticator() Authenticator {
+	return certAuthenticator{}
+}
+
+// Authenticate implements Authenticator.
+func (certAuthenticator) Authenticate(c Credentials) (string, error) {
+	if c.TLS == nil || len(c.TLS.VerifiedChains) == 0 {
+		return "", ErrorNoCredentials
+	}
+	return c.TLS.VerifiedChains[0][0].Subject.String(), nil
+}
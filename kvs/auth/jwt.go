@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+// JWTParams configures a JWT authenticator.
+type JWTParams struct {
+	// Key is the HMAC key tokens are signed with, using HS256, HS384 or
+	// HS512.
+	Key []byte
+	// Issuer and Audience, if set, must match the "iss" and "aud" claims.
+	Issuer   string
+	Audience string
+	// Leeway tolerates clock skew when checking "exp" and "nbf".
+	Leeway time.Duration
+	// Now returns the current time; time.Now if nil.
+	Now func() time.Time
+}
+
+// jwtAuthenticator identifies principals by HMAC-signed JSON Web Tokens.
+type jwtAuthenticator struct {
+	params JWTParams
+}
+
+// jwtClaims are the registered claims a token is checked against.
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  audience `json:"aud"`
+	ExpiresAt *int64   `json:"exp"`
+	NotBefore *int64   `json:"nbf"`
+}
+
+// audience is the "aud" claim, a string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+// NewJWTAuthenticator returns an Authenticator accepting bearer tokens
+// that are JWTs signed with params.Key. The principal is the "sub" claim.
+// Tokens need an "exp" claim.
+func NewJWTAuthenticator(params JWTParams) Authenticator {
+	if params.Now == nil {
+		params.Now = time.Now
+	}
+	return &jwtAuthenticator{params: params}
+}
+
+// Authenticate implements Authenticator.
+func (a *jwtAuthenticator) Authenticate(c Credentials) (string, error) {
+	parts := strings.Split(c.Bearer, ".")
+	if len(parts) != 3 {
+		return "", ErrorNoCredentials
+	}
+
+	claims, err := a.verify(parts)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrorInvalidCredentials, err)
+	}
+	return claims.Subject, nil
+}
+
+// verify checks the signature and claims of a token split at its dots.
+func (a *jwtAuthenticator) verify(parts []string) (*jwtClaims, error) {
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+
+	var h func() hash.Hash
+	switch header.Alg {
+	case "HS256":
+		h = sha256.New
+	case "HS384":
+		h = sha512.New384
+	case "HS512":
+		h = sha512.New
+	default:
+		// Notably "none" and public key algorithms, whose keys an HMAC
+		// key must not stand in for.
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %w", err)
+	}
+
+	mac := hmac.New(h, a.params.Key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("bad signature")
+	}
+
+	var claims jwtClaims
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+
+	now := a.params.Now()
+	switch {
+	case claims.Subject == "":
+		return nil, fmt.Errorf("no subject")
+	case claims.ExpiresAt == nil:
+		return nil, fmt.Errorf("no expiry")
+	case now.After(time.Unix(*claims.ExpiresAt, 0).Add(a.params.Leeway)):
+		return nil, fmt.Errorf("expired")
+	case claims.NotBefore != nil && now.Add(a.params.Leeway).Before(time.Unix(*claims.NotBefore, 0)):
+		return nil, fmt.Errorf("not valid yet")
+	case a.params.Issuer != "" && claims.Issuer != a.params.Issuer:
+		return nil, fmt.Errorf("wrong issuer %q", claims.Issuer)
+	case a.params.Audience != "" && !claims.Audience.contains(a.params.Audience):
+		return nil, fmt.Errorf("wrong audience")
+	}
+	return &claims, nil
+}
+
+// contains reports whether a lists s.
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeSegment decodes a base64url-encoded JSON segment of a token.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sign returns a JWT of claims signed with key using alg.
+func sign(t *testing.T, alg string, key []byte, claims map[string]interface{}) string {
+	t.Helper()
+
+	segment := func(v interface{}) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	unsigned := segment(map[string]string{"alg": alg, "typ": "JWT"}) + "." + segment(claims)
+
+	var h func() hash.Hash
+	switch alg {
+	case "HS256":
+		h = sha256.New
+	case "HS384":
+		h = sha512.New384
+	case "HS512":
+		h = sha512.New
+	default:
+		return unsigned + "."
+	}
+	mac := hmac.New(h, key)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	key := []byte("secret")
+	now := time.Unix(1700000000, 0)
+	a := NewJWTAuthenticator(JWTParams{Key: key, Issuer: "issuer", Audience: "kvs",
+		Leeway: 30 * time.Second, Now: func() time.Time { return now }})
+
+	// claims returns valid claims with changes applied; a nil value
+	// removes a claim.
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{"sub": "alice", "iss": "issuer", "aud": "kvs",
+			"exp": now.Add(time.Minute).Unix()}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	at := func(d time.Duration) int64 { return now.Add(d).Unix() }
+
+	tests := []struct {
+		name  string
+		token string
+		err   error // nil if the token identifies alice.
+	}{
+		{"valid", sign(t, "HS256", key, claims(nil)), nil},
+		{"HS384", sign(t, "HS384", key, claims(nil)), nil},
+		{"HS512", sign(t, "HS512", key, claims(nil)), nil},
+		{"bad signature", sign(t, "HS256", []byte("other"), claims(nil)), ErrorInvalidCredentials},
+		{"tampered claims", strings.Replace(sign(t, "HS256", key, claims(nil)), ".", ".e30", 1),
+			ErrorInvalidCredentials},
+		{"alg none", sign(t, "none", key, claims(nil)), ErrorInvalidCredentials},
+		{"public key algorithm", sign(t, "RS256", key, claims(nil)), ErrorInvalidCredentials},
+		{"expired", sign(t, "HS256", key, claims(map[string]interface{}{"exp": at(-time.Minute)})),
+			ErrorInvalidCredentials},
+		{"expired within leeway", sign(t, "HS256", key, claims(map[string]interface{}{"exp": at(-10 * time.Second)})), nil},
+		{"no expiry", sign(t, "HS256", key, claims(map[string]interface{}{"exp": nil})), ErrorInvalidCredentials},
+		{"not valid yet", sign(t, "HS256", key, claims(map[string]interface{}{"nbf": at(time.Minute)})),
+			ErrorInvalidCredentials},
+		{"valid soon, within leeway", sign(t, "HS256", key, claims(map[string]interface{}{"nbf": at(10 * time.Second)})), nil},
+		{"wrong issuer", sign(t, "HS256", key, claims(map[string]interface{}{"iss": "other"})), ErrorInvalidCredentials},
+		{"no issuer", sign(t, "HS256", key, claims(map[string]interface{}{"iss": nil})), ErrorInvalidCredentials},
+		{"wrong audience", sign(t, "HS256", key, claims(map[string]interface{}{"aud": "other"})), ErrorInvalidCredentials},
+		{"audience among several", sign(t, "HS256", key, claims(map[string]interface{}{"aud": []string{"other", "kvs"}})), nil},
+		{"audiences without ours", sign(t, "HS256", key, claims(map[string]interface{}{"aud": []string{"other"}})),
+			ErrorInvalidCredentials},
+		{"no subject", sign(t, "HS256", key, claims(map[string]interface{}{"sub": nil})), ErrorInvalidCredentials},
+		{"not a JWT", "opaque-token", ErrorNoCredentials},
+		{"no token", "", ErrorNoCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := a.Authenticate(Credentials{Bearer: tt.token})
+			if tt.err == nil && (err != nil || principal != "alice") {
+				t.Errorf("Authenticate() = %q, %v, want alice", principal, err)
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("Authenticate() = %q, %v, want %v", principal, err, tt.err)
+			}
+		})
+	}
+}
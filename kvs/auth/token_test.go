@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestTokenAuthenticator(t *testing.T) {
+	a := NewTokenAuthenticator(map[string]string{"reader-token": "reader", "writer-token": "writer"})
+
+	tests := []struct {
+		name, token, principal string
+		err                    error
+	}{
+		{"known token", "reader-token", "reader", nil},
+		{"another known token", "writer-token", "writer", nil},
+		{"unknown token", "guessed-token", "", ErrorInvalidCredentials},
+		{"prefix of a token", "reader", "", ErrorInvalidCredentials},
+		{"unknown JWT, left to others", "a.b.c", "", ErrorNoCredentials},
+		{"no token", "", "", ErrorNoCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := a.Authenticate(Credentials{Bearer: tt.token})
+			if principal != tt.principal || !errors.Is(err, tt.err) {
+				t.Errorf("Authenticate() = %q, %v, want %q, %v", principal, err, tt.principal, tt.err)
+			}
+		})
+	}
+}
+
+func TestTokensHeldByDigest(t *testing.T) {
+	a := NewTokenAuthenticator(map[string]string{"secret-token": "alice"}).(*tokenAuthenticator)
+
+	if len(a.principals) != 1 || a.principals[sha256.Sum256([]byte("secret-token"))] != "alice" {
+		t.Errorf("tokens held as %v, want by their SHA-256 digest", a.principals)
+	}
+}
+
+func TestChain(t *testing.T) {
+	tokens := NewTokenAuthenticator(map[string]string{"token": "alice"})
+	jwts := NewJWTAuthenticator(JWTParams{Key: []byte("secret")})
+	chain := Chain{tokens, jwts, NewCertAuthenticator()}
+
+	tests := []struct {
+		name, token, principal string
+		err                    error
+	}{
+		{"first authenticator", "token", "alice", nil},
+		{"rejected by one", "unknown", "", ErrorInvalidCredentials},
+		{"forged JWT", "a.b.c", "", ErrorInvalidCredentials},
+		{"no credentials", "", "", ErrorNoCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := chain.Authenticate(Credentials{Bearer: tt.token})
+			if principal != tt.principal || !errors.Is(err, tt.err) {
+				t.Errorf("Authenticate() = %q, %v, want %q, %v", principal, err, tt.principal, tt.err)
+			}
+		})
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := map[string]string{
+		"Bearer abc":   "abc",
+		"bearer abc ":  "abc",
+		"BEARER  abc":  "abc",
+		"Basic abc":    "",
+		"Bearer":       "",
+		"abc":          "",
+		"":             "",
+		"Bearerabc de": "",
+	}
+
+	for header, want := range tests {
+		if got := BearerToken(header); got != want {
+			t.Errorf("BearerToken(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
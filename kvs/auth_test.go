@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/auth"
+	"github.com/gorilla/mux"
+)
+
+// useAuth has the service authenticate the given tokens, mapped to their
+// principals, and authorize them with grants for the duration of the test.
+// It returns the buffer the audit log is written to.
+func useAuth(t *testing.T, tokens map[string]string, grants ...auth.Grant) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	oldAuthn, oldACL, oldAudit := authn, acl, audit
+	authn, acl, audit = auth.NewTokenAuthenticator(tokens), auth.NewACL(grants), auth.NewAuditLog(&buf)
+	t.Cleanup(func() { authn, acl, audit = oldAuthn, oldACL, oldAudit })
+	return &buf
+}
+
+// auditRecords decodes the records written to buf.
+func auditRecords(t *testing.T, buf *bytes.Buffer) []auth.AuditRecord {
+	t.Helper()
+
+	var records []auth.AuditRecord
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var r auth.AuditRecord
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+// authRouter routes the key, batch, health and metrics requests the way
+// the service does.
+func authRouter() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/_batch", keyValueBatchHandler).Methods("POST")
+	r.HandleFunc("/v1/{key}", requires(auth.Write, keyResource, keyValuePutHandler)).Methods("PUT")
+	r.HandleFunc("/v1/{key}", requires(auth.Read, keyResource, keyValueGetHandler)).Methods("GET")
+	r.HandleFunc("/v1", requires(auth.Read, prefixResource, keyValueListHandler)).Methods("GET")
+	r.HandleFunc("/healthz", healthHandler).Methods("GET")
+	r.Handle(metricsPath, metricsHandler).Methods("GET")
+	return authenticated(r)
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	useFileLog(t)
+	buf := useAuth(t, map[string]string{"reader-token": "reader", "writer-token": "writer"},
+		auth.Grant{Principal: "reader", Prefix: "", Permissions: []auth.Permission{auth.Read}},
+		auth.Grant{Principal: "writer", Prefix: "a-", Permissions: []auth.Permission{auth.Read, auth.Write}})
+	h := authRouter()
+
+	tests := []struct {
+		name, method, path, token, body string
+		status                          int
+		audit                           *auth.AuditRecord // The record expected, if any.
+	}{
+		{"no credentials", "GET", "/v1/a-key", "", "", http.StatusUnauthorized,
+			&auth.AuditRecord{Decision: auth.Unauthenticated, Operation: "GET /v1/a-key"}},
+		{"unknown token", "GET", "/v1/a-key", "guessed", "", http.StatusUnauthorized,
+			&auth.AuditRecord{Decision: auth.Unauthenticated, Operation: "GET /v1/a-key"}},
+		{"write", "PUT", "/v1/a-key", "writer-token", "value", http.StatusCreated, nil},
+		{"read", "GET", "/v1/a-key", "reader-token", "", http.StatusOK, nil},
+		{"read everything", "GET", "/v1", "reader-token", "", http.StatusOK, nil},
+		{"write without permission", "PUT", "/v1/a-key", "reader-token", "value", http.StatusForbidden,
+			&auth.AuditRecord{Decision: auth.Denied, Principal: "reader", Operation: "PUT /v1/a-key",
+				Permission: auth.Write, Resource: "a-key"}},
+		{"write outside prefix", "PUT", "/v1/b", "writer-token", "value", http.StatusForbidden,
+			&auth.AuditRecord{Decision: auth.Denied, Principal: "writer", Operation: "PUT /v1/b",
+				Permission: auth.Write, Resource: "b"}},
+		{"list outside prefix", "GET", "/v1", "writer-token", "", http.StatusForbidden,
+			&auth.AuditRecord{Decision: auth.Denied, Principal: "writer", Operation: "GET /v1",
+				Permission: auth.Read, Resource: ""}},
+		{"health check", "GET", "/healthz", "", "", http.StatusOK, nil},
+		{"metrics scrape", "GET", metricsPath, "", "", http.StatusOK, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			challenge := w.Header().Get("WWW-Authenticate")
+			if want := tt.status == http.StatusUnauthorized; (challenge != "") != want {
+				t.Errorf("WWW-Authenticate %q on status %d", challenge, w.Code)
+			}
+
+			records := auditRecords(t, buf)
+			if tt.audit == nil {
+				if len(records) != 0 {
+					t.Errorf("audited %+v, want nothing", records)
+				}
+				return
+			}
+			if len(records) != 1 {
+				t.Fatalf("audited %+v, want one record", records)
+			}
+			got := records[0]
+			if got.Remote == "" || got.Time.IsZero() {
+				t.Errorf("record %+v lacks the time or client address", got)
+			}
+			got.Time, got.Remote, got.Reason = tt.audit.Time, "", ""
+			if got != *tt.audit {
+				t.Errorf("audited %+v, want %+v", got, *tt.audit)
+			}
+		})
+	}
+}
+
+func TestAuthBatchDeniedWhole(t *testing.T) {
+	useFileLog(t)
+	buf := useAuth(t, map[string]string{"writer-token": "writer"},
+		auth.Grant{Principal: "writer", Prefix: "a-", Permissions: []auth.Permission{auth.Write, auth.Delete}})
+
+	body := `{"operations": [{"op": "put", "key": "a-1", "value": "x"},
+		{"op": "delete", "key": "a-2"}, {"op": "put", "key": "b", "value": "y"}]}`
+	r := httptest.NewRequest(http.MethodPost, "/v1/_batch", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer writer-token")
+	w := httptest.NewRecorder()
+	authRouter().ServeHTTP(w, r)
+
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status %d, want %d: %s", w.Code, http.StatusForbidden, w.Body)
+	}
+	var resp errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error.Code != api.CodePermissionDenied {
+		t.Errorf("error code %q, want %q", resp.Error.Code, api.CodePermissionDenied)
+	}
+
+	if _, err := store.Get("a-1"); err != api.ErrorNoSuchKey {
+		t.Errorf("a-1 written by a rejected batch: %v", err)
+	}
+	if records := auditRecords(t, buf); len(records) != 1 || records[0].Resource != "b" {
+		t.Errorf("audited %+v, want the denial of b", records)
+	}
+}
+
+func TestStartAuth(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "jwt.key")
+	if err := os.WriteFile(keyFile, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		auth  authConfig
+		on    bool // Whether requests need credentials.
+		peer  bool // Whether requests to peers carry the peer token.
+		error bool
+	}{
+		{"nothing configured", authConfig{}, false, false, false},
+		{"peer token alone", authConfig{PeerToken: "peer"}, false, false, false},
+		{"tokens", authConfig{Tokens: []tokenConfig{{Principal: "alice", Token: "token"}}}, true, false, false},
+		{"jwt key", authConfig{JWT: jwtConfig{KeyFile: keyFile}}, true, false, false},
+		{"missing jwt key", authConfig{JWT: jwtConfig{KeyFile: filepath.Join(dir, "missing")}}, false, false, true},
+		{"tokens and peer token", authConfig{Tokens: []tokenConfig{{Principal: "node", Token: "peer"}},
+			PeerToken: "peer", AuditLog: filepath.Join(dir, "audit.log")}, true, true, false},
+		{"unwritable audit log", authConfig{Tokens: []tokenConfig{{Principal: "alice", Token: "token"}},
+			AuditLog: filepath.Join(dir, "missing", "audit.log")}, false, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldAuthn, oldACL, oldAudit, oldPeer := authn, acl, audit, peerClient
+			authn, acl, audit = nil, nil, nil
+			defer func() { authn, acl, audit, peerClient = oldAuthn, oldACL, oldAudit, oldPeer }()
+
+			err := startAuth(config{Auth: tt.auth})
+			if (err != nil) != tt.error {
+				t.Fatalf("startAuth() = %v, want error %v", err, tt.error)
+			}
+			if on := authn != nil; on != tt.on {
+				t.Errorf("authentication on: %v, want %v", on, tt.on)
+			}
+			_, peer := peerClient.Transport.(*bearerTransport)
+			if peer != tt.peer {
+				t.Errorf("peer requests carry a token: %v, want %v", peer, tt.peer)
+			}
+		})
+	}
+}
+
+func TestBearerTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: &bearerTransport{token: "peer"}}
+
+	tests := []struct {
+		name, header, want string
+	}{
+		{"own request", "", "Bearer peer"},
+		{"forwarded request", "Bearer client", "Bearer client"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+
+			resp, err := client.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			var got bytes.Buffer
+			got.ReadFrom(resp.Body)
+
+			if got.String() != tt.want {
+				t.Errorf("sent Authorization %q, want %q", got.String(), tt.want)
+			}
+			if r.Header.Get("Authorization") != tt.header {
+				t.Errorf("caller's request changed to %q", r.Header.Get("Authorization"))
+			}
+		})
+	}
+}
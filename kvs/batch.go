@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cloud-native-go/kvs/api"
+)
+
+// maxBatchOperations bounds the operations of one batch request.
+var maxBatchOperations = 1000
+
+// maxBatchBytes bounds the size of a batch request body, and so the memory
+// one request can take up, whatever its operations hold.
+var maxBatchBytes int64 = 4 << 20
+
+// batchBodyError describes err, which reading or decoding a batch request
+// body failed with.
+func batchBodyError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return api.Errorf(api.CodeRequestTooLarge, "batch is larger than %d bytes", tooLarge.Limit)
+	}
+	return api.Errorf(api.CodeInvalidRequest, "malformed batch: %v", err)
+}
+
+// batchOperation is one operation of a batch request. IfVersion makes the
+// batch conditional on the key being at that version, as returned in the
+// ETag; IfExists on the key existing or not.
+type batchOperation struct {
+	Op        string  `json:"op"` // "put" or "delete"
+	Key       string  `json:"key"`
+	Value     string  `json:"value"`
+	TTL       string  `json:"ttl"` // Seconds or a duration, puts only.
+	IfVersion *uint64 `json:"if_version"`
+	IfExists  *bool   `json:"if_exists"`
+}
+
+// batchRequest is the request body of keyValueBatchHandler.
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+}
+
+// batchResponse is the response body of keyValueBatchHandler, holding the
+// version of each operation.
+type batchResponse struct {
+	Versions []uint64 `json:"versions"`
+}
+
+// keyValueBatchHandler expects to be called with a POST request for
+// "/v1/_batch" and applies the put and delete operations of the JSON body
+// atomically: either all of them take effect or, if a precondition fails,
+// none does and the response is 412 Precondition Failed. The batch is
+// written to the transaction log as one unit. Each operation needs the
+// permission to write or delete its key. Bodies larger than maxBatchBytes
+// are refused with 413 Request Entity Too Large.
+func keyValueBatchHandler(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&req)
+	defer r.Body.Close()
+
+	if err != nil {
+		writeError(w, r, batchBodyError(err))
+		return
+	}
+
+	ops, err := batchOps(req.Operations)
+
+	if err == nil {
+		err = authorizeOps(r.Context(), ops)
+	}
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	versions, err := applyBatch(r.Context(), ops)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(batchResponse{Versions: versions})
+}
+
+// batchOps validates the operations of a batch request and converts them
+// into store ops.
+func batchOps(operations []batchOperation) ([]api.Op, error) {
+	if len(operations) == 0 {
+		return nil, api.Errorf(api.CodeInvalidRequest, "batch has no operations")
+	}
+	if len(operations) > maxBatchOperations {
+		return nil, api.Errorf(api.CodeInvalidRequest, "batch has more than %d operations", maxBatchOperations)
+	}
+
+	ops := make([]api.Op, len(operations))
+	for i, o := range operations {
+		op := api.Op{Key: o.Key}
+
+		switch o.Op {
+		case "put":
+			op.Type, op.Value = api.OpPut, o.Value
+		case "delete":
+			op.Type = api.OpDelete
+		default:
+			return nil, api.Errorf(api.CodeInvalidRequest, "operation %d: unknown op %q", i, o.Op)
+		}
+
+		if o.Key == "" {
+			return nil, api.Errorf(api.CodeInvalidKey, "operation %d: missing key", i)
+		}
+
+		if o.TTL != "" {
+			if op.Type != api.OpPut {
+				return nil, api.Errorf(api.CodeInvalidRequest, "operation %d: ttl is only valid for put", i)
+			}
+			expiry, err := parseTTL(o.TTL)
+			if err != nil {
+				return nil, fmt.Errorf("operation %d: %w", i, err)
+			}
+			op.Expiry = expiry
+		}
+
+		switch {
+		case o.IfVersion != nil && o.IfExists != nil:
+			return nil, api.Errorf(api.CodeInvalidRequest, "operation %d: if_version and if_exists are exclusive", i)
+		case o.IfVersion != nil:
+			op.Conditional, op.Version = true, *o.IfVersion
+		case o.IfExists != nil && *o.IfExists:
+			op.Conditional, op.Version = true, api.AnyVersion
+		case o.IfExists != nil:
+			op.Conditional, op.Version = true, api.NoVersion
+		}
+
+		ops[i] = op
+	}
+
+	return ops, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloud-native-go/kvs/api"
+)
+
+func TestBatchBodyLimit(t *testing.T) {
+	useFileLog(t)
+
+	oldOps, oldBytes, oldValue := maxBatchOperations, maxBatchBytes, api.MaxValueSize
+	maxBatchOperations, maxBatchBytes, api.MaxValueSize = 2, 1000, 100
+	defer func() { maxBatchOperations, maxBatchBytes, api.MaxValueSize = oldOps, oldBytes, oldValue }()
+
+	op := func(key string, size int) string {
+		return fmt.Sprintf(`{"op": "put", "key": %q, "value": %q}`, key, strings.Repeat("v", size))
+	}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   api.ErrorCode
+	}{
+		{"largest batch", `{"operations": [` + op("a", 100) + `, ` + op("b", 100) + `]}`, http.StatusOK, ""},
+		{"padded body", `{"operations": [` + op("a", 1) + strings.Repeat(" ", int(maxBatchBytes)) + `]}`,
+			http.StatusRequestEntityTooLarge, api.CodeRequestTooLarge},
+		{"huge value", `{"operations": [` + op("a", int(maxBatchBytes)) + `]}`,
+			http.StatusRequestEntityTooLarge, api.CodeRequestTooLarge},
+		{"value too large", `{"operations": [` + op("a", 101) + `]}`,
+			http.StatusRequestEntityTooLarge, api.CodeValueTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			keyValueBatchHandler(w, httptest.NewRequest(http.MethodPost, "/v1/_batch", strings.NewReader(tt.body)))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.code == "" {
+				return
+			}
+
+			var resp errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error.Code != tt.code {
+				t.Errorf("error code %q, want %q", resp.Error.Code, tt.code)
+			}
+		})
+	}
+}
+
+func TestPartitionedBatchBodyLimit(t *testing.T) {
+	useFileLog(t)
+	usePartitions(t, "http://b", "http://a", "http://b")
+
+	oldBytes := maxBatchBytes
+	maxBatchBytes = 100
+	defer func() { maxBatchBytes = oldBytes }()
+
+	body := `{"operations": [{"op": "put", "key": "k", "value": "` + strings.Repeat("v", 200) + `"}]}`
+	w := httptest.NewRecorder()
+	partitionedBatch(keyValueBatchHandler)(w, httptest.NewRequest(http.MethodPost, "/v1/_batch", strings.NewReader(body)))
+
+	var resp errorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusRequestEntityTooLarge || resp.Error.Code != api.CodeRequestTooLarge {
+		t.Errorf("answered %d %s, want the batch refused as too large", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/cluster"
+	"github.com/cloud-native-go/kvs/logger"
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// raftMaxPool is how many connections the Raft transport keeps per
+	// peer, and raftTimeout bounds each of its I/O operations.
+	raftMaxPool = 3
+	raftTimeout = 10 * time.Second
+
+	// joinRetryDelay is how long a node waits between attempts to join a
+	// cluster.
+	joinRetryDelay = time.Second
+)
+
+// clusterConfig configures cluster mode, enabled when ID is set.
+type clusterConfig struct {
+	ID        string `json:"id"`        // The node ID.
+	Addr      string `json:"addr"`      // The Raft transport address.
+	Dir       string `json:"dir"`       // The Raft log and snapshot directory.
+	URL       string `json:"url"`       // The base URL of this node's HTTP API.
+	Bootstrap bool   `json:"bootstrap"` // Form a new cluster.
+	Join      string `json:"join"`      // The URL of a member to join through.
+}
+
+// clusterParams configures this node's cluster mode.
+var clusterParams clusterConfig
+
+// node is this instance's cluster member, nil unless in cluster mode.
+var node *cluster.Node
+
+// errNoLeader reports a write while the cluster is electing a leader.
+var errNoLeader error = &api.Error{Code: api.CodeUnavailable,
+	Err: errors.New("no cluster leader")}
+
+// startCluster starts a Raft node and makes it the store. Writes commit
+// through the Raft log, which replaces the transaction log.
+func startCluster(local api.Store) error {
+	addr, err := net.ResolveTCPAddr("tcp", clusterParams.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid raft address: %w", err)
+	}
+
+	transport, err := raft.NewTCPTransport(clusterParams.Addr, addr, raftMaxPool, raftTimeout, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("cannot start raft transport: %w", err)
+	}
+
+	feed = api.NewFeed(watchHistory, 0)
+
+	node, err = cluster.NewNode(cluster.NodeParams{
+		ID:        clusterParams.ID,
+		URL:       clusterParams.URL,
+		Dir:       clusterParams.Dir,
+		Transport: transport,
+		Store:     local,
+		Feed:      feed,
+		Bootstrap: clusterParams.Bootstrap,
+	})
+	if err != nil {
+		return err
+	}
+
+	store, transact = node, nopTransactionLogger{}
+
+	if clusterParams.Join != "" {
+		go joinCluster(cluster.Member{ID: clusterParams.ID,
+			Address: string(transport.LocalAddr()), URL: clusterParams.URL})
+	}
+
+	return nil
+}
+
+// joinCluster asks the member at clusterParams.Join to add this node,
+// retrying until it succeeds. Non-leaders redirect the request.
+func joinCluster(m cluster.Member) {
+	body, _ := json.Marshal(m)
+	u := strings.TrimSuffix(clusterParams.Join, "/") + "/v1/_cluster/members"
+
+	for {
+		resp, err := peerClient.Post(u, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				slogger.Info("joined cluster", "through", clusterParams.Join)
+				return
+			}
+			err = fmt.Errorf("%s answered %s", clusterParams.Join, resp.Status)
+		}
+
+		slogger.Warn("cannot join cluster; retrying",
+			"through", clusterParams.Join, "delay", joinRetryDelay, "error", err)
+		time.Sleep(joinRetryDelay)
+	}
+}
+
+// leaderURL returns the URL to redirect writes to, or an empty string if
+// this instance accepts them.
+func leaderURL() (string, error) {
+	if node == nil || node.IsLeader() {
+		return leader, nil
+	}
+
+	if u := node.LeaderURL(); u != "" {
+		return u, nil
+	}
+	return "", errNoLeader
+}
+
+// clusterMembersHandler expects to be called with a GET request for
+// "/v1/_cluster/members" and returns the members as JSON.
+func clusterMembersHandler(w http.ResponseWriter, r *http.Request) {
+	members, err := node.Members()
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Members []cluster.Member `json:"members"`
+	}{members})
+}
+
+// clusterJoinHandler expects to be called with a POST request for
+// "/v1/_cluster/members" whose JSON body names the ID, Raft address and
+// URL of a node to add as a voter.
+func clusterJoinHandler(w http.ResponseWriter, r *http.Request) {
+	var m cluster.Member
+	err := json.NewDecoder(r.Body).Decode(&m)
+	defer r.Body.Close()
+
+	if err != nil || m.ID == "" || m.Address == "" {
+		writeError(w, r, api.Errorf(api.CodeInvalidRequest, "member needs an id and an address"))
+		return
+	}
+
+	if err = node.Join(m); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// clusterLeaveHandler expects to be called with a DELETE request for
+// "/v1/_cluster/members/{id}" and removes that member.
+func clusterLeaveHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	if err := node.Leave(id); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// defaultNodeURL guesses the URL of this node's HTTP API from the address
+// it listens on.
+func defaultNodeURL(listen string, https bool) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return ""
+	}
+	if host == "" {
+		if host, err = os.Hostname(); err != nil {
+			host = "localhost"
+		}
+	}
+	scheme := "http://"
+	if https {
+		scheme = "https://"
+	}
+	return scheme + net.JoinHostPort(host, port)
+}
+
+// defaultRaftDir is where a node keeps its Raft state unless told
+// otherwise.
+func defaultRaftDir(id string) string {
+	return filepath.Join("raft", id)
+}
+
+// nopTransactionLogger stands in for the transaction log in cluster mode,
+// where the store commits writes to the Raft log before returning.
+type nopTransactionLogger struct{}
+
+func (nopTransactionLogger) WriteDelete(context.Context, string, uint64) error { return nil }
+func (nopTransactionLogger) WritePut(context.Context, string, string, time.Time, uint64) error {
+	return nil
+}
+func (nopTransactionLogger) WriteBatch(context.Context, []logger.Event) error { return nil }
+func (nopTransactionLogger) Err() <-chan error                                { return nil }
+func (nopTransactionLogger) Run()                                             {}
+func (nopTransactionLogger) Recover() error                                   { return nil }
+func (nopTransactionLogger) Close(context.Context) error                      { return nil }
+func (nopTransactionLogger) Stats() logger.Stats                              { return logger.Stats{} }
+func (nopTransactionLogger) ReadEvents() (<-chan logger.Event, <-chan error) {
+	events, errors := make(chan logger.Event), make(chan error)
+	close(events)
+	close(errors)
+	return events, errors
+}
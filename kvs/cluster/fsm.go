@@ -0,0 +1,169 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/hashicorp/raft"
+)
+
+// command is an entry of the Raft log. Changes carry the versions the
+// leader assigned, so every node applies them identically.
+type command struct {
+	Changes []api.Change `json:"changes,omitempty"`
+	// Member records the HTTP URL of a node; Remove forgets a node.
+	Member *Member `json:"member,omitempty"`
+	Remove string  `json:"remove,omitempty"`
+}
+
+// fsmState is the content of a Raft snapshot.
+type fsmState struct {
+	Index    uint64               `json:"index"`
+	Revision uint64               `json:"revision"`
+	URLs     map[string]string    `json:"urls"`
+	Entries  map[string]api.Entry `json:"entries"`
+}
+
+// fsm applies committed log entries to the local store. Raft calls Apply,
+// Snapshot and Restore from a single goroutine; the lock guards the fields
+// read by Node.
+type fsm struct {
+	store api.Store
+	feed  *api.Feed
+
+	mu       sync.Mutex
+	index    uint64            // The index of the last entry applied.
+	revision uint64            // The highest version applied.
+	urls     map[string]string // The HTTP URL of each node by ID.
+}
+
+func newFSM(store api.Store, feed *api.Feed) *fsm {
+	return &fsm{store: store, feed: feed, urls: make(map[string]string)}
+}
+
+// Apply applies a committed command. Its return value is the Response of
+// the ApplyFuture.
+func (f *fsm) Apply(l *raft.Log) interface{} {
+	var cmd command
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		return fmt.Errorf("malformed raft log entry %d: %w", l.Index, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.index = l.Index
+
+	switch {
+	case cmd.Member != nil:
+		f.urls[cmd.Member.ID] = cmd.Member.URL
+	case cmd.Remove != "":
+		delete(f.urls, cmd.Remove)
+	}
+
+	// The changes of a command are a batch: readers see all of them or
+	// none, and a change failing leaves the store as it was.
+	ops := make([]api.Op, len(cmd.Changes))
+	for i := range cmd.Changes {
+		c := &cmd.Changes[i]
+		c.Sequence = l.Index
+		ops[i] = api.Op{Type: c.Type, Key: c.Key, Value: c.Value, Expiry: c.Expiry, Version: c.Version}
+	}
+	if len(ops) > 0 {
+		if err := f.store.RestoreBatch(ops); err != nil {
+			return fmt.Errorf("cannot apply raft log entry %d: %w", l.Index, err)
+		}
+	}
+
+	for _, c := range cmd.Changes {
+		if c.Version > f.revision {
+			f.revision = c.Version
+		}
+	}
+
+	if f.feed != nil {
+		f.feed.Publish(cmd.Changes)
+	}
+	return nil
+}
+
+// Snapshot captures the store. It is called between two Apply calls, so the
+// store holds exactly the entries up to index.
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	urls := make(map[string]string, len(f.urls))
+	for id, u := range f.urls {
+		urls[id] = u
+	}
+
+	return &fsmSnapshot{fsmState{Index: f.index, Revision: f.revision,
+		URLs: urls, Entries: f.store.Snapshot()}}, nil
+}
+
+// Restore replaces the store with the content of a snapshot.
+func (f *fsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	var state fsmState
+	if err := json.NewDecoder(rc).Decode(&state); err != nil {
+		return fmt.Errorf("cannot read raft snapshot: %w", err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for k, e := range state.Entries {
+		if err := f.store.Restore(k, e); err != nil {
+			return fmt.Errorf("cannot restore raft snapshot: %w", err)
+		}
+	}
+	for k := range f.store.Snapshot() {
+		if _, ok := state.Entries[k]; !ok {
+			if err := f.store.RestoreDelete(k, api.NoVersion); err != nil {
+				return fmt.Errorf("cannot restore raft snapshot: %w", err)
+			}
+		}
+	}
+
+	f.index, f.revision = state.Index, state.Revision
+	f.urls = state.URLs
+	if f.urls == nil {
+		f.urls = make(map[string]string)
+	}
+
+	if f.feed != nil {
+		f.feed.Reset(state.Index)
+	}
+	return nil
+}
+
+func (f *fsm) url(id string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.urls[id]
+}
+
+func (f *fsm) lastRevision() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.revision
+}
+
+type fsmSnapshot struct {
+	state fsmState
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.state); err != nil {
+		sink.Cancel()
+		return fmt.Errorf("cannot write raft snapshot: %w", err)
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/hashicorp/raft"
+)
+
+// applyChanges applies a command of changes to f as the entry index.
+func applyChanges(t *testing.T, f *fsm, index uint64, changes ...api.Change) interface{} {
+	t.Helper()
+
+	data, err := json.Marshal(command{Changes: changes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Apply(&raft.Log{Index: index, Data: data})
+}
+
+func TestFSMAppliesBatchesAtomically(t *testing.T) {
+	const batches = 1000
+	store := api.NewMapStore()
+	f := newFSM(store, nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := uint64(1); i <= batches; i++ {
+			value := fmt.Sprint(i)
+			resp := applyChanges(t, f, i,
+				api.Change{Type: api.OpPut, Key: "a", Entry: api.Entry{Value: value, Version: 2*i - 1}},
+				api.Change{Type: api.OpPut, Key: "b", Entry: api.Entry{Value: value, Version: 2 * i}})
+			if resp != nil {
+				t.Error(resp)
+				return
+			}
+		}
+	}()
+
+	// Readers never see one key of a batch written without the other.
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+
+		snapshot := store.Snapshot()
+		if a, b := snapshot["a"], snapshot["b"]; a.Value != b.Value {
+			t.Fatalf("read half a batch: a = %q, b = %q", a.Value, b.Value)
+		}
+	}
+
+	if v, _ := store.Get("b"); v != fmt.Sprint(batches) {
+		t.Errorf("b = %q after the last batch", v)
+	}
+}
+
+func TestFSMRejectsBatchesWhole(t *testing.T) {
+	store := api.NewMapStore()
+	f := newFSM(store, nil)
+	store.Put("a", "before")
+
+	resp := applyChanges(t, f, 1,
+		api.Change{Type: api.OpPut, Key: "a", Entry: api.Entry{Value: "after", Version: 2}},
+		api.Change{Key: "b"}) // No type.
+	if _, ok := resp.(error); !ok {
+		t.Fatalf("Apply() = %v, want an error", resp)
+	}
+	if v, _ := store.Get("a"); v != "before" {
+		t.Errorf("a = %q, want the batch applied not at all", v)
+	}
+}
@@ -0,0 +1,74 @@
+package cluster
+
+import (
+	"sync"
+
+	"github.com/hashicorp/raft"
+)
+
+// Network connects nodes in memory, for deterministic tests of elections,
+// partitions and membership changes without sockets.
+type Network struct {
+	mu         sync.Mutex
+	transports map[raft.ServerAddress]*raft.InmemTransport
+	isolated   map[raft.ServerAddress]bool
+}
+
+// NewNetwork returns an empty in-memory network.
+func NewNetwork() *Network {
+	return &Network{
+		transports: make(map[raft.ServerAddress]*raft.InmemTransport),
+		isolated:   make(map[raft.ServerAddress]bool),
+	}
+}
+
+// Transport returns a transport at addr, connected to every other transport
+// of the network, for use as NodeParams.Transport.
+func (n *Network) Transport(addr string) raft.Transport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	a, t := raft.NewInmemTransport(raft.ServerAddress(addr))
+	for peer, pt := range n.transports {
+		t.Connect(peer, pt)
+		pt.Connect(a, t)
+	}
+	n.transports[a] = t
+	return t
+}
+
+// Partition cuts the nodes at addrs off from the rest of the network. They
+// still reach each other.
+func (n *Network) Partition(addrs ...string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, addr := range addrs {
+		n.isolated[raft.ServerAddress(addr)] = true
+	}
+
+	for a, t := range n.transports {
+		for b, u := range n.transports {
+			if n.isolated[a] != n.isolated[b] {
+				t.Disconnect(b)
+				u.Disconnect(a)
+			}
+		}
+	}
+}
+
+// Heal reconnects every node to every other.
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.isolated = make(map[raft.ServerAddress]bool)
+
+	for a, t := range n.transports {
+		for b, u := range n.transports {
+			if a != b {
+				t.Connect(b, u)
+			}
+		}
+	}
+}
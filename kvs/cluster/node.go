@@ -0,0 +1,424 @@
+// Package cluster runs kvs as a Raft cluster. Writes are committed to a
+// replicated Raft log once a quorum of nodes has persisted them, and a new
+// leader is elected when the current one fails.
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// defaultApplyTimeout is used when NodeParams.ApplyTimeout is not set.
+const defaultApplyTimeout = 10 * time.Second
+
+// retainSnapshots is how many Raft snapshots a node keeps on disk.
+const retainSnapshots = 2
+
+// ErrorNotLeader error value indicating a write or membership change was
+// sent to a node that is not the leader.
+var ErrorNotLeader error = &api.Error{Code: api.CodeUnavailable,
+	Err: errors.New("not the cluster leader")}
+
+// NodeParams configures a Node.
+type NodeParams struct {
+	// ID identifies the node within the cluster. It must not change across
+	// restarts.
+	ID string
+	// URL is the base URL of the node's HTTP API, to which other nodes
+	// redirect writes while it leads.
+	URL string
+	// Dir holds the Raft log and snapshots. If empty, they are kept in
+	// memory, which is only suitable for tests.
+	Dir string
+	// Transport connects the node to the others: raft.NewTCPTransport in
+	// production, a Network in tests.
+	Transport raft.Transport
+	// Store receives the committed writes. Nothing else should write to it.
+	Store api.Store
+	// Feed, if set, receives the committed writes, sequenced by their Raft
+	// log index.
+	Feed *api.Feed
+	// Bootstrap forms a new cluster with this node as its only member,
+	// unless the node has joined a cluster before.
+	Bootstrap bool
+	// ApplyTimeout bounds how long a write waits to be committed.
+	ApplyTimeout time.Duration
+	// Config, if set, overrides raft.DefaultConfig, e.g. to shorten
+	// timeouts in tests. LocalID and NotifyCh are set by NewNode.
+	Config *raft.Config
+}
+
+// Member is a node of the cluster.
+type Member struct {
+	ID      string `json:"id"`
+	Address string `json:"address,omitempty"` // The Raft transport address.
+	URL     string `json:"url,omitempty"`
+	Voter   bool   `json:"voter,omitempty"`
+	Leader  bool   `json:"leader,omitempty"`
+}
+
+// Node is a member of a kvs cluster. It implements api.Store: reads are
+// served from the local store, which may lag behind the leader, while
+// writes are only accepted by the leader and return once committed.
+type Node struct {
+	params NodeParams
+	raft   *raft.Raft
+	fsm    *fsm
+	closer func() error // Closes the Raft log store.
+
+	// mu serializes writes, so each is checked against the state left by
+	// the one before.
+	mu sync.Mutex
+	// readyTerm is the term in which the node, as leader, has applied every
+	// entry committed before and so can check preconditions locally.
+	readyTerm uint64
+}
+
+// NewNode starts a Raft node as described by params.
+func NewNode(params NodeParams) (*Node, error) {
+	if params.ApplyTimeout <= 0 {
+		params.ApplyTimeout = defaultApplyTimeout
+	}
+
+	config := raft.DefaultConfig()
+	if params.Config != nil {
+		c := *params.Config
+		config = &c
+	}
+	notify := make(chan bool, 1)
+	config.LocalID = raft.ServerID(params.ID)
+	config.NotifyCh = notify
+
+	n := &Node{params: params, fsm: newFSM(params.Store, params.Feed)}
+
+	var logs raft.LogStore
+	var stable raft.StableStore
+	var snapshots raft.SnapshotStore
+
+	if params.Dir == "" {
+		store := raft.NewInmemStore()
+		logs, stable, snapshots = store, store, raft.NewInmemSnapshotStore()
+		n.closer = func() error { return nil }
+	} else {
+		if err := os.MkdirAll(params.Dir, 0700); err != nil {
+			return nil, fmt.Errorf("cannot create raft directory: %w", err)
+		}
+
+		store, err := raftboltdb.NewBoltStore(filepath.Join(params.Dir, "raft.db"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot open raft log: %w", err)
+		}
+		logs, stable, n.closer = store, store, store.Close
+
+		snapshots, err = raft.NewFileSnapshotStore(params.Dir, retainSnapshots, os.Stderr)
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("cannot open raft snapshots: %w", err)
+		}
+	}
+
+	if params.Bootstrap {
+		existing, err := raft.HasExistingState(logs, stable, snapshots)
+		if err != nil {
+			n.closer()
+			return nil, fmt.Errorf("cannot read raft state: %w", err)
+		}
+
+		if !existing {
+			err = raft.BootstrapCluster(config, logs, stable, snapshots, params.Transport,
+				raft.Configuration{Servers: []raft.Server{{
+					ID: config.LocalID, Address: params.Transport.LocalAddr()}}})
+			if err != nil {
+				n.closer()
+				return nil, fmt.Errorf("cannot bootstrap cluster: %w", err)
+			}
+		}
+	}
+
+	r, err := raft.NewRaft(config, n.fsm, logs, stable, snapshots, params.Transport)
+	if err != nil {
+		n.closer()
+		return nil, fmt.Errorf("cannot start raft: %w", err)
+	}
+	n.raft = r
+
+	go n.watchLeadership(notify)
+
+	return n, nil
+}
+
+// watchLeadership prepares the node for writes whenever it becomes leader.
+// Raft blocks until notifications are read, so this never waits itself.
+func (n *Node) watchLeadership(notify <-chan bool) {
+	for leader := range notify {
+		if leader {
+			go n.establishLeadership()
+		}
+	}
+}
+
+// establishLeadership waits until the entries of earlier terms are applied,
+// so that preconditions and versions are checked against the latest state,
+// and records this node's URL for redirects.
+func (n *Node) establishLeadership() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	term := n.raft.CurrentTerm()
+
+	if err := n.raft.Barrier(n.params.ApplyTimeout).Error(); err != nil {
+		return
+	}
+
+	if n.fsm.url(n.params.ID) != n.params.URL {
+		err := n.apply(command{Member: &Member{ID: n.params.ID, URL: n.params.URL}})
+		if err != nil {
+			return
+		}
+	}
+
+	atomic.StoreUint64(&n.readyTerm, term)
+}
+
+// IsLeader reports whether the node is the leader and accepts writes.
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader &&
+		atomic.LoadUint64(&n.readyTerm) == n.raft.CurrentTerm()
+}
+
+// LeaderURL returns the URL of the leader, or an empty string if there is
+// no leader or its URL is not known yet.
+func (n *Node) LeaderURL() string {
+	_, id := n.raft.LeaderWithID()
+	if id == "" {
+		return ""
+	}
+	return n.fsm.url(string(id))
+}
+
+// apply commits cmd to the Raft log and waits until it is applied here.
+func (n *Node) apply(cmd command) error {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	future := n.raft.Apply(data, n.params.ApplyTimeout)
+	if err := future.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			return fmt.Errorf("%w: %v", ErrorNotLeader, err)
+		}
+		return fmt.Errorf("cannot commit to raft log: %w", err)
+	}
+
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// Put the value into the key.
+func (n *Node) Put(key, value string) error {
+	_, err := n.PutWithExpiry(key, value, time.Time{})
+	return err
+}
+
+// PutWithExpiry puts the value into the key until expiry.
+func (n *Node) PutWithExpiry(key, value string, expiry time.Time) (uint64, error) {
+	return n.applyOne(api.Op{Type: api.OpPut, Key: key, Value: value, Expiry: expiry})
+}
+
+// CompareAndSwap puts the value into the key if it is at version.
+func (n *Node) CompareAndSwap(key string, version uint64, value string, expiry time.Time) (uint64, error) {
+	return n.applyOne(api.Op{Type: api.OpPut, Key: key, Value: value, Expiry: expiry,
+		Conditional: true, Version: version})
+}
+
+// Delete the key.
+func (n *Node) Delete(key string) (uint64, error) {
+	return n.applyOne(api.Op{Type: api.OpDelete, Key: key})
+}
+
+// CompareAndDelete deletes the key if it is at version.
+func (n *Node) CompareAndDelete(key string, version uint64) (uint64, error) {
+	return n.applyOne(api.Op{Type: api.OpDelete, Key: key, Conditional: true, Version: version})
+}
+
+func (n *Node) applyOne(op api.Op) (uint64, error) {
+	versions, err := n.Apply([]api.Op{op})
+	if errors.Is(err, api.ErrorVersionMismatch) {
+		return 0, api.ErrorVersionMismatch
+	}
+	if err != nil {
+		return 0, err
+	}
+	return versions[0], nil
+}
+
+// Apply checks the preconditions of ops on the leader, assigns their
+// versions and commits them to the Raft log as a single entry, so every
+// node applies all of them or none.
+func (n *Node) Apply(ops []api.Op) ([]uint64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !n.IsLeader() {
+		return nil, ErrorNotLeader
+	}
+
+	err := api.CheckOps(ops, func(key string) (api.Entry, bool) {
+		e, err := n.params.Store.Lookup(key)
+		return e, err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	revision := n.fsm.lastRevision()
+	versions := make([]uint64, len(ops))
+	changes := make([]api.Change, len(ops))
+
+	for i, op := range ops {
+		revision++
+		versions[i] = revision
+		changes[i] = api.Change{Type: op.Type, Key: op.Key, Entry: api.Entry{Version: revision}}
+		if op.Type == api.OpPut {
+			changes[i].Value, changes[i].Expiry = op.Value, op.Expiry
+		}
+	}
+
+	if err := n.apply(command{Changes: changes}); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// Get the value of a key from the local store.
+func (n *Node) Get(key string) (string, error) {
+	return n.params.Store.Get(key)
+}
+
+// Lookup the entry of a key in the local store.
+func (n *Node) Lookup(key string) (api.Entry, error) {
+	return n.params.Store.Lookup(key)
+}
+
+// List keys of the local store.
+func (n *Node) List(prefix, start string, limit int) []api.KeyValue {
+	return n.params.Store.List(prefix, start, limit)
+}
+
+// Snapshot returns a copy of the local store.
+func (n *Node) Snapshot() map[string]api.Entry {
+	return n.params.Store.Snapshot()
+}
+
+// Stats returns the size of the local store.
+func (n *Node) Stats() api.StoreStats {
+	return n.params.Store.Stats()
+}
+
+// RemoveExpired deletes the expired keys of the local store. Expiry is not
+// replicated: every node expires keys by its own clock.
+func (n *Node) RemoveExpired() int {
+	return n.params.Store.RemoveExpired()
+}
+
+// Restore writes to the local store only, bypassing the Raft log.
+func (n *Node) Restore(key string, e api.Entry) error {
+	return n.params.Store.Restore(key, e)
+}
+
+// RestoreDelete deletes from the local store only, bypassing the Raft log.
+func (n *Node) RestoreDelete(key string, version uint64) error {
+	return n.params.Store.RestoreDelete(key, version)
+}
+
+// RestoreBatch restores a batch into the local store only, bypassing the
+// Raft log.
+func (n *Node) RestoreBatch(ops []api.Op) error {
+	return n.params.Store.RestoreBatch(ops)
+}
+
+// Join adds a voting member to the cluster. It must be called on the leader.
+func (n *Node) Join(m Member) error {
+	err := n.raft.AddVoter(raft.ServerID(m.ID), raft.ServerAddress(m.Address),
+		0, n.params.ApplyTimeout).Error()
+	if errors.Is(err, raft.ErrNotLeader) {
+		return ErrorNotLeader
+	}
+	if err != nil {
+		return fmt.Errorf("cannot add %s to cluster: %w", m.ID, err)
+	}
+
+	if m.URL == "" {
+		return nil
+	}
+	return n.apply(command{Member: &Member{ID: m.ID, URL: m.URL}})
+}
+
+// Leave removes a member from the cluster. It must be called on the leader.
+func (n *Node) Leave(id string) error {
+	// A leader removing itself steps down and cannot commit afterwards, so
+	// it forgets its URL first.
+	self := id == n.params.ID
+	if self {
+		if err := n.apply(command{Remove: id}); err != nil {
+			return err
+		}
+	}
+
+	err := n.raft.RemoveServer(raft.ServerID(id), 0, n.params.ApplyTimeout).Error()
+	if errors.Is(err, raft.ErrNotLeader) {
+		return ErrorNotLeader
+	}
+	if err != nil {
+		return fmt.Errorf("cannot remove %s from cluster: %w", id, err)
+	}
+
+	if self {
+		return nil
+	}
+	return n.apply(command{Remove: id})
+}
+
+// Members returns the current members of the cluster.
+func (n *Node) Members() ([]Member, error) {
+	future := n.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, fmt.Errorf("cannot read cluster configuration: %w", err)
+	}
+
+	_, leader := n.raft.LeaderWithID()
+
+	var members []Member
+	for _, s := range future.Configuration().Servers {
+		members = append(members, Member{
+			ID:      string(s.ID),
+			Address: string(s.Address),
+			URL:     n.fsm.url(string(s.ID)),
+			Voter:   s.Suffrage == raft.Voter,
+			Leader:  s.ID == leader,
+		})
+	}
+	return members, nil
+}
+
+// Shutdown stops the node. The local store keeps its content.
+func (n *Node) Shutdown() error {
+	err := n.raft.Shutdown().Error()
+	if cerr := n.closer(); err == nil {
+		err = cerr
+	}
+	return err
+}
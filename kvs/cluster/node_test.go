@@ -0,0 +1,277 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+// testConfig shortens the Raft timeouts so elections take milliseconds.
+func testConfig() *raft.Config {
+	c := raft.DefaultConfig()
+	c.HeartbeatTimeout = 50 * time.Millisecond
+	c.ElectionTimeout = 50 * time.Millisecond
+	c.LeaderLeaseTimeout = 50 * time.Millisecond
+	c.CommitTimeout = 5 * time.Millisecond
+	c.Logger = hclog.New(&hclog.LoggerOptions{Output: ioutil.Discard})
+	return c
+}
+
+// testCluster is a cluster of nodes connected by an in-memory network.
+type testCluster struct {
+	t       *testing.T
+	network *Network
+	nodes   map[string]*Node
+	stores  map[string]api.Store
+}
+
+// newTestCluster starts a cluster of n nodes, "n0" to "n<n-1>", and waits
+// until n0 leads it.
+func newTestCluster(t *testing.T, n int) *testCluster {
+	c := &testCluster{t: t, network: NewNetwork(),
+		nodes: make(map[string]*Node), stores: make(map[string]api.Store)}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Shutdown()
+		}
+	})
+
+	c.start("n0", true)
+	c.waitFor("n0 to lead", func() bool { return c.nodes["n0"].IsLeader() })
+	for i := 1; i < n; i++ {
+		c.join(fmt.Sprint("n", i))
+	}
+	return c
+}
+
+// start starts the node id.
+func (c *testCluster) start(id string, bootstrap bool) {
+	c.t.Helper()
+
+	store := api.NewMapStore()
+	node, err := NewNode(NodeParams{ID: id, URL: "http://" + id, Transport: c.network.Transport(id),
+		Store: store, Bootstrap: bootstrap, ApplyTimeout: time.Second, Config: testConfig()})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.nodes[id], c.stores[id] = node, store
+}
+
+// join starts the node id and adds it to the cluster.
+func (c *testCluster) join(id string) {
+	c.t.Helper()
+
+	c.start(id, false)
+	if err := c.leader().Join(Member{ID: id, Address: id, URL: "http://" + id}); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// waitFor waits until cond holds.
+func (c *testCluster) waitFor(what string, cond func() bool) {
+	c.t.Helper()
+
+	for deadline := time.Now().Add(10 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// leader waits for one of the nodes to lead and returns it.
+func (c *testCluster) leader(among ...string) *Node {
+	c.t.Helper()
+
+	if len(among) == 0 {
+		for id := range c.nodes {
+			among = append(among, id)
+		}
+	}
+
+	var leader *Node
+	c.waitFor("a leader", func() bool {
+		for _, id := range among {
+			if c.nodes[id].IsLeader() {
+				leader = c.nodes[id]
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// waitForValue waits until the nodes hold value at key.
+func (c *testCluster) waitForValue(key, value string, ids ...string) {
+	c.t.Helper()
+
+	for _, id := range ids {
+		c.waitFor(fmt.Sprintf("%s to hold %s=%s", id, key, value), func() bool {
+			v, err := c.stores[id].Get(key)
+			return err == nil && v == value
+		})
+	}
+}
+
+func TestClusterReplicatesWrites(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.nodes["n0"]
+
+	version, err := leader.PutWithExpiry("a", "1", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.waitForValue("a", "1", "n1", "n2")
+
+	// Followers refuse writes and point at the leader.
+	if _, err = c.nodes["n1"].PutWithExpiry("b", "1", time.Time{}); err != ErrorNotLeader {
+		t.Errorf("write on a follower: %v, want %v", err, ErrorNotLeader)
+	}
+	if u := c.nodes["n2"].LeaderURL(); u != "http://n0" {
+		t.Errorf("LeaderURL() = %q, want %q", u, "http://n0")
+	}
+
+	// Every node holds the version the leader assigned.
+	c.waitFor("versions to agree", func() bool {
+		e, err := c.stores["n2"].Lookup("a")
+		return err == nil && e.Version == version
+	})
+	if _, err = leader.CompareAndSwap("a", version+1, "x", time.Time{}); err != api.ErrorVersionMismatch {
+		t.Errorf("CompareAndSwap at the wrong version: %v, want %v", err, api.ErrorVersionMismatch)
+	}
+
+	versions, err := leader.Apply([]api.Op{
+		{Type: api.OpPut, Key: "b", Value: "2"},
+		{Type: api.OpDelete, Key: "a"},
+	})
+	if err != nil || len(versions) != 2 || versions[0] <= version {
+		t.Fatalf("Apply() = %v, %v", versions, err)
+	}
+	c.waitForValue("b", "2", "n1", "n2")
+	if _, err = c.stores["n1"].Get("a"); err != api.ErrorNoSuchKey {
+		t.Errorf("deleted key on a follower: %v", err)
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	c := newTestCluster(t, 3)
+	if _, err := c.nodes["n0"].PutWithExpiry("a", "1", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	c.waitForValue("a", "1", "n1", "n2")
+
+	// Cut the leader off: the majority elects a new leader among itself.
+	c.network.Partition("n0")
+	leader := c.leader("n1", "n2")
+	if _, err := leader.PutWithExpiry("a", "2", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old leader cannot commit without a majority.
+	if _, err := c.nodes["n0"].PutWithExpiry("lost", "x", time.Time{}); err == nil {
+		t.Fatal("write committed by an isolated leader")
+	}
+
+	// Once healed, the old leader follows and catches up; the write it
+	// could not commit is gone.
+	c.network.Heal()
+	c.waitForValue("a", "2", "n0", "n1", "n2")
+	c.waitFor("n0 to step down", func() bool { return !c.nodes["n0"].IsLeader() })
+	for id, s := range c.stores {
+		if _, err := s.Get("lost"); err != api.ErrorNoSuchKey {
+			t.Errorf("%s holds an uncommitted write: %v", id, err)
+		}
+	}
+
+	if _, err := c.leader().PutWithExpiry("after", "heal", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	c.waitForValue("after", "heal", "n0", "n1", "n2")
+}
+
+func TestClusterMinorityPartition(t *testing.T) {
+	c := newTestCluster(t, 5)
+
+	// A minority without the leader keeps it leading.
+	c.network.Partition("n3", "n4")
+	if _, err := c.nodes["n0"].PutWithExpiry("a", "1", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	c.waitForValue("a", "1", "n1", "n2")
+	for _, id := range []string{"n3", "n4"} {
+		if _, err := c.stores[id].Get("a"); err == nil {
+			t.Errorf("partitioned %s received a write", id)
+		}
+	}
+
+	c.network.Heal()
+	c.waitForValue("a", "1", "n3", "n4")
+}
+
+func TestClusterMembershipChanges(t *testing.T) {
+	c := newTestCluster(t, 3)
+	leader := c.nodes["n0"]
+	if _, err := leader.PutWithExpiry("a", "1", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A node joining later catches up with the writes before it.
+	c.join("n3")
+	c.waitForValue("a", "1", "n3")
+
+	members := func() map[string]Member {
+		ms, err := c.leader().Members()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]Member)
+		for _, member := range ms {
+			m[member.ID] = member
+		}
+		return m
+	}
+	if m := members(); len(m) != 4 || m["n3"].URL != "http://n3" || !m["n3"].Voter || !m["n0"].Leader {
+		t.Fatalf("members after join: %+v", m)
+	}
+
+	// Joining goes through the leader.
+	if err := c.nodes["n1"].Join(Member{ID: "n4", Address: "n4"}); err != ErrorNotLeader {
+		t.Errorf("Join() on a follower: %v, want %v", err, ErrorNotLeader)
+	}
+
+	if err := leader.Leave("n1"); err != nil {
+		t.Fatal(err)
+	}
+	if m := members(); len(m) != 3 || m["n1"].ID != "" {
+		t.Fatalf("members after leave: %+v", m)
+	}
+
+	// With n1 gone, n0, n2 and n3 still form a majority when n2 is cut off.
+	c.network.Partition("n1", "n2")
+	if _, err := leader.PutWithExpiry("b", "2", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	c.waitForValue("b", "2", "n3")
+
+	// The leader leaving hands leadership to another member.
+	c.network.Heal()
+	if err := leader.Leave("n0"); err != nil {
+		t.Fatal(err)
+	}
+	next := c.leader("n2", "n3")
+	if _, err := next.PutWithExpiry("c", "3", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	c.waitForValue("c", "3", "n2", "n3")
+	if m := members(); len(m) != 2 || m["n0"].ID != "" {
+		t.Errorf("members after the leader left: %+v", m)
+	}
+	if u := c.nodes["n3"].LeaderURL(); u != "http://"+next.params.ID {
+		t.Errorf("LeaderURL() = %q after the leader left", u)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cloud-native-go/kvs/api"
+)
+
+// errPreconditionFailed reports that If-Match or If-None-Match rule out a
+// request before it reaches the store.
+var errPreconditionFailed error = &api.Error{Code: api.CodePreconditionFailed,
+	Err: errors.New("precondition failed")}
+
+// etag formats a store version as an entity tag.
+func etag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// etagsMatch reports whether the If-Match or If-None-Match header value
+// lists version. Weak tags compare like strong ones.
+func etagsMatch(header string, version uint64) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// writePrecondition turns the If-Match and If-None-Match headers of a write
+// to key into the version the store must find, for use with CompareAndSwap
+// and CompareAndDelete. conditional is false if neither header is set.
+//
+// Tag lists are resolved against the current version here and then
+// enforced by the store, so a concurrent write in between still fails.
+func writePrecondition(r *http.Request, key string) (version uint64, conditional bool, err error) {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+
+	switch {
+	case ifMatch == "*":
+		return api.AnyVersion, true, nil
+	case ifMatch != "":
+		current, err := lookupKey(r.Context(), key)
+		if err != nil || !etagsMatch(ifMatch, current.Version) {
+			return 0, true, errPreconditionFailed
+		}
+		return current.Version, true, nil
+	case ifNoneMatch == "*":
+		return api.NoVersion, true, nil
+	case ifNoneMatch != "":
+		current, err := lookupKey(r.Context(), key)
+		if err != nil {
+			return api.NoVersion, true, nil
+		}
+		if etagsMatch(ifNoneMatch, current.Version) {
+			return 0, true, errPreconditionFailed
+		}
+		return current.Version, true, nil
+	}
+
+	return 0, false, nil
+}
@@ -0,0 +1,691 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/auth"
+	"github.com/cloud-native-go/kvs/logger"
+	"github.com/cloud-native-go/kvs/partition"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix prefixes the environment variables that set flags: -raft-id
+// is KVS_RAFT_ID.
+const envPrefix = "KVS_"
+
+// config is the configuration of the service. Settings come from, in
+// increasing order of precedence: defaults, the config file, environment
+// variables and command-line flags.
+type config struct {
+	Listen     string          `json:"listen"`      // The HTTP address.
+	GRPCListen string          `json:"grpc_listen"` // The gRPC address; empty disables gRPC.
+	Leader     string          `json:"leader"`      // The leader a follower replicates from.
+	Logger     loggerConfig    `json:"logger"`
+	Raft       clusterConfig   `json:"raft"`
+	Partition  partitionConfig `json:"partition"`
+	TLS        tlsConfig       `json:"tls"`
+	Auth       authConfig      `json:"auth"`
+	Tracing    tracingConfig   `json:"tracing"`
+	Logging    loggingConfig   `json:"logging"`
+	Limits     limitsConfig    `json:"limits"`
+}
+
+// loggerConfig selects and configures the transaction logger of a
+// standalone or leader node.
+type loggerConfig struct {
+	Backend  string         `json:"backend"` // "file" or "postgres".
+	File     string         `json:"file"`    // The path of the file log.
+	Postgres postgresConfig `json:"postgres"`
+	// ServeDuringReplay serves reads from the snapshot of the log while
+	// the events logged after it replay, and writes once they have.
+	ServeDuringReplay bool `json:"serve_during_replay"`
+}
+
+// postgresConfig holds the connection parameters of the Postgres logger,
+// its connection pool and how it batches and retries writes. Zero values
+// select the defaults of the logger package.
+type postgresConfig struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	DbName   string `json:"dbname"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// PasswordFile holds the password, for secrets mounted as files.
+	PasswordFile string `json:"password_file"`
+	SSLMode      string `json:"sslmode"`
+	SSLRootCert  string `json:"sslrootcert"`
+	SSLCert      string `json:"sslcert"`
+	SSLKey       string `json:"sslkey"`
+	Schema       string `json:"schema"`
+	Table        string `json:"table"`
+
+	MaxOpenConns    int      `json:"max_open_conns"`
+	MaxIdleConns    int      `json:"max_idle_conns"`
+	ConnMaxLifetime duration `json:"conn_max_lifetime"`
+	ConnMaxIdleTime duration `json:"conn_max_idle_time"`
+
+	// MaxBatch and MaxBatchDelay bound the events committed together and
+	// how long the first of them waits for more.
+	MaxBatch      int      `json:"max_batch"`
+	MaxBatchDelay duration `json:"max_batch_delay"`
+
+	Retries    int      `json:"retries"` // Negative disables retries.
+	RetryDelay duration `json:"retry_delay"`
+
+	// SnapshotFile is a local file the state is snapshotted to, so replay
+	// reads only the events logged after it from the database.
+	SnapshotFile   string `json:"snapshot_file"`
+	ReplayPageSize int    `json:"replay_page_size"`
+}
+
+// partitionConfig configures partitioning, enabled when Nodes is set.
+type partitionConfig struct {
+	Nodes  stringList `json:"nodes"`  // The base URLs of the nodes on the ring.
+	Self   string     `json:"self"`   // This node's base URL on the ring.
+	VNodes int        `json:"vnodes"` // Points per node on the ring.
+}
+
+// tlsConfig makes the servers use TLS, if both CertFile and KeyFile are
+// set. ClientCAFile enables mutual TLS: clients need a certificate signed
+// by one of its CAs, unless ClientAuth is "optional". ClientPermissions
+// grants certificate subjects the permissions "read", "write", "delete"
+// and "admin" on every key, and enables authentication.
+type tlsConfig struct {
+	CertFile          string              `json:"cert_file"`
+	KeyFile           string              `json:"key_file"`
+	ClientCAFile      string              `json:"client_ca_file"`
+	ClientAuth        string              `json:"client_auth"` // "require" (default) or "optional".
+	ClientPermissions map[string][]string `json:"client_permissions"`
+}
+
+// authConfig enables authentication with static tokens or HMAC-signed
+// JWTs, and grants principals permissions on key prefixes.
+type authConfig struct {
+	Tokens []tokenConfig `json:"tokens"`
+	JWT    jwtConfig     `json:"jwt"`
+	ACL    []auth.Grant  `json:"acl"`
+	// AuditLog is the file refused requests are recorded in; stderr if
+	// empty.
+	AuditLog string `json:"audit_log"`
+	// PeerToken authenticates the requests of this node to other nodes,
+	// which need to grant its principal permissions.
+	PeerToken string `json:"peer_token"`
+}
+
+// tokenConfig is a static API token and the principal it identifies.
+type tokenConfig struct {
+	Principal string `json:"principal"`
+	Token     string `json:"token"`
+}
+
+// jwtConfig configures the verification of JWTs, signed with the key in
+// KeyFile.
+type jwtConfig struct {
+	KeyFile  string `json:"key_file"`
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+}
+
+// tracingConfig selects where spans are exported to: nowhere ("none"),
+// standard output ("stdout") or an OTLP collector over HTTP ("otlp").
+type tracingConfig struct {
+	Exporter string `json:"exporter"`
+	// Endpoint is the URL of the OTLP collector, e.g.
+	// http://collector:4318/v1/traces. If empty, the OTEL_EXPORTER_OTLP_*
+	// environment variables apply.
+	Endpoint string `json:"endpoint"`
+	// SampleRatio is the share of traces started here that are sampled.
+	// Traces started by clients follow their sampling decision.
+	SampleRatio float64 `json:"sample_ratio"`
+	ServiceName string  `json:"service_name"`
+}
+
+// loggingConfig sets what the service logs.
+type loggingConfig struct {
+	Level string `json:"level"` // "debug", "info", "warn" or "error".
+	// RedactKeys logs a hash of keys instead of the keys, which may hold
+	// personal data.
+	RedactKeys bool `json:"redact_keys"`
+}
+
+// limitsConfig bounds requests and server state.
+type limitsConfig struct {
+	MaxKeyLength       int `json:"max_key_length"`
+	MaxValueSize       int `json:"max_value_size"`
+	MaxBatchOperations int `json:"max_batch_operations"`
+	MaxBatchBytes      int `json:"max_batch_bytes"`
+	WatchHistory       int `json:"watch_history"`
+}
+
+// stringList is a flag holding a comma-separated list.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// duration is a time.Duration read from flags and config files as a
+// string such as "1m30s".
+type duration time.Duration
+
+func (d *duration) String() string { return time.Duration(*d).String() }
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	return d.Set(s)
+}
+
+// defaultConfig returns the settings in effect unless configured otherwise.
+func defaultConfig() config {
+	return config{
+		Listen: ":8080",
+		Logger: loggerConfig{
+			Backend: "postgres",
+			File:    "transaction.log",
+			Postgres: postgresConfig{
+				Host: "host.docker.internal", Port: 5432,
+				DbName: "postgres", User: "postgres", SSLMode: "disable",
+				Schema: "public", Table: "transactions"},
+		},
+		Raft:      clusterConfig{Addr: "127.0.0.1:7000"},
+		Partition: partitionConfig{VNodes: partition.DefaultVirtualNodes},
+		Tracing:   tracingConfig{Exporter: "none", SampleRatio: 1, ServiceName: "kvs"},
+		Logging:   loggingConfig{Level: "info"},
+		Limits: limitsConfig{
+			MaxKeyLength:       api.MaxKeyLength,
+			MaxValueSize:       api.MaxValueSize,
+			MaxBatchOperations: maxBatchOperations,
+			MaxBatchBytes:      int(maxBatchBytes),
+			WatchHistory:       watchHistory,
+		},
+	}
+}
+
+// flagSet returns the command-line flags, which set the fields of c.
+func (c *config) flagSet(name string, file *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	fs.StringVar(file, "config", "",
+		"JSON or YAML config file (.json, .yaml or .yml)")
+
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address to serve on")
+	fs.StringVar(&c.GRPCListen, "grpc-listen", c.GRPCListen,
+		"address to serve the gRPC API on, e.g. :50051 (default off)")
+	fs.StringVar(&c.Leader, "leader", c.Leader,
+		"base URL of the leader to replicate from, e.g. http://leader:8080")
+
+	fs.StringVar(&c.Logger.Backend, "logger", c.Logger.Backend,
+		`transaction logger: "file" or "postgres"`)
+	fs.StringVar(&c.Logger.File, "log-file", c.Logger.File,
+		"path of the file transaction log")
+	fs.BoolVar(&c.Logger.ServeDuringReplay, "serve-during-replay", c.Logger.ServeDuringReplay,
+		"serve reads from the log snapshot while the rest of the log replays; writes are refused until done")
+	fs.StringVar(&c.Logger.Postgres.Host, "postgres-host", c.Logger.Postgres.Host,
+		"Postgres host")
+	fs.IntVar(&c.Logger.Postgres.Port, "postgres-port", c.Logger.Postgres.Port,
+		"Postgres port")
+	fs.StringVar(&c.Logger.Postgres.DbName, "postgres-db", c.Logger.Postgres.DbName,
+		"Postgres database")
+	fs.StringVar(&c.Logger.Postgres.User, "postgres-user", c.Logger.Postgres.User,
+		"Postgres user")
+	fs.StringVar(&c.Logger.Postgres.Password, "postgres-password", c.Logger.Postgres.Password,
+		"Postgres password; prefer "+envPrefix+"POSTGRES_PASSWORD, flags show in ps")
+	fs.StringVar(&c.Logger.Postgres.PasswordFile, "postgres-password-file", c.Logger.Postgres.PasswordFile,
+		"file holding the Postgres password")
+	fs.StringVar(&c.Logger.Postgres.SSLMode, "postgres-sslmode", c.Logger.Postgres.SSLMode,
+		"Postgres sslmode: disable, allow, prefer, require, verify-ca or verify-full")
+	fs.StringVar(&c.Logger.Postgres.SSLRootCert, "postgres-sslrootcert", c.Logger.Postgres.SSLRootCert,
+		"PEM file of the CAs verifying the Postgres server certificate")
+	fs.StringVar(&c.Logger.Postgres.SSLCert, "postgres-sslcert", c.Logger.Postgres.SSLCert,
+		"PEM client certificate file for Postgres")
+	fs.StringVar(&c.Logger.Postgres.SSLKey, "postgres-sslkey", c.Logger.Postgres.SSLKey,
+		"PEM private key file of -postgres-sslcert")
+	fs.StringVar(&c.Logger.Postgres.Schema, "postgres-schema", c.Logger.Postgres.Schema,
+		"Postgres schema of the transaction table")
+	fs.StringVar(&c.Logger.Postgres.Table, "postgres-table", c.Logger.Postgres.Table,
+		"name of the Postgres transaction table")
+	fs.IntVar(&c.Logger.Postgres.MaxOpenConns, "postgres-max-open-conns", c.Logger.Postgres.MaxOpenConns,
+		"most open Postgres connections (default unlimited)")
+	fs.IntVar(&c.Logger.Postgres.MaxIdleConns, "postgres-max-idle-conns", c.Logger.Postgres.MaxIdleConns,
+		"most idle Postgres connections kept open (default 2)")
+	fs.Var(&c.Logger.Postgres.ConnMaxLifetime, "postgres-conn-max-lifetime",
+		"longest a Postgres connection is reused, e.g. 30m (default forever)")
+	fs.Var(&c.Logger.Postgres.ConnMaxIdleTime, "postgres-conn-max-idle-time",
+		"longest a Postgres connection stays idle, e.g. 5m (default forever)")
+	fs.IntVar(&c.Logger.Postgres.MaxBatch, "postgres-max-batch", c.Logger.Postgres.MaxBatch,
+		"most events committed to Postgres together")
+	fs.Var(&c.Logger.Postgres.MaxBatchDelay, "postgres-max-batch-delay",
+		"longest an event waits for others to be committed with, e.g. 5ms")
+	fs.IntVar(&c.Logger.Postgres.Retries, "postgres-retries", c.Logger.Postgres.Retries,
+		"times a batch failing with a transient error is retried; negative disables retries (default 3)")
+	fs.Var(&c.Logger.Postgres.RetryDelay, "postgres-retry-delay",
+		"wait before the first retry, doubling for every further one (default 100ms)")
+	fs.StringVar(&c.Logger.Postgres.SnapshotFile, "postgres-snapshot-file", c.Logger.Postgres.SnapshotFile,
+		"local file to snapshot the state to, so replay reads only later events from Postgres")
+	fs.IntVar(&c.Logger.Postgres.ReplayPageSize, "postgres-replay-page-size", c.Logger.Postgres.ReplayPageSize,
+		"events replay reads from Postgres per query (default 10000)")
+
+	fs.StringVar(&c.Raft.ID, "raft-id", c.Raft.ID,
+		"run as a Raft cluster member with this node ID")
+	fs.StringVar(&c.Raft.Addr, "raft-addr", c.Raft.Addr,
+		"address of the Raft transport")
+	fs.StringVar(&c.Raft.Dir, "raft-dir", c.Raft.Dir,
+		"directory of the Raft log (default raft/<raft-id>)")
+	fs.StringVar(&c.Raft.URL, "raft-url", c.Raft.URL,
+		"base URL other members redirect writes to (default from -listen)")
+	fs.BoolVar(&c.Raft.Bootstrap, "raft-bootstrap", c.Raft.Bootstrap,
+		"form a new cluster with this node as its first member")
+	fs.StringVar(&c.Raft.Join, "raft-join", c.Raft.Join,
+		"base URL of a cluster member to join through")
+
+	fs.Var(&c.Partition.Nodes, "partition-nodes",
+		"comma-separated base URLs of the nodes to partition keys across")
+	fs.StringVar(&c.Partition.Self, "partition-self", c.Partition.Self,
+		"base URL of this node on the partition ring (default from -listen)")
+	fs.IntVar(&c.Partition.VNodes, "partition-vnodes", c.Partition.VNodes,
+		"points each node gets on the partition ring")
+
+	fs.StringVar(&c.TLS.CertFile, "tls-cert", c.TLS.CertFile,
+		"PEM certificate file; serves HTTPS together with -tls-key")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key", c.TLS.KeyFile,
+		"PEM private key file of -tls-cert")
+	fs.StringVar(&c.TLS.ClientCAFile, "tls-client-ca", c.TLS.ClientCAFile,
+		"PEM file of the CAs client certificates must be signed by (mutual TLS)")
+	fs.StringVar(&c.TLS.ClientAuth, "tls-client-auth", c.TLS.ClientAuth,
+		`whether clients need a certificate: "require" or "optional"`)
+
+	fs.StringVar(&c.Auth.JWT.KeyFile, "auth-jwt-key", c.Auth.JWT.KeyFile,
+		"file holding the HMAC key JWTs are signed with")
+	fs.StringVar(&c.Auth.JWT.Issuer, "auth-jwt-issuer", c.Auth.JWT.Issuer,
+		`"iss" claim JWTs need, if set`)
+	fs.StringVar(&c.Auth.JWT.Audience, "auth-jwt-audience", c.Auth.JWT.Audience,
+		`"aud" claim JWTs need, if set`)
+	fs.StringVar(&c.Auth.AuditLog, "auth-audit-log", c.Auth.AuditLog,
+		"file to record refused requests in (default stderr)")
+	fs.StringVar(&c.Auth.PeerToken, "auth-peer-token", c.Auth.PeerToken,
+		"token this node authenticates to other nodes with; prefer "+envPrefix+"AUTH_PEER_TOKEN")
+
+	fs.StringVar(&c.Tracing.Exporter, "trace-exporter", c.Tracing.Exporter,
+		`where to export spans: "none", "stdout" or "otlp"`)
+	fs.StringVar(&c.Tracing.Endpoint, "trace-endpoint", c.Tracing.Endpoint,
+		"URL of the OTLP collector (default from OTEL_EXPORTER_OTLP_ENDPOINT)")
+	fs.Float64Var(&c.Tracing.SampleRatio, "trace-sample-ratio", c.Tracing.SampleRatio,
+		"share of the traces started here that are sampled, from 0 to 1")
+	fs.StringVar(&c.Tracing.ServiceName, "trace-service-name", c.Tracing.ServiceName,
+		"service name spans are exported with")
+
+	fs.StringVar(&c.Logging.Level, "log-level", c.Logging.Level,
+		`least severe level logged: "debug", "info", "warn" or "error"`)
+	fs.BoolVar(&c.Logging.RedactKeys, "log-redact-keys", c.Logging.RedactKeys,
+		"log a hash of keys instead of the keys")
+
+	fs.IntVar(&c.Limits.MaxKeyLength, "max-key-length", c.Limits.MaxKeyLength,
+		"longest key accepted, in bytes")
+	fs.IntVar(&c.Limits.MaxValueSize, "max-value-size", c.Limits.MaxValueSize,
+		"largest value accepted, in bytes")
+	fs.IntVar(&c.Limits.MaxBatchOperations, "max-batch-operations", c.Limits.MaxBatchOperations,
+		"most operations in one batch")
+	fs.IntVar(&c.Limits.MaxBatchBytes, "max-batch-bytes", c.Limits.MaxBatchBytes,
+		"largest batch request body accepted, in bytes")
+	fs.IntVar(&c.Limits.WatchHistory, "watch-history", c.Limits.WatchHistory,
+		"changes kept for watchers resuming a stream")
+
+	return fs
+}
+
+// loadConfig reads the configuration from the config file named by the
+// -config flag or KVS_CONFIG, the KVS_* environment variables and the
+// command-line arguments, and validates it.
+func loadConfig(name string, args []string) (config, error) {
+	// A first pass over the arguments only looks for -config.
+	var file string
+	c := defaultConfig()
+	fs := c.flagSet(name, &file)
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		// Let the second pass report the error, with usage.
+		file = ""
+	}
+	if file == "" {
+		file = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	c = defaultConfig()
+	if file != "" {
+		if err := c.readFile(file); err != nil {
+			return c, err
+		}
+	}
+
+	fs = c.flagSet(name, &file)
+
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		env := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(env); ok {
+			if err := fs.Set(f.Name, v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", env, err))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return c, errors.Join(errs...)
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	if err := c.validate(); err != nil {
+		return c, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return c, nil
+}
+
+// readFile overlays c with the settings of a JSON or YAML file. Settings
+// the file lacks keep their value; unknown settings are an error.
+func (c *config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("cannot read config file: %w", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+	case ".yaml", ".yml":
+		// Decode YAML generically and re-encode it as JSON, so that both
+		// formats share the JSON field names.
+		var v interface{}
+		if err = yaml.Unmarshal(data, &v); err != nil {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+		if v == nil {
+			return nil // An empty file.
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("config file %s: unknown format %q, want .json, .yaml or .yml", path, ext)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(c); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// validate reports every invalid setting of c.
+func (c *config) validate() error {
+	var errs []error
+	fail := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	checkAddr := func(setting, addr string) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			fail("%s: %q is not a host:port address", setting, addr)
+		}
+	}
+	checkURL := func(setting, u string) {
+		p, err := url.Parse(u)
+		if err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			fail("%s: %q is not an http or https URL", setting, u)
+		}
+	}
+
+	checkAddr("listen", c.Listen)
+	if c.GRPCListen != "" {
+		checkAddr("grpc-listen", c.GRPCListen)
+	}
+	if c.Leader != "" {
+		checkURL("leader", c.Leader)
+	}
+
+	switch c.Logger.Backend {
+	case "file":
+		if c.Logger.File == "" {
+			fail("log-file: must be set for the file logger")
+		}
+	case "postgres":
+		pg := c.Logger.Postgres
+		if pg.Host == "" || pg.DbName == "" || pg.User == "" {
+			fail("postgres-host, postgres-db, postgres-user: must be set for the postgres logger")
+		}
+		if pg.Port < 1 || pg.Port > 65535 {
+			fail("postgres-port: %d is not a port", pg.Port)
+		}
+		switch pg.SSLMode {
+		case "disable", "allow", "prefer", "require", "verify-ca", "verify-full":
+		default:
+			fail("postgres-sslmode: unknown mode %q", pg.SSLMode)
+		}
+		if pg.Password != "" && pg.PasswordFile != "" {
+			fail("postgres-password, postgres-password-file: set only one")
+		}
+		if (pg.SSLCert == "") != (pg.SSLKey == "") {
+			fail("postgres-sslcert, postgres-sslkey: set both or neither")
+		}
+		// Leave room for the suffixes of the tables and indexes named after
+		// the table, within the 63 bytes of a Postgres identifier.
+		if pg.Schema == "" || len(pg.Schema) > 63 {
+			fail("postgres-schema: must be 1 to 63 bytes long")
+		}
+		if pg.Table == "" || len(pg.Table) > 52 {
+			fail("postgres-table: must be 1 to 52 bytes long")
+		}
+		if pg.MaxOpenConns < 0 || pg.MaxIdleConns < 0 || pg.MaxBatch < 0 || pg.ReplayPageSize < 0 {
+			fail("postgres-max-open-conns, postgres-max-idle-conns, postgres-max-batch, postgres-replay-page-size: must not be negative")
+		}
+		if pg.ConnMaxLifetime < 0 || pg.ConnMaxIdleTime < 0 || pg.MaxBatchDelay < 0 || pg.RetryDelay < 0 {
+			fail("postgres-conn-max-lifetime, postgres-conn-max-idle-time, postgres-max-batch-delay, postgres-retry-delay: must not be negative")
+		}
+	default:
+		fail(`logger: unknown backend %q, want "file" or "postgres"`, c.Logger.Backend)
+	}
+
+	if c.Raft.ID != "" {
+		checkAddr("raft-addr", c.Raft.Addr)
+		if c.Raft.URL != "" {
+			checkURL("raft-url", c.Raft.URL)
+		}
+		if c.Raft.Join != "" {
+			checkURL("raft-join", c.Raft.Join)
+		}
+		if c.Raft.Bootstrap && c.Raft.Join != "" {
+			fail("raft-bootstrap, raft-join: a node either forms a cluster or joins one")
+		}
+		if c.Leader != "" {
+			fail("leader, raft-id: a node is either a follower or a cluster member")
+		}
+	} else if c.Raft.Bootstrap || c.Raft.Join != "" {
+		fail("raft-bootstrap, raft-join: need raft-id")
+	}
+
+	for _, n := range c.Partition.Nodes {
+		checkURL("partition-nodes", n)
+	}
+	if c.Partition.Self != "" {
+		checkURL("partition-self", c.Partition.Self)
+	}
+	if c.Partition.VNodes < 1 {
+		fail("partition-vnodes: must be positive")
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		fail("tls-cert, tls-key: set both or neither")
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		fail("tls-client-ca: needs tls-cert and tls-key")
+	}
+	switch c.TLS.ClientAuth {
+	case "", "require", "optional":
+	default:
+		fail(`tls-client-auth: unknown mode %q, want "require" or "optional"`, c.TLS.ClientAuth)
+	}
+	if len(c.TLS.ClientPermissions) > 0 && c.TLS.ClientCAFile == "" {
+		fail("tls.client_permissions: needs tls-client-ca")
+	}
+	for subject, perms := range c.TLS.ClientPermissions {
+		for _, p := range perms {
+			if _, err := auth.ParsePermission(p); err != nil {
+				fail("tls.client_permissions: %q: %v", subject, err)
+			}
+		}
+	}
+
+	for i, t := range c.Auth.Tokens {
+		if t.Principal == "" || t.Token == "" {
+			fail("auth.tokens[%d]: needs a principal and a token", i)
+		}
+	}
+	for i, g := range c.Auth.ACL {
+		if g.Principal == "" {
+			fail("auth.acl[%d]: needs a principal", i)
+		}
+		for _, p := range g.Permissions {
+			if _, err := auth.ParsePermission(string(p)); err != nil {
+				fail("auth.acl[%d]: %v", i, err)
+			}
+		}
+	}
+	if c.Auth.JWT.KeyFile != "" {
+		if fi, err := os.Stat(c.Auth.JWT.KeyFile); err != nil {
+			fail("auth-jwt-key: %v", err)
+		} else if fi.Size() < 32 {
+			fail("auth-jwt-key: key is shorter than 32 bytes")
+		}
+	}
+	for _, file := range []string{c.TLS.CertFile, c.TLS.KeyFile, c.TLS.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			fail("tls: %v", err)
+		}
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if c.Tracing.Endpoint != "" {
+			checkURL("trace-endpoint", c.Tracing.Endpoint)
+		}
+	default:
+		fail(`trace-exporter: unknown exporter %q, want "none", "stdout" or "otlp"`, c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		fail("trace-sample-ratio: %v is not between 0 and 1", c.Tracing.SampleRatio)
+	}
+	if c.Tracing.ServiceName == "" {
+		fail("trace-service-name: must be set")
+	}
+
+	switch c.Logging.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		fail(`log-level: unknown level %q, want "debug", "info", "warn" or "error"`, c.Logging.Level)
+	}
+
+	limits := []struct {
+		setting string
+		value   int
+	}{
+		{"max-key-length", c.Limits.MaxKeyLength},
+		{"max-value-size", c.Limits.MaxValueSize},
+		{"max-batch-operations", c.Limits.MaxBatchOperations},
+		{"max-batch-bytes", c.Limits.MaxBatchBytes},
+		{"watch-history", c.Limits.WatchHistory},
+	}
+	for _, l := range limits {
+		if l.value < 1 {
+			fail("%s: must be positive", l.setting)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// apply puts the settings of c into effect.
+func (c *config) apply() {
+	api.MaxKeyLength = c.Limits.MaxKeyLength
+	api.MaxValueSize = c.Limits.MaxValueSize
+	maxBatchOperations = c.Limits.MaxBatchOperations
+	maxBatchBytes = int64(c.Limits.MaxBatchBytes)
+	watchHistory = c.Limits.WatchHistory
+
+	leader = c.Leader
+	clusterParams = c.Raft
+}
+
+// newTransactionLogger creates the transaction logger c selects.
+func (c loggerConfig) newTransactionLogger() (logger.TransactionLogger, error) {
+	switch c.Backend {
+	case "file":
+		return logger.NewFileTransactionLogger(c.File, commitParams)
+	default:
+		pg := c.Postgres
+		if pg.PasswordFile != "" {
+			password, err := os.ReadFile(pg.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read Postgres password: %w", err)
+			}
+			pg.Password = strings.TrimRight(string(password), "\r\n")
+		}
+
+		commit := commitParams
+		if pg.MaxBatch != 0 {
+			commit.MaxBatch = pg.MaxBatch
+		}
+		if pg.MaxBatchDelay != 0 {
+			commit.MaxDelay = time.Duration(pg.MaxBatchDelay)
+		}
+		return logger.NewPostgreTransactionLogger(logger.PostgresDbParams{
+			Host: pg.Host, Port: pg.Port, DbName: pg.DbName, User: pg.User,
+			Password: pg.Password, SSLMode: pg.SSLMode, Commit: commit,
+			SSLRootCert: pg.SSLRootCert, SSLCert: pg.SSLCert, SSLKey: pg.SSLKey,
+			Schema: pg.Schema, Table: pg.Table,
+			SnapshotFile: pg.SnapshotFile, ReplayPageSize: pg.ReplayPageSize,
+			MaxOpenConns: pg.MaxOpenConns, MaxIdleConns: pg.MaxIdleConns,
+			ConnMaxLifetime: time.Duration(pg.ConnMaxLifetime),
+			ConnMaxIdleTime: time.Duration(pg.ConnMaxIdleTime),
+			Retries:         pg.Retries, RetryDelay: time.Duration(pg.RetryDelay)})
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloud-native-go/kvs/auth"
+)
+
+// writeConfigFile writes a config file named name to a temporary
+// directory and returns its path.
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	jsonFile := writeConfigFile(t, "kvs.json",
+		`{"listen": ":1000", "logger": {"backend": "file", "postgres": {"conn_max_lifetime": "1m"}},
+		  "logging": {"level": "warn"}}`)
+	yamlFile := writeConfigFile(t, "kvs.yaml", "listen: \":2000\"\nlogging:\n  level: error\n")
+	emptyFile := writeConfigFile(t, "empty.yml", "")
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		want func(*config)
+	}{
+		{"defaults", nil, nil, func(*config) {}},
+		{"file", nil, []string{"-config", jsonFile}, func(c *config) {
+			c.Listen, c.Logger.Backend, c.Logging.Level = ":1000", "file", "warn"
+			c.Logger.Postgres.ConnMaxLifetime = duration(time.Minute)
+		}},
+		{"yaml file", nil, []string{"-config", yamlFile}, func(c *config) {
+			c.Listen, c.Logging.Level = ":2000", "error"
+		}},
+		{"empty file", nil, []string{"-config", emptyFile}, func(*config) {}},
+		{"file named by the environment", map[string]string{"KVS_CONFIG": yamlFile}, nil, func(c *config) {
+			c.Listen, c.Logging.Level = ":2000", "error"
+		}},
+		{"flag over environment naming the file", map[string]string{"KVS_CONFIG": yamlFile},
+			[]string{"-config", jsonFile}, func(c *config) {
+				c.Listen, c.Logger.Backend, c.Logging.Level = ":1000", "file", "warn"
+				c.Logger.Postgres.ConnMaxLifetime = duration(time.Minute)
+			}},
+		{"environment over file", map[string]string{"KVS_LISTEN": ":3000", "KVS_PARTITION_NODES": "http://a, http://b"},
+			[]string{"-config", jsonFile}, func(c *config) {
+				c.Listen, c.Logger.Backend, c.Logging.Level = ":3000", "file", "warn"
+				c.Logger.Postgres.ConnMaxLifetime = duration(time.Minute)
+				c.Partition.Nodes = stringList{"http://a", "http://b"}
+			}},
+		{"flags over environment and file", map[string]string{"KVS_LISTEN": ":3000", "KVS_LOG_LEVEL": "debug"},
+			[]string{"-config", jsonFile, "-listen", ":4000", "-postgres-conn-max-lifetime", "2m"}, func(c *config) {
+				c.Listen, c.Logger.Backend, c.Logging.Level = ":4000", "file", "debug"
+				c.Logger.Postgres.ConnMaxLifetime = duration(2 * time.Minute)
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			got, err := loadConfig("kvs", tt.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := defaultConfig()
+			tt.want(&want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("loadConfig() = %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string // The content of kvs.json, if not empty.
+		env  map[string]string
+		args []string
+		want []string // Substrings of the error.
+	}{
+		{"missing file", "", nil, []string{"-config", "missing.json"}, []string{"cannot read config file"}},
+		{"unknown format", "", nil, []string{"-config", writeConfigFile(t, "kvs.toml", "")},
+			[]string{`unknown format ".toml"`}},
+		{"unknown setting", `{"listne": ":1000"}`, nil, nil, []string{"invalid config file", "listne"}},
+		{"malformed duration", `{"logger": {"postgres": {"retry_delay": 5}}}`, nil, nil,
+			[]string{`duration must be a string such as "30s"`}},
+		{"malformed environment variable", "", map[string]string{"KVS_POSTGRES_PORT": "five"}, nil,
+			[]string{"KVS_POSTGRES_PORT"}},
+		{"unknown flag", "", nil, []string{"-lisen", ":1000"}, []string{"-lisen"}},
+		{"every invalid setting", `{"listen": "nowhere"}`, map[string]string{"KVS_LOG_LEVEL": "loud"}, nil,
+			[]string{"invalid configuration", `listen: "nowhere" is not a host:port address`,
+				`log-level: unknown level "loud"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfigFile(t, "kvs.json", tt.file)}, args...)
+			}
+
+			_, err := loadConfig("kvs", args)
+			if err == nil {
+				t.Fatal("loadConfig() succeeded")
+			}
+			for _, s := range tt.want {
+				if !strings.Contains(err.Error(), s) {
+					t.Errorf("loadConfig() = %v, want it to mention %q", err, s)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	shortKey := writeConfigFile(t, "short.key", "secret")
+
+	tests := []struct {
+		name   string
+		change func(*config)
+		want   string // A substring of the error; empty if c is valid.
+	}{
+		{"defaults", func(*config) {}, ""},
+		{"file logger", func(c *config) { c.Logger.Backend = "file" }, ""},
+		{"file logger without file", func(c *config) { c.Logger.Backend, c.Logger.File = "file", "" },
+			"log-file: must be set"},
+		{"unknown logger", func(c *config) { c.Logger.Backend = "memory" }, `unknown backend "memory"`},
+		{"bad grpc address", func(c *config) { c.GRPCListen = "9090" }, "grpc-listen"},
+		{"bad leader", func(c *config) { c.Leader = "leader:8080" }, "leader: \"leader:8080\" is not an http or https URL"},
+		{"bad postgres port", func(c *config) { c.Logger.Postgres.Port = 70000 }, "postgres-port: 70000 is not a port"},
+		{"bad sslmode", func(c *config) { c.Logger.Postgres.SSLMode = "maybe" }, `postgres-sslmode: unknown mode "maybe"`},
+		{"password twice", func(c *config) { c.Logger.Postgres.Password, c.Logger.Postgres.PasswordFile = "p", "f" },
+			"set only one"},
+		{"long table", func(c *config) { c.Logger.Postgres.Table = strings.Repeat("t", 53) }, "postgres-table"},
+		{"negative delay", func(c *config) { c.Logger.Postgres.RetryDelay = -1 }, "must not be negative"},
+		{"bootstrap and join", func(c *config) { c.Raft.ID, c.Raft.Bootstrap, c.Raft.Join = "n1", true, "http://a" },
+			"either forms a cluster or joins one"},
+		{"join without id", func(c *config) { c.Raft.Join = "http://a" }, "need raft-id"},
+		{"follower and member", func(c *config) { c.Raft.ID, c.Leader = "n1", "http://a" }, "either a follower"},
+		{"bad partition node", func(c *config) { c.Partition.Nodes = stringList{"a:8080"} }, "partition-nodes"},
+		{"cert without key", func(c *config) { c.TLS.CertFile = "cert.pem" }, "tls-cert, tls-key: set both"},
+		{"bad client auth", func(c *config) { c.TLS.ClientAuth = "always" }, `tls-client-auth: unknown mode "always"`},
+		{"client permissions without ca", func(c *config) {
+			c.TLS.ClientPermissions = map[string][]string{"CN=a": {"read"}}
+		}, "tls.client_permissions: needs tls-client-ca"},
+		{"token without principal", func(c *config) { c.Auth.Tokens = []tokenConfig{{Token: "t"}} },
+			"auth.tokens[0]: needs a principal"},
+		{"unknown permission", func(c *config) {
+			c.Auth.ACL = []auth.Grant{{Principal: "alice", Permissions: []auth.Permission{"everything"}}}
+		}, "auth.acl[0]"},
+		{"short jwt key", func(c *config) { c.Auth.JWT.KeyFile = shortKey }, "shorter than 32 bytes"},
+		{"missing jwt key", func(c *config) { c.Auth.JWT.KeyFile = shortKey + ".missing" }, "auth-jwt-key"},
+		{"unknown exporter", func(c *config) { c.Tracing.Exporter = "jaeger" }, `unknown exporter "jaeger"`},
+		{"sample ratio", func(c *config) { c.Tracing.SampleRatio = 2 }, "trace-sample-ratio: 2 is not between 0 and 1"},
+		{"unknown log level", func(c *config) { c.Logging.Level = "trace" }, `log-level: unknown level "trace"`},
+		{"zero batch size", func(c *config) { c.Limits.MaxBatchBytes = 0 }, "max-batch-bytes: must be positive"},
+		{"negative history", func(c *config) { c.Limits.WatchHistory = -1 }, "watch-history: must be positive"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			tt.change(&c)
+
+			err := c.validate()
+			if tt.want == "" && err != nil {
+				t.Errorf("validate() = %v", err)
+			}
+			if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+				t.Errorf("validate() = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/cloud-native-go/kvs/api"
+)
+
+// errorResponse is the JSON body of an error response.
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+// errorDetail describes an error: Code is one of the api.ErrorCode values,
+// Message is for humans.
+type errorDetail struct {
+	Code    api.ErrorCode `json:"code"`
+	Message string        `json:"message"`
+}
+
+// errorStatus maps the code of err to a status code.
+func errorStatus(err error) int {
+	switch api.Code(err) {
+	case api.CodeInvalidRequest, api.CodeInvalidKey:
+		return http.StatusBadRequest
+	case api.CodeUnauthenticated:
+		return http.StatusUnauthorized
+	case api.CodePermissionDenied:
+		return http.StatusForbidden
+	case api.CodeNotFound:
+		return http.StatusNotFound
+	case api.CodeNotAcceptable:
+		return http.StatusNotAcceptable
+	case api.CodeHistoryUnavailable:
+		return http.StatusGone
+	case api.CodePreconditionFailed:
+		return http.StatusPreconditionFailed
+	case api.CodeValueTooLarge, api.CodeRequestTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case api.CodeBadGateway:
+		return http.StatusBadGateway
+	case api.CodeGatewayTimeout:
+		return http.StatusGatewayTimeout
+	case api.CodeUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError answers r with err: as a JSON errorResponse, or as plain text
+// if the client prefers that.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status := errorStatus(err)
+
+	if negotiate(r, jsonType, textType) == textType {
+		http.Error(w,
+			err.Error(),
+			status)
+		return
+	}
+
+	w.Header().Set("Content-Type", jsonType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{errorDetail{api.Code(err), err.Error()}})
+}
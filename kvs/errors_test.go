@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/gorilla/mux"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		code   api.ErrorCode
+	}{
+		{api.Errorf(api.CodeInvalidRequest, "failed"), http.StatusBadRequest, api.CodeInvalidRequest},
+		{api.Errorf(api.CodeInvalidKey, "failed"), http.StatusBadRequest, api.CodeInvalidKey},
+		{api.Errorf(api.CodeValueTooLarge, "failed"), http.StatusRequestEntityTooLarge, api.CodeValueTooLarge},
+		{api.Errorf(api.CodeRequestTooLarge, "failed"), http.StatusRequestEntityTooLarge, api.CodeRequestTooLarge},
+		{api.Errorf(api.CodeUnauthenticated, "failed"), http.StatusUnauthorized, api.CodeUnauthenticated},
+		{api.Errorf(api.CodePermissionDenied, "failed"), http.StatusForbidden, api.CodePermissionDenied},
+		{api.Errorf(api.CodeNotFound, "failed"), http.StatusNotFound, api.CodeNotFound},
+		{api.Errorf(api.CodeNotAcceptable, "failed"), http.StatusNotAcceptable, api.CodeNotAcceptable},
+		{api.Errorf(api.CodePreconditionFailed, "failed"), http.StatusPreconditionFailed, api.CodePreconditionFailed},
+		{api.Errorf(api.CodeHistoryUnavailable, "failed"), http.StatusGone, api.CodeHistoryUnavailable},
+		{api.Errorf(api.CodeUnavailable, "failed"), http.StatusServiceUnavailable, api.CodeUnavailable},
+		{api.Errorf(api.CodeBadGateway, "failed"), http.StatusBadGateway, api.CodeBadGateway},
+		{api.Errorf(api.CodeGatewayTimeout, "failed"), http.StatusGatewayTimeout, api.CodeGatewayTimeout},
+		{api.Errorf(api.CodeInternal, "failed"), http.StatusInternalServerError, api.CodeInternal},
+		{fmt.Errorf("wrapped: %w", api.ErrorNoSuchKey), http.StatusNotFound, api.CodeNotFound},
+		{errors.New("failed"), http.StatusInternalServerError, api.CodeInternal},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.code), func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeError(w, httptest.NewRequest(http.MethodGet, "/v1/key", nil), tt.err)
+
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if ct := w.Header().Get("Content-Type"); ct != jsonType {
+				t.Errorf("Content-Type %q, want %q", ct, jsonType)
+			}
+
+			var resp errorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("body %q: %v", w.Body, err)
+			}
+			if want := (errorDetail{tt.code, tt.err.Error()}); resp.Error != want {
+				t.Errorf("body %+v, want %+v", resp.Error, want)
+			}
+		})
+	}
+}
+
+func TestWriteErrorNegotiation(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string // The media type of the response.
+	}{
+		{"", jsonType},
+		{"application/json", jsonType},
+		{"text/plain", textType},
+		{"text/*", textType},
+		{"*/*", jsonType},
+		{"application/json;q=0.5, text/plain", textType},
+		{"application/json, text/plain;q=0.5", jsonType},
+		{"text/plain;q=0, */*", jsonType},
+		{"text/html, */*;q=0.1", jsonType},
+		// Errors are answered in JSON even to clients accepting neither.
+		{"image/png", jsonType},
+		{"not a media type", jsonType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/key", nil)
+			r.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			writeError(w, r, api.Errorf(api.CodeNotFound, "no such key"))
+
+			if w.Code != http.StatusNotFound {
+				t.Errorf("status %d, want %d", w.Code, http.StatusNotFound)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.want) {
+				t.Errorf("Content-Type %q, want %q", ct, tt.want)
+			}
+			if tt.want == textType && w.Body.String() != "no such key\n" {
+				t.Errorf("body %q, want the message", w.Body)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{octetType, textType, jsonType} // Those of a GET.
+
+	tests := []struct {
+		accept, want string
+	}{
+		{"", octetType},
+		{"*/*", octetType},
+		{"application/*", octetType},
+		{"application/json", jsonType},
+		{"application/*, application/json;q=0.5", octetType},
+		{"application/*;q=0.5, application/json", jsonType},
+		{"text/plain, application/json;q=0.9", textType},
+		{"*/*;q=0.1, application/json;q=0.2", jsonType},
+		{"application/json;q=0", ""},
+		{"image/png", ""},
+		{"image/png, ;;, text/plain", textType},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/v1/key", nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := negotiate(r, offers...); got != tt.want {
+			t.Errorf("negotiate(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestGetNotAcceptable(t *testing.T) {
+	useStore(t)
+	store.Put("key", "value")
+
+	r := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/v1/key", nil), map[string]string{"key": "key"})
+	r.Header.Set("Accept", "image/png")
+	w := httptest.NewRecorder()
+	keyValueGetHandler(w, r)
+
+	if w.Code != http.StatusNotAcceptable {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusNotAcceptable)
+	}
+	var resp errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error.Code != api.CodeNotAcceptable {
+		t.Errorf("error code %q, want %q", resp.Error.Code, api.CodeNotAcceptable)
+	}
+}
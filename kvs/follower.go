@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/replication"
+)
+
+// leader is the base URL of the leader when this instance runs as a
+// follower, and empty otherwise.
+var leader string
+
+// startFollower replicates the leader's store into store until ctx is done.
+// Followers keep no transaction log of their own: after a restart they
+// resync from the leader.
+func startFollower(ctx context.Context) {
+	feed = api.NewFeed(watchHistory, 0)
+
+	f := replication.NewFollower(replication.FollowerParams{
+		Leader: leader, Store: store, Feed: feed, Client: peerClient,
+		Logger: slogger})
+
+	go f.Run(ctx)
+}
+
+// leaderOnly wraps a handler that modifies the store so that, on a
+// follower or a cluster member that does not lead, it redirects the request
+// to the leader. 307 Temporary Redirect makes clients repeat the method and
+// body.
+func leaderOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := leaderURL()
+
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		if u == "" {
+			h(w, r)
+			return
+		}
+
+		http.Redirect(w, r,
+			strings.TrimSuffix(u, "/")+r.URL.RequestURI(),
+			http.StatusTemporaryRedirect)
+	}
+}
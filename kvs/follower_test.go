@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestFollowerRejectsWrites checks that a follower sends writes to the
+// leader instead of applying them.
+func TestFollowerRejectsWrites(t *testing.T) {
+	useStore(t)
+	store.Put("k", "leader's value")
+
+	old := leader
+	leader = "http://leader:8080/"
+	defer func() { leader = old }()
+
+	tests := []struct {
+		method, target string
+		body           string
+		handler        http.HandlerFunc
+	}{
+		{http.MethodPut, "/v1/k?ttl=60", "follower's value", keyValuePutHandler},
+		{http.MethodDelete, "/v1/k", "", keyValueDeleteHandler},
+		{http.MethodPost, "/v1/_batch", `{"operations": [{"op": "delete", "key": "k"}]}`, keyValueBatchHandler},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			leaderOnly(writable(tt.handler))(w,
+				httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+
+			if w.Code != http.StatusTemporaryRedirect {
+				t.Fatalf("status %d, want %d", w.Code, http.StatusTemporaryRedirect)
+			}
+			if loc, want := w.Header().Get("Location"), "http://leader:8080"+tt.target; loc != want {
+				t.Errorf("redirected to %q, want %q", loc, want)
+			}
+			if v, err := store.Get("k"); err != nil || v != "leader's value" {
+				t.Errorf("follower's store holds %q, %v", v, err)
+			}
+		})
+	}
+
+	err := grpcWritable("k")
+	if status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), leader) {
+		t.Errorf("gRPC write on a follower: %v, want it sent to the leader", err)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/auth"
+	"github.com/cloud-native-go/kvs/kvspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// keyValueServer implements the gRPC API on the same store and transaction
+// log as the HTTP handlers.
+type keyValueServer struct {
+	kvspb.UnimplementedKeyValueServer
+}
+
+// newGRPCServer returns a gRPC server offering the KeyValue service, over
+// TLS if tlsConfig is not nil.
+func newGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(traceUnaryInterceptor, logUnaryInterceptor, authUnaryInterceptor),
+		grpc.ChainStreamInterceptor(traceStreamInterceptor, logStreamInterceptor, authStreamInterceptor),
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	s := grpc.NewServer(opts...)
+	kvspb.RegisterKeyValueServer(s, &keyValueServer{})
+	return s
+}
+
+// stopGRPCServer lets in-flight calls finish, cancelling them when ctx
+// ends. Watch streams end once the HTTP server shut down closed the feed.
+func stopGRPCServer(ctx context.Context, s *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.Stop()
+	}
+}
+
+// Get returns the value of a key.
+func (keyValueServer) Get(ctx context.Context, req *kvspb.GetRequest) (*kvspb.GetResponse, error) {
+	if err := authorize(ctx, auth.Read, req.Key); err != nil {
+		return nil, grpcError(err)
+	}
+	if err := ownKey(req.Key); err != nil {
+		return nil, err
+	}
+
+	entry, err := lookupKey(ctx, req.Key)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	resp := &kvspb.GetResponse{Value: entry.Value, Version: entry.Version}
+	if !entry.Expiry.IsZero() {
+		resp.Expiry = timestamppb.New(entry.Expiry)
+	}
+	return resp, nil
+}
+
+// Put writes the value of a key.
+func (keyValueServer) Put(ctx context.Context, req *kvspb.PutRequest) (*kvspb.PutResponse, error) {
+	if err := authorize(ctx, auth.Write, req.Key); err != nil {
+		return nil, grpcError(err)
+	}
+	if err := grpcWritable(req.Key); err != nil {
+		return nil, err
+	}
+
+	expiry, err := grpcExpiry(req.Ttl.AsDuration(), req.Ttl != nil)
+	if err != nil {
+		return nil, err
+	}
+
+	version, conditional := grpcPrecondition(req.Precondition)
+
+	version, err = putKey(ctx, req.Key, req.Value, expiry, version, conditional)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvspb.PutResponse{Version: version}, nil
+}
+
+// Delete deletes a key.
+func (keyValueServer) Delete(ctx context.Context, req *kvspb.DeleteRequest) (*kvspb.DeleteResponse, error) {
+	if err := authorize(ctx, auth.Delete, req.Key); err != nil {
+		return nil, grpcError(err)
+	}
+	if err := grpcWritable(req.Key); err != nil {
+		return nil, err
+	}
+
+	version, conditional := grpcPrecondition(req.Precondition)
+
+	version, err := deleteKey(ctx, req.Key, version, conditional)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvspb.DeleteResponse{Version: version}, nil
+}
+
+// Batch applies several operations atomically.
+func (keyValueServer) Batch(ctx context.Context, req *kvspb.BatchRequest) (*kvspb.BatchResponse, error) {
+	if len(req.Operations) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "batch has no operations")
+	}
+	if len(req.Operations) > maxBatchOperations {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"batch has more than %d operations", maxBatchOperations)
+	}
+
+	ops := make([]api.Op, len(req.Operations))
+	for i, o := range req.Operations {
+		if err := grpcWritable(o.Key); err != nil {
+			return nil, err
+		}
+
+		op := api.Op{Key: o.Key}
+		switch o.Type {
+		case kvspb.OperationType_OPERATION_TYPE_PUT:
+			op.Type, op.Value = api.OpPut, o.Value
+		case kvspb.OperationType_OPERATION_TYPE_DELETE:
+			op.Type = api.OpDelete
+		default:
+			return nil, status.Errorf(codes.InvalidArgument,
+				"operation %d: unknown type %v", i, o.Type)
+		}
+
+		if o.Ttl != nil {
+			if op.Type != api.OpPut {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"operation %d: ttl is only valid for put", i)
+			}
+			expiry, err := grpcExpiry(o.Ttl.AsDuration(), true)
+			if err != nil {
+				return nil, err
+			}
+			op.Expiry = expiry
+		}
+
+		op.Version, op.Conditional = grpcPrecondition(o.Precondition)
+		ops[i] = op
+	}
+
+	if err := authorizeOps(ctx, ops); err != nil {
+		return nil, grpcError(err)
+	}
+
+	versions, err := applyBatch(ctx, ops)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &kvspb.BatchResponse{Versions: versions}, nil
+}
+
+// Watch streams the changes to keys starting with a prefix, as the
+// "/v1/_watch" HTTP handler does. A client resumes after the last change
+// it received with its sequence number and, if it may have been cut off
+// within a batch, its index.
+func (keyValueServer) Watch(req *kvspb.WatchRequest, stream kvspb.KeyValue_WatchServer) error {
+	ctx := stream.Context()
+
+	if err := authorize(ctx, auth.Read, req.Prefix); err != nil {
+		return grpcError(err)
+	}
+
+	var changes <-chan api.Change
+	var err error
+	switch {
+	case req.AfterSequence == nil && req.AfterIndex != nil:
+		return status.Error(codes.InvalidArgument, "after_index needs after_sequence")
+	case req.AfterSequence == nil:
+		changes = feed.Watch(ctx, req.Prefix)
+	case req.AfterIndex == nil:
+		changes, err = feed.WatchFrom(ctx, req.Prefix, *req.AfterSequence)
+	default:
+		changes, err = feed.WatchAfter(ctx, req.Prefix, *req.AfterSequence, int(*req.AfterIndex))
+	}
+	if err != nil {
+		return grpcError(err)
+	}
+
+	for c := range changes {
+		msg := &kvspb.Change{Sequence: c.Sequence, Index: uint32(c.Index), Key: c.Key,
+			Type: kvspb.OperationType_OPERATION_TYPE_DELETE, Version: c.Version}
+		if c.Type == api.OpPut {
+			msg.Type, msg.Value = kvspb.OperationType_OPERATION_TYPE_PUT, c.Value
+			if !c.Expiry.IsZero() {
+				msg.Expiry = timestamppb.New(c.Expiry)
+			}
+		}
+
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+	}
+
+	if ctx.Err() != nil {
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	// The watcher fell behind or the server is shutting down.
+	return status.Error(codes.Unavailable, "watch interrupted; resume with after_sequence and after_index")
+}
+
+// grpcPrecondition turns a precondition into the version the store must
+// find, for use with CompareAndSwap and CompareAndDelete.
+func grpcPrecondition(p *kvspb.Precondition) (version uint64, conditional bool) {
+	switch c := p.GetCondition().(type) {
+	case *kvspb.Precondition_Version:
+		return c.Version, true
+	case *kvspb.Precondition_Exists:
+		if c.Exists {
+			return api.AnyVersion, true
+		}
+		return api.NoVersion, true
+	}
+	return 0, false
+}
+
+// grpcExpiry returns the expiry for a TTL, or the zero time if set is
+// false.
+func grpcExpiry(ttl time.Duration, set bool) (time.Time, error) {
+	if !set {
+		return time.Time{}, nil
+	}
+	if ttl <= 0 {
+		return time.Time{}, status.Error(codes.InvalidArgument, "ttl must be a positive duration")
+	}
+	return time.Now().Add(ttl), nil
+}
+
+// ownKey fails with FAILED_PRECONDITION if another node of the partition
+// ring owns key. Unlike HTTP requests, gRPC calls are not forwarded.
+func ownKey(key string) error {
+	ring, self := currentRing()
+	if ring == nil {
+		return nil
+	}
+
+	if owner := ring.Owner(key); owner != "" && owner != self {
+		return status.Errorf(codes.FailedPrecondition, "key is owned by %s", owner)
+	}
+	return nil
+}
+
+// grpcWritable checks what the writable and leaderOnly middleware check
+// for HTTP: writes need a healthy transaction log and go to the leader.
+func grpcWritable(key string) error {
+	if err := ownKey(key); err != nil {
+		return err
+	}
+
+	if err := degraded(); err != nil {
+		return grpcError(readOnly(err))
+	}
+
+	u, err := leaderURL()
+	if err != nil {
+		return grpcError(err)
+	}
+	if u != "" {
+		return status.Errorf(codes.FailedPrecondition, "writes go to the leader at %s", u)
+	}
+	return nil
+}
+
+// grpcError maps the code of an error to a gRPC status code.
+func grpcError(err error) error {
+	code := codes.Internal
+
+	switch api.Code(err) {
+	case api.CodeInvalidRequest, api.CodeInvalidKey, api.CodeValueTooLarge, api.CodeRequestTooLarge:
+		code = codes.InvalidArgument
+	case api.CodeUnauthenticated:
+		code = codes.Unauthenticated
+	case api.CodePermissionDenied:
+		code = codes.PermissionDenied
+	case api.CodeNotFound:
+		code = codes.NotFound
+	case api.CodePreconditionFailed:
+		code = codes.FailedPrecondition
+	case api.CodeHistoryUnavailable:
+		code = codes.OutOfRange
+	case api.CodeUnavailable, api.CodeBadGateway:
+		code = codes.Unavailable
+	case api.CodeGatewayTimeout:
+		code = codes.DeadlineExceeded
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/auth"
+	"github.com/cloud-native-go/kvs/kvspb"
+	"github.com/cloud-native-go/kvs/logger"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// newGRPCClient serves the gRPC API over an in-memory connection and
+// returns a client of it.
+func newGRPCClient(t *testing.T) kvspb.KeyValueClient {
+	t.Helper()
+
+	lis := bufconn.Listen(1 << 20)
+	srv := newGRPCServer(nil)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return kvspb.NewKeyValueClient(conn)
+}
+
+// useFeed points the feed at a fresh one.
+func useFeed(t *testing.T) {
+	old := feed
+	feed = api.NewFeed(watchHistory, 0)
+	t.Cleanup(func() { feed = old })
+}
+
+// receive returns the "sequence.index" of the next n changes of stream.
+func receive(t *testing.T, stream kvspb.KeyValue_WatchClient, n int) []string {
+	t.Helper()
+
+	var ids []string
+	for len(ids) < n {
+		c, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("after %v: %v", ids, err)
+		}
+		ids = append(ids, fmt.Sprintf("%d.%d", c.Sequence, c.Index))
+	}
+	return ids
+}
+
+func TestGRPCWatchResumesWithinBatch(t *testing.T) {
+	useFeed(t)
+	client := newGRPCClient(t)
+
+	publishChanges([]logger.Event{{Sequence: 1, EventType: logger.EventPut, Key: "a"}})
+	publishChanges([]logger.Event{
+		{Sequence: 2, EventType: logger.EventPut, Key: "b"},
+		{Sequence: 2, EventType: logger.EventDelete, Key: "a"},
+		{Sequence: 2, EventType: logger.EventPut, Key: "c"},
+	})
+
+	tests := []struct {
+		name     string
+		sequence uint64
+		index    *uint32
+		want     []string
+	}{
+		{"after a whole sequence", 1, nil, []string{"2.0", "2.1", "2.2"}},
+		{"within a batch", 2, proto.Uint32(0), []string{"2.1", "2.2"}},
+		{"before a batch", 1, proto.Uint32(0), []string{"2.0", "2.1", "2.2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			stream, err := client.Watch(ctx, &kvspb.WatchRequest{AfterSequence: &tt.sequence, AfterIndex: tt.index})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := receive(t, stream, len(tt.want)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("received %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// An index needs the sequence number it belongs to.
+	stream, err := client.Watch(context.Background(), &kvspb.WatchRequest{AfterIndex: proto.Uint32(1)})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Watch() without a sequence = %v, want %v", err, codes.InvalidArgument)
+	}
+}
+
+// storeValues returns the value of every key of the store.
+func storeValues() map[string]string {
+	values := make(map[string]string)
+	for k, e := range store.Snapshot() {
+		values[k] = e.Value
+	}
+	return values
+}
+
+// version is a precondition on the version of a key.
+func version(v uint64) *kvspb.Precondition {
+	return &kvspb.Precondition{Condition: &kvspb.Precondition_Version{Version: v}}
+}
+
+// exists is a precondition on whether a key exists.
+func exists(e bool) *kvspb.Precondition {
+	return &kvspb.Precondition{Condition: &kvspb.Precondition_Exists{Exists: e}}
+}
+
+func TestGRPCKeyValue(t *testing.T) {
+	useFileLog(t)
+	client := newGRPCClient(t)
+	ctx := context.Background()
+
+	put := func(key, value string, p *kvspb.Precondition) error {
+		_, err := client.Put(ctx, &kvspb.PutRequest{Key: key, Value: value, Precondition: p})
+		return err
+	}
+	del := func(key string, p *kvspb.Precondition) error {
+		_, err := client.Delete(ctx, &kvspb.DeleteRequest{Key: key, Precondition: p})
+		return err
+	}
+	op := func(typ kvspb.OperationType, key, value string) *kvspb.Operation {
+		return &kvspb.Operation{Type: typ, Key: key, Value: value}
+	}
+	batch := func(ops ...*kvspb.Operation) error {
+		_, err := client.Batch(ctx, &kvspb.BatchRequest{Operations: ops})
+		return err
+	}
+	putOp, deleteOp := kvspb.OperationType_OPERATION_TYPE_PUT, kvspb.OperationType_OPERATION_TYPE_DELETE
+
+	// Each step runs against the store the steps before it left.
+	steps := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{"put", func() error { return put("a", "1", nil) }, codes.OK},
+		{"put if absent, present", func() error { return put("a", "2", exists(false)) }, codes.FailedPrecondition},
+		{"put at version", func() error { return put("a", "2", version(1)) }, codes.OK},
+		{"put at stale version", func() error { return put("a", "3", version(1)) }, codes.FailedPrecondition},
+		{"put if present", func() error { return put("b", "1", exists(true)) }, codes.FailedPrecondition},
+		{"put empty key", func() error { return put("", "1", nil) }, codes.InvalidArgument},
+		{"put huge value", func() error { return put("b", strings.Repeat("v", api.MaxValueSize+1), nil) },
+			codes.InvalidArgument},
+		{"put negative ttl", func() error {
+			_, err := client.Put(ctx, &kvspb.PutRequest{Key: "b", Value: "1", Ttl: durationpb.New(-time.Second)})
+			return err
+		}, codes.InvalidArgument},
+		{"put with ttl", func() error {
+			_, err := client.Put(ctx, &kvspb.PutRequest{Key: "t", Value: "1", Ttl: durationpb.New(time.Hour)})
+			return err
+		}, codes.OK},
+		{"delete missing", func() error { return del("b", nil) }, codes.OK},
+		{"delete missing if present", func() error { return del("b", exists(true)) }, codes.FailedPrecondition},
+		{"delete at stale version", func() error { return del("a", version(1)) }, codes.FailedPrecondition},
+		{"batch", func() error { return batch(op(putOp, "b", "1"), op(putOp, "c", "1"), op(deleteOp, "t", "")) }, codes.OK},
+		{"empty batch", func() error { return batch() }, codes.InvalidArgument},
+		{"batch of unknown type", func() error { return batch(op(kvspb.OperationType_OPERATION_TYPE_UNSPECIFIED, "d", "")) },
+			codes.InvalidArgument},
+		{"batch deleting with ttl", func() error {
+			return batch(&kvspb.Operation{Type: deleteOp, Key: "b", Ttl: durationpb.New(time.Hour)})
+		}, codes.InvalidArgument},
+		{"batch failing a precondition", func() error {
+			return batch(op(putOp, "d", "1"), &kvspb.Operation{Type: deleteOp, Key: "b", Precondition: version(99)})
+		}, codes.FailedPrecondition},
+		{"delete", func() error { return del("c", exists(true)) }, codes.OK},
+	}
+
+	for _, s := range steps {
+		if err := s.call(); status.Code(err) != s.code {
+			t.Fatalf("%s: %v, want %v", s.name, err, s.code)
+		}
+	}
+
+	resp, err := client.Get(ctx, &kvspb.GetRequest{Key: "a"})
+	if err != nil || resp.Value != "2" || resp.Version != 2 || resp.Expiry != nil {
+		t.Errorf("Get(a) = %v, %v, want 2 at version 2", resp, err)
+	}
+	for _, key := range []string{"c", "d", "t"} {
+		if _, err := client.Get(ctx, &kvspb.GetRequest{Key: key}); status.Code(err) != codes.NotFound {
+			t.Errorf("Get(%s) = %v, want %v", key, err, codes.NotFound)
+		}
+	}
+	if got, want := storeValues(), map[string]string{"a": "2", "b": "1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("store holds %v, want %v", got, want)
+	}
+}
+
+func TestGRPCUnavailableWrites(t *testing.T) {
+	useFileLog(t)
+	client := newGRPCClient(t)
+	ctx := context.Background()
+
+	transact = failingLog{transact, errors.New("disk full")}
+	_, err := client.Put(ctx, &kvspb.PutRequest{Key: "a", Value: "1"})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Put() with a failing log = %v, want %v", err, codes.Unavailable)
+	}
+
+	setReplaying(true)
+	defer setReplaying(false)
+	_, err = client.Delete(ctx, &kvspb.DeleteRequest{Key: "a"})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Delete() while replaying = %v, want %v", err, codes.Unavailable)
+	}
+}
+
+func TestGRPCError(t *testing.T) {
+	tests := []struct {
+		code api.ErrorCode
+		want codes.Code
+	}{
+		{api.CodeInvalidRequest, codes.InvalidArgument},
+		{api.CodeInvalidKey, codes.InvalidArgument},
+		{api.CodeValueTooLarge, codes.InvalidArgument},
+		{api.CodeRequestTooLarge, codes.InvalidArgument},
+		{api.CodeUnauthenticated, codes.Unauthenticated},
+		{api.CodePermissionDenied, codes.PermissionDenied},
+		{api.CodeNotFound, codes.NotFound},
+		{api.CodePreconditionFailed, codes.FailedPrecondition},
+		{api.CodeHistoryUnavailable, codes.OutOfRange},
+		{api.CodeUnavailable, codes.Unavailable},
+		{api.CodeBadGateway, codes.Unavailable},
+		{api.CodeGatewayTimeout, codes.DeadlineExceeded},
+		{api.CodeInternal, codes.Internal},
+	}
+
+	for _, tt := range tests {
+		err := grpcError(api.Errorf(tt.code, "failed"))
+		if s, _ := status.FromError(err); s.Code() != tt.want || s.Message() != "failed" {
+			t.Errorf("grpcError(%s) = %v, want %v", tt.code, err, tt.want)
+		}
+	}
+
+	// Errors of the store carry their codes too; others are internal.
+	if got := status.Code(grpcError(api.ErrorNoSuchKey)); got != codes.NotFound {
+		t.Errorf("grpcError(ErrorNoSuchKey) = %v, want %v", got, codes.NotFound)
+	}
+	if got := status.Code(grpcError(errors.New("failed"))); got != codes.Internal {
+		t.Errorf("grpcError() of a plain error = %v, want %v", got, codes.Internal)
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	useFileLog(t)
+	useFeed(t)
+	buf := useAuth(t, map[string]string{"reader-token": "reader", "writer-token": "writer"},
+		auth.Grant{Principal: "reader", Prefix: "", Permissions: []auth.Permission{auth.Read}},
+		auth.Grant{Principal: "writer", Prefix: "a-", Permissions: []auth.Permission{auth.Write}})
+	client := newGRPCClient(t)
+	store.Put("a-key", "1")
+
+	as := func(token string) context.Context {
+		if token == "" {
+			return context.Background()
+		}
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	}
+	watch := func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		stream, err := client.Watch(ctx, &kvspb.WatchRequest{Prefix: "a-"})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		return err
+	}
+
+	tests := []struct {
+		name     string
+		call     func() error
+		code     codes.Code
+		decision string // Of the audit record expected, if any.
+	}{
+		{"get without credentials", func() error {
+			_, err := client.Get(as(""), &kvspb.GetRequest{Key: "a-key"})
+			return err
+		}, codes.Unauthenticated, auth.Unauthenticated},
+		{"get with unknown token", func() error {
+			_, err := client.Get(as("guessed"), &kvspb.GetRequest{Key: "a-key"})
+			return err
+		}, codes.Unauthenticated, auth.Unauthenticated},
+		{"get", func() error {
+			_, err := client.Get(as("reader-token"), &kvspb.GetRequest{Key: "a-key"})
+			return err
+		}, codes.OK, ""},
+		{"put without permission", func() error {
+			_, err := client.Put(as("reader-token"), &kvspb.PutRequest{Key: "a-key", Value: "2"})
+			return err
+		}, codes.PermissionDenied, auth.Denied},
+		{"put", func() error {
+			_, err := client.Put(as("writer-token"), &kvspb.PutRequest{Key: "a-key", Value: "2"})
+			return err
+		}, codes.OK, ""},
+		{"delete without permission", func() error {
+			_, err := client.Delete(as("writer-token"), &kvspb.DeleteRequest{Key: "a-key"})
+			return err
+		}, codes.PermissionDenied, auth.Denied},
+		{"batch with a denied operation", func() error {
+			_, err := client.Batch(as("writer-token"), &kvspb.BatchRequest{Operations: []*kvspb.Operation{
+				{Type: kvspb.OperationType_OPERATION_TYPE_PUT, Key: "a-other", Value: "1"},
+				{Type: kvspb.OperationType_OPERATION_TYPE_PUT, Key: "b", Value: "1"},
+			}})
+			return err
+		}, codes.PermissionDenied, auth.Denied},
+		{"watch without credentials", func() error { return watch(as("")) }, codes.Unauthenticated, auth.Unauthenticated},
+		{"watch without permission", func() error { return watch(as("writer-token")) }, codes.PermissionDenied, auth.Denied},
+		{"watch", func() error { return watch(as("reader-token")) }, codes.DeadlineExceeded, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			if err := tt.call(); status.Code(err) != tt.code {
+				t.Fatalf("call = %v, want %v", err, tt.code)
+			}
+
+			records := auditRecords(t, buf)
+			if tt.decision == "" && len(records) != 0 {
+				t.Errorf("audited %+v, want nothing", records)
+			}
+			if tt.decision != "" && (len(records) != 1 || records[0].Decision != tt.decision ||
+				!strings.HasPrefix(records[0].Operation, "/kvs.v1.KeyValue/")) {
+				t.Errorf("audited %+v, want one %q record", records, tt.decision)
+			}
+		})
+	}
+
+	if got, want := storeValues(), map[string]string{"a-key": "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("store holds %v, want %v", got, want)
+	}
+}
+
+func TestGRPCWatchHistoryLost(t *testing.T) {
+	old := feed
+	feed = api.NewFeed(2, 0)
+	t.Cleanup(func() { feed = old })
+	client := newGRPCClient(t)
+
+	for i := uint64(1); i <= 4; i++ {
+		publishChanges([]logger.Event{{Sequence: i, EventType: logger.EventPut, Key: "a"}})
+	}
+
+	for _, after := range []uint64{1, 3} {
+		stream, err := client.Watch(context.Background(), &kvspb.WatchRequest{AfterSequence: proto.Uint64(after)})
+		if err == nil && after == 3 {
+			if got := receive(t, stream, 1); got[0] != "4.0" {
+				t.Errorf("resumed after 3 with %v, want 4.0", got)
+			}
+			continue
+		}
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if status.Code(err) != codes.OutOfRange {
+			t.Errorf("Watch() after %d = %v, want %v", after, err, codes.OutOfRange)
+		}
+	}
+}
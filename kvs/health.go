@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/logger"
+)
+
+const (
+	// minRecoveryDelay and maxRecoveryDelay bound the exponential back off
+	// between attempts to recover a failed transaction logger.
+	minRecoveryDelay = 100 * time.Millisecond
+	maxRecoveryDelay = 30 * time.Second
+)
+
+// health tracks whether the transaction logger is able to persist writes.
+// While it is degraded the service stays up but only serves reads. While it
+// is replaying, the service is read-only too, but not degraded: it is
+// ready to serve reads.
+var health = struct {
+	sync.RWMutex
+	err       error     // The failure that degraded the service, nil if healthy.
+	since     time.Time // When the service became degraded.
+	replaying bool      // Whether the transaction log is still being replayed.
+}{}
+
+// degraded returns the error that put the service into read-only mode, or
+// nil when writes are accepted.
+func degraded() error {
+	health.RLock()
+	defer health.RUnlock()
+
+	if health.err == nil && health.replaying {
+		return errReplaying
+	}
+	return health.err
+}
+
+// setReplaying records whether the transaction log is being replayed.
+func setReplaying(replaying bool) {
+	health.Lock()
+	health.replaying = replaying
+	health.Unlock()
+}
+
+// setDegraded records err and reports whether the service was healthy
+// before, i.e. whether the caller should start recovery.
+func setDegraded(err error) bool {
+	health.Lock()
+	defer health.Unlock()
+
+	if health.err != nil {
+		health.err = err
+		return false
+	}
+
+	health.err, health.since = err, time.Now()
+	return true
+}
+
+func setHealthy() {
+	health.Lock()
+	health.err = nil
+	health.Unlock()
+}
+
+// monitorTransactionLog reads the errors reported by the transaction logger,
+// switches the service to read-only mode and starts recovery.
+func monitorTransactionLog(tl logger.TransactionLogger) {
+	for err := range tl.Err() {
+		slogger.Error("transaction log failure", "error", err)
+
+		if setDegraded(err) {
+			go recoverTransactionLog(tl)
+		}
+	}
+}
+
+// recoverTransactionLog calls Recover with exponential back off until it
+// succeeds, then accepts writes again.
+func recoverTransactionLog(tl logger.TransactionLogger) {
+	delay := minRecoveryDelay
+
+	for attempt := 1; ; attempt++ {
+		time.Sleep(delay)
+
+		err := tl.Recover()
+		if err == nil {
+			slogger.Info("transaction log recovered", "attempt", attempt)
+			setHealthy()
+			return
+		}
+
+		slogger.Warn("transaction log recovery failed; retrying",
+			"attempt", attempt, "delay", delay, "error", err)
+
+		if delay *= 2; delay > maxRecoveryDelay {
+			delay = maxRecoveryDelay
+		}
+	}
+}
+
+// writable wraps a handler that modifies the store so that it answers
+// 503 Service Unavailable while the transaction log is failing.
+func writable(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := degraded(); err != nil {
+			writeError(w, r, readOnly(err))
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// readOnly reports that writes are refused because the transaction log
+// failed with err or is still being replayed.
+func readOnly(err error) error {
+	if err == errReplaying {
+		return api.Errorf(api.CodeUnavailable, "read-only mode: %v", err)
+	}
+	return api.Errorf(api.CodeUnavailable,
+		"read-only mode: transaction log unavailable: %v", err)
+}
+
+// healthHandler reports whether the service is ready to serve requests
+// and whether it accepts writes. It answers 200 OK when healthy or
+// replaying, read-only, and 503 Service Unavailable while degraded.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	health.RLock()
+	status := struct {
+		Status   string     `json:"status"`
+		Ready    bool       `json:"ready"`
+		Writable bool       `json:"writable"`
+		Error    string     `json:"error,omitempty"`
+		Since    *time.Time `json:"since,omitempty"`
+	}{Status: "ok", Ready: true, Writable: true}
+
+	switch {
+	case health.err != nil:
+		since := health.since
+		status.Status, status.Error, status.Since = "degraded", health.err.Error(), &since
+		status.Ready, status.Writable = false, false
+	case health.replaying:
+		status.Status, status.Writable = "replaying", false
+	}
+	health.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealth(t *testing.T) {
+	tests := []struct {
+		name            string
+		replaying       bool
+		err             error
+		code            int
+		status          string
+		ready, writable bool
+	}{
+		{"healthy", false, nil, http.StatusOK, "ok", true, true},
+		{"replaying", true, nil, http.StatusOK, "replaying", true, false},
+		{"degraded", false, errors.New("disk full"), http.StatusServiceUnavailable, "degraded", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useStore(t)
+			setReplaying(tt.replaying)
+			if tt.err != nil {
+				setDegraded(tt.err)
+			}
+			t.Cleanup(func() {
+				setReplaying(false)
+				setHealthy()
+			})
+
+			w := httptest.NewRecorder()
+			healthHandler(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+			var status struct {
+				Status          string
+				Ready, Writable bool
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.code || status.Status != tt.status ||
+				status.Ready != tt.ready || status.Writable != tt.writable {
+				t.Errorf("GET /healthz = %d %s, want %d, status %q, ready %v, writable %v",
+					w.Code, w.Body, tt.code, tt.status, tt.ready, tt.writable)
+			}
+
+			// Writes are refused unless the service reports them accepted.
+			w = httptest.NewRecorder()
+			writable(keyValuePutHandler)(w, httptest.NewRequest(http.MethodPut, "/v1/k", nil))
+			if refused := w.Code == http.StatusServiceUnavailable; refused == tt.writable {
+				t.Errorf("PUT answered %d %s while writable is %v", w.Code, w.Body, tt.writable)
+			}
+		})
+	}
+}
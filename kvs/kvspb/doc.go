@@ -0,0 +1,5 @@
+// Package kvspb holds the protobuf messages and gRPC service of the key
+// value store, generated from kvs.proto.
+package kvspb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative kvs.proto
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/cloud-native-go/kvs/api"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// defaultListLimit and maxListLimit bound the keys returned per page.
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// listedKey is one key of a listing. Value is only set when requested.
+type listedKey struct {
+	Key     string  `json:"key"`
+	Value   *string `json:"value,omitempty"`
+	Version uint64  `json:"version"`
+}
+
+// listing is the response body of keyValueListHandler.
+type listing struct {
+	Keys []listedKey `json:"keys"`
+	// Next is the cursor of the following page, empty on the last page.
+	Next string `json:"next,omitempty"`
+}
+
+// keyValueListHandler expects to be called with a GET request for "/v1"
+// and returns keys in lexical order as JSON. Query parameters:
+//
+//	prefix  only keys starting with prefix
+//	start   only keys sorting at or after start
+//	cursor  continue after the page that returned it as "next"
+//	limit   at most limit keys (default 100, maximum 1000)
+//	values  include values if "true"
+//
+// Pages follow each other by key, so a listing stays consistent while keys
+// are written: every key present for the whole listing is returned once.
+func keyValueListHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	limit := defaultListLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > maxListLimit {
+			writeError(w, r, api.Errorf(api.CodeInvalidRequest,
+				"limit must be between 1 and %d", maxListLimit))
+			return
+		}
+		limit = n
+	}
+
+	start := q.Get("start")
+	if c := q.Get("cursor"); c != "" {
+		after, err := base64.RawURLEncoding.DecodeString(c)
+		if err != nil {
+			writeError(w, r, api.Errorf(api.CodeInvalidRequest, "malformed cursor"))
+			return
+		}
+		// The smallest key sorting after the last one of the previous page.
+		if s := string(after) + "\x00"; s > start {
+			start = s
+		}
+	}
+
+	values := q.Get("values") == "true"
+
+	// Ask for one more key than the page holds to learn if there is a next page.
+	_, span := startSpan(r.Context(), "store.list", attribute.String("kvs.prefix", q.Get("prefix")))
+	kvs := store.List(q.Get("prefix"), start, limit+1)
+	span.End()
+
+	resp := listing{Keys: make([]listedKey, 0, len(kvs))}
+	for i, kv := range kvs {
+		if i == limit {
+			resp.Next = base64.RawURLEncoding.EncodeToString([]byte(kvs[i-1].Key))
+			break
+		}
+
+		k := listedKey{Key: kv.Key, Version: kv.Version}
+		if values {
+			v := kv.Value
+			k.Value = &v
+		}
+		resp.Keys = append(resp.Keys, k)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
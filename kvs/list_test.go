@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/cloud-native-go/kvs/api"
+)
+
+// useStore points the store at a fresh one for the duration of the test.
+func useStore(t *testing.T) {
+	old := store
+	store = api.NewShardedStore(storeShards)
+	t.Cleanup(func() { store = old })
+}
+
+// listPage requests a page of keys with the query q.
+func listPage(t *testing.T, q url.Values) listing {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	keyValueListHandler(w, httptest.NewRequest(http.MethodGet, "/v1?"+q.Encode(), nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /v1?%s: %d %s", q.Encode(), w.Code, w.Body)
+	}
+
+	var l listing
+	if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// listAll follows the cursors of a listing to its end, calling between
+// after each page, and returns every key listed.
+func listAll(t *testing.T, q url.Values, between func()) []string {
+	t.Helper()
+
+	var keys []string
+	for {
+		l := listPage(t, q)
+		for _, k := range l.Keys {
+			keys = append(keys, k.Key)
+		}
+		if l.Next == "" {
+			return keys
+		}
+		q.Set("cursor", l.Next)
+		between()
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	useStore(t)
+	const n = 5000
+	for i := 0; i < n; i++ {
+		store.Put(fmt.Sprintf("key/%05d", i), fmt.Sprint(i))
+	}
+	store.Put("other", "x")
+
+	tests := []struct {
+		name  string
+		query url.Values
+		first string
+		count int
+	}{
+		{"default limit", url.Values{"prefix": {"key/"}}, "key/00000", n},
+		{"max limit", url.Values{"prefix": {"key/"}, "limit": {"1000"}}, "key/00000", n},
+		{"odd limit", url.Values{"prefix": {"key/"}, "limit": {"7"}}, "key/00000", n},
+		{"start", url.Values{"prefix": {"key/"}, "start": {"key/04990"}, "limit": {"3"}}, "key/04990", 10},
+		{"everything", url.Values{"limit": {"999"}}, "key/00000", n + 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := listAll(t, tt.query, func() {})
+			if len(keys) != tt.count || keys[0] != tt.first {
+				t.Fatalf("listed %d keys from %q, want %d from %q", len(keys), keys[0], tt.count, tt.first)
+			}
+			for i := 1; i < len(keys); i++ {
+				if keys[i] <= keys[i-1] {
+					t.Fatalf("%q listed after %q", keys[i], keys[i-1])
+				}
+			}
+		})
+	}
+}
+
+func TestListPageValues(t *testing.T) {
+	useStore(t)
+	store.Put("a", "1")
+	store.Put("b", "2")
+
+	l := listPage(t, url.Values{"limit": {"1"}, "values": {"true"}})
+	if len(l.Keys) != 1 || l.Keys[0].Value == nil || *l.Keys[0].Value != "1" || l.Next == "" {
+		t.Fatalf("first page = %+v", l)
+	}
+
+	l = listPage(t, url.Values{"limit": {"1"}, "cursor": {l.Next}})
+	if len(l.Keys) != 1 || l.Keys[0].Key != "b" || l.Keys[0].Value != nil || l.Next != "" {
+		t.Fatalf("last page = %+v", l)
+	}
+}
+
+func TestListInvalidQuery(t *testing.T) {
+	useStore(t)
+
+	for _, q := range []string{"limit=0", "limit=1001", "limit=x", "cursor=%25%25"} {
+		w := httptest.NewRecorder()
+		keyValueListHandler(w, httptest.NewRequest(http.MethodGet, "/v1?"+q, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET /v1?%s: %d, want %d", q, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// TestListCursorStability writes and deletes keys while paging through a
+// listing: every key present for the whole listing is listed exactly once.
+func TestListCursorStability(t *testing.T) {
+	useStore(t)
+	const n = 20000
+
+	// Even keys stay put; odd keys are deleted and put back throughout.
+	for i := 0; i < n; i++ {
+		store.Put(fmt.Sprintf("key/%05d", i), "v")
+	}
+
+	// churn deletes or puts back an odd key and a key next to an even one.
+	churn := func(i int) {
+		odd, next := fmt.Sprintf("key/%05d", (2*i+1)%n), fmt.Sprintf("key/%05d-next", (2*i)%n)
+		if i%2 == 0 {
+			store.Delete(odd)
+			store.Put(next, "v")
+		} else {
+			store.Put(odd, "v")
+			store.Delete(next)
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; ; i += 2 {
+				select {
+				case <-stop:
+					return
+				default:
+					churn(i)
+				}
+			}
+		}(w)
+	}
+
+	// Besides the concurrent writers, churn between the pages for sure.
+	r := rand.New(rand.NewSource(1))
+	keys := listAll(t, url.Values{"prefix": {"key/"}, "limit": {"250"}}, func() {
+		for i := 0; i < 100; i++ {
+			churn(r.Intn(n))
+		}
+	})
+	close(stop)
+	wg.Wait()
+
+	seen := make(map[string]int)
+	for i, k := range keys {
+		seen[k]++
+		if i > 0 && k <= keys[i-1] {
+			t.Fatalf("%q listed after %q", k, keys[i-1])
+		}
+	}
+	for i := 0; i < n; i += 2 {
+		k := fmt.Sprintf("key/%05d", i)
+		if seen[k] != 1 {
+			t.Fatalf("%q listed %d times, want once", k, seen[k])
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Durability selects when WritePut and WriteDelete return to the caller.
+type Durability int
+
+const (
+	// DurabilityNone returns as soon as the event is queued for writing.
+	// Events still queued are lost if the process crashes.
+	DurabilityNone Durability = iota
+	// DurabilitySync returns once the event has been fsynced to the log file
+	// or committed to the database.
+	DurabilitySync
+)
+
+// defaultMaxBatch is used when CommitParams.MaxBatch is not set.
+const defaultMaxBatch = 128
+
+// CommitParams controls durability and group commit. The zero value queues
+// events without waiting for them to be persisted.
+type CommitParams struct {
+	Durability Durability
+	// MaxBatch is the largest number of events persisted by one fsync or
+	// database commit.
+	MaxBatch int
+	// MaxDelay is how long the writer waits for more events to join a batch
+	// before persisting it. Zero persists whatever is queued right away.
+	MaxDelay time.Duration
+	// OnCommit, if set, is called by the writer goroutine with the events of
+	// every batch once they are persisted, in sequence order. It must not
+	// block.
+	OnCommit func(events []Event)
+	// Logger receives the log records of the transaction logger, such as
+	// failed writes; slog.Default() if nil.
+	Logger *slog.Logger
+}
+
+func (p CommitParams) maxBatch() int {
+	if p.MaxBatch <= 0 {
+		return defaultMaxBatch
+	}
+	return p.MaxBatch
+}
+
+func (p CommitParams) log() *slog.Logger {
+	if p.Logger == nil {
+		return slog.Default()
+	}
+	return p.Logger
+}
+
+// pending is an event, or a batch of events persisted atomically, waiting
+// for the writer goroutine. When done is not nil, the writer reports the
+// outcome on it.
+type pending struct {
+	event Event
+	batch []Event // The events of a batch; nil for a single event.
+	done  chan<- error
+	link  trace.Link // To the span of the write, for the span of the batch.
+}
+
+// ErrClosed is returned for writes made after Close was called.
+var ErrClosed = errors.New("transaction logger is closed")
+
+// ErrNotQueued wraps the error of a context that ended before a write was
+// queued for the writer; such a write is never persisted.
+var ErrNotQueued = errors.New("write not queued")
+
+// eventQueue hands events to the writer goroutine. Writers hold the read lock
+// while sending, so close can close the channel once they are done and the
+// writer drains whatever is left.
+type eventQueue struct {
+	mu     sync.RWMutex
+	ch     chan pending
+	closed bool
+}
+
+func newEventQueue(size int) *eventQueue {
+	return &eventQueue{ch: make(chan pending, size)}
+}
+
+// submit queues e and, for DurabilitySync, waits until the writer has
+// persisted it.
+func (q *eventQueue) submit(ctx context.Context, e Event, d Durability) error {
+	return q.send(ctx, pending{event: e}, d, 1)
+}
+
+// submitBatch queues a batch of events to be persisted together. The events
+// are copied, as the writer stamps them with their sequence number.
+func (q *eventQueue) submitBatch(ctx context.Context, events []Event, d Durability) error {
+	return q.send(ctx, pending{batch: append([]Event{}, events...)}, d, len(events))
+}
+
+// send queues p and, for DurabilitySync, waits until the writer has persisted
+// it. If ctx ends first, send returns its error, wrapped in ErrNotQueued if
+// p was not queued; an event already queued may still be persisted.
+func (q *eventQueue) send(ctx context.Context, p pending, d Durability, events int) (err error) {
+	ctx, span := startAppend(ctx, events)
+	defer func() { endSpan(span, err) }()
+	p.link = trace.LinkFromContext(ctx)
+
+	var done chan error
+	if d == DurabilitySync {
+		done = make(chan error, 1)
+		p.done = done
+	}
+
+	q.mu.RLock()
+	if q.closed {
+		q.mu.RUnlock()
+		return ErrClosed
+	}
+	select {
+	case q.ch <- p:
+		q.mu.RUnlock()
+	case <-ctx.Done():
+		q.mu.RUnlock()
+		return fmt.Errorf("%w: %w", ErrNotQueued, ctx.Err())
+	}
+
+	if done == nil {
+		return nil
+	}
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// close stops accepting events and closes the channel, which ends the
+// writer's loop once the events already queued have been persisted.
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.ch)
+	}
+}
+
+// collectBatch starts a batch with first and adds events from the channel
+// until the batch is full, or the channel is empty and MaxDelay has passed.
+func collectBatch(first pending, events <-chan pending, p CommitParams) []pending {
+	batch := []pending{first}
+	max := p.maxBatch()
+
+	var deadline <-chan time.Time
+	if p.MaxDelay > 0 {
+		timer := time.NewTimer(p.MaxDelay)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for len(batch) < max {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, e)
+			continue
+		default:
+		}
+
+		if deadline == nil {
+			break
+		}
+
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, e)
+		case <-deadline:
+			deadline = nil
+		}
+	}
+
+	return batch
+}
+
+// persist writes batch with write, recording the outcome in a span, the
+// stats s and the log. backend names the logger, e.g. "file".
+func persist(backend string, batch []pending, p CommitParams, s *writerStats, write func([]pending) error) error {
+	start := time.Now()
+	span := startWrite(backend, batch)
+	err := write(batch)
+	endSpan(span, err)
+	s.record(batch, err)
+
+	attrs := []any{"backend", backend, "writes", len(batch),
+		"events", countEvents(batch), "duration", time.Since(start)}
+	if err != nil {
+		p.log().Error("cannot persist batch", append(attrs, "error", err)...)
+	} else {
+		p.log().Debug("batch persisted", append(attrs,
+			"last_sequence", atomic.LoadUint64(&s.lastSequence))...)
+	}
+	return err
+}
+
+// countEvents returns the number of events in batch.
+func countEvents(batch []pending) int {
+	n := 0
+	for _, p := range batch {
+		if p.batch != nil {
+			n += len(p.batch)
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// acknowledge reports err to every caller waiting on an event of batch.
+func acknowledge(batch []pending, err error) {
+	for _, p := range batch {
+		if p.done != nil {
+			p.done <- err
+		}
+	}
+}
+
+// committed passes the events of a persisted batch to OnCommit.
+func (p CommitParams) committed(batch []pending) {
+	if p.OnCommit == nil {
+		return
+	}
+
+	var events []Event
+	for _, p := range batch {
+		if p.batch != nil {
+			events = append(events, p.batch...)
+		} else {
+			events = append(events, p.event)
+		}
+	}
+	if len(events) > 0 {
+		p.OnCommit(events)
+	}
+}
+
+// Stats describes the work of a transaction logger.
+type Stats struct {
+	Pending      int    // Writes queued for the writer and not yet taken.
+	WriteErrors  uint64 // Batches that failed to be persisted.
+	LastSequence uint64 // The sequence number of the last event persisted.
+}
+
+// writerStats counts what a writer goroutine did. It is safe for concurrent
+// use.
+type writerStats struct {
+	writeErrors  uint64 // Accessed atomically.
+	lastSequence uint64 // Accessed atomically.
+}
+
+// record counts the outcome of writing batch.
+func (s *writerStats) record(batch []pending, err error) {
+	if err != nil {
+		atomic.AddUint64(&s.writeErrors, 1)
+		return
+	}
+
+	for _, p := range batch {
+		if p.batch == nil {
+			s.seen(p.event.Sequence)
+		} else if len(p.batch) > 0 {
+			s.seen(p.batch[len(p.batch)-1].Sequence)
+		}
+	}
+}
+
+// seen notes that the event with sequence is persisted, whether it was
+// written or read back from the log. Only the writer goroutine, or the replay
+// before it starts, calls seen.
+func (s *writerStats) seen(sequence uint64) {
+	if sequence > atomic.LoadUint64(&s.lastSequence) {
+		atomic.StoreUint64(&s.lastSequence, sequence)
+	}
+}
+
+// stats returns the counts together with the depth of q.
+func (s *writerStats) stats(q *eventQueue) Stats {
+	st := Stats{
+		WriteErrors:  atomic.LoadUint64(&s.writeErrors),
+		LastSequence: atomic.LoadUint64(&s.lastSequence),
+	}
+	if q != nil {
+		st.Pending = len(q.ch)
+	}
+	return st
+}
+
+// errNotRunning is returned for tasks given to a logger before Run.
+var errNotRunning = errors.New("transaction logger is not running")
+
+// runTask runs task on the writer goroutine, which takes tasks from tasks
+// between batches, and returns its result.
+func runTask(tasks chan<- func(), stopped <-chan struct{}, task func() error) error {
+	if tasks == nil {
+		return errNotRunning
+	}
+
+	done := make(chan error, 1)
+	select {
+	case tasks <- func() { done <- task() }:
+		return <-done
+	case <-stopped:
+		return ErrClosed
+	}
+}
+
+// waitStopped waits for the writer goroutine to close stopped, giving up when
+// ctx is done.
+func waitStopped(ctx context.Context, stopped <-chan struct{}) error {
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// report sends err on errors unless an earlier error is still unread, so a
+// writer goroutine never blocks on a caller that is not watching Err.
+func report(errors chan<- error, err error) {
+	select {
+	case errors <- err:
+	default:
+	}
+}
@@ -0,0 +1,42 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSendHonorsContext(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int // Capacity of the queue, which nothing drains.
+		d      Durability
+		queued bool
+	}{
+		{"queue full", 0, DurabilityNone, false},
+		{"waiting for the writer", 1, DurabilitySync, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newEventQueue(tt.size)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			err := q.submit(ctx, Event{EventType: EventPut, Key: "k"}, tt.d)
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("submit() = %v, want %v", err, context.DeadlineExceeded)
+			}
+			if errors.Is(err, ErrNotQueued) == tt.queued {
+				t.Errorf("submit() = %v, want queued %v", err, tt.queued)
+			}
+
+			// A writer blocked on a full queue must not hold up close.
+			q.close()
+			if err = q.submit(context.Background(), Event{}, tt.d); err != ErrClosed {
+				t.Errorf("submit() after close = %v, want ErrClosed", err)
+			}
+		})
+	}
+}
@@ -1,14 +1,16 @@
 package logger
 
+import "time"
+
 // EventType is a constant which defines the action taken.
 type EventType byte
 
 const (
-	_                     = iota // iota == 0; ignore the zero value.
-    // EventDelete for action DELETE.
-    EventDelete EventType = iota // iota = 1.
-    // EventPut for action PUT
-	EventPut                     // iota == 2; implicitly repeat.
+	_ = iota // iota == 0; ignore the zero value.
+	// EventDelete for action DELETE.
+	EventDelete EventType = iota // iota = 1.
+	// EventPut for action PUT
+	EventPut // iota == 2; implicitly repeat.
 )
 
 // Event Record which defines an entry in the transaction log.
@@ -17,4 +19,7 @@ type Event struct {
 	EventType EventType // The action taken.
 	Key       string    // The key affected by this transaction.
 	Value     string    // The value of a PUT the transaction.
+	Expiry    time.Time // When the key of a PUT expires; zero means never.
+	Version   uint64    // The store version assigned to the write.
+	Remaining int       // The events of the same batch following this one.
 }
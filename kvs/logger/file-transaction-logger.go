@@ -1,36 +1,84 @@
 package logger
 
 import (
-	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"time"
 )
 
 // FileTransactionLogger defines the File logger.
 type FileTransactionLogger struct {
-	events       chan<- Event // Write only channel for sending events.
-	errors       <-chan error // Read only channel for receiving errors.
-	lastSequence uint64       // The last used event sequence number.
-	file         *os.File     // The location of transaction log.
+	events       *eventQueue     // Queue for sending events to the writer.
+	errors       <-chan error    // Read only channel for receiving errors.
+	tasks        chan<- func()   // Work run by the writer goroutine between batches.
+	stopped      <-chan struct{} // Closed when the writer goroutine exits.
+	closeErr     error           // Result of closing the file, set before stopped.
+	lastSequence uint64          // The last used event sequence number.
+	filename     string          // The path of the transaction log.
+	file         *os.File        // The location of transaction log.
+	commit       CommitParams    // When writes are acknowledged.
+	stats        writerStats     // What the writer goroutine did.
 }
 
-// NewFileTransactionLogger creates new FileTransactionLogger
-func NewFileTransactionLogger(filename string) (TransactionLogger, error) {
+// NewFileTransactionLogger creates new FileTransactionLogger.
+// A log written in the legacy text format is migrated to the binary format.
+// commit selects whether writes wait for the log file to be fsynced.
+func NewFileTransactionLogger(filename string, commit CommitParams) (TransactionLogger, error) {
+	if err := MigrateLegacyLog(filename); err != nil {
+		return nil, err
+	}
+
+	file, err := openLog(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &FileTransactionLogger{filename: filename, file: file, commit: commit}, nil
+}
+
+// openLog opens the transaction log for appending, writing the file header
+// if the log is new.
+func openLog(filename string) (*os.File, error) {
 	file, err := os.OpenFile(filename, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0755)
 	if err != nil {
-		return nil, fmt.Errorf("cannot open transaction log")
+		return nil, fmt.Errorf("cannot open transaction log: %w", err)
 	}
-	return &FileTransactionLogger{file: file}, nil
+
+	info, err := file.Stat()
+	if err == nil && info.Size() == 0 {
+		_, err = io.WriteString(file, logMagic)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot initialize transaction log: %w", err)
+	}
+
+	return file, nil
 }
 
 // WritePut writes PUT event in the log.
-func (l *FileTransactionLogger) WritePut(key, value string) {
-	l.events <- Event{EventType: EventPut, Key: key, Value: value}
+func (l *FileTransactionLogger) WritePut(ctx context.Context, key, value string, expiry time.Time, version uint64) error {
+	e := Event{EventType: EventPut, Key: key, Value: value, Expiry: expiry, Version: version}
+	return l.events.submit(ctx, e, l.commit.Durability)
 }
 
 // WriteDelete writes DELETE event in the log.
-func (l *FileTransactionLogger) WriteDelete(key string) {
-	l.events <- Event{EventType: EventDelete, Key: key}
+func (l *FileTransactionLogger) WriteDelete(ctx context.Context, key string, version uint64) error {
+	e := Event{EventType: EventDelete, Key: key, Version: version}
+	return l.events.submit(ctx, e, l.commit.Durability)
+}
+
+// WriteBatch writes the events of a batch as one record, so replay sees
+// either all of them or, if the write was cut short, none.
+func (l *FileTransactionLogger) WriteBatch(ctx context.Context, events []Event) error {
+	return l.events.submitBatch(ctx, events, l.commit.Durability)
+}
+
+// Stats reports the queue depth, write failures and progress of the logger.
+func (l *FileTransactionLogger) Stats() Stats {
+	return l.stats.stats(l.events)
 }
 
 // Err returns errors channel to commmunicate errors.
@@ -40,61 +88,329 @@ func (l *FileTransactionLogger) Err() <-chan error {
 
 // Run the FileTransaction logger.
 // Reads the events written and writes them to file in separate goroutine.
-// Writes errors to error channel of in case.
-func (l *FileTransactionLogger) Run(){
-    events := make(chan Event, 16)
-    l.events = events
-
-    errors := make(chan error,1)
-    l.errors = errors
-
-    go func ()  {
-        for e := range events{
-            l.lastSequence++
-            _,err := fmt.Fprintf(
-                l.file,
-                "%d\t%d\t%s\t%s\n",
-                l.lastSequence, e.EventType,e.Key,e.Value)
-            if err != nil{
-                errors <- err
-                return
-            }
-        }
-    }()
+// Events queued together are written, and synced, as one batch.
+// Writes errors to error channel of in case. A failed batch is reported to its
+// writers and the goroutine keeps serving later events, so writers never
+// block on a logger that stopped. The goroutine exits after Close, once every
+// queued event is written.
+func (l *FileTransactionLogger) Run() {
+	l.events = newEventQueue(16)
+	events := l.events.ch
+
+	errors := make(chan error, 1)
+	l.errors = errors
+
+	tasks := make(chan func())
+	l.tasks = tasks
+
+	stopped := make(chan struct{})
+	l.stopped = stopped
+
+	go func() {
+		defer close(stopped)
+		defer close(errors)
+
+		for {
+			select {
+			case p, ok := <-events:
+				if !ok {
+					l.closeErr = l.closeFile()
+					return
+				}
+				batch := collectBatch(p, events, l.commit)
+				err := persist("file", batch, l.commit, &l.stats, l.writeBatch)
+				if err == nil {
+					l.commit.committed(batch)
+				}
+				acknowledge(batch, err)
+				if err != nil {
+					report(errors, err)
+				}
+			case task := <-tasks:
+				task()
+			}
+		}
+	}()
+}
+
+// writeBatch appends the events of batch to the log with a single write and,
+// for DurabilitySync, fsyncs the file before returning. If the write fails the
+// log is cut back to its previous length, so a partial record never ends up
+// in front of records appended later. The events of batch are stamped with
+// their sequence numbers.
+func (l *FileTransactionLogger) writeBatch(batch []pending) error {
+	info, err := l.file.Stat()
+	if err != nil {
+		return fmt.Errorf("cannot write transaction log: %w", err)
+	}
+
+	sequence := l.lastSequence
+
+	var buf []byte
+	for i := range batch {
+		p := &batch[i]
+		sequence++
+		if p.batch != nil {
+			for j := range p.batch {
+				p.batch[j].Sequence = sequence
+			}
+			buf = append(buf, encodeBatch(sequence, p.batch)...)
+			continue
+		}
+		p.event.Sequence = sequence
+		buf = append(buf, encodeEvent(p.event)...)
+	}
+
+	if _, err = l.file.Write(buf); err == nil && l.commit.Durability == DurabilitySync {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		l.file.Truncate(info.Size())
+		return fmt.Errorf("cannot write transaction log: %w", err)
+	}
+
+	l.lastSequence = sequence
+	return nil
+}
+
+// do runs task on the writer goroutine and returns its result.
+func (l *FileTransactionLogger) do(task func() error) error {
+	return runTask(l.tasks, l.stopped, task)
+}
+
+// Close stops accepting events, waits for the queued ones to be written and
+// then syncs and closes the log file. If ctx ends first, Close returns its
+// error and the remaining events are still written in the background.
+func (l *FileTransactionLogger) Close(ctx context.Context) error {
+	if l.events == nil {
+		return l.closeFile()
+	}
+
+	l.events.close()
+
+	if err := waitStopped(ctx, l.stopped); err != nil {
+		return err
+	}
+	return l.closeErr
+}
+
+func (l *FileTransactionLogger) closeFile() error {
+	err := l.file.Sync()
+	if cerr := l.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("cannot close transaction log: %w", err)
+	}
+	return nil
+}
+
+// Recover reopens the transaction log file, replacing a handle that may have
+// gone bad, and checks that it can be synced.
+func (l *FileTransactionLogger) Recover() error {
+	return l.do(func() error {
+		file, err := openLog(l.filename)
+		if err != nil {
+			return err
+		}
+
+		if err = file.Sync(); err != nil {
+			file.Close()
+			return fmt.Errorf("cannot sync transaction log: %w", err)
+		}
+
+		l.file.Close()
+		l.file = file
+		return nil
+	})
+}
+
+// Compact writes state to a snapshot covering every event logged so far and
+// truncates the transaction log. It must be called after Run; the snapshot is
+// taken by the writer goroutine, so no event is logged while it is written.
+func (l *FileTransactionLogger) Compact(state func() []Event) error {
+	return l.do(func() error {
+		return l.compact(state())
+	})
+}
+
+// compact installs the snapshot first and only then truncates the log. A crash
+// in between leaves events in the log that the snapshot already covers;
+// ReadEvents skips them by sequence number.
+func (l *FileTransactionLogger) compact(state []Event) error {
+	start := time.Now()
+	err := writeSnapshot(snapshotPath(l.filename), l.lastSequence, state)
+	if err != nil {
+		return err
+	}
+
+	if err = l.truncate(); err != nil {
+		return err
+	}
+
+	l.commit.log().Info("transaction log compacted", "file", l.filename,
+		"events", len(state), "sequence", l.lastSequence, "duration", time.Since(start))
+	return nil
+}
+
+// truncate atomically replaces the transaction log with an empty file and
+// reopens it for appending.
+func (l *FileTransactionLogger) truncate() error {
+	err := writeFileAtomic(l.filename, func(w io.Writer) error {
+		_, err := io.WriteString(w, logMagic)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("cannot truncate transaction log: %w", err)
+	}
+
+	file, err := openLog(l.filename)
+	if err != nil {
+		return err
+	}
+
+	l.file.Close()
+	l.file = file
+	return nil
 }
 
 // ReadEvents reads from file transaction logs  and replays the event into the store.
+// The snapshot, if any, is replayed first, followed by the events logged after it.
+// A record torn by a crash at the end of the log is truncated away; any other
+// invalid record is reported as a *CorruptRecordError.
 func (l *FileTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
-    scanner := bufio.NewScanner(l.file)  // Create a Scanner for l.file.
-    outEvent := make(chan Event) // An unbuffered events channel.
-    outError := make(chan error,1) // A buffered errors channel.
-
-    go func(){
-        var e Event
-        
-        defer close(outEvent)
-        defer close(outError)
-
-        for scanner.Scan(){
-            line := scanner.Text()
-
-            fmt.Sscanf(
-                line, "%d\t%d\t%s\t%s\t",
-                &e.Sequence, &e.EventType, &e.Key, &e.Value)
-
-            // Sanity check! Are the sequence numbers in increasing order?
-            if l.lastSequence >= e.Sequence{
-                outError <- fmt.Errorf("transaction numbers out of sequence")
-            }
-            
-            l.lastSequence = e.Sequence
-            outEvent <- e
-        }
-
-        if err := scanner.Err(); err != nil{
-            outError <- fmt.Errorf("transaction log read failure: %w", err)
-        }
-    }()
-
-    return outEvent,outError
+	outEvent := make(chan Event)    // An unbuffered events channel.
+	outError := make(chan error, 1) // A buffered errors channel.
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		snapshotSequence, err := l.ReadSnapshot(func(e Event) error {
+			outEvent <- e
+			return nil
+		})
+		if err == nil {
+			err = l.readLog(snapshotSequence, outEvent)
+		}
+		if err != nil {
+			outError <- err
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// ReadSnapshot passes the events of the snapshot, if there is one, to apply
+// and returns the sequence number the snapshot covers.
+func (l *FileTransactionLogger) ReadSnapshot(apply func(Event) error) (uint64, error) {
+	seq, err := replaySnapshot(snapshotPath(l.filename), apply)
+	if err != nil {
+		return 0, err
+	}
+
+	l.lastSequence = seq
+	l.stats.seen(seq)
+	return seq, nil
+}
+
+// ReadEventsAfter replays the events logged after sequence number after,
+// such as those a snapshot restored with ReadSnapshot does not cover.
+func (l *FileTransactionLogger) ReadEventsAfter(after uint64) (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
+
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
+
+		if err := l.readLog(after, outEvent); err != nil {
+			outError <- err
+		}
+	}()
+
+	return outEvent, outError
+}
+
+// LastSequence returns the sequence number of the last record of the log,
+// or of the snapshot if the log holds no later record. It skips from
+// record to record without decoding them; a torn final record is ignored.
+func (l *FileTransactionLogger) LastSequence() (uint64, error) {
+	last, _, file, err := readSnapshot(snapshotPath(l.filename))
+	if err != nil {
+		return 0, err
+	}
+	if file != nil {
+		file.Close()
+	}
+
+	rr, err := newRecordReader(io.NewSectionReader(l.file, 0, math.MaxInt64), logMagic)
+	if err != nil {
+		return 0, fmt.Errorf("transaction log read failure: %w", err)
+	}
+
+	for {
+		seq, err := rr.Sequence()
+		if err == io.EOF || err == errTornRecord {
+			return last, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("transaction log read failure: %w", err)
+		}
+		if seq > last {
+			last = seq
+		}
+	}
+}
+
+// readLog sends the events of the log with sequence numbers greater than
+// after to out.
+func (l *FileTransactionLogger) readLog(after uint64, out chan<- Event) error {
+	// Read through a SectionReader; appends move the file offset.
+	rr, err := newRecordReader(io.NewSectionReader(l.file, 0, math.MaxInt64), logMagic)
+	if err != nil {
+		return fmt.Errorf("transaction log read failure: %w", err)
+	}
+
+	for {
+		events, err := rr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == errTornRecord {
+			err = l.file.Truncate(rr.offset)
+			if err == nil {
+				l.commit.log().Warn("truncated a record torn by a crash",
+					"file", l.filename, "offset", rr.offset)
+				return nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("transaction log read failure: %w", err)
+		}
+		if len(events) == 0 {
+			continue // An empty batch.
+		}
+
+		// The events of a batch record share one sequence number.
+		sequence := events[0].Sequence
+
+		// Covered by the snapshot, e.g. left behind by a compaction that
+		// crashed before truncating the log.
+		if sequence <= after {
+			continue
+		}
+
+		// Sanity check! Are the sequence numbers in increasing order?
+		if l.lastSequence >= sequence {
+			return fmt.Errorf("transaction numbers out of sequence")
+		}
+
+		l.lastSequence = sequence
+		l.stats.seen(sequence)
+		for i, e := range events {
+			e.Remaining = len(events) - 1 - i
+			out <- e
+		}
+	}
 }
@@ -0,0 +1,240 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openFileLogger opens the file logger at path and starts it.
+func openFileLogger(t *testing.T, path string) *FileTransactionLogger {
+	t.Helper()
+
+	tl, err := NewFileTransactionLogger(path, CommitParams{Durability: DurabilitySync})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tl.(*FileTransactionLogger)
+}
+
+// replayFile opens the file logger at path, replays it and returns the
+// events it replayed and the logger, which is not running.
+func replayFile(t *testing.T, path string) ([]Event, *FileTransactionLogger) {
+	t.Helper()
+
+	l := openFileLogger(t, path)
+	t.Cleanup(func() { l.file.Close() })
+
+	var replayed []Event
+	events, errs := l.ReadEvents()
+	for e := range events {
+		replayed = append(replayed, e)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	return replayed, l
+}
+
+// state folds events into the resulting key-value pairs.
+func state(events []Event) map[string]string {
+	m := map[string]string{}
+	for _, e := range events {
+		switch e.EventType {
+		case EventPut:
+			m[e.Key] = e.Value
+		case EventDelete:
+			delete(m, e.Key)
+		}
+	}
+	return m
+}
+
+func TestFileLastSequence(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		log  func(l *FileTransactionLogger)
+		want uint64
+	}{
+		{"empty", func(l *FileTransactionLogger) {}, 0},
+		{"events", func(l *FileTransactionLogger) {
+			l.WritePut(ctx, "a", "1", time.Time{}, 1)
+			l.WriteDelete(ctx, "a", 2)
+			l.WritePut(ctx, "b", "2", time.Time{}, 1)
+		}, 3},
+		{"batch", func(l *FileTransactionLogger) {
+			l.WritePut(ctx, "a", "1", time.Time{}, 1)
+			l.WriteBatch(ctx, []Event{
+				{EventType: EventPut, Key: "b", Value: "2", Version: 1},
+				{EventType: EventDelete, Key: "a", Version: 2},
+			})
+		}, 2},
+		{"snapshot only", func(l *FileTransactionLogger) {
+			l.WritePut(ctx, "a", "1", time.Time{}, 1)
+			l.WritePut(ctx, "b", "2", time.Time{}, 1)
+			l.Compact(func() []Event { return nil })
+		}, 2},
+		{"snapshot and log", func(l *FileTransactionLogger) {
+			l.WritePut(ctx, "a", "1", time.Time{}, 1)
+			l.Compact(func() []Event { return nil })
+			l.WritePut(ctx, "b", "2", time.Time{}, 1)
+		}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "transaction.log")
+			l := openFileLogger(t, path)
+			l.Run()
+			tt.log(l)
+			if err := l.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			l = openFileLogger(t, path)
+			defer l.file.Close()
+			got, err := l.LastSequence()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("LastSequence() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileLastSequenceIgnoresTornRecord(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "transaction.log")
+
+	l := openFileLogger(t, path)
+	l.Run()
+	l.WritePut(ctx, "a", "1", time.Time{}, 1)
+	l.WritePut(ctx, "b", "2", time.Time{}, 1)
+	if err := l.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openFileLogger(t, path)
+	defer l.file.Close()
+	got, err := l.LastSequence()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1 {
+		t.Errorf("LastSequence() = %d, want 1", got)
+	}
+
+	replayed, _ := replayFile(t, path)
+	if want := map[string]string{"a": "1"}; !reflect.DeepEqual(state(replayed), want) {
+		t.Errorf("replayed %v, want %v", state(replayed), want)
+	}
+}
+
+// TestFileCloseDrainsWrites closes a logger while writers are busy and
+// expects every write it acknowledged to be replayed after a restart.
+func TestFileCloseDrainsWrites(t *testing.T) {
+	tests := []struct {
+		name string
+		d    Durability
+	}{
+		{"queued", DurabilityNone},
+		{"synced", DurabilitySync},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "transaction.log")
+			tl, err := NewFileTransactionLogger(path, CommitParams{
+				Durability: tt.d, MaxBatch: 4, MaxDelay: 5 * time.Millisecond})
+			if err != nil {
+				t.Fatal(err)
+			}
+			tl.Run()
+
+			var (
+				mu      sync.Mutex
+				acked   = map[string]string{}
+				started = make(chan struct{}, 100)
+				wg      sync.WaitGroup
+			)
+			for w := 0; w < 8; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; ; i++ {
+						key, value := fmt.Sprintf("w%d-%d", w, i), fmt.Sprint(i)
+						var err error
+						if i%5 == 0 {
+							err = tl.WriteBatch(context.Background(), []Event{
+								{EventType: EventPut, Key: key, Value: value},
+								{EventType: EventPut, Key: key + "-b", Value: value}})
+						} else {
+							err = tl.WritePut(context.Background(), key, value, time.Time{}, uint64(i))
+						}
+						if err == ErrClosed {
+							return
+						}
+						if err != nil {
+							t.Errorf("write %s: %v", key, err)
+							return
+						}
+
+						mu.Lock()
+						acked[key] = value
+						if i%5 == 0 {
+							acked[key+"-b"] = value
+						}
+						mu.Unlock()
+						select {
+						case started <- struct{}{}:
+						default:
+						}
+					}
+				}(w)
+			}
+
+			// Close once writes are under way, with more still coming.
+			for i := 0; i < 20; i++ {
+				<-started
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tl.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+			wg.Wait()
+
+			if err := tl.WritePut(context.Background(), "late", "v", time.Time{}, 1); err != ErrClosed {
+				t.Errorf("WritePut() after Close = %v, want ErrClosed", err)
+			}
+
+			replayed, _ := replayFile(t, path)
+			got := state(replayed)
+			for key, value := range acked {
+				if got[key] != value {
+					t.Errorf("acknowledged %s=%s, replayed %q", key, value, got[key])
+				}
+			}
+			if len(acked) < 20 {
+				t.Errorf("only %d writes acknowledged before Close", len(acked))
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package logger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// isLegacyLog reports whether the log at path holds events written in the
+// legacy tab separated format, i.e. it is non-empty but lacks logMagic.
+func isLegacyLog(path string) (bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, len(logMagic))
+	n, err := io.ReadFull(file, header)
+	if err == io.EOF {
+		return false, nil // An empty file holds nothing to migrate.
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+
+	return string(header[:n]) != logMagic, nil
+}
+
+// MigrateLegacyLog rewrites the transaction log at filename from the legacy
+// "%d\t%d\t%s\t%s\n" text format into the binary format. A log already in
+// the binary format is left untouched. The log is rewritten to a temporary
+// file and renamed into place, so a crash during migration leaves the
+// legacy log intact.
+func MigrateLegacyLog(filename string) error {
+	legacy, err := isLegacyLog(filename)
+	if err != nil {
+		return fmt.Errorf("cannot migrate transaction log: %w", err)
+	}
+	if !legacy {
+		return nil
+	}
+
+	in, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("cannot migrate transaction log: %w", err)
+	}
+	defer in.Close()
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxRecordSize)
+
+	err = writeFileAtomic(filename, func(w io.Writer) error {
+		if _, err := io.WriteString(w, logMagic); err != nil {
+			return err
+		}
+
+		for scanner.Scan() {
+			e, err := parseLegacyEvent(scanner.Text())
+			if err != nil {
+				return err
+			}
+			if err = writeEvent(w, e); err != nil {
+				return err
+			}
+		}
+
+		return scanner.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("cannot migrate transaction log: %w", err)
+	}
+	return nil
+}
+
+// parseLegacyEvent parses a line of the legacy text format. Unlike the
+// fmt.Sscanf based parser it replaces, it keeps spaces within values.
+func parseLegacyEvent(line string) (Event, error) {
+	var e Event
+
+	fields := strings.SplitN(line, "\t", 4)
+	if len(fields) < 3 {
+		return e, fmt.Errorf("malformed legacy transaction log entry %q", line)
+	}
+
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("malformed legacy sequence number %q: %w", fields[0], err)
+	}
+
+	eventType, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return e, fmt.Errorf("malformed legacy event type %q: %w", fields[1], err)
+	}
+
+	e.Sequence = seq
+	e.EventType = EventType(eventType)
+	e.Key = fields[2]
+	if len(fields) == 4 {
+		e.Value = fields[3]
+	}
+
+	return e, nil
+}
@@ -0,0 +1,81 @@
+package logger
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMigrateLegacyLog(t *testing.T) {
+	tests := []struct {
+		name string
+		log  string // Legacy log content.
+		want map[string]string
+	}{
+		{
+			name: "log only",
+			log:  "1\t2\ta\t1\n2\t2\tb\tvalue with spaces\n3\t1\ta\t\n",
+			want: map[string]string{"b": "value with spaces"},
+		},
+		{
+			name: "value with tabs",
+			log:  "1\t2\tk\tone\ttwo\n",
+			want: map[string]string{"k": "one\ttwo"},
+		},
+		{
+			name: "empty log",
+			log:  "",
+			want: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "transaction.log")
+			if err := os.WriteFile(path, []byte(tt.log), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			replayed, l := replayFile(t, path)
+			if got := state(replayed); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("replayed %v, want %v", got, tt.want)
+			}
+
+			// Migrating again leaves the binary log as it is.
+			l.file.Close()
+			before, _ := os.ReadFile(path)
+			if err := MigrateLegacyLog(path); err != nil {
+				t.Fatal(err)
+			}
+			if after, _ := os.ReadFile(path); !bytes.Equal(before, after) {
+				t.Error("a second migration rewrote the log")
+			}
+		})
+	}
+}
+
+func TestMigrateLegacyLogMalformed(t *testing.T) {
+	tests := []struct {
+		name, log string
+	}{
+		{"bad sequence", "x\t2\ta\t1\n"},
+		{"missing key", "1\t2\n"},
+		{"bad event type", "1\tput\ta\t1\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "transaction.log")
+			os.WriteFile(path, []byte(tt.log), 0644)
+
+			if err := MigrateLegacyLog(path); err == nil {
+				t.Fatal("MigrateLegacyLog() succeeded on a malformed log")
+			}
+			if b, _ := os.ReadFile(path); string(b) != tt.log {
+				t.Errorf("failed migration left %q, want the legacy log intact", b)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package logger
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// migration is a step in the evolution of the schema of the transaction
+// table. Its statements name the table {table} and may use {table_literal},
+// the table name as a string, and {key_index}, the name of its key index.
+type migration struct {
+	description string
+	statements  string
+}
+
+// postgresMigrations upgrades the transaction table one version at a time:
+// migration i brings it to version i+1. Tables created before versioning
+// existed are at version 0; the first migrations leave them as they are.
+// Append new migrations; never change applied ones.
+var postgresMigrations = []migration{
+	{"create table", `CREATE TABLE IF NOT EXISTS {table} (
+        sequence serial,
+        event_type int,
+        key varchar,
+        value varchar)`},
+	{"add expiry and version", `ALTER TABLE {table}
+        ADD COLUMN IF NOT EXISTS expiry timestamptz,
+        ADD COLUMN IF NOT EXISTS version bigint`},
+	{"make sequence a 64-bit primary key", `ALTER TABLE {table}
+        ALTER COLUMN sequence TYPE bigint,
+        ADD PRIMARY KEY (sequence);
+    DO $$ BEGIN
+        EXECUTE format('ALTER SEQUENCE %s AS bigint',
+            pg_get_serial_sequence({table_literal}, 'sequence'));
+    END $$`},
+	{"index keys", `CREATE INDEX IF NOT EXISTS {key_index} ON {table} (key, sequence)`},
+	{"record batches", `ALTER TABLE {table}
+        ADD COLUMN IF NOT EXISTS batch_remaining int NOT NULL DEFAULT 0`},
+}
+
+// postgresTable names the transaction table and the objects belonging to
+// it in a schema.
+type postgresTable struct {
+	schema, name string
+}
+
+// String returns the quoted, schema-qualified name of the table.
+func (t postgresTable) String() string {
+	return pq.QuoteIdentifier(t.schema) + "." + pq.QuoteIdentifier(t.name)
+}
+
+// versions returns the quoted name of the table recording the migrations
+// applied to t.
+func (t postgresTable) versions() string {
+	return pq.QuoteIdentifier(t.schema) + "." + pq.QuoteIdentifier(t.name+"_migrations")
+}
+
+// expand returns the statements of m for t.
+func (t postgresTable) expand(m migration) string {
+	return strings.NewReplacer(
+		"{table}", t.String(),
+		"{table_literal}", pq.QuoteLiteral(t.String()),
+		"{key_index}", pq.QuoteIdentifier(t.name+"_key_idx"),
+	).Replace(m.statements)
+}
+
+// migrate creates the schema and the transaction table if they do not
+// exist and applies the migrations it lacks, each in a transaction of its
+// own. An advisory lock keeps loggers starting together from migrating the
+// same table at once. It returns the version the table is at.
+func (l *PostgresTransactionLogger) migrate() (int, error) {
+	var schemaExists bool
+	err := l.db.QueryRow(`SELECT EXISTS (SELECT FROM pg_namespace WHERE nspname = $1)`,
+		l.table.schema).Scan(&schemaExists)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up schema: %w", err)
+	}
+	if !schemaExists {
+		if _, err = l.db.Exec("CREATE SCHEMA IF NOT EXISTS " + pq.QuoteIdentifier(l.table.schema)); err != nil {
+			return 0, fmt.Errorf("failed to create schema: %w", err)
+		}
+	}
+
+	_, err = l.db.Exec(`CREATE TABLE IF NOT EXISTS ` + l.table.versions() + ` (
+        version int PRIMARY KEY,
+        description varchar,
+        applied_at timestamptz NOT NULL DEFAULT now())`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	for {
+		applied, err := l.migrateOnce()
+		if err != nil || applied == 0 {
+			return len(postgresMigrations), err
+		}
+	}
+}
+
+// migrateOnce applies the next migration the table lacks, if any, and
+// returns its version, or 0 if the table is up to date.
+func (l *PostgresTransactionLogger) migrateOnce() (int, error) {
+	tx, err := l.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin migration: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, l.table.String()); err != nil {
+		return 0, fmt.Errorf("failed to lock migrations: %w", err)
+	}
+
+	var version int
+	err = tx.QueryRow(`SELECT COALESCE(max(version), 0) FROM ` + l.table.versions()).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	if version > len(postgresMigrations) {
+		return 0, fmt.Errorf("table %s is at schema version %d, newer than the %d this logger knows",
+			l.table, version, len(postgresMigrations))
+	}
+	if version == len(postgresMigrations) {
+		return 0, nil
+	}
+
+	m := postgresMigrations[version]
+	if _, err = tx.Exec(l.table.expand(m)); err != nil {
+		return 0, fmt.Errorf("migration %d (%s): %w", version+1, m.description, err)
+	}
+	_, err = tx.Exec(`INSERT INTO `+l.table.versions()+` (version, description) VALUES ($1, $2)`,
+		version+1, m.description)
+	if err != nil {
+		return 0, fmt.Errorf("failed to record migration %d: %w", version+1, err)
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit migration %d: %w", version+1, err)
+	}
+
+	l.commit.log().Info("transaction table migrated", "backend", "postgres",
+		"table", l.table.String(), "version", version+1, "migration", m.description)
+	return version + 1, nil
+}
@@ -0,0 +1,364 @@
+package logger
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// migrationDB is a database/sql driver standing in for Postgres while
+// migrating: it keeps the schema version, records the migration statements
+// committed and holds the advisory lock until the end of the transaction
+// taking it, as pg_advisory_xact_lock does.
+type migrationDB struct {
+	lock sync.Mutex // The advisory lock.
+
+	mu      sync.Mutex
+	version int
+	applied []string                // The migration statements committed.
+	fail    func(stmt string) error // Fails migration statements, if set.
+}
+
+func (db *migrationDB) Connect(context.Context) (driver.Conn, error) {
+	return &migrationConn{db: db}, nil
+}
+func (db *migrationDB) Driver() driver.Driver { return nil }
+
+// state returns the schema version and the statements committed.
+func (db *migrationDB) state() (int, []string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.version, append([]string{}, db.applied...)
+}
+
+// migrationConn is a connection to a migrationDB, with the state of its
+// open transaction.
+type migrationConn struct {
+	db      *migrationDB
+	locked  bool
+	version int      // The version recorded by the transaction, if any.
+	applied []string // The migration statements of the transaction.
+}
+
+func (c *migrationConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("unexpected prepare of %q", query)
+}
+
+func (c *migrationConn) Close() error { return nil }
+
+func (c *migrationConn) Begin() (driver.Tx, error) {
+	c.version, c.applied = 0, nil
+	return c, nil
+}
+
+func (c *migrationConn) Commit() error {
+	c.db.mu.Lock()
+	if c.version != 0 {
+		c.db.version = c.version
+	}
+	c.db.applied = append(c.db.applied, c.applied...)
+	c.db.mu.Unlock()
+	return c.Rollback()
+}
+
+func (c *migrationConn) Rollback() error {
+	c.version, c.applied = 0, nil
+	if c.locked {
+		c.locked = false
+		c.db.lock.Unlock()
+	}
+	return nil
+}
+
+func (c *migrationConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO"):
+		c.version = int(args[0].Value.(int64))
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(query, "CREATE SCHEMA"), strings.Contains(query, "_migrations\" ("):
+		return driver.ResultNoRows, nil
+	case strings.Contains(query, "pg_advisory_xact_lock"):
+		c.db.lock.Lock()
+		c.locked = true
+		return driver.ResultNoRows, nil
+	}
+
+	if !c.locked {
+		return nil, errors.New("migration run without the lock")
+	}
+	// Give other loggers a chance to interfere.
+	time.Sleep(time.Millisecond)
+	if c.db.fail != nil {
+		if err := c.db.fail(query); err != nil {
+			return nil, err
+		}
+	}
+	c.applied = append(c.applied, query)
+	return driver.RowsAffected(0), nil
+}
+
+func (c *migrationConn) QueryContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Rows, error) {
+	switch {
+	case strings.Contains(query, "pg_namespace"):
+		return &valueRows{values: []driver.Value{true}}, nil
+	case strings.Contains(query, "max(version)"):
+		if !c.locked {
+			return nil, errors.New("schema version read without the lock")
+		}
+		c.db.mu.Lock()
+		defer c.db.mu.Unlock()
+		return &valueRows{values: []driver.Value{int64(c.db.version)}}, nil
+	}
+	return nil, fmt.Errorf("unexpected query %q", query)
+}
+
+// valueRows is a single row of values.
+type valueRows struct {
+	values []driver.Value
+	read   bool
+}
+
+func (r *valueRows) Columns() []string { return make([]string, len(r.values)) }
+func (r *valueRows) Close() error      { return nil }
+
+func (r *valueRows) Next(dest []driver.Value) error {
+	if r.read {
+		return io.EOF
+	}
+	r.read = true
+	copy(dest, r.values)
+	return nil
+}
+
+// newMigratingLogger returns a logger migrating the table of db, which
+// is not running.
+func newMigratingLogger(t *testing.T, db *migrationDB) *PostgresTransactionLogger {
+	sqlDB := sql.OpenDB(db)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	return &PostgresTransactionLogger{db: sqlDB,
+		table:  postgresTable{schema: defaultPostgresSchema, name: defaultPostgresTable},
+		commit: CommitParams{Logger: slog.New(slog.NewTextHandler(ioutil.Discard, nil))}}
+}
+
+// allMigrations returns the statements of every migration of table.
+func allMigrations(table postgresTable) []string {
+	var stmts []string
+	for _, m := range postgresMigrations {
+		stmts = append(stmts, table.expand(m))
+	}
+	return stmts
+}
+
+func TestMigrate(t *testing.T) {
+	db := &migrationDB{}
+	l := newMigratingLogger(t, db)
+	want := allMigrations(l.table)
+
+	if version, err := l.migrate(); err != nil || version != len(postgresMigrations) {
+		t.Fatalf("migrate() = %d, %v, want %d", version, err, len(postgresMigrations))
+	}
+	if version, applied := db.state(); version != len(postgresMigrations) || !reflect.DeepEqual(applied, want) {
+		t.Fatalf("at version %d after %q, want %d after every migration", version, applied, len(want))
+	}
+
+	// Migrating again, as every restart does, changes nothing.
+	if version, err := newMigratingLogger(t, db).migrate(); err != nil || version != len(postgresMigrations) {
+		t.Fatalf("migrate() again = %d, %v", version, err)
+	}
+	if _, applied := db.state(); !reflect.DeepEqual(applied, want) {
+		t.Errorf("migrating again applied %q", applied[len(want):])
+	}
+}
+
+func TestMigrateConcurrently(t *testing.T) {
+	db := &migrationDB{}
+	loggers := make([]*PostgresTransactionLogger, 4)
+	for i := range loggers {
+		loggers[i] = newMigratingLogger(t, db)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(loggers))
+	for i, l := range loggers {
+		wg.Add(1)
+		go func(i int, l *PostgresTransactionLogger) {
+			defer wg.Done()
+			_, errs[i] = l.migrate()
+		}(i, l)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("logger %d: %v", i, err)
+		}
+	}
+	// Each migration ran once, in order, whichever logger ran it.
+	want := allMigrations(loggers[0].table)
+	if version, applied := db.state(); version != len(want) || !reflect.DeepEqual(applied, want) {
+		t.Errorf("at version %d after %d statements, want each of the %d migrations once", version, len(applied), len(want))
+	}
+}
+
+func TestMigrateFailsHalfway(t *testing.T) {
+	db := &migrationDB{}
+	l := newMigratingLogger(t, db)
+	all := allMigrations(l.table)
+	const failing = 3 // The index of the migration failing.
+
+	db.fail = func(stmt string) error {
+		if stmt == all[failing] {
+			return errors.New("disk full")
+		}
+		return nil
+	}
+	_, err := l.migrate()
+	want := fmt.Sprintf("migration %d (%s): disk full", failing+1, postgresMigrations[failing].description)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Fatalf("migrate() = %v, want %q", err, want)
+	}
+	// The migrations before stay applied; the failed one is rolled back.
+	if version, applied := db.state(); version != failing || !reflect.DeepEqual(applied, all[:failing]) {
+		t.Fatalf("at version %d after %q, want %d", version, applied, failing)
+	}
+
+	// The next start resumes with the migration that failed.
+	db.fail = nil
+	if version, err := newMigratingLogger(t, db).migrate(); err != nil || version != len(all) {
+		t.Fatalf("migrate() after the failure = %d, %v", version, err)
+	}
+	if version, applied := db.state(); version != len(all) || !reflect.DeepEqual(applied, all) {
+		t.Errorf("at version %d after %q, want each migration once", version, applied)
+	}
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	db := &migrationDB{version: len(postgresMigrations) + 1}
+
+	_, err := newMigratingLogger(t, db).migrate()
+	if err == nil || !strings.Contains(err.Error(), "newer than") {
+		t.Errorf("migrate() = %v, want the schema reported newer", err)
+	}
+	if _, applied := db.state(); len(applied) != 0 {
+		t.Errorf("applied %q to a newer schema", applied)
+	}
+}
+
+// postgresTestParams returns the parameters of a Postgres server to test
+// against, taken from the PG* environment variables libpq reads, with a
+// schema of its own. It skips the test unless KVS_TEST_POSTGRES is set.
+func postgresTestParams(t *testing.T) PostgresDbParams {
+	if os.Getenv("KVS_TEST_POSTGRES") == "" {
+		t.Skip("KVS_TEST_POSTGRES not set; set it and the PG* variables to test against Postgres")
+	}
+
+	p := PostgresDbParams{SSLMode: os.Getenv("PGSSLMODE"),
+		Schema: fmt.Sprintf("kvs_test_%d", time.Now().UnixNano()), Retries: -1,
+		Commit: CommitParams{Logger: slog.New(slog.NewTextHandler(ioutil.Discard, nil))}}
+
+	db, err := sql.Open("postgres", p.connString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DROP SCHEMA ` + pq.QuoteIdentifier(p.Schema) + ` CASCADE`)
+		db.Close()
+	})
+	return p
+}
+
+// TestPostgresMigrations migrates a table of a real Postgres server from
+// several loggers at once, then again, and checks each migration ran once.
+func TestPostgresMigrations(t *testing.T) {
+	p := postgresTestParams(t)
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var tl TransactionLogger
+			if tl, errs[i] = NewPostgreTransactionLogger(p); errs[i] == nil {
+				tl.Close(context.Background())
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("logger %d: %v", i, err)
+		}
+	}
+
+	versions := func() []string {
+		tl, err := NewPostgreTransactionLogger(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := tl.(*PostgresTransactionLogger)
+		defer l.Close(context.Background())
+
+		rows, err := l.db.Query(`SELECT version, description, applied_at FROM ` + l.table.versions() + ` ORDER BY version`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+
+		var vs []string
+		for rows.Next() {
+			var version int
+			var description string
+			var applied time.Time
+			if err := rows.Scan(&version, &description, &applied); err != nil {
+				t.Fatal(err)
+			}
+			vs = append(vs, fmt.Sprint(version, description, applied))
+		}
+		return vs
+	}
+
+	first := versions()
+	if len(first) != len(postgresMigrations) {
+		t.Fatalf("recorded migrations %q, want %d", first, len(postgresMigrations))
+	}
+	if again := versions(); !reflect.DeepEqual(again, first) {
+		t.Errorf("migrating again recorded %q, want %q", again, first)
+	}
+}
+
+// TestPostgresMigrationFailsHalfway adds a migration failing after its
+// first statement and checks that it is rolled back as a whole.
+func TestPostgresMigrationFailsHalfway(t *testing.T) {
+	p := postgresTestParams(t)
+
+	old := postgresMigrations
+	t.Cleanup(func() { postgresMigrations = old })
+	postgresMigrations = append(old[:len(old):len(old)], migration{"half",
+		`ALTER TABLE {table} ADD COLUMN half int; SELECT * FROM missing_table`})
+
+	if _, err := NewPostgreTransactionLogger(p); err == nil || !strings.Contains(err.Error(), "(half)") {
+		t.Fatalf("NewPostgreTransactionLogger() = %v, want migration half to fail", err)
+	}
+
+	postgresMigrations[len(old)].statements = `ALTER TABLE {table} ADD COLUMN half int`
+	tl, err := NewPostgreTransactionLogger(p)
+	if err != nil {
+		t.Fatalf("migrating after the failure: %v", err)
+	}
+	tl.Close(context.Background())
+}
@@ -1,180 +1,577 @@
 package logger
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
-
-	_ "github.com/lib/pq" // Anonymously import the driver package
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
 // PostgresDbParams parameters required for Postgres Database connection.
+// Unset connection parameters fall back to the PG* environment variables
+// libpq reads, such as PGPASSWORD.
 type PostgresDbParams struct {
-	DbName string
-	Host   string
-	User   string
+	DbName   string
+	Host     string
+	Port     int // Zero selects the default port, 5432.
+	User     string
+	Password string
+	SSLMode  string       // A libpq sslmode such as "require"; default "disable".
+	Commit   CommitParams // Whether writes wait for their transaction to commit.
+
+	// PEM files of the CAs verifying the server certificate, for sslmode
+	// verify-ca and verify-full, and of the client certificate and key.
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+
+	// The schema and the table the events are stored in; "public" and
+	// "transactions" by default. Both are created if missing.
+	Schema string
+	Table  string
+
+	// The connection pool. Zero values keep the database/sql defaults:
+	// unlimited open connections, 2 idle ones and no lifetime limits.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// Retries is how often a batch failing with a transient error, such as
+	// a lost connection, is written again, RetryDelay how long to wait
+	// before the first retry, doubling for every further one. Zero selects
+	// the defaults; negative Retries disables retries.
+	Retries    int
+	RetryDelay time.Duration
+
+	// SnapshotFile, if set, is a local file Compact writes the state to.
+	// Replay restores it and reads only the events committed after it
+	// from the database.
+	SnapshotFile string
+	// ReplayPageSize is how many events replay reads per query; zero
+	// selects the default.
+	ReplayPageSize int
+}
+
+const (
+	defaultPostgresRetries    = 3
+	defaultPostgresRetryDelay = 100 * time.Millisecond
+	defaultPostgresSchema     = "public"
+	defaultPostgresTable      = "transactions"
+	defaultReplayPageSize     = 10000
+)
+
+// connString returns the libpq connection string for the parameters,
+// quoting values as libpq requires.
+func (p PostgresDbParams) connString() string {
+	sslMode := p.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+
+	params := []struct{ key, value string }{
+		{"host", p.Host},
+		{"dbname", p.DbName},
+		{"user", p.User},
+		{"password", p.Password},
+		{"sslmode", sslMode},
+		{"sslrootcert", p.SSLRootCert},
+		{"sslcert", p.SSLCert},
+		{"sslkey", p.SSLKey},
+	}
+	if p.Port != 0 {
+		params = append(params, struct{ key, value string }{"port", strconv.Itoa(p.Port)})
+	}
+
+	var b strings.Builder
+	for _, kv := range params {
+		if kv.value == "" {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		quoted := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(kv.value)
+		fmt.Fprintf(&b, "%s='%s'", kv.key, quoted)
+	}
+	return b.String()
 }
 
 // PostgresTransactionLogger defines the Database transaction logger.
 type PostgresTransactionLogger struct {
-	events chan<- Event // Write-only channel for sending events
-	errors <-chan error // Read-only channel for receiving errors
-	db     *sql.DB      // Our database access interface
+	events  *eventQueue     // Queue for sending events to the writer
+	errors  <-chan error    // Read-only channel for receiving errors
+	tasks   chan<- func()   // Work run by the writer goroutine between batches
+	stopped <-chan struct{} // Closed when the writer goroutine exits
+	db      *sql.DB         // Our database access interface
+	table   postgresTable   // Where the events are stored
+	insert  *sql.Stmt       // Prepared insertQuery
+	params  PostgresDbParams
+	commit  CommitParams // When writes are acknowledged
+	stats   writerStats  // What the writer goroutine did
 }
 
 // NewPostgreTransactionLogger creates a new Database transaction logger.
 func NewPostgreTransactionLogger(config PostgresDbParams) (TransactionLogger, error) {
 
-	connStr := fmt.Sprintf("host=%s dbname=%s user=%s sslmode=disable",
-		config.Host, config.DbName,config.User)
-
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", config.connString())
 	if err != nil {
 		return nil, fmt.Errorf("failed to created db value :%w", err)
 	}
 
+	db.SetMaxOpenConns(config.MaxOpenConns)
+	if config.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+	db.SetConnMaxLifetime(config.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(config.ConnMaxIdleTime)
+
+	if config.Retries == 0 {
+		config.Retries = defaultPostgresRetries
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = defaultPostgresRetryDelay
+	}
+	if config.Schema == "" {
+		config.Schema = defaultPostgresSchema
+	}
+	if config.Table == "" {
+		config.Table = defaultPostgresTable
+	}
+	if config.ReplayPageSize <= 0 {
+		config.ReplayPageSize = defaultReplayPageSize
+	}
+
 	err = db.Ping() // Test the database connection.
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to open db connection: %w", err)
 	}
 
-	tl := &PostgresTransactionLogger{db: db}
+	tl := &PostgresTransactionLogger{db: db, params: config, commit: config.Commit,
+		table: postgresTable{schema: config.Schema, name: config.Table}}
 
-	exists, err := tl.verifyTableExists()
+	version, err := tl.migrate()
 	if err != nil {
-		return nil, fmt.Errorf("failed to verify table exists: %w", err)
+		return nil, fmt.Errorf("failed to migrate table: %w", err)
 	}
 
-	if !exists {
-		if err = tl.createTable(); err != nil {
-			return nil, fmt.Errorf("failed to create table: %w", err)
-		}
+	if tl.insert, err = db.Prepare(fmt.Sprintf(insertQuery, tl.table)); err != nil {
+		return nil, fmt.Errorf("failed to prepare insert: %w", err)
 	}
 
-	fmt.Println("transaction logger created successfully")
+	config.Commit.log().Info("transaction logger created",
+		"backend", "postgres", "host", config.Host, "dbname", config.DbName,
+		"table", tl.table.String(), "schema_version", version)
 	return tl, nil
 
 }
 
-func (l *PostgresTransactionLogger) verifyTableExists() (bool, error) {
-	query := `SELECT EXISTS (
-        SELECT FROM information_schema.tables 
-        WHERE  table_schema = 'public'
-        AND    table_name   = 'transactions'
-        )`
+// WritePut writes PUT event in the log.
+func (l *PostgresTransactionLogger) WritePut(ctx context.Context, key, value string, expiry time.Time, version uint64) error {
+	e := Event{EventType: EventPut, Key: key, Value: value, Expiry: expiry, Version: version}
+	return l.events.submit(ctx, e, l.commit.Durability)
+}
+
+// WriteDelete writes DELETE event in the log.
+func (l *PostgresTransactionLogger) WriteDelete(ctx context.Context, key string, version uint64) error {
+	e := Event{EventType: EventDelete, Key: key, Version: version}
+	return l.events.submit(ctx, e, l.commit.Durability)
+}
 
-	rows, err := l.db.Query(query)
-	if err != nil {
-		return false, err
+// WriteBatch inserts the events of a batch in the same database
+// transaction, so replay sees either all of them or none.
+func (l *PostgresTransactionLogger) WriteBatch(ctx context.Context, events []Event) error {
+	return l.events.submitBatch(ctx, events, l.commit.Durability)
+}
+
+// Err returns errors channel to commmunicate errors.
+func (l *PostgresTransactionLogger) Err() <-chan error {
+	return l.errors
+}
+
+// Stats reports the queue depth, write failures and progress of the logger.
+func (l *PostgresTransactionLogger) Stats() Stats {
+	return l.stats.stats(l.events)
+}
+
+// Run the PostgresTransactionLogger.
+// Events queued together are inserted in a single database transaction.
+// Failures are reported on the error channel without stopping the writer.
+// The writer exits after Close, once every queued event is committed.
+func (l *PostgresTransactionLogger) Run() {
+	l.events = newEventQueue(16)
+	events := l.events.ch
+
+	errors := make(chan error, 1)
+	l.errors = errors
+
+	tasks := make(chan func())
+	l.tasks = tasks
+
+	stopped := make(chan struct{})
+	l.stopped = stopped
+
+	go func() {
+		defer close(stopped)
+		defer close(errors)
+
+		for {
+			select {
+			case p, ok := <-events:
+				if !ok {
+					return
+				}
+				batch := collectBatch(p, events, l.commit)
+				err := persist("postgres", batch, l.commit, &l.stats, l.writeBatch)
+				if err == nil {
+					l.commit.committed(batch)
+				}
+				acknowledge(batch, err)
+				if err != nil {
+					report(errors, err)
+				}
+			case task := <-tasks:
+				task()
+			}
+		}
+	}()
+}
+
+// do runs task on the writer goroutine and returns its result.
+func (l *PostgresTransactionLogger) do(task func() error) error {
+	return runTask(l.tasks, l.stopped, task)
+}
+
+// Compact writes state to the snapshot file, covering every event committed
+// so far, so that replay reads only the events committed after it from the
+// database. The table keeps every event, as the snapshot is local to this
+// node. Without a snapshot file, Compact does nothing.
+func (l *PostgresTransactionLogger) Compact(state func() []Event) error {
+	if l.params.SnapshotFile == "" {
+		return nil
 	}
 
-	var exists bool
-	defer rows.Close()
+	return l.do(func() error {
+		start := time.Now()
+		seq, events := l.stats.stats(nil).LastSequence, state()
+		if err := writeSnapshot(l.params.SnapshotFile, seq, events); err != nil {
+			return err
+		}
 
-	for rows.Next() {
-		err = rows.Scan(&exists)
+		l.commit.log().Info("transaction log snapshot written", "file", l.params.SnapshotFile,
+			"events", len(events), "sequence", seq, "duration", time.Since(start))
+		return nil
+	})
+}
 
-		if err != nil {
-			return false, err
+// writeBatch writes batch, retrying it while it fails with transient
+// errors. The writer takes no other batch meanwhile, so events are never
+// reordered. A commit that failed may have succeeded nonetheless; its events
+// are then logged twice in a row, which replay tolerates.
+func (l *PostgresTransactionLogger) writeBatch(batch []pending) error {
+	delay := l.params.RetryDelay
+
+	for attempt := 1; ; attempt++ {
+		err := l.insertBatch(batch)
+		if err == nil || attempt > l.params.Retries || !transient(err) {
+			return err
 		}
+
+		l.commit.log().Warn("cannot persist batch; retrying",
+			"backend", "postgres", "attempt", attempt, "delay", delay, "error", err)
+		time.Sleep(delay)
+		delay *= 2
 	}
+}
 
-	err = rows.Err()
+// insertBatch inserts the events of batch and commits them together. The
+// events of batch are stamped with the sequence numbers the database
+// assigned, and those of batch writes with how many of theirs follow, so
+// replay can restore them together.
+func (l *PostgresTransactionLogger) insertBatch(batch []pending) error {
+	var events []*Event
+	for i := range batch {
+		if batch[i].batch == nil {
+			events = append(events, &batch[i].event)
+		}
+		for j := range batch[i].batch {
+			batch[i].batch[j].Remaining = len(batch[i].batch) - 1 - j
+			events = append(events, &batch[i].batch[j])
+		}
+	}
+
+	tx, err := l.db.Begin()
 	if err != nil {
-		return false, err
+		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
-	return exists, nil
+	insert := tx.Stmt(l.insert)
+	for len(events) > 0 {
+		n := len(events)
+		if n > maxInsertRows {
+			n = maxInsertRows
+		}
+
+		if err = insertEvents(insert, events[:n]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		events = events[n:]
+	}
 
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit events: %w", err)
+	}
+	return nil
 }
 
-func (l *PostgresTransactionLogger) createTable() error {
-	query := `create table postgres.public.transactions (
-        sequence serial,
-        event_type int,
-        key varchar,
-        value varchar
-   )`
+// maxInsertRows bounds the events inserted by one statement.
+const maxInsertRows = 1000
+
+// insertQuery inserts events passed as arrays of their fields into the
+// table it is formatted with. The rows are inserted in array order, so the
+// sequence numbers they get ascend in that order too.
+const insertQuery = `INSERT INTO %s
+        (event_type,key,value,expiry,version,batch_remaining)
+        SELECT event_type,key,value,expiry,version,batch_remaining
+        FROM unnest($1::int[], $2::varchar[], $3::varchar[],
+                    $4::timestamptz[], $5::bigint[], $6::int[])
+            WITH ORDINALITY AS e(event_type,key,value,expiry,version,batch_remaining,n)
+        ORDER BY n
+        RETURNING sequence`
+
+// insertEvents inserts events with one statement, stamping them with their
+// sequence numbers.
+func insertEvents(insert *sql.Stmt, events []*Event) error {
+	types := make([]int64, len(events))
+	keys := make([]string, len(events))
+	values := make([]string, len(events))
+	expiries := make([]sql.NullString, len(events))
+	versions := make([]int64, len(events))
+	remaining := make([]int64, len(events))
+
+	for i, e := range events {
+		types[i], keys[i], values[i] = int64(e.EventType), e.Key, e.Value
+		versions[i], remaining[i] = int64(e.Version), int64(e.Remaining)
+		if !e.Expiry.IsZero() {
+			expiries[i] = sql.NullString{String: e.Expiry.Format(time.RFC3339Nano), Valid: true}
+		}
+	}
 
-	_, err := l.db.Exec(query)
-	return err
-}
+	rows, err := insert.Query(pq.Array(types), pq.Array(keys), pq.Array(values),
+		pq.GenericArray{A: expiries}, pq.Array(versions), pq.Array(remaining))
+	if err != nil {
+		return fmt.Errorf("failed to insert events: %w", err)
+	}
+	defer rows.Close()
 
-// WritePut writes PUT event in the log.
-func (l *PostgresTransactionLogger) WritePut(key, value string) {
-	l.events <- Event{EventType: EventPut, Key: key, Value: value}
-}
+	sequences := make([]uint64, 0, len(events))
+	for rows.Next() {
+		var s uint64
+		if err = rows.Scan(&s); err != nil {
+			return fmt.Errorf("failed to insert events: %w", err)
+		}
+		sequences = append(sequences, s)
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("failed to insert events: %w", err)
+	}
+	if len(sequences) != len(events) {
+		return fmt.Errorf("inserted %d events, want %d", len(sequences), len(events))
+	}
 
-// WriteDelete writes DELETE event in the log.
-func (l *PostgresTransactionLogger) WriteDelete(key string) {
-	l.events <- Event{EventType: EventDelete, Key: key}
+	// RETURNING promises no order, but the sequence numbers ascend in the
+	// order of the events.
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	for i, e := range events {
+		e.Sequence = sequences[i]
+	}
+	return nil
 }
 
-// Err returns errors channel to commmunicate errors.
-func (l *PostgresTransactionLogger) Err() <-chan error {
-	return l.errors
+// transient reports whether err may go away if the batch is written again:
+// lost connections, serialization failures, deadlocks and a server that is
+// shutting down or out of connections.
+func transient(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", "40P01", "53300", "57P01", "57P02", "57P03":
+			return true
+		}
+		return pqErr.Code.Class() == "08" // Connection exception.
+	}
+
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netErr)
 }
 
-// Run the PostgresTransactionLogger.
-func (l *PostgresTransactionLogger) Run() {
-	events := make(chan Event, 16)
-	l.events = events
+// Close stops accepting events, waits for the queued ones to be committed and
+// releases the database connections. If ctx ends first, Close returns its
+// error and leaves the database open for the events still being written.
+func (l *PostgresTransactionLogger) Close(ctx context.Context) error {
+	if l.events != nil {
+		l.events.close()
 
-	errors := make(chan error, 1)
-	l.errors = errors
-
-	go func() {
-		query := `INSERT INTO transactions
-        (event_type,key,value)
-        VALUES ($1,$2,$3)`
-
-		for e := range events {
-			_, err := l.db.Exec(query, e.EventType, e.Key, e.Value)
-			if err != nil {
-				errors <- err
-			}
+		if err := waitStopped(ctx, l.stopped); err != nil {
+			return err
 		}
-	}()
+	}
+
+	return l.db.Close()
+}
+
+// Recover checks that the database is reachable again. database/sql
+// replaces broken connections in its pool by itself.
+func (l *PostgresTransactionLogger) Recover() error {
+	if err := l.db.Ping(); err != nil {
+		return fmt.Errorf("failed to reach database: %w", err)
+	}
+	return nil
 }
 
 // ReadEvents reads from events database transactions tables
-// and replays the event into the store.
+// and replays the event into the store: the snapshot file first, if there is
+// one, then the events committed after it, in sequence order.
 func (l *PostgresTransactionLogger) ReadEvents() (<-chan Event, <-chan error) {
-	outEvent := make(chan Event) // An unbuffered events channel
-	outError := make(chan error) // A buffered errors channel
+	outEvent := make(chan Event)    // An unbuffered events channel
+	outError := make(chan error, 1) // A buffered errors channel
 
 	go func() {
 		defer close(outEvent) // Close the channels when the
 		defer close(outError) // goroutine ends
 
-		query := "SELECT sequence,event_type,key,value FROM transactions"
-		rows, err := l.db.Query(query) // Run query: get result
+		after, err := l.ReadSnapshot(func(e Event) error {
+			outEvent <- e
+			return nil
+		})
+		if err == nil {
+			err = l.readTable(after, outEvent)
+		}
 		if err != nil {
-			outError <- fmt.Errorf("sql query error: %w", err)
-			return
+			outError <- err
 		}
+	}()
+
+	return outEvent, outError
+}
+
+// ReadSnapshot passes the events of the snapshot file, if there is one, to
+// apply and returns the sequence number the snapshot covers.
+func (l *PostgresTransactionLogger) ReadSnapshot(apply func(Event) error) (uint64, error) {
+	if l.params.SnapshotFile == "" {
+		return 0, nil
+	}
 
-		defer rows.Close()
+	seq, err := replaySnapshot(l.params.SnapshotFile, apply)
+	if err != nil {
+		return 0, err
+	}
 
-		e := Event{}
+	// A snapshot of another table, or of one since recreated, would hide
+	// the events of this one.
+	last, err := l.LastSequence()
+	if err != nil {
+		return 0, err
+	}
+	if seq > last {
+		return 0, fmt.Errorf("snapshot %s covers sequence %d, beyond the last event %d of table %s",
+			l.params.SnapshotFile, seq, last, l.table)
+	}
 
-		for rows.Next() {
-			err = rows.Scan(
-				&e.Sequence, &e.EventType, &e.Key, &e.Value)
+	l.stats.seen(seq)
+	return seq, nil
+}
 
-			if err != nil {
-				outError <- fmt.Errorf("error reading row: %w", err)
-				return
-			}
+// ReadEventsAfter replays the events committed after sequence number after,
+// in sequence order.
+func (l *PostgresTransactionLogger) ReadEventsAfter(after uint64) (<-chan Event, <-chan error) {
+	outEvent := make(chan Event)
+	outError := make(chan error, 1)
 
-			outEvent <- e
-		}
+	go func() {
+		defer close(outEvent)
+		defer close(outError)
 
-		err = rows.Err()
-		if err != nil {
-			outError <- fmt.Errorf("transaction log read failure: %w", err)
+		if err := l.readTable(after, outEvent); err != nil {
+			outError <- err
 		}
 	}()
 
 	return outEvent, outError
 }
+
+// LastSequence returns the sequence number of the last event in the table.
+func (l *PostgresTransactionLogger) LastSequence() (uint64, error) {
+	var last uint64
+	err := l.db.QueryRow("SELECT COALESCE(max(sequence), 0) FROM " + l.table.String()).Scan(&last)
+	if err != nil {
+		return 0, fmt.Errorf("sql query error: %w", err)
+	}
+	return last, nil
+}
+
+// readTable sends the events with sequence numbers greater than after to
+// out, in sequence order. It reads them a page at a time, each page
+// starting after the last event of the one before, so no query stays open
+// for the whole replay.
+func (l *PostgresTransactionLogger) readTable(after uint64, out chan<- Event) error {
+	query := `SELECT sequence,event_type,key,value,expiry,version,batch_remaining FROM ` + l.table.String() + `
+        WHERE sequence > $1 ORDER BY sequence LIMIT $2`
+
+	for {
+		n, err := l.readPage(query, &after, out)
+		if err != nil {
+			return err
+		}
+		if n < l.params.ReplayPageSize {
+			return nil
+		}
+	}
+}
+
+// readPage sends the events of the page of query following *after to out,
+// advances *after past them and returns how many there were.
+func (l *PostgresTransactionLogger) readPage(query string, after *uint64, out chan<- Event) (int, error) {
+	rows, err := l.db.Query(query, *after, l.params.ReplayPageSize)
+	if err != nil {
+		return 0, fmt.Errorf("sql query error: %w", err)
+	}
+	defer rows.Close()
+
+	n := 0
+	e := Event{}
+	var expiry sql.NullTime
+	var version sql.NullInt64
+
+	for rows.Next() {
+		err = rows.Scan(
+			&e.Sequence, &e.EventType, &e.Key, &e.Value, &expiry, &version, &e.Remaining)
+
+		if err != nil {
+			return n, fmt.Errorf("error reading row: %w", err)
+		}
+
+		e.Expiry, e.Version = expiry.Time, uint64(version.Int64)
+		l.stats.seen(e.Sequence)
+		*after = e.Sequence
+		n++
+		out <- e
+	}
+
+	if err = rows.Err(); err != nil {
+		return n, fmt.Errorf("transaction log read failure: %w", err)
+	}
+	return n, nil
+}
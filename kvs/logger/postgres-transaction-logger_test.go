@@ -0,0 +1,298 @@
+package logger
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// fakeDB is a database/sql driver standing in for Postgres. It answers the
+// insert statement with sequence numbers, which it hands out like a
+// Postgres sequence, and fails the operations fail tells it to.
+type fakeDB struct {
+	mu       sync.Mutex
+	sequence int64
+	fail     func(op string, n int) error // op is "insert" or "commit"; n counts from 1.
+	ops      map[string]int               // How often each operation ran.
+	inserts  []int                        // The rows of every insert statement.
+	rows     int                          // The rows of committed transactions.
+	pending  int                          // The rows of the open transaction.
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{ops: make(map[string]int)}
+}
+
+// do counts op and returns the error fail has for it.
+func (db *fakeDB) do(op string) error {
+	db.ops[op]++
+	if db.fail == nil {
+		return nil
+	}
+	return db.fail(op, db.ops[op])
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{db}, nil }
+func (db *fakeDB) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	if !strings.HasPrefix(query, "INSERT") {
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+	return fakeInsert{c.db}, nil
+}
+
+func (c fakeConn) Close() error { return nil }
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.ops["begin"]++
+	c.db.pending = 0
+	return fakeTx{c.db}, nil
+}
+
+type fakeTx struct{ db *fakeDB }
+
+func (tx fakeTx) Commit() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if err := tx.db.do("commit"); err != nil {
+		return err
+	}
+	tx.db.rows += tx.db.pending
+	return nil
+}
+
+func (tx fakeTx) Rollback() error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	tx.db.ops["rollback"]++
+	return nil
+}
+
+// fakeInsert is the prepared insertQuery.
+type fakeInsert struct{ db *fakeDB }
+
+func (s fakeInsert) Close() error  { return nil }
+func (s fakeInsert) NumInput() int { return 6 }
+
+func (s fakeInsert) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+// Query inserts as many rows as the versions array, the fifth argument,
+// has elements, and returns their sequence numbers.
+func (s fakeInsert) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if err := s.db.do("insert"); err != nil {
+		return nil, err
+	}
+
+	versions, _ := args[4].(string)
+	n := 0
+	if versions != "{}" {
+		n = strings.Count(versions, ",") + 1
+	}
+
+	rows := &fakeRows{}
+	for i := 0; i < n; i++ {
+		s.db.sequence++
+		rows.sequences = append(rows.sequences, s.db.sequence)
+	}
+	s.db.inserts = append(s.db.inserts, n)
+	s.db.pending += n
+	return rows, nil
+}
+
+type fakeRows struct{ sequences []int64 }
+
+func (r *fakeRows) Columns() []string { return []string{"sequence"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.sequences) == 0 {
+		return io.EOF
+	}
+	dest[0], r.sequences = r.sequences[0], r.sequences[1:]
+	return nil
+}
+
+// newFakeLogger returns a logger writing to db, retrying failed batches
+// retries times.
+func newFakeLogger(tb testing.TB, db *fakeDB, retries int) *PostgresTransactionLogger {
+	tb.Helper()
+
+	sqlDB := sql.OpenDB(db)
+	tb.Cleanup(func() { sqlDB.Close() })
+
+	table := postgresTable{schema: defaultPostgresSchema, name: defaultPostgresTable}
+	insert, err := sqlDB.Prepare(fmt.Sprintf(insertQuery, table))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return &PostgresTransactionLogger{db: sqlDB, table: table, insert: insert,
+		params: PostgresDbParams{Retries: retries, RetryDelay: time.Microsecond},
+		commit: CommitParams{Logger: slog.New(slog.NewTextHandler(ioutil.Discard, nil))}}
+}
+
+// testBatch returns writes of single events and of a batch of size events.
+func testBatch(singles, size int) []pending {
+	var batch []pending
+	for i := 0; i < singles; i++ {
+		batch = append(batch, pending{event: Event{EventType: EventPut, Key: fmt.Sprint("k", i), Version: uint64(i + 1)}})
+	}
+	if size > 0 {
+		events := make([]Event, size)
+		for i := range events {
+			events[i] = Event{EventType: EventDelete, Key: fmt.Sprint("b", i), Version: uint64(i + 1)}
+		}
+		batch = append(batch, pending{batch: events})
+	}
+	return batch
+}
+
+func TestInsertBatch(t *testing.T) {
+	tests := []struct {
+		name          string
+		singles, size int
+		inserts       []int // The rows of each statement.
+	}{
+		{"single event", 1, 0, []int{1}},
+		{"several writes", 5, 3, []int{8}},
+		{"full statement", 0, maxInsertRows, []int{maxInsertRows}},
+		{"several statements", 2, 2 * maxInsertRows, []int{maxInsertRows, maxInsertRows, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB()
+			l := newFakeLogger(t, db, 0)
+			batch := testBatch(tt.singles, tt.size)
+
+			if err := l.writeBatch(batch); err != nil {
+				t.Fatal(err)
+			}
+
+			if fmt.Sprint(db.inserts) != fmt.Sprint(tt.inserts) {
+				t.Errorf("statements of %v rows, want %v", db.inserts, tt.inserts)
+			}
+			// One transaction commits all of them.
+			if db.ops["begin"] != 1 || db.ops["commit"] != 1 {
+				t.Errorf("%d transactions, %d commits; want 1", db.ops["begin"], db.ops["commit"])
+			}
+
+			// The events are stamped with ascending sequence numbers, in
+			// the order they were queued, and those of a batch with how
+			// many of theirs follow.
+			var last uint64
+			for _, p := range batch {
+				events := p.batch
+				if events == nil {
+					events = []Event{p.event}
+				}
+				for i, e := range events {
+					if e.Sequence != last+1 {
+						t.Fatalf("event %s stamped %d after %d", e.Key, e.Sequence, last)
+					}
+					if want := len(events) - 1 - i; e.Remaining != want {
+						t.Fatalf("event %s stamped with %d remaining, want %d", e.Key, e.Remaining, want)
+					}
+					last = e.Sequence
+				}
+			}
+		})
+	}
+}
+
+func TestWriteBatchRetries(t *testing.T) {
+	transientErr := &pq.Error{Code: "40001"} // Serialization failure.
+	permanentErr := &pq.Error{Code: "23505"} // Unique violation.
+
+	// failFirst fails the first n attempts at op with err.
+	failFirst := func(op string, n int, err error) func(string, int) error {
+		return func(o string, i int) error {
+			if o == op && i <= n {
+				return err
+			}
+			return nil
+		}
+	}
+
+	tests := []struct {
+		name     string
+		retries  int
+		fail     func(op string, n int) error
+		attempts int // Transactions begun.
+		err      error
+	}{
+		{"insert fails once", 3, failFirst("insert", 1, transientErr), 2, nil},
+		{"commit fails twice", 3, failFirst("commit", 2, transientErr), 3, nil},
+		{"connection lost mid-transaction", 3, failFirst("insert", 1, io.ErrUnexpectedEOF), 2, nil},
+		{"retries exhausted", 2, failFirst("insert", 10, transientErr), 3, transientErr},
+		{"permanent error", 3, failFirst("insert", 1, permanentErr), 1, permanentErr},
+		{"retries disabled", -1, failFirst("commit", 1, transientErr), 1, transientErr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newFakeDB()
+			db.fail = tt.fail
+			l := newFakeLogger(t, db, tt.retries)
+
+			err := l.writeBatch(testBatch(2, 3))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("writeBatch() = %v, want %v", err, tt.err)
+			}
+			if db.ops["begin"] != tt.attempts {
+				t.Errorf("%d attempts, want %d", db.ops["begin"], tt.attempts)
+			}
+
+			// Attempts failing before the commit are rolled back.
+			if want := db.ops["begin"] - db.ops["commit"]; db.ops["rollback"] != want {
+				t.Errorf("%d rollbacks, want %d", db.ops["rollback"], want)
+			}
+			// A successful attempt commits the events once.
+			want := 5
+			if tt.err != nil {
+				want = 0
+			}
+			if db.rows != want {
+				t.Errorf("committed %d rows, want %d", db.rows, want)
+			}
+		})
+	}
+}
+
+func BenchmarkInsertBatch(b *testing.B) {
+	for _, size := range []int{1, 10, 100, 1000, 10000} {
+		b.Run(fmt.Sprint(size), func(b *testing.B) {
+			l := newFakeLogger(b, newFakeDB(), 0)
+			batch := testBatch(0, size)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if err := l.insertBatch(batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(size*b.N)/b.Elapsed().Seconds(), "events/s")
+		})
+	}
+}
@@ -0,0 +1,366 @@
+package logger
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// The transaction log and snapshot files start with a magic string that
+// identifies the binary format, followed by a sequence of records:
+//
+//	+----------------+----------------+----------------------+
+//	| length uint32  | crc32c uint32  | payload (length)     |
+//	+----------------+----------------+----------------------+
+//
+// The payload holds the event fields, each variable length field prefixed
+// with its uvarint encoded length, so keys and values may contain arbitrary
+// bytes. Decoders ignore payload bytes they do not understand, which lets
+// later versions append fields without breaking older records; fields
+// appended that way are optional and default to their zero value:
+//
+//	sequence uvarint | type byte | key string | value string |
+//	expiry uvarint (Unix nanoseconds, 0 for none) | version uvarint
+//
+// A batch written by WriteBatch is a single record, so a crash can never
+// leave part of it behind. Its events share the batch's sequence number:
+//
+//	sequence uvarint | batchRecord byte | count uvarint |
+//	count * (length uvarint | event payload)
+const (
+	logMagic      = "KVSLOG\x00\x01"
+	snapshotMagic = "KVSSNP\x00\x01"
+
+	recordHeaderSize = 8
+	maxRecordSize    = 1 << 30
+
+	// batchRecord is the type byte of a batch record. It is distinct from
+	// every EventType.
+	batchRecord = 0xff
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrCorruptRecord is wrapped by every CorruptRecordError.
+var ErrCorruptRecord = errors.New("corrupt transaction log record")
+
+// errTornRecord reports a record cut short by the end of the file, which is
+// what a crash in the middle of a write leaves behind.
+var errTornRecord = errors.New("torn transaction log record")
+
+// CorruptRecordError reports a record whose checksum or contents are invalid.
+type CorruptRecordError struct {
+	Offset int64  // Offset of the record in the file.
+	Reason string // What is wrong with the record.
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("%v at offset %d: %s", ErrCorruptRecord, e.Offset, e.Reason)
+}
+
+// Unwrap allows errors.Is(err, ErrCorruptRecord).
+func (e *CorruptRecordError) Unwrap() error {
+	return ErrCorruptRecord
+}
+
+// encodeEvent returns the complete record, header included, for e.
+func encodeEvent(e Event) []byte {
+	return frame(appendEvent(nil, e))
+}
+
+// encodeBatch returns the complete record of a batch of events, which all
+// take the sequence number seq.
+func encodeBatch(seq uint64, events []Event) []byte {
+	payload := appendUvarint(nil, seq)
+	payload = append(payload, batchRecord)
+	payload = appendUvarint(payload, uint64(len(events)))
+
+	for _, e := range events {
+		e.Sequence = seq
+		p := appendEvent(nil, e)
+		payload = appendUvarint(payload, uint64(len(p)))
+		payload = append(payload, p...)
+	}
+
+	return frame(payload)
+}
+
+// appendEvent appends the payload encoding of e to b.
+func appendEvent(b []byte, e Event) []byte {
+	b = appendUvarint(b, e.Sequence)
+	b = append(b, byte(e.EventType))
+	b = appendString(b, e.Key)
+	b = appendString(b, e.Value)
+	b = appendUvarint(b, expiryNanos(e.Expiry))
+	return appendUvarint(b, e.Version)
+}
+
+// frame prepends the record header to payload.
+func frame(payload []byte) []byte {
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	return append(record, payload...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// decodeRecord parses a record payload produced by encodeEvent or
+// encodeBatch and returns its events.
+func decodeRecord(payload []byte) ([]Event, error) {
+	d := decoder{b: payload}
+	seq := d.uvarint()
+	if d.byte() != batchRecord || d.err != nil {
+		e, err := decodeEvent(payload)
+		return []Event{e}, err
+	}
+
+	n := d.uvarint()
+	if d.err == nil && n > uint64(len(d.b)) {
+		d.err = errors.New("batch count exceeds payload")
+	}
+
+	events := make([]Event, 0, n)
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		var e Event
+		if e, d.err = decodeEvent([]byte(d.string())); d.err == nil {
+			e.Sequence = seq
+			events = append(events, e)
+		}
+	}
+
+	return events, d.err
+}
+
+// decodeEvent parses an event payload produced by appendEvent.
+func decodeEvent(payload []byte) (Event, error) {
+	var e Event
+	d := decoder{b: payload}
+
+	e.Sequence = d.uvarint()
+	e.EventType = EventType(d.byte())
+	e.Key = d.string()
+	e.Value = d.string()
+
+	if d.more() {
+		if ns := d.uvarint(); ns != 0 {
+			e.Expiry = time.Unix(0, int64(ns))
+		}
+	}
+	if d.more() {
+		e.Version = d.uvarint()
+	}
+
+	return e, d.err
+}
+
+// expiryNanos encodes an expiry as Unix nanoseconds, using 0 for no expiry.
+func expiryNanos(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+// decoder reads fields from a payload, remembering the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+// more reports whether fields remain, i.e. the record was written by a
+// version that knew about the optional fields read next.
+func (d *decoder) more() bool {
+	return d.err == nil && len(d.b) > 0
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errors.New("bad varint")
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) == 0 {
+		d.err = errors.New("payload too short")
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.b)) < n {
+		d.err = errors.New("field length exceeds payload")
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+// writeEvent writes a single event record. The record is handed to w in one
+// Write call to keep torn writes confined to the tail of the file.
+func writeEvent(w io.Writer, e Event) error {
+	_, err := w.Write(encodeEvent(e))
+	return err
+}
+
+// recordReader reads event records from a file in the binary format.
+type recordReader struct {
+	r      *bufio.Reader
+	offset int64 // Offset of the next record.
+}
+
+// newRecordReader checks that r starts with magic and returns a reader
+// positioned at the first record.
+func newRecordReader(r io.Reader, magic string) (*recordReader, error) {
+	rr := &recordReader{r: bufio.NewReader(r)}
+
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(rr.r, header); err != nil {
+		return nil, &CorruptRecordError{Offset: 0, Reason: "missing file header"}
+	}
+	if string(header) != magic {
+		return nil, &CorruptRecordError{Offset: 0, Reason: "unknown file header"}
+	}
+
+	rr.offset = int64(len(magic))
+	return rr, nil
+}
+
+// Next returns the events of the next record: one event, or all events of
+// a batch. It returns io.EOF at the clean end of the file, errTornRecord if
+// the file ends part way through a record, and a *CorruptRecordError if a
+// complete record fails validation.
+func (rr *recordReader) Next() ([]Event, error) {
+	header := make([]byte, recordHeaderSize)
+	n, err := io.ReadFull(rr.r, header)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		return nil, errTornRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+
+	if length > maxRecordSize {
+		return nil, &CorruptRecordError{Offset: rr.offset, Reason: "record too large"}
+	}
+
+	payload := make([]byte, length)
+	m, err := io.ReadFull(rr.r, payload)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errTornRecord
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if crc32.Checksum(payload, crcTable) != sum {
+		return nil, &CorruptRecordError{Offset: rr.offset, Reason: "checksum mismatch"}
+	}
+
+	events, err := decodeRecord(payload)
+	if err != nil {
+		return nil, &CorruptRecordError{Offset: rr.offset, Reason: err.Error()}
+	}
+
+	rr.offset += int64(n + m)
+	return events, nil
+}
+
+// Sequence skips the next record and returns its sequence number, which
+// leads the payload of event and batch records alike. It reads no more of
+// the payload than the sequence number and does not verify the checksum.
+// Like Next, it returns io.EOF at the clean end of the file and
+// errTornRecord if the file ends part way through a record.
+func (rr *recordReader) Sequence() (uint64, error) {
+	header := make([]byte, recordHeaderSize)
+	n, err := io.ReadFull(rr.r, header)
+	if err == io.EOF {
+		return 0, io.EOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		return 0, errTornRecord
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return 0, &CorruptRecordError{Offset: rr.offset, Reason: "record too large"}
+	}
+
+	counter := &countingByteReader{r: rr.r}
+	seq, err := binary.ReadUvarint(counter)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, errTornRecord
+	}
+	if err == nil && counter.n > int64(length) {
+		err = errors.New("sequence exceeds payload")
+	}
+	if err != nil {
+		return 0, &CorruptRecordError{Offset: rr.offset, Reason: err.Error()}
+	}
+
+	read := counter.n
+	m, err := rr.r.Discard(int(int64(length) - read))
+	if err == io.EOF {
+		return 0, errTornRecord
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	rr.offset += int64(n) + read + int64(m)
+	return seq, nil
+}
+
+// countingByteReader counts the bytes read through it.
+type countingByteReader struct {
+	r io.ByteReader
+	n int64
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
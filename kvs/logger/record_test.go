@@ -0,0 +1,199 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	expiry := time.Unix(1700000000, 123456789)
+
+	tests := []struct {
+		name  string
+		event Event
+	}{
+		{"empty value", Event{Sequence: 1, EventType: EventPut, Key: "k", Version: 1}},
+		{"whitespace", Event{Sequence: 2, EventType: EventPut, Key: " key\twith tabs ", Value: "  spaced  value\t"}},
+		{"newlines", Event{Sequence: 3, EventType: EventPut, Key: "multi\nline", Value: "line one\nline two\r\n"}},
+		{"binary", Event{Sequence: 4, EventType: EventPut, Key: "\x00\xff", Value: "\x00\x01\xfe\xff\x00"}},
+		{"expiry and version", Event{Sequence: 5, EventType: EventPut, Key: "k", Value: "v", Expiry: expiry, Version: 7}},
+		{"delete", Event{Sequence: 1 << 40, EventType: EventDelete, Key: "gone", Version: 9}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			buf.WriteString(logMagic)
+			if err := writeEvent(&buf, tt.event); err != nil {
+				t.Fatal(err)
+			}
+
+			rr, err := newRecordReader(&buf, logMagic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events, err := rr.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != 1 || !eventsEqual(events[0], tt.event) {
+				t.Errorf("read %+v, want %+v", events, tt.event)
+			}
+			if _, err = rr.Next(); err != io.EOF {
+				t.Errorf("Next() after the last record = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestBatchRecordRoundTrip(t *testing.T) {
+	batch := []Event{
+		{EventType: EventPut, Key: "a b", Value: "1\n2", Version: 1},
+		{EventType: EventDelete, Key: "\x00", Version: 3},
+	}
+
+	rr, err := newRecordReader(bytes.NewReader(append([]byte(logMagic), encodeBatch(8, batch)...)), logMagic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := rr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(batch) {
+		t.Fatalf("read %d events, want %d", len(events), len(batch))
+	}
+	for i, e := range events {
+		want := batch[i]
+		want.Sequence = 8
+		if !eventsEqual(e, want) {
+			t.Errorf("event %d = %+v, want %+v", i, e, want)
+		}
+	}
+}
+
+// eventsEqual compares events, expiries by instant.
+func eventsEqual(a, b Event) bool {
+	if !a.Expiry.Equal(b.Expiry) {
+		return false
+	}
+	a.Expiry, b.Expiry = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a, b)
+}
+
+// logFile writes a log holding a record for each event and returns its path
+// and the offsets the records start at.
+func logFile(t *testing.T, events ...Event) (string, []int64) {
+	t.Helper()
+
+	buf := bytes.NewBufferString(logMagic)
+	var offsets []int64
+	for _, e := range events {
+		offsets = append(offsets, int64(buf.Len()))
+		buf.Write(encodeEvent(e))
+	}
+
+	path := filepath.Join(t.TempDir(), "transaction.log")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, offsets
+}
+
+var recordEvents = []Event{
+	{Sequence: 1, EventType: EventPut, Key: "a", Value: "1", Version: 1},
+	{Sequence: 2, EventType: EventPut, Key: "b", Value: "2", Version: 1},
+	{Sequence: 3, EventType: EventDelete, Key: "a", Version: 2},
+}
+
+func TestTornRecordTruncated(t *testing.T) {
+	last := int64(len(encodeEvent(recordEvents[2])))
+
+	tests := []struct {
+		name string
+		keep int64 // Bytes of the final record left in the file.
+	}{
+		{"partial header", recordHeaderSize / 2},
+		{"header only", recordHeaderSize},
+		{"partial payload", last - 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, offsets := logFile(t, recordEvents...)
+			if err := os.Truncate(path, offsets[2]+tt.keep); err != nil {
+				t.Fatal(err)
+			}
+
+			replayed, _ := replayFile(t, path)
+			if want := map[string]string{"a": "1", "b": "2"}; !reflect.DeepEqual(state(replayed), want) {
+				t.Errorf("replayed %v, want %v", state(replayed), want)
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != offsets[2] {
+				t.Errorf("log is %d bytes after replay, want the torn record cut at %d",
+					info.Size(), offsets[2])
+			}
+		})
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(b []byte, offset int64)
+		reason  string
+	}{
+		{"bad checksum", func(b []byte, offset int64) { b[offset+4] ^= 0xff }, "checksum mismatch"},
+		{"flipped payload bit", func(b []byte, offset int64) { b[offset+recordHeaderSize+2] ^= 0x01 }, "checksum mismatch"},
+		{"oversized length", func(b []byte, offset int64) { b[offset] = 0xff }, "record too large"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, offsets := logFile(t, recordEvents...)
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.corrupt(b, offsets[1]) // A record in the middle of the log.
+			if err = os.WriteFile(path, b, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			l := openFileLogger(t, path)
+			defer l.file.Close()
+			events, errs := l.ReadEvents()
+			for range events {
+			}
+			err = <-errs
+
+			var corrupt *CorruptRecordError
+			if !errors.As(err, &corrupt) {
+				t.Fatalf("replay error = %v, want a *CorruptRecordError", err)
+			}
+			if corrupt.Offset != offsets[1] || corrupt.Reason != tt.reason {
+				t.Errorf("got %q at offset %d, want %q at %d",
+					corrupt.Reason, corrupt.Offset, tt.reason, offsets[1])
+			}
+			if !errors.Is(err, ErrCorruptRecord) {
+				t.Errorf("replay error %v does not wrap ErrCorruptRecord", err)
+			}
+
+			// Corruption is reported, never truncated away like a torn record.
+			if after, _ := os.ReadFile(path); !bytes.Equal(after, b) {
+				t.Error("replay modified the corrupt log")
+			}
+		})
+	}
+}
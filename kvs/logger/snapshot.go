@@ -0,0 +1,170 @@
+package logger
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// snapshotPath returns the location of the snapshot belonging to the
+// transaction log at filename.
+func snapshotPath(filename string) string {
+	return filename + ".snapshot"
+}
+
+// writeSnapshot writes state to path as a series of PUT events carrying the
+// sequence number seq, whatever their own sequence and type. The snapshot is
+// written to a temporary file, synced and then renamed over path, so a crash
+// leaves either the old or the new snapshot in place, never a partial one.
+func writeSnapshot(path string, seq uint64, state []Event) error {
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		if err := writeSnapshotHeader(w, seq); err != nil {
+			return err
+		}
+
+		for _, e := range state {
+			e.Sequence, e.EventType = seq, EventPut
+			if err := writeEvent(w, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot write snapshot: %w", err)
+	}
+	return nil
+}
+
+// writeSnapshotHeader writes the snapshot magic followed by the sequence
+// number of the last event folded into the snapshot.
+func writeSnapshotHeader(w io.Writer, seq uint64) error {
+	header := make([]byte, len(snapshotMagic)+8)
+	copy(header, snapshotMagic)
+	binary.BigEndian.PutUint64(header[len(snapshotMagic):], seq)
+
+	_, err := w.Write(header)
+	return err
+}
+
+// readSnapshot opens the snapshot at path and returns the sequence number it
+// covers together with a reader positioned at its first event. A missing
+// snapshot is not an error: it returns a nil reader and sequence zero.
+func readSnapshot(path string) (uint64, *recordReader, *os.File, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil, nil, nil
+	}
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("cannot open snapshot: %w", err)
+	}
+
+	rr, err := newRecordReader(file, snapshotMagic)
+	if err != nil {
+		file.Close()
+		return 0, nil, nil, fmt.Errorf("cannot read snapshot: %w", err)
+	}
+
+	seq := make([]byte, 8)
+	if _, err = io.ReadFull(rr.r, seq); err != nil {
+		file.Close()
+		return 0, nil, nil, fmt.Errorf("cannot read snapshot: %w",
+			&CorruptRecordError{Offset: rr.offset, Reason: "missing snapshot sequence"})
+	}
+	rr.offset += int64(len(seq))
+
+	return binary.BigEndian.Uint64(seq), rr, file, nil
+}
+
+// replaySnapshot passes the events of the snapshot at path, if there is
+// one, to apply and returns the sequence number the snapshot covers.
+func replaySnapshot(path string, apply func(Event) error) (uint64, error) {
+	seq, rr, file, err := readSnapshot(path)
+	if err != nil || rr == nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	for {
+		events, err := rr.Next()
+		if err == io.EOF {
+			return seq, nil
+		}
+		if err == errTornRecord {
+			// Snapshots are installed by rename, so they are never torn.
+			err = &CorruptRecordError{Offset: rr.offset, Reason: "truncated snapshot"}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("snapshot read failure: %w", err)
+		}
+		for _, e := range events {
+			if err = apply(e); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// crashPoint is called at the steps of writeFileAtomic a crash would leave
+// distinct files behind: once the temporary file is written and once it is
+// renamed over path. Tests replace it to stop there, as if the process died.
+var crashPoint = func(step, path string) error { return nil }
+
+// writeFileAtomic replaces the file at path with the content produced by
+// write. The content goes to a temporary file in the same directory which is
+// synced and renamed over path, so readers observe either the old or the new
+// file, even across a crash.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once the rename succeeded.
+
+	w := bufio.NewWriter(tmp)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = crashPoint("written", path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if err = crashPoint("renamed", path); err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir fsyncs a directory so that a preceding rename within it is durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("cannot open directory: %w", err)
+	}
+	defer d.Close()
+
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("cannot sync directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package logger
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var errCrash = errors.New("simulated crash")
+
+// TestCompactCrash crashes a compaction at each step and checks that
+// replaying what it left behind restores the state before the compaction,
+// and that the log keeps working afterwards.
+func TestCompactCrash(t *testing.T) {
+	tests := []struct {
+		name string
+		step string
+		file func(log string) string
+	}{
+		{"snapshot written", "written", snapshotPath},
+		{"snapshot renamed", "renamed", snapshotPath},
+		{"log truncation written", "written", func(log string) string { return log }},
+		{"log truncated", "renamed", func(log string) string { return log }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			path := filepath.Join(t.TempDir(), "transaction.log")
+
+			// A first compaction leaves an older snapshot behind.
+			l := openFileLogger(t, path)
+			l.Run()
+			var logged []Event
+			put := func(key, value string) {
+				logged = append(logged, Event{EventType: EventPut, Key: key, Value: value})
+				if err := l.WritePut(ctx, key, value, time.Time{}, 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			put("a", "1")
+			put("b", "2")
+			if err := l.Compact(func() []Event { return snapshotOf(logged) }); err != nil {
+				t.Fatal(err)
+			}
+
+			put("c", "3")
+			logged = append(logged, Event{EventType: EventDelete, Key: "a"})
+			if err := l.WriteDelete(ctx, "a", 2); err != nil {
+				t.Fatal(err)
+			}
+			batch := []Event{
+				{EventType: EventPut, Key: "d", Value: "4", Version: 1},
+				{EventType: EventPut, Key: "b", Value: "5", Version: 2},
+			}
+			logged = append(logged, batch...)
+			if err := l.WriteBatch(ctx, batch); err != nil {
+				t.Fatal(err)
+			}
+			want := state(logged)
+
+			crashPoint = func(step, p string) error {
+				if step == tt.step && p == tt.file(path) {
+					return errCrash
+				}
+				return nil
+			}
+			defer func() { crashPoint = func(string, string) error { return nil } }()
+
+			err := l.Compact(func() []Event { return snapshotOf(logged) })
+			if !errors.Is(err, errCrash) {
+				t.Fatalf("Compact() = %v, want the simulated crash", err)
+			}
+			crashPoint = func(string, string) error { return nil }
+
+			// Abandon the logger without closing it, as a crash would.
+			l.events.close()
+			<-l.stopped
+
+			replayed, l := replayFile(t, path)
+			if got := state(replayed); !reflect.DeepEqual(got, want) {
+				t.Fatalf("replayed %v, want %v", got, want)
+			}
+
+			last, err := l.LastSequence()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last != 5 {
+				t.Errorf("LastSequence() = %d, want 5", last)
+			}
+
+			// Writes after recovery carry on from the replayed sequence.
+			l.Run()
+			if err = l.WritePut(ctx, "e", "6", time.Time{}, 1); err != nil {
+				t.Fatal(err)
+			}
+			if err = l.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+			want["e"] = "6"
+
+			replayed, _ = replayFile(t, path)
+			if got := state(replayed); !reflect.DeepEqual(got, want) {
+				t.Errorf("replayed %v after recovery, want %v", got, want)
+			}
+		})
+	}
+}
+
+// snapshotOf returns the state events fold into as the PUT events a
+// compaction snapshots.
+func snapshotOf(events []Event) []Event {
+	var snapshot []Event
+	for k, v := range state(events) {
+		snapshot = append(snapshot, Event{EventType: EventPut, Key: k, Value: v, Version: 1})
+	}
+	return snapshot
+}
@@ -0,0 +1,52 @@
+package logger
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the transaction loggers. It comes from the
+// global tracer provider, so nothing is recorded unless the service sets one.
+var tracer = otel.Tracer("github.com/cloud-native-go/kvs/logger")
+
+// startAppend starts the span of a write, from being queued until it has
+// reached the durability level of the logger. It is a child of the span of
+// ctx, usually that of the request making the write.
+func startAppend(ctx context.Context, events int) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "log.append",
+		trace.WithAttributes(attribute.Int("kvs.log.events", events)))
+}
+
+// startWrite starts the span of persisting batch. A batch persists the
+// writes of many requests at once, so the span starts a trace of its own,
+// linked to the append span of every write in the batch.
+func startWrite(backend string, batch []pending) trace.Span {
+	var links []trace.Link
+	for _, p := range batch {
+		if p.link.SpanContext.IsValid() {
+			links = append(links, p.link)
+		}
+	}
+
+	_, span := tracer.Start(context.Background(), "log.write",
+		trace.WithNewRoot(),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			attribute.String("kvs.log.backend", backend),
+			attribute.Int("kvs.log.writes", len(batch)),
+			attribute.Int("kvs.log.events", countEvents(batch))))
+	return span
+}
+
+// endSpan ends span, marking it as failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -1,11 +1,60 @@
 package logger
 
+import (
+	"context"
+	"time"
+)
+
 // TransactionLogger interface for logging transactions done
 // on the map store.
 type TransactionLogger interface {
-	WriteDelete(key string)
-    WritePut(key, value string)
-    Err() <-chan error
-    ReadEvents() (<-chan Event, <-chan error)
-    Run()
+	// WriteDelete and WritePut return once the event has reached the
+	// durability level the logger was created with. A zero expiry means
+	// the key never expires; version is the store version of the write.
+	// The span of the write is a child of the span of ctx.
+	WriteDelete(ctx context.Context, key string, version uint64) error
+	WritePut(ctx context.Context, key, value string, expiry time.Time, version uint64) error
+	// WriteBatch writes PUT and DELETE events as one atomic unit: replay
+	// returns either all of them or none.
+	WriteBatch(ctx context.Context, events []Event) error
+	// Err reports write failures. Writers keep failing until Recover
+	// succeeds or the underlying problem goes away.
+	Err() <-chan error
+	ReadEvents() (<-chan Event, <-chan error)
+	Run()
+	// Recover tries to restore the logger after a failure, e.g. by
+	// reopening its file or reconnecting to its database.
+	Recover() error
+	// Close stops the logger, persisting the events already written and
+	// releasing its file or database. Writes made afterwards fail with
+	// ErrClosed.
+	Close(ctx context.Context) error
+	// Stats reports the queue depth, write failures and progress of the
+	// logger.
+	Stats() Stats
+}
+
+// Compactor is implemented by transaction loggers that can replace their
+// history with a snapshot of the current state, so replay does not grow
+// without bound.
+type Compactor interface {
+	// Compact snapshots the state returned by state, one PUT event per
+	// key, and discards the events the snapshot covers.
+	Compact(state func() []Event) error
+}
+
+// Replayer is implemented by transaction loggers that can replay their
+// snapshot separately from the events logged after it, so the service can
+// serve reads from the snapshot while the rest is replayed.
+type Replayer interface {
+	// ReadSnapshot passes the events of the snapshot, all carrying the
+	// sequence number it covers, to apply and returns that number. Without
+	// a snapshot it returns zero.
+	ReadSnapshot(apply func(Event) error) (uint64, error)
+	// ReadEventsAfter replays the events with a sequence number greater
+	// than after, in sequence order.
+	ReadEventsAfter(after uint64) (<-chan Event, <-chan error)
+	// LastSequence returns the sequence number replay will end at, to
+	// report its progress, or zero if it is not known in advance.
+	LastSequence() (uint64, error)
 }
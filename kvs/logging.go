@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// slogger writes the log of the service, as JSON once startLogging has run.
+var slogger = slog.Default()
+
+// redactKeys makes log records carry a hash of keys rather than the keys.
+var redactKeys bool
+
+// startLogging makes the service, its transaction logger and the packages
+// logging to slog.Default() write JSON records at the level c sets to
+// stderr.
+func startLogging(c loggingConfig) {
+	var level slog.Level
+	level.UnmarshalText([]byte(c.Level)) // Checked by validate.
+
+	h := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})
+	slogger = slog.New(contextHandler{h})
+	slog.SetDefault(slogger)
+	redactKeys = c.RedactKeys
+
+	commitParams.Logger = slogger
+}
+
+// fatal logs msg with err and exits.
+func fatal(msg string, err error) {
+	slogger.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// contextHandler adds the request ID and the trace of the context to the
+// records logged with it.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()),
+			slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// logKey returns the attribute logging key: the key itself or, if keys
+// are redacted, a hash that still tells records about the same key apart.
+func logKey(key string) slog.Attr {
+	if redactKeys {
+		sum := sha256.Sum256([]byte(key))
+		return slog.String("key_hash", hex.EncodeToString(sum[:8]))
+	}
+	return slog.String("key", key)
+}
+
+// requestIDHeader carries the ID of a request, which clients may set and
+// forwarded requests keep.
+const requestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// requestID returns id if it is a usable request ID, or a new one.
+func requestID(id string) string {
+	if id != "" && len(id) <= 128 {
+		usable := true
+		for _, c := range id {
+			if c < '!' || c > '~' {
+				usable = false
+				break
+			}
+		}
+		if usable {
+			return id
+		}
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestID returns ctx carrying id, also recorded on the span of ctx.
+func withRequestID(ctx context.Context, id string) context.Context {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("kvs.request_id", id))
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// logged wraps h, which is r with its middleware, to give every request an
+// ID and log it once handled. Health checks and scrapes log at debug level.
+func logged(r *mux.Router, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		id := requestID(req.Header.Get(requestIDHeader))
+		req.Header.Set(requestIDHeader, id) // Passed on when forwarded.
+		w.Header().Set(requestIDHeader, id)
+		ctx := withRequestID(req.Context(), id)
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, req.WithContext(ctx))
+
+		route, vars := matchRoute(r, req)
+		attrs := []any{"method", req.Method, "route", route, "status", sw.status,
+			"duration", time.Since(start), "remote", req.RemoteAddr}
+		if key, ok := vars["key"]; ok {
+			attrs = append(attrs, logKey(key))
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case sw.status >= http.StatusInternalServerError:
+			level = slog.LevelError
+		case route == "/healthz" || route == metricsPath:
+			level = slog.LevelDebug
+		}
+		slogger.Log(ctx, level, "request", attrs...)
+	})
+}
+
+// grpcRequestID returns the request ID the client sent in the
+// "x-request-id" metadata, or a new one.
+func grpcRequestID(ctx context.Context) string {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(requestIDHeader); len(v) > 0 {
+			id = v[0]
+		}
+	}
+	return requestID(id)
+}
+
+// logCall logs a gRPC call once handled.
+func logCall(ctx context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+	level := slog.LevelInfo
+	if grpcServerError(code) {
+		level = slog.LevelError
+	}
+	slogger.Log(ctx, level, "call", "method", method, "code", code.String(),
+		"duration", time.Since(start))
+}
+
+// logUnaryInterceptor gives unary gRPC calls an ID and logs them.
+func logUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	start := time.Now()
+	id := grpcRequestID(ctx)
+	ctx = withRequestID(ctx, id)
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, id))
+	defer func() { logCall(ctx, info.FullMethod, start, err) }()
+
+	return handler(ctx, req)
+}
+
+// logStreamInterceptor gives streaming gRPC calls an ID and logs them.
+func logStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	start := time.Now()
+	id := grpcRequestID(ss.Context())
+	ctx := withRequestID(ss.Context(), id)
+	ss.SetHeader(metadata.Pairs(requestIDHeader, id))
+	defer func() { logCall(ctx, info.FullMethod, start, err) }()
+
+	return handler(srv, &contextStream{ss, ctx})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloud-native-go/kvs/logger"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsPath is where Prometheus scrapes the metrics.
+const metricsPath = "/metrics"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "kvs_http_requests_total",
+		Help: "HTTP requests handled, by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "kvs_http_request_duration_seconds",
+		Help:    "Time taken to handle HTTP requests, by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	replayDuration = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "kvs_transaction_log_replay_seconds",
+		Help: "Time taken to replay the transaction log into the store at startup.",
+	})
+
+	replayProgressRatio = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "kvs_transaction_log_replay_progress_ratio",
+		Help: "Share of the transaction log replayed at startup, from 0 to 1.",
+	})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "kvs_store_keys",
+		Help: "Keys in the store, including expired keys not yet reaped.",
+	}, func() float64 { return float64(store.Stats().Keys) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "kvs_store_bytes",
+		Help: "Bytes of keys and values in the store.",
+	}, func() float64 { return float64(store.Stats().Bytes) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "kvs_transaction_log_pending_events",
+		Help: "Writes queued for the transaction logger and not yet taken by its writer.",
+	}, func() float64 { return float64(loggerStats().Pending) })
+
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "kvs_transaction_log_write_errors_total",
+		Help: "Batches the transaction logger failed to persist.",
+	}, func() float64 { return float64(loggerStats().WriteErrors) })
+
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "kvs_transaction_log_last_sequence",
+		Help: "Sequence number of the last event persisted to the transaction log.",
+	}, func() float64 { return float64(loggerStats().LastSequence) })
+}
+
+// loggerStats returns the stats of the transaction logger, which followers
+// and nodes that are still starting do not have.
+func loggerStats() logger.Stats {
+	if transact == nil {
+		return logger.Stats{}
+	}
+	return transact.Stats()
+}
+
+// metricsHandler serves the metrics in the Prometheus text format.
+var metricsHandler = promhttp.Handler()
+
+// instrumented wraps h, which is r with its middleware, to count requests
+// and time them by route.
+func instrumented(r *mux.Router, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		route, _ := matchRoute(r, req)
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, req)
+
+		httpRequests.WithLabelValues(req.Method, route, strconv.Itoa(sw.status)).Inc()
+		httpDuration.WithLabelValues(req.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// matchRoute returns the path template of the route req matches, such as
+// "/v1/{key}", which keeps the number of label values bounded, and the
+// variables of the path.
+func matchRoute(r *mux.Router, req *http.Request) (string, map[string]string) {
+	var m mux.RouteMatch
+	if !r.Match(req, &m) || m.Route == nil {
+		return "unmatched", nil
+	}
+
+	t, err := m.Route.GetPathTemplate()
+	if err != nil {
+		return "unmatched", nil
+	}
+	return t, m.Vars
+}
+
+// statusWriter records the status code of a response. It flushes like the
+// writer it wraps, which watch streams rely on.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
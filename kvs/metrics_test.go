@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cloud-native-go/kvs/logger"
+	"github.com/gorilla/mux"
+)
+
+// scrape returns the value of every series the metrics handler serves,
+// keyed by its name and labels as they appear in the text format.
+func scrape(t *testing.T) map[string]float64 {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	metricsHandler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, metricsPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET %s: %d %s", metricsPath, w.Code, w.Body)
+	}
+
+	series := make(map[string]float64)
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("series %q: %v", line, err)
+		}
+		series[line[:i]] = v
+	}
+	return series
+}
+
+// statsLog reports fixed stats.
+type statsLog struct {
+	logger.TransactionLogger
+	stats logger.Stats
+}
+
+func (l statsLog) Stats() logger.Stats { return l.stats }
+
+func TestMetrics(t *testing.T) {
+	useFileLog(t)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/v1/{key}", keyValuePutHandler).Methods("PUT")
+	r.HandleFunc("/v1/{key}", keyValueGetHandler).Methods("GET")
+	h := instrumented(r, r)
+	request := func(method, path, body string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, path, strings.NewReader(body)))
+	}
+
+	before := scrape(t)
+	request(http.MethodPut, "/v1/key", "value")
+	request(http.MethodGet, "/v1/key", "")
+	request(http.MethodGet, "/v1/missing", "")
+	request(http.MethodGet, "/nowhere", "")
+	transact = statsLog{transact, logger.Stats{Pending: 3, WriteErrors: 2, LastSequence: 7}}
+	after := scrape(t)
+
+	// Counters are shared with other tests, so compare their increase.
+	counters := map[string]float64{
+		`kvs_http_requests_total{method="PUT",route="/v1/{key}",status="201"}`:    1,
+		`kvs_http_requests_total{method="GET",route="/v1/{key}",status="200"}`:    1,
+		`kvs_http_requests_total{method="GET",route="/v1/{key}",status="404"}`:    1,
+		`kvs_http_requests_total{method="GET",route="unmatched",status="404"}`:    1,
+		`kvs_http_request_duration_seconds_count{method="GET",route="/v1/{key}"}`: 2,
+		`kvs_http_request_duration_seconds_count{method="PUT",route="/v1/{key}"}`: 1,
+	}
+	for s, want := range counters {
+		if got := after[s] - before[s]; got != want {
+			t.Errorf("%s increased by %v, want %v", s, got, want)
+		}
+	}
+
+	gauges := map[string]float64{
+		"kvs_store_keys":                         1,
+		"kvs_store_bytes":                        float64(len("key") + len("value")),
+		"kvs_transaction_log_pending_events":     3,
+		"kvs_transaction_log_write_errors_total": 2,
+		"kvs_transaction_log_last_sequence":      7,
+	}
+	for s, want := range gauges {
+		if got, ok := after[s]; !ok || got != want {
+			t.Errorf("%s = %v (served %v), want %v", s, got, ok, want)
+		}
+	}
+
+	for _, s := range []string{"kvs_transaction_log_replay_seconds", "kvs_transaction_log_replay_progress_ratio"} {
+		if _, ok := after[s]; !ok {
+			t.Errorf("%s not served", s)
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/partition"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// rebalanceInterval is how often a node retries moving the keys it no
+	// longer owns, in case an earlier transfer failed.
+	rebalanceInterval = time.Minute
+
+	// transferChunk is how many keys one transfer request carries.
+	transferChunk = 1000
+
+	// tombstoneTTL is how long after a ring change a node remembers the
+	// keys it deleted, so that transfers still arriving from their previous
+	// owner do not bring them back.
+	tombstoneTTL = 10 * rebalanceInterval
+)
+
+// partitions holds the consistent hash ring of partitioned mode, enabled
+// when the ring is set. self is the base URL this node has on the ring.
+var partitions = struct {
+	sync.RWMutex
+	ring   *partition.Ring
+	self   string
+	vnodes int
+	// changed wakes up the rebalancer when the ring changes.
+	changed chan struct{}
+	forward *partition.Forwarder
+
+	// changedAt is when the ring last changed, and watermark the highest
+	// version this node held then: entries at a higher version were written
+	// since, and transfers must not overwrite them.
+	changedAt time.Time
+	watermark uint64
+	// tombstones holds the keys deleted within tombstoneTTL of a ring
+	// change.
+	tombstones map[string]bool
+}{changed: make(chan struct{}, 1)}
+
+// startPartitions places this node on a ring of nodes and starts moving
+// away the keys it does not own.
+func startPartitions(self string, nodes []string, vnodes int) {
+	watermark := highestVersion()
+	partitions.Lock()
+	partitions.self, partitions.vnodes = self, vnodes
+	partitions.ring = partition.NewRing(vnodes, nodes)
+	markRingChange(watermark)
+	partitions.forward = partition.NewForwarder(partition.ForwarderParams{
+		Client: peerClient, Logger: slogger})
+	partitions.Unlock()
+
+	if !partitions.ring.Contains(self) {
+		slogger.Warn("partitioned mode: this node is not on the ring and owns no keys", "self", self)
+	}
+
+	go rebalancePeriodically(context.Background())
+}
+
+// currentRing returns the ring and this node's place on it, or a nil ring
+// outside partitioned mode.
+func currentRing() (*partition.Ring, string) {
+	partitions.RLock()
+	defer partitions.RUnlock()
+	return partitions.ring, partitions.self
+}
+
+// setRing replaces the ring and wakes up the rebalancer.
+func setRing(nodes []string) *partition.Ring {
+	watermark := highestVersion()
+	partitions.Lock()
+	partitions.ring = partition.NewRing(partitions.vnodes, nodes)
+	markRingChange(watermark)
+	r := partitions.ring
+	partitions.Unlock()
+
+	select {
+	case partitions.changed <- struct{}{}:
+	default:
+	}
+	return r
+}
+
+// highestVersion returns the highest version of the entries of the store.
+func highestVersion() uint64 {
+	var highest uint64
+	for _, e := range store.Snapshot() {
+		if e.Version > highest {
+			highest = e.Version
+		}
+	}
+	return highest
+}
+
+// markRingChange records that the ring changed while the store held
+// entries up to version watermark. partitions must be locked.
+func markRingChange(watermark uint64) {
+	partitions.changedAt, partitions.watermark = time.Now(), watermark
+}
+
+// recordDelete remembers that key was deleted, if the ring changed
+// recently enough for a transfer of key to be under way. The key must be
+// locked with lockKeys.
+func recordDelete(key string) {
+	partitions.Lock()
+	defer partitions.Unlock()
+
+	if partitions.ring == nil || time.Since(partitions.changedAt) > tombstoneTTL {
+		return
+	}
+	if partitions.tombstones == nil {
+		partitions.tombstones = make(map[string]bool)
+	}
+	partitions.tombstones[key] = true
+}
+
+// pruneTombstones forgets the deleted keys once tombstoneTTL has passed
+// since the last ring change.
+func pruneTombstones() {
+	partitions.Lock()
+	defer partitions.Unlock()
+
+	if time.Since(partitions.changedAt) > tombstoneTTL {
+		partitions.tombstones = nil
+	}
+}
+
+// changedSinceRing reports whether key, whose entry is local or nil, was
+// written or deleted here since the ring changed. The key must be locked
+// with lockKeys.
+func changedSinceRing(key string, local *api.Entry) bool {
+	partitions.RLock()
+	defer partitions.RUnlock()
+
+	if partitions.tombstones[key] {
+		return true
+	}
+	return local != nil && local.Version > partitions.watermark
+}
+
+// partitioned wraps a handler of "/v1/{key}" so that requests for keys
+// owned by another node are forwarded there, with retries and a circuit
+// breaker per node. Requests another node forwarded are served locally, so
+// that nodes briefly disagreeing on the ring cannot forward in circles.
+func partitioned(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ring, self := currentRing()
+		if ring == nil || r.Header.Get(partition.ForwardedHeader) != "" {
+			h(w, r)
+			return
+		}
+
+		owner := ring.Owner(mux.Vars(r)["key"])
+		if owner == "" || owner == self {
+			h(w, r)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, int64(api.MaxValueSize))
+		if err := partitions.forward.Forward(w, r, owner); err != nil {
+			writeError(w, r, err)
+		}
+	}
+}
+
+// partitionedBatch is like partitioned for batches, which can only be
+// atomic if a single node owns all of their keys.
+func partitionedBatch(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ring, self := currentRing()
+		if ring == nil || r.Header.Get(partition.ForwardedHeader) != "" {
+			h(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+		r.Body.Close()
+
+		if err != nil {
+			writeError(w, r, batchBodyError(err))
+			return
+		}
+
+		var req batchRequest
+		json.Unmarshal(body, &req) // The handler reports malformed batches.
+
+		owner := self
+		for i, op := range req.Operations {
+			o := ring.Owner(op.Key)
+			if i == 0 {
+				owner = o
+			} else if o != owner {
+				writeError(w, r, api.Errorf(api.CodeInvalidRequest,
+					"batch spans keys owned by different nodes"))
+				return
+			}
+		}
+
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if owner == "" || owner == self {
+			h(w, r)
+			return
+		}
+
+		if err := partitions.forward.Forward(w, r, owner); err != nil {
+			writeError(w, r, err)
+		}
+	}
+}
+
+// ringMembership is the body of ringGetHandler and ringPutHandler.
+type ringMembership struct {
+	Nodes []string `json:"nodes"`
+}
+
+// ringGetHandler expects to be called with a GET request for "/v1/_ring"
+// and returns the nodes of the ring.
+func ringGetHandler(w http.ResponseWriter, r *http.Request) {
+	ring, _ := currentRing()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ringMembership{Nodes: ring.Nodes()})
+}
+
+// ringPutHandler expects to be called with a PUT request for "/v1/_ring"
+// whose JSON body lists the nodes of the new ring. The node passes the
+// ring on to every node of the old and new ring, then each moves the keys
+// it no longer owns to their new owner. Keys are unavailable on their new
+// owner until they have been moved.
+func ringPutHandler(w http.ResponseWriter, r *http.Request) {
+	var m ringMembership
+	err := json.NewDecoder(r.Body).Decode(&m)
+	defer r.Body.Close()
+
+	if err != nil || len(m.Nodes) == 0 {
+		writeError(w, r, api.Errorf(api.CodeInvalidRequest, "ring needs at least one node"))
+		return
+	}
+
+	old, self := currentRing()
+	ring := setRing(m.Nodes)
+
+	if r.Header.Get(partition.ForwardedHeader) == "" {
+		body, _ := json.Marshal(ringMembership{Nodes: ring.Nodes()})
+		header := http.Header{"Content-Type": {"application/json"}}
+
+		var failed []string
+		for _, n := range union(old.Nodes(), ring.Nodes()) {
+			if n == self {
+				continue
+			}
+
+			resp, err := partitions.forward.Do(r.Context(), n, http.MethodPut, "/v1/_ring", header, body)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					err = errors.New(resp.Status)
+				}
+			}
+			if err != nil {
+				slogger.ErrorContext(r.Context(), "cannot pass ring on", "node", n, "error", err)
+				failed = append(failed, n)
+			}
+		}
+
+		if len(failed) > 0 {
+			writeError(w, r, api.Errorf(api.CodeBadGateway,
+				"ring not passed on to %s", strings.Join(failed, ", ")))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ringMembership{Nodes: ring.Nodes()})
+}
+
+// acceptTransfer stores a key moved here from its previous owner, unless
+// the key was written or deleted here since the ring changed, which makes
+// the moved value stale. A copy held from before the ring change is
+// overwritten.
+func acceptTransfer(ctx context.Context, key string, e api.Entry) error {
+	unlock := lockKeys(key)
+	defer unlock()
+	prior := lookupPrior(key)
+
+	local := prior[key]
+	if changedSinceRing(key, local) {
+		return nil
+	}
+	expected := api.NoVersion
+	if local != nil {
+		expected = local.Version
+	}
+
+	version, err := store.CompareAndSwap(key, expected, e.Value, e.Expiry)
+	if err == api.ErrorVersionMismatch {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = transact.WritePut(ctx, key, e.Value, e.Expiry, version); err != nil {
+		prior.undo(err)
+		return err
+	}
+	return nil
+}
+
+// rebalancePeriodically moves away the keys this node does not own
+// whenever the ring changes, and every rebalanceInterval.
+func rebalancePeriodically(ctx context.Context) {
+	ticker := time.NewTicker(rebalanceInterval)
+	defer ticker.Stop()
+
+	for {
+		rebalance(ctx)
+
+		select {
+		case <-partitions.changed:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// rebalance streams every key owned by another node to that node, then
+// deletes it here unless it was written in the meantime.
+func rebalance(ctx context.Context) {
+	pruneTombstones()
+	ring, self := currentRing()
+
+	moving := make(map[string][]api.KeyValue)
+	for k, e := range store.Snapshot() {
+		if owner := ring.Owner(k); owner != "" && owner != self {
+			moving[owner] = append(moving[owner], api.KeyValue{Key: k, Entry: e})
+		}
+	}
+
+	for owner, kvs := range moving {
+		for len(kvs) > 0 {
+			n := len(kvs)
+			if n > transferChunk {
+				n = transferChunk
+			}
+			chunk := kvs[:n]
+			kvs = kvs[n:]
+
+			if err := partitions.forward.Transfer(ctx, owner, chunk); err != nil {
+				slogger.Warn("rebalancing failed; retrying",
+					"node", owner, "keys", len(chunk), "delay", rebalanceInterval, "error", err)
+				break
+			}
+
+			for _, kv := range chunk {
+				dropMoved(ctx, kv)
+			}
+		}
+	}
+}
+
+// dropMoved deletes a key moved to its new owner, unless it was written
+// since it was read.
+func dropMoved(ctx context.Context, kv api.KeyValue) {
+	unlock := lockKeys(kv.Key)
+	defer unlock()
+	prior := lookupPrior(kv.Key)
+
+	version, err := store.CompareAndDelete(kv.Key, kv.Version)
+	if err != nil {
+		return
+	}
+	if err = transact.WriteDelete(ctx, kv.Key, version); err != nil {
+		prior.undo(err)
+		slogger.Error("rebalancing: cannot log delete", logKey(kv.Key), "error", err)
+	}
+}
+
+// union returns the distinct strings of a and b.
+func union(a, b []string) []string {
+	seen := make(map[string]bool)
+	var u []string
+	for _, s := range append(a, b...) {
+		if !seen[s] {
+			seen[s] = true
+			u = append(u, s)
+		}
+	}
+	return u
+}
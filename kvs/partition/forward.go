@@ -0,0 +1,237 @@
+package partition
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloud-native-go/circuit"
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/retry"
+)
+
+// ForwardedHeader marks a request forwarded by another node, which the
+// receiver serves itself rather than forwarding it again.
+const ForwardedHeader = "X-Kvs-Forwarded"
+
+// ForwarderParams configures a Forwarder. Zero values select the defaults.
+type ForwarderParams struct {
+	// Retries is how often a failed idempotent request is retried, Delay
+	// how long to wait in between.
+	Retries int
+	Delay   time.Duration
+	// FailureThreshold is how many consecutive failures open the circuit
+	// to a node, which then fails fast with circuit.ErrOpen.
+	FailureThreshold uint64
+	// Client sends the requests; http.DefaultClient if nil.
+	Client *http.Client
+	// Logger receives failed attempts and circuits opening and closing;
+	// slog.Default() if nil.
+	Logger *slog.Logger
+}
+
+const (
+	defaultRetries          = 2
+	defaultRetryDelay       = 100 * time.Millisecond
+	defaultFailureThreshold = 5
+)
+
+// Forwarder sends requests to other nodes. Each node gets its own circuit
+// breaker, so one failing node does not slow down requests to the others.
+type Forwarder struct {
+	params ForwarderParams
+
+	mu    sync.Mutex
+	peers map[string]*peer
+}
+
+// peer sends calls to a node through its circuit breaker, with or without
+// retries.
+type peer struct {
+	once     circuit.Circuit
+	retrying retry.Effector
+}
+
+// NewForwarder returns a Forwarder configured by params.
+func NewForwarder(params ForwarderParams) *Forwarder {
+	if params.Retries <= 0 {
+		params.Retries = defaultRetries
+	}
+	if params.Delay <= 0 {
+		params.Delay = defaultRetryDelay
+	}
+	if params.FailureThreshold == 0 {
+		params.FailureThreshold = defaultFailureThreshold
+	}
+	if params.Client == nil {
+		params.Client = http.DefaultClient
+	}
+	if params.Logger == nil {
+		params.Logger = slog.Default()
+	}
+
+	return &Forwarder{params: params, peers: make(map[string]*peer)}
+}
+
+// call is a request in flight, passed to the effector of a node through the
+// context, as Retry and Breaker only pass on a context. resp is the
+// response to the last attempt, if the node answered it.
+type call struct {
+	method string
+	url    string
+	header http.Header
+	body   []byte
+	resp   *http.Response
+}
+
+// idempotent reports whether a request can be sent again after an attempt
+// that may have reached the node. Conditional writes cannot: a retry
+// of one that succeeded would fail on the version it changed.
+func idempotent(method string, header http.Header) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPut, http.MethodDelete:
+		return header.Get("If-Match") == "" && header.Get("If-None-Match") == ""
+	}
+	return false
+}
+
+type callKey struct{}
+
+// peer returns the circuit breaker of node, on its own and wrapped in
+// retries that give up once the circuit opens.
+func (f *Forwarder) peer(node string) *peer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	p, ok := f.peers[node]
+	if !ok {
+		logger := f.params.Logger.With("node", node)
+		breaker := circuit.Breaker(f.send, f.params.FailureThreshold, logger)
+		failFast := func(ctx context.Context) (string, error) {
+			response, err := breaker(ctx)
+			if errors.Is(err, circuit.ErrOpen) {
+				err = retry.Permanent(err)
+			}
+			return response, err
+		}
+		p = &peer{once: breaker,
+			retrying: retry.Retry(failFast, f.params.Retries, f.params.Delay, logger)}
+		f.peers[node] = p
+	}
+	return p
+}
+
+// send performs the call in ctx. Transport errors and gateway errors count
+// as failures of the node; any other response is passed on. The body of a
+// gateway error is kept, to be passed on if no retry succeeds.
+func (f *Forwarder) send(ctx context.Context) (string, error) {
+	c := ctx.Value(callKey{}).(*call)
+	c.resp = nil
+
+	req, err := http.NewRequestWithContext(ctx, c.method, c.url, bytes.NewReader(c.body))
+	if err != nil {
+		return "", err
+	}
+	req.Header = c.header.Clone()
+	req.Header.Set(ForwardedHeader, "1")
+
+	resp, err := f.params.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return "", err
+		}
+
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		c.resp = resp
+		return "", fmt.Errorf("%s answered %s", c.url, resp.Status)
+	}
+
+	c.resp = resp
+	return resp.Status, nil
+}
+
+// Do sends a request with body to node, the node's base URL, retrying
+// idempotent requests while the node fails. If the node answered the last
+// attempt, even with a gateway error, Do returns its response; otherwise
+// it returns an error, circuit.ErrOpen without trying if the node failed
+// too often lately. The caller closes the response body.
+func (f *Forwarder) Do(ctx context.Context, node, method, uri string, header http.Header, body []byte) (*http.Response, error) {
+	return f.do(ctx, node, method, uri, header, body, idempotent(method, header))
+}
+
+// do is Do, retrying if retries is set.
+func (f *Forwarder) do(ctx context.Context, node, method, uri string, header http.Header, body []byte, retries bool) (*http.Response, error) {
+	c := &call{method: method, url: strings.TrimSuffix(node, "/") + uri,
+		header: header, body: body}
+	if c.header == nil {
+		c.header = make(http.Header)
+	}
+
+	send := retry.Effector(f.peer(node).once)
+	if retries {
+		send = f.peer(node).retrying
+	}
+
+	_, err := send(context.WithValue(ctx, callKey{}, c))
+	if err != nil && c.resp == nil {
+		return nil, err
+	}
+	return c.resp, nil
+}
+
+// Forward sends r to node and copies the response to w. If the node does
+// not answer, it writes nothing and returns an api.Error for the caller to
+// answer with: CodeUnavailable if the circuit to the node is open,
+// CodeGatewayTimeout if r timed out and CodeBadGateway otherwise. A body
+// r.Body limits with http.MaxBytesReader and exceeds is reported with
+// CodeRequestTooLarge.
+func (f *Forwarder) Forward(w http.ResponseWriter, r *http.Request, node string) error {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return api.Errorf(api.CodeRequestTooLarge, "request body is larger than %d bytes", tooLarge.Limit)
+	}
+	if err != nil {
+		return api.Errorf(api.CodeInvalidRequest, "cannot read request body: %v", err)
+	}
+
+	resp, err := f.Do(r.Context(), node, r.Method, r.URL.RequestURI(), r.Header, body)
+
+	if err != nil {
+		code := api.CodeBadGateway
+		switch {
+		case errors.Is(err, circuit.ErrOpen):
+			code = api.CodeUnavailable
+		case errors.Is(err, context.DeadlineExceeded):
+			code = api.CodeGatewayTimeout
+		}
+		return api.Errorf(code, "cannot forward to %s: %w", node, err)
+	}
+	defer resp.Body.Close()
+
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return nil
+}
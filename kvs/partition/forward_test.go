@@ -0,0 +1,161 @@
+package partition
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cloud-native-go/circuit"
+	"github.com/cloud-native-go/kvs/api"
+)
+
+const unavailable = `{"error":{"code":"unavailable","message":"write not persisted"}}`
+
+// newOwner starts a node answering every request with status and counts
+// the requests.
+func newOwner(t *testing.T, status int) (*httptest.Server, *int32) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get(ForwardedHeader) == "" {
+			t.Errorf("%s %s not marked as forwarded", r.Method, r.URL)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(unavailable))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func newTestForwarder(threshold uint64) *Forwarder {
+	return NewForwarder(ForwarderParams{Retries: 2, Delay: time.Millisecond,
+		FailureThreshold: threshold,
+		Logger:           slog.New(slog.NewTextHandler(ioutil.Discard, nil))})
+}
+
+func TestForwardRetriesIdempotentRequests(t *testing.T) {
+	tests := []struct {
+		method   string
+		header   string // A conditional header set, if any.
+		attempts int32
+	}{
+		{http.MethodGet, "", 3},
+		{http.MethodGet, "If-None-Match", 3},
+		{http.MethodPut, "", 3},
+		{http.MethodDelete, "", 3},
+		{http.MethodPut, "If-Match", 1},
+		{http.MethodPut, "If-None-Match", 1},
+		{http.MethodDelete, "If-Match", 1},
+		{http.MethodPost, "", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.header, func(t *testing.T) {
+			owner, requests := newOwner(t, http.StatusServiceUnavailable)
+			f := newTestForwarder(100)
+
+			r := httptest.NewRequest(tt.method, "/v1/key", strings.NewReader("value"))
+			if tt.header != "" {
+				r.Header.Set(tt.header, `"1"`)
+			}
+			w := httptest.NewRecorder()
+			if err := f.Forward(w, r, owner.URL); err != nil {
+				t.Fatal(err)
+			}
+
+			if n := atomic.LoadInt32(requests); n != tt.attempts {
+				t.Errorf("sent %d times, want %d", n, tt.attempts)
+			}
+			// The owner's answer is passed on rather than turned into a
+			// 502 Bad Gateway.
+			if w.Code != http.StatusServiceUnavailable || w.Body.String() != unavailable ||
+				w.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("answered %d %q %q, want the owner's answer",
+					w.Code, w.Header().Get("Content-Type"), w.Body)
+			}
+		})
+	}
+}
+
+func TestForwardPassesAnswersOn(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusConflict, http.StatusBadGateway, http.StatusGatewayTimeout} {
+		owner, requests := newOwner(t, status)
+		f := newTestForwarder(100)
+
+		w := httptest.NewRecorder()
+		if err := f.Forward(w, httptest.NewRequest(http.MethodGet, "/v1/key", nil), owner.URL); err != nil {
+			t.Fatal(err)
+		}
+
+		if w.Code != status || w.Body.String() != unavailable {
+			t.Errorf("owner answered %d, forwarded %d %q", status, w.Code, w.Body)
+		}
+		n := atomic.LoadInt32(requests)
+		if gateway := status >= http.StatusBadGateway; (n > 1) != gateway {
+			t.Errorf("owner answered %d, sent %d times", status, n)
+		}
+	}
+}
+
+func TestForwardFailsFastWhenOpen(t *testing.T) {
+	owner, _ := newOwner(t, http.StatusOK)
+	owner.Close() // Every attempt fails to connect.
+	f := newTestForwarder(1)
+
+	// Two failures in a row open the circuit, which ends the retries.
+	_, err := f.Do(context.Background(), owner.URL, http.MethodGet, "/v1/key", nil, nil)
+	if !errors.Is(err, circuit.ErrOpen) {
+		t.Fatalf("Do() = %v, want %v", err, circuit.ErrOpen)
+	}
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	err = f.Forward(w, httptest.NewRequest(http.MethodGet, "/v1/key", nil), owner.URL)
+	if api.Code(err) != api.CodeUnavailable {
+		t.Errorf("forwarded through an open circuit: %v, want it unavailable", err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("open circuit took %v to fail", d)
+	}
+}
+
+func TestForwardLimitsBody(t *testing.T) {
+	owner, requests := newOwner(t, http.StatusOK)
+	f := newTestForwarder(100)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/v1/key", strings.NewReader("too long"))
+	r.Body = http.MaxBytesReader(w, r.Body, 4)
+
+	if err := f.Forward(w, r, owner.URL); api.Code(err) != api.CodeRequestTooLarge {
+		t.Errorf("Forward() = %v, want it too large", err)
+	}
+	if n := atomic.LoadInt32(requests); n != 0 {
+		t.Errorf("sent %d times", n)
+	}
+}
+
+func TestTransferRetries(t *testing.T) {
+	var requests int32
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer owner.Close()
+
+	if err := newTestForwarder(100).Transfer(context.Background(), owner.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("sent %d times, want 2", n)
+	}
+}
@@ -0,0 +1,105 @@
+// Package partition spreads keys over several kvs nodes with a consistent
+// hash ring, forwards requests to the node owning a key and moves keys
+// when the ring changes.
+package partition
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is how many points each node gets on the ring unless
+// configured otherwise. More points spread keys more evenly.
+const DefaultVirtualNodes = 128
+
+// Ring assigns keys to nodes by consistent hashing: each node is placed on
+// a circle of hashes at several virtual points, and a key belongs to the
+// node of the first point at or after its hash. Adding or removing a node
+// only moves the keys between its points and their neighbours. A Ring is
+// immutable and safe for concurrent use.
+type Ring struct {
+	nodes  []string
+	points []uint64 // Sorted hashes of the virtual nodes.
+	owners map[uint64]string
+}
+
+// NewRing returns a ring of nodes, each placed at vnodes points.
+func NewRing(vnodes int, nodes []string) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+
+	r := &Ring{owners: make(map[uint64]string)}
+
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		if n == "" || seen[n] {
+			continue
+		}
+		seen[n] = true
+		r.nodes = append(r.nodes, n)
+
+		for i := 0; i < vnodes; i++ {
+			h := hash(n + "#" + strconv.Itoa(i))
+			// On the rare collision the lexically smaller node wins, so
+			// every node builds the same ring.
+			if owner, ok := r.owners[h]; ok && owner < n {
+				continue
+			} else if !ok {
+				r.points = append(r.points, h)
+			}
+			r.owners[h] = n
+		}
+	}
+
+	sort.Strings(r.nodes)
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Nodes returns the nodes of the ring in lexical order.
+func (r *Ring) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+// Owner returns the node that owns key, or an empty string if the ring is
+// empty.
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Contains reports whether node is on the ring.
+func (r *Ring) Contains(node string) bool {
+	for _, n := range r.nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// hash returns FNV-1a of s, finalized with the MurmurHash3 mixer so that
+// the points of a node, whose names differ only in their last digits, end
+// up spread over the whole ring.
+func hash(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+
+	h := f.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,88 @@
+package partition
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+)
+
+// TransferPath is where a node receives the keys it took over.
+const TransferPath = "/v1/_ring/transfer"
+
+// transferred is one line of a transfer body, which is newline-delimited
+// JSON.
+type transferred struct {
+	Key    string     `json:"key"`
+	Value  string     `json:"value"`
+	Expiry *time.Time `json:"expiry,omitempty"`
+}
+
+// Transfer sends entries to node, their new owner. Versions are not sent:
+// they are local to each node, so the new owner assigns its own. Failed
+// transfers are retried, as the new owner keeps the keys it already took.
+func (f *Forwarder) Transfer(ctx context.Context, node string, entries []api.KeyValue) error {
+	var body strings.Builder
+	enc := json.NewEncoder(&body)
+
+	for _, kv := range entries {
+		t := transferred{Key: kv.Key, Value: kv.Value}
+		if !kv.Expiry.IsZero() {
+			t.Expiry = &kv.Expiry
+		}
+		if err := enc.Encode(t); err != nil {
+			return err
+		}
+	}
+
+	header := http.Header{"Content-Type": {"application/x-ndjson"}}
+	resp, err := f.do(ctx, node, http.MethodPost, TransferPath, header, []byte(body.String()), true)
+	if err != nil {
+		return fmt.Errorf("cannot transfer keys to %s: %w", node, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("cannot transfer keys to %s: %s: %s",
+			node, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// TransferHandler returns the handler for POST requests to TransferPath,
+// which passes every entry received to accept. It answers failures with
+// writeError: a malformed transfer with CodeInvalidRequest, an entry accept
+// fails with CodeUnavailable, so the sender retries.
+func TransferHandler(accept func(ctx context.Context, key string, e api.Entry) error,
+	writeError func(http.ResponseWriter, *http.Request, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dec := json.NewDecoder(r.Body)
+		defer r.Body.Close()
+
+		for dec.More() {
+			var t transferred
+			if err := dec.Decode(&t); err != nil {
+				writeError(w, r, api.Errorf(api.CodeInvalidRequest, "malformed transfer: %v", err))
+				return
+			}
+
+			e := api.Entry{Value: t.Value}
+			if t.Expiry != nil {
+				e.Expiry = *t.Expiry
+			}
+
+			if err := accept(r.Context(), t.Key, e); err != nil {
+				writeError(w, r, api.Errorf(api.CodeUnavailable, "cannot accept %q: %w", t.Key, err))
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+)
+
+// usePartitions enables partitioned mode with a ring of nodes, without
+// starting the rebalancer.
+func usePartitions(t *testing.T, self string, nodes ...string) {
+	old := partitions.ring
+	partitions.self, partitions.vnodes = self, 16
+	t.Cleanup(func() {
+		partitions.Lock()
+		partitions.ring, partitions.tombstones = old, nil
+		partitions.Unlock()
+	})
+	setRing(nodes)
+}
+
+func TestAcceptTransfer(t *testing.T) {
+	ctx := context.Background()
+	put := func(t *testing.T) {
+		if _, err := putKey(ctx, "k", "written here", time.Time{}, 0, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		before func(t *testing.T) // Before the ring change.
+		after  func(t *testing.T) // After the ring change.
+		want   string             // The value kept, if any.
+	}{
+		{"new key", nil, nil, "moved"},
+		{"copy from before the ring change", put, nil, "moved"},
+		{"written since", nil, put, "written here"},
+		{"overwritten since", put, put, "written here"},
+		{"deleted since", put, func(t *testing.T) {
+			if _, err := deleteKey(ctx, "k", 0, false); err != nil {
+				t.Fatal(err)
+			}
+		}, ""},
+		{"written and deleted since", nil, func(t *testing.T) {
+			put(t)
+			if _, err := applyBatch(ctx, []api.Op{{Type: api.OpDelete, Key: "k"}}); err != nil {
+				t.Fatal(err)
+			}
+		}, ""},
+		{"deleted long before the transfer", put, func(t *testing.T) {
+			deleteKey(ctx, "k", 0, false)
+			partitions.Lock()
+			partitions.changedAt = partitions.changedAt.Add(-tombstoneTTL - time.Second)
+			partitions.Unlock()
+			pruneTombstones()
+		}, "moved"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := useFileLog(t)
+			if tt.before != nil {
+				tt.before(t)
+			}
+			usePartitions(t, "http://b", "http://a", "http://b")
+			if tt.after != nil {
+				tt.after(t)
+			}
+
+			if err := acceptTransfer(ctx, "k", api.Entry{Value: "moved"}); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := store.Get("k")
+			if tt.want == "" && err != api.ErrorNoSuchKey {
+				t.Errorf("deleted key brought back as %q, %v", got, err)
+			}
+			if tt.want != "" && got != tt.want {
+				t.Errorf("holds %q, %v, want %q", got, err, tt.want)
+			}
+
+			// The log agrees with the store.
+			if v, _ := replayInto(t, path).Get("k"); v != got {
+				t.Errorf("log holds %q, store %q", v, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/logger"
+)
+
+// replayProgressInterval is how often replay logs how far it got.
+const replayProgressInterval = 5 * time.Second
+
+// errReplaying is why writes are refused while the service serves reads
+// from a snapshot and replays the events logged after it.
+var errReplaying = errors.New("replaying transaction log")
+
+// replayTransactionLog replays the whole transaction log into the store
+// and starts it.
+func replayTransactionLog() error {
+	start := time.Now()
+	p := newReplayProgress(replayTarget())
+
+	events, errors := transact.ReadEvents()
+	sequence, err := replay(events, errors, p, false)
+	replayDuration.Set(time.Since(start).Seconds())
+	if err == nil {
+		p.done()
+	}
+
+	// Watchers can resume from the last replayed event on.
+	feed = api.NewFeed(watchHistory, sequence)
+
+	startTransactionLog()
+	return err
+}
+
+// replayFromSnapshot restores the snapshot of r into the store and replays
+// the events logged after it in the background. Meanwhile the service
+// serves reads from the snapshot and refuses writes.
+func replayFromSnapshot(r logger.Replayer) error {
+	start := time.Now()
+
+	sequence, err := r.ReadSnapshot(restoreEvent)
+	if err != nil {
+		return fmt.Errorf("cannot restore snapshot: %w", err)
+	}
+	slogger.Info("transaction log snapshot restored", "sequence", sequence,
+		"duration", time.Since(start))
+
+	// Replayed events are published, so watchers starting from the
+	// snapshot see them.
+	feed = api.NewFeed(watchHistory, sequence)
+	setReplaying(true)
+
+	go func() {
+		p := newReplayProgress(replayTarget())
+
+		events, errors := r.ReadEventsAfter(sequence)
+		_, err := replay(events, errors, p, true)
+		replayDuration.Set(time.Since(start).Seconds())
+		if err != nil {
+			fatal("cannot replay transaction log", err)
+		}
+		p.done()
+
+		startTransactionLog()
+		setReplaying(false)
+	}()
+	return nil
+}
+
+// startTransactionLog starts persisting writes to the transaction log,
+// watching it for failures and compacting it.
+func startTransactionLog() {
+	transact.Run()
+
+	go monitorTransactionLog(transact)
+
+	if c, ok := transact.(logger.Compactor); ok {
+		go compactPeriodically(c, compactionInterval)
+	}
+}
+
+// replay restores events into the store until errors reports a failure or
+// both are closed, and returns the last sequence number replayed. The
+// events of a batch are restored together, so readers of a store serving
+// during replay never see part of one. With publish, the events also go to
+// watchers.
+func replay(events <-chan logger.Event, errors <-chan error, p *replayProgress, publish bool) (uint64, error) {
+	ok, e := true, logger.Event{}
+	var sequence uint64
+	var batch []logger.Event
+	var err error
+
+	for ok && err == nil {
+
+		select {
+		case err, ok = <-errors:
+		case e, ok = <-events:
+			if !ok {
+				break
+			}
+
+			if e.Sequence > sequence {
+				sequence = e.Sequence
+			}
+			p.event(e)
+
+			batch = append(batch, e)
+			if e.Remaining > 0 {
+				continue // More events of the batch follow.
+			}
+
+			if err = restoreEvents(batch); err == nil && publish {
+				publishChanges(batch)
+			}
+			batch = nil
+		}
+	}
+
+	// A log ending within a batch holds no more of it.
+	if err == nil && len(batch) > 0 {
+		if err = restoreEvents(batch); err == nil && publish {
+			publishChanges(batch)
+		}
+	}
+
+	return sequence, err
+}
+
+// restoreEvents applies the replayed events of a batch to the store
+// atomically.
+func restoreEvents(events []logger.Event) error {
+	if len(events) == 1 {
+		return restoreEvent(events[0])
+	}
+
+	ops := make([]api.Op, len(events))
+	for i, e := range events {
+		ops[i] = api.Op{Type: api.OpPut, Key: e.Key, Value: e.Value,
+			Expiry: e.Expiry, Version: e.Version}
+		if e.EventType == logger.EventDelete {
+			ops[i].Type = api.OpDelete
+		}
+	}
+	return store.RestoreBatch(ops)
+}
+
+// restoreEvent applies a replayed event to the store.
+func restoreEvent(e logger.Event) error {
+	switch e.EventType {
+	case logger.EventDelete:
+		return store.RestoreDelete(e.Key, e.Version)
+	case logger.EventPut:
+		// Keys that expired while the service was down are
+		// deleted rather than resurrected.
+		return store.Restore(e.Key, api.Entry{
+			Value: e.Value, Expiry: e.Expiry, Version: e.Version})
+	}
+	return nil
+}
+
+// replayTarget returns the sequence number replay will end at, or zero if
+// the transaction logger cannot tell in advance.
+func replayTarget() uint64 {
+	r, ok := transact.(logger.Replayer)
+	if !ok {
+		return 0
+	}
+
+	target, err := r.LastSequence()
+	if err != nil {
+		slogger.Warn("cannot tell how far replay goes", "error", err)
+		return 0
+	}
+	return target
+}
+
+// replayProgress logs how many events replay restored, how fast and, if
+// the sequence number it ends at is known, how far it got.
+type replayProgress struct {
+	start, logged time.Time
+	events        uint64
+	first, last   uint64 // The sequence numbers of the first and last event.
+	target        uint64 // Where replay ends; zero if unknown.
+}
+
+func newReplayProgress(target uint64) *replayProgress {
+	now := time.Now()
+	replayProgressRatio.Set(0)
+	return &replayProgress{start: now, logged: now, target: target}
+}
+
+// event notes that e was replayed.
+func (p *replayProgress) event(e logger.Event) {
+	if p.events == 0 {
+		p.first = e.Sequence
+	}
+	p.events++
+	p.last = e.Sequence
+
+	if p.events%1024 == 0 && time.Since(p.logged) >= replayProgressInterval {
+		p.logged = time.Now()
+		slogger.Info("replaying transaction log", p.attrs()...)
+	}
+}
+
+// done logs that replay completed.
+func (p *replayProgress) done() {
+	attrs := p.attrs()
+	replayProgressRatio.Set(1)
+	slogger.Info("transaction log replayed", attrs...)
+}
+
+func (p *replayProgress) attrs() []any {
+	elapsed := time.Since(p.start)
+	attrs := []any{"events", p.events, "sequence", p.last, "duration", elapsed,
+		"events_per_second", int(float64(p.events) / elapsed.Seconds())}
+
+	if p.target > 0 && p.events > 0 {
+		ratio := 1.0
+		if p.target > p.last {
+			ratio = float64(p.last-p.first+1) / float64(p.target-p.first+1)
+		}
+		replayProgressRatio.Set(ratio)
+		attrs = append(attrs, "target", p.target, "percent", int(ratio*100))
+	}
+	return attrs
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/logger"
+)
+
+// restoreCounter records how many events each restore of the store
+// applied.
+type restoreCounter struct {
+	api.Store
+	restores []int
+}
+
+func (s *restoreCounter) Restore(key string, e api.Entry) error {
+	s.restores = append(s.restores, 1)
+	return s.Store.Restore(key, e)
+}
+
+func (s *restoreCounter) RestoreDelete(key string, version uint64) error {
+	s.restores = append(s.restores, 1)
+	return s.Store.RestoreDelete(key, version)
+}
+
+func (s *restoreCounter) RestoreBatch(ops []api.Op) error {
+	s.restores = append(s.restores, len(ops))
+	return s.Store.RestoreBatch(ops)
+}
+
+func TestReplayRestoresBatchesAtomically(t *testing.T) {
+	ctx := context.Background()
+	path := useFileLog(t)
+
+	putKey(ctx, "a", "1", time.Time{}, 0, false)
+	_, err := applyBatch(ctx, []api.Op{
+		{Type: api.OpPut, Key: "a", Value: "2"},
+		{Type: api.OpDelete, Key: "b"},
+		{Type: api.OpPut, Key: "c", Value: "3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleteKey(ctx, "c", 0, false)
+	want := store.Snapshot()
+
+	tl, err := logger.NewFileTransactionLogger(path, logger.CommitParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close(context.Background())
+
+	counter := &restoreCounter{Store: api.NewShardedStore(storeShards)}
+	store = counter
+
+	events, errs := tl.ReadEvents()
+	if _, err := replay(events, errs, newReplayProgress(0), false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The batch is restored in one go, between the writes around it.
+	if want := []int{1, 3, 1}; !reflect.DeepEqual(counter.restores, want) {
+		t.Errorf("restored %v events at a time, want %v", counter.restores, want)
+	}
+	if got := store.Snapshot(); !reflect.DeepEqual(got, want) {
+		t.Errorf("replayed %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,224 @@
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+)
+
+const (
+	// minRetryDelay and maxRetryDelay bound the exponential back off between
+	// attempts to reconnect to the leader.
+	minRetryDelay = 100 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+)
+
+// FollowerParams configures a Follower.
+type FollowerParams struct {
+	// Leader is the base URL of the leader, e.g. "http://leader:8080".
+	Leader string
+	// Store receives the leader's changes. Nothing else should write to it.
+	Store api.Store
+	// Feed, if set, republishes the changes applied to Store to the
+	// follower's own watchers.
+	Feed *api.Feed
+	// Client makes the requests to the leader; http.DefaultClient if nil.
+	Client *http.Client
+	// Logger receives interruptions of the replication; slog.Default() if
+	// nil.
+	Logger *slog.Logger
+}
+
+// Follower applies the changes of a leader to a local store.
+type Follower struct {
+	params FollowerParams
+
+	mu sync.RWMutex
+	// synced is set once the follower holds the leader's state as of
+	// sequence, the sequence number of the last change applied.
+	synced   bool
+	sequence uint64
+	// resume is the sequence number to resume after: the one before
+	// sequence, as a batch sharing sequence may have been cut short.
+	resume uint64
+}
+
+// NewFollower returns a Follower for the leader described by params. It
+// does nothing until Run is called.
+func NewFollower(params FollowerParams) *Follower {
+	if params.Client == nil {
+		params.Client = http.DefaultClient
+	}
+	if params.Logger == nil {
+		params.Logger = slog.Default()
+	}
+	params.Leader = strings.TrimSuffix(params.Leader, "/")
+
+	return &Follower{params: params}
+}
+
+// Sequence returns the sequence number of the last change applied and
+// whether the follower has synced with the leader at all.
+func (f *Follower) Sequence() (uint64, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.sequence, f.synced
+}
+
+// Run follows the leader until ctx is done, reconnecting with exponential
+// back off whenever the stream breaks.
+func (f *Follower) Run(ctx context.Context) {
+	delay := minRetryDelay
+
+	for {
+		connected, err := f.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			delay = minRetryDelay
+		}
+
+		f.params.Logger.Warn("replication interrupted; retrying",
+			"leader", f.params.Leader, "delay", delay, "error", err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// follow streams changes from the leader until the connection breaks. It
+// reports whether it connected at all.
+func (f *Follower) follow(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	u := f.params.Leader + Path
+	f.mu.RLock()
+	if f.synced {
+		u += "?" + url.Values{"after": {strconv.FormatUint(f.resume, 10)}}.Encode()
+	}
+	f.mu.RUnlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := f.params.Client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return false, fmt.Errorf("leader answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	// A leader that stops sending, heartbeats included, is gone.
+	watchdog := time.AfterFunc(followerTimeout, cancel)
+	defer watchdog.Stop()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var m message
+		if err := dec.Decode(&m); err != nil {
+			return true, err
+		}
+		watchdog.Reset(followerTimeout)
+
+		switch m.Type {
+		case messagePut, messageDelete:
+			err = f.apply(m.change())
+		case messageSnapshot:
+			err = f.installSnapshot(dec, m, watchdog)
+		case messageHeartbeat:
+		default:
+			err = fmt.Errorf("unknown message type %q", m.Type)
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+}
+
+// apply writes a change to the store with the version the leader gave it.
+func (f *Follower) apply(c api.Change) error {
+	var err error
+	if c.Type == api.OpDelete {
+		err = f.params.Store.RestoreDelete(c.Key, c.Version)
+	} else {
+		err = f.params.Store.Restore(c.Key, c.Entry)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot apply change %d: %w", c.Sequence, err)
+	}
+
+	f.mu.Lock()
+	if c.Sequence > f.sequence {
+		f.resume, f.sequence = f.sequence, c.Sequence
+	}
+	f.mu.Unlock()
+
+	if f.params.Feed != nil {
+		f.params.Feed.Publish([]api.Change{c})
+	}
+	return nil
+}
+
+// installSnapshot replaces the contents of the store with the entries
+// following the snapshot message m.
+func (f *Follower) installSnapshot(dec *json.Decoder, m message, watchdog *time.Timer) error {
+	keys := make(map[string]bool, m.Count)
+
+	for i := 0; i < m.Count; i++ {
+		var e message
+		if err := dec.Decode(&e); err != nil {
+			return fmt.Errorf("incomplete snapshot: %w", err)
+		}
+		watchdog.Reset(followerTimeout)
+
+		c := e.change()
+		if err := f.params.Store.Restore(c.Key, c.Entry); err != nil {
+			return fmt.Errorf("cannot apply snapshot: %w", err)
+		}
+		keys[c.Key] = true
+	}
+
+	for k := range f.params.Store.Snapshot() {
+		if !keys[k] {
+			if err := f.params.Store.RestoreDelete(k, api.NoVersion); err != nil {
+				return fmt.Errorf("cannot apply snapshot: %w", err)
+			}
+		}
+	}
+
+	f.mu.Lock()
+	f.synced, f.sequence, f.resume = true, m.Sequence, m.Sequence
+	f.mu.Unlock()
+
+	if f.params.Feed != nil {
+		f.params.Feed.Reset(m.Sequence)
+	}
+	return nil
+}
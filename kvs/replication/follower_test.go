@@ -0,0 +1,216 @@
+package replication
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+)
+
+// testLeader serves the replication stream of a store it writes to the way
+// the service does: the store first, then the feed.
+type testLeader struct {
+	store    api.Store
+	feed     *api.Feed
+	sequence uint64
+	srv      *httptest.Server
+
+	mu       sync.Mutex
+	requests []string         // The query of every replication request.
+	override http.HandlerFunc // If set, serves requests instead.
+}
+
+func newTestLeader(t *testing.T, history int) *testLeader {
+	l := &testLeader{store: api.NewMapStore(), feed: api.NewFeed(history, 0)}
+	h := Handler(l.store, l.feed, func(w http.ResponseWriter, r *http.Request, err error) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	})
+	l.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		l.mu.Lock()
+		l.requests = append(l.requests, r.URL.RawQuery)
+		override := l.override
+		l.mu.Unlock()
+
+		if override != nil {
+			override(w, r)
+			return
+		}
+		h(w, r)
+	}))
+	t.Cleanup(l.srv.Close)
+	return l
+}
+
+// serve has h answer the following requests, or the leader if h is nil.
+func (l *testLeader) serve(h http.HandlerFunc) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.override = h
+}
+
+// write applies ops to the store as one batch sharing a sequence number.
+func (l *testLeader) write(t *testing.T, ops ...api.Op) {
+	t.Helper()
+
+	versions, err := l.store.Apply(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.sequence++
+	changes := make([]api.Change, len(ops))
+	for i, op := range ops {
+		changes[i] = api.Change{Sequence: l.sequence, Type: op.Type, Key: op.Key,
+			Entry: api.Entry{Value: op.Value, Version: versions[i]}}
+	}
+	l.feed.Publish(changes)
+}
+
+func (l *testLeader) put(t *testing.T, key, value string) {
+	t.Helper()
+	l.write(t, api.Op{Type: api.OpPut, Key: key, Value: value})
+}
+
+// lastRequest returns the query of the last replication request.
+func (l *testLeader) lastRequest() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.requests[len(l.requests)-1]
+}
+
+// follow starts a follower of l replicating into store and republishing to
+// feed, which may be nil.
+func follow(t *testing.T, l *testLeader, store api.Store, feed *api.Feed) *Follower {
+	f := NewFollower(FollowerParams{Leader: l.srv.URL + "/", Store: store, Feed: feed})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go f.Run(ctx)
+	return f
+}
+
+// waitFor waits until the follower applied the leader's last change and
+// its store holds what the leader's does.
+func waitFor(t *testing.T, f *Follower, l *testLeader, store api.Store) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		sequence, synced := f.Sequence()
+		got, want := store.Snapshot(), l.store.Snapshot()
+		if synced && sequence == l.sequence && reflect.DeepEqual(got, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("follower at %d (synced %v) holds %v, leader at %d holds %v",
+				sequence, synced, got, l.sequence, want)
+		}
+	}
+}
+
+func TestFollowerCatchesUpFromSnapshot(t *testing.T) {
+	l := newTestLeader(t, 4)
+	for i := 0; i < 100; i++ {
+		l.put(t, fmt.Sprint("key", i%10), fmt.Sprint(i))
+	}
+	l.write(t, api.Op{Type: api.OpDelete, Key: "key3"})
+
+	// Keys the follower holds but the leader does not are dropped.
+	store := api.NewShardedStore(4)
+	store.Put("stale", "x")
+
+	f := follow(t, l, store, nil)
+	waitFor(t, f, l, store)
+	if q := l.lastRequest(); q != "" {
+		t.Errorf("first request %q, want one without a sequence number", q)
+	}
+
+	// Versions follow the leader's, so conditional writes keep working
+	// against either.
+	want, _ := l.store.Lookup("key5")
+	if got, _ := store.Lookup("key5"); got.Version != want.Version {
+		t.Errorf("key5 at version %d, leader at %d", got.Version, want.Version)
+	}
+
+	l.put(t, "after", "snapshot")
+	waitFor(t, f, l, store)
+}
+
+func TestFollowerResumesAfterDisconnect(t *testing.T) {
+	tests := []struct {
+		name     string
+		writes   int  // Writes made while the follower is disconnected.
+		snapshot bool // Whether the follower resyncs from a snapshot.
+	}{
+		{"within history", 5, false},
+		{"history lost", 50, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestLeader(t, 20)
+			l.put(t, "a", "1")
+			l.put(t, "b", "2")
+			l.put(t, "c", "3")
+
+			store, feed := api.NewMapStore(), api.NewFeed(100, 0)
+			f := follow(t, l, store, feed)
+			waitFor(t, f, l, store)
+
+			// Stop the leader answering while it is written.
+			l.serve(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			})
+			l.srv.CloseClientConnections()
+
+			for i := 0; i < tt.writes; i++ {
+				l.put(t, fmt.Sprint("k", i), "v")
+			}
+			l.write(t, api.Op{Type: api.OpDelete, Key: "a"},
+				api.Op{Type: api.OpPut, Key: "b", Value: "changed"})
+
+			l.serve(nil)
+			waitFor(t, f, l, store)
+
+			// The follower resumes after the snapshot it started from.
+			if q := l.lastRequest(); q != "after=3" {
+				t.Errorf("resumed with %q, want %q", q, "after=3")
+			}
+			// A snapshot resets the follower's feed; a resumed stream
+			// republishes the changes it missed.
+			_, err := feed.WatchFrom(context.Background(), "", 3)
+			if snapshot := err == api.ErrorHistoryUnavailable; snapshot != tt.snapshot {
+				t.Errorf("resynced from a snapshot: %v, want %v", snapshot, tt.snapshot)
+			}
+		})
+	}
+}
+
+// TestFollowerResumesCutBatch cuts the stream in the middle of a batch and
+// expects the follower to receive the whole batch again.
+func TestFollowerResumesCutBatch(t *testing.T) {
+	l := newTestLeader(t, 20)
+	l.put(t, "a", "1")
+
+	// A leader that dies half way through sending a batch.
+	l.serve(func(w http.ResponseWriter, r *http.Request) {
+		l.serve(nil)
+		w.Write([]byte(`{"type":"snapshot","sequence":1,"count":1}` + "\n"))
+		w.Write([]byte(`{"type":"put","sequence":1,"key":"a","value":"1","version":1}` + "\n"))
+		l.write(t, api.Op{Type: api.OpPut, Key: "b", Value: "2"},
+			api.Op{Type: api.OpPut, Key: "c", Value: "3"})
+		w.Write([]byte(`{"type":"put","sequence":2,"key":"b","value":"2","version":2}` + "\n"))
+	})
+
+	store := api.NewMapStore()
+	f := follow(t, l, store, nil)
+	waitFor(t, f, l, store)
+
+	if q := l.lastRequest(); q != "after=1" {
+		t.Errorf("resumed with %q, want %q", q, "after=1")
+	}
+}
@@ -0,0 +1,115 @@
+package replication
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+)
+
+// Handler returns the leader's handler for GET requests to Path. It streams
+// the changes published to feed after the sequence number in the "after"
+// query parameter. Without it, or if feed no longer holds those changes, the
+// stream starts with a snapshot of store, which must hold only writes that
+// are published, never one that is later undone. Failures to start the
+// stream are answered with writeError.
+func Handler(store api.Store, feed *api.Feed, writeError func(http.ResponseWriter, *http.Request, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, r, api.Errorf(api.CodeInternal, "streaming unsupported"))
+			return
+		}
+
+		var changes <-chan api.Change
+		var err error
+
+		if after := r.URL.Query().Get("after"); after != "" {
+			sequence, err := strconv.ParseUint(after, 10, 64)
+
+			if err != nil {
+				writeError(w, r, api.Errorf(api.CodeInvalidRequest, "invalid sequence %q", after))
+				return
+			}
+
+			changes, err = feed.WatchFrom(r.Context(), "", sequence)
+
+			if err != nil && !errors.Is(err, api.ErrorHistoryUnavailable) {
+				writeError(w, r, err)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+
+		enc := json.NewEncoder(w)
+
+		if changes == nil {
+			changes, err = writeSnapshot(enc, r, store, feed)
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(heartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case c, ok := <-changes:
+				if !ok {
+					// The follower fell behind, or the leader is shutting
+					// down; either way the follower reconnects.
+					return
+				}
+				if err := enc.Encode(changeMessage(c)); err != nil {
+					return
+				}
+				if len(changes) == 0 {
+					flusher.Flush()
+				}
+			case <-heartbeat.C:
+				if err := enc.Encode(message{Type: messageHeartbeat}); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// writeSnapshot subscribes to feed and then sends a snapshot of store. As
+// the store is written before a change is published, the snapshot holds
+// every change up to the sequence number it is sent with; later changes it
+// may hold as well are sent again, which followers tolerate.
+func writeSnapshot(enc *json.Encoder, r *http.Request, store api.Store, feed *api.Feed) (<-chan api.Change, error) {
+	var changes <-chan api.Change
+	var sequence uint64
+
+	for changes == nil {
+		sequence = feed.Last()
+		changes, _ = feed.WatchFrom(r.Context(), "", sequence)
+	}
+
+	snapshot := store.Snapshot()
+
+	err := enc.Encode(message{Type: messageSnapshot, Sequence: sequence, Count: len(snapshot)})
+	if err != nil {
+		return nil, err
+	}
+
+	for k, e := range snapshot {
+		c := api.Change{Sequence: sequence, Type: api.OpPut, Key: k, Entry: e}
+		if err := enc.Encode(changeMessage(c)); err != nil {
+			return nil, err
+		}
+	}
+
+	return changes, nil
+}
@@ -0,0 +1,68 @@
+// Package replication keeps follower stores in sync with a leader by
+// streaming the changes persisted in the leader's transaction log.
+//
+// A follower asks the leader for the changes after the last sequence number
+// it applied. If the leader no longer holds them, or the follower has no
+// state yet, the leader first sends a snapshot of its store. The stream is
+// newline-delimited JSON, one message per change.
+package replication
+
+import (
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+)
+
+// Path is where the leader serves the replication stream.
+const Path = "/v1/_replicate"
+
+// heartbeatInterval is how often an idle stream sends a heartbeat, and
+// followerTimeout how long a follower waits for any message before it
+// assumes the connection is dead.
+const (
+	heartbeatInterval = 5 * time.Second
+	followerTimeout   = 3 * heartbeatInterval
+)
+
+const (
+	messagePut       = "put"
+	messageDelete    = "delete"
+	messageSnapshot  = "snapshot"
+	messageHeartbeat = "heartbeat"
+)
+
+// message is one line of the replication stream. A snapshot message is
+// followed by Count put messages holding the leader's entries.
+type message struct {
+	Type     string     `json:"type"`
+	Sequence uint64     `json:"sequence,omitempty"`
+	Key      string     `json:"key,omitempty"`
+	Value    string     `json:"value,omitempty"`
+	Expiry   *time.Time `json:"expiry,omitempty"`
+	Version  uint64     `json:"version,omitempty"`
+	Count    int        `json:"count,omitempty"`
+}
+
+func changeMessage(c api.Change) message {
+	m := message{Type: messagePut, Sequence: c.Sequence, Key: c.Key,
+		Value: c.Value, Version: c.Version}
+	if c.Type == api.OpDelete {
+		m.Type = messageDelete
+	}
+	if !c.Expiry.IsZero() {
+		m.Expiry = &c.Expiry
+	}
+	return m
+}
+
+func (m message) change() api.Change {
+	c := api.Change{Sequence: m.Sequence, Type: api.OpPut, Key: m.Key,
+		Entry: api.Entry{Value: m.Value, Version: m.Version}}
+	if m.Type == messageDelete {
+		c.Type = api.OpDelete
+	}
+	if m.Expiry != nil {
+		c.Expiry = *m.Expiry
+	}
+	return c
+}
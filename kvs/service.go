@@ -1,142 +1,403 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/auth"
 	"github.com/cloud-native-go/kvs/logger"
+	"github.com/cloud-native-go/kvs/partition"
+	"github.com/cloud-native-go/kvs/replication"
 	"github.com/gorilla/mux"
+	"google.golang.org/grpc"
 )
 
 var transact logger.TransactionLogger
 
-func initializeTransactionLog() error {
-	var err error
+// store holds the keys and values served by the handlers.
+var store api.Store
 
-	postgresDbParams := logger.PostgresDbParams{
-		DbName: "postgres", Host: "host.docker.internal", User: "postgres"}
+// storeShards is the number of lock-striped shards the store splits keys
+// across.
+const storeShards = 32
 
-	// transact, err = logger.NewFileTransactionLogger("transaction.log")
-	transact, err = logger.NewPostgreTransactionLogger(postgresDbParams)
+// compactionInterval is how often a compacting transaction logger folds its
+// log into a snapshot of the store.
+const compactionInterval = 5 * time.Minute
 
-	if err != nil {
-		return fmt.Errorf("failed to create transaction logger: %w", err)
-	}
+// shutdownTimeout bounds how long a SIGTERM waits for in-flight requests and
+// queued transaction log writes.
+const shutdownTimeout = 30 * time.Second
 
-	events, errors := transact.ReadEvents()
-	ok, e := true, logger.Event{}
+// commitParams makes handlers wait until writes are persisted, grouping
+// concurrent writes into one fsync or database commit.
+var commitParams = logger.CommitParams{
+	Durability: logger.DurabilitySync,
+	MaxBatch:   128,
+	MaxDelay:   2 * time.Millisecond,
+	OnCommit:   publishChanges,
+}
 
-	for ok && err == nil {
+// initializeTransactionLog creates the transaction logger c selects and
+// replays it into the store. With ServeDuringReplay, only the snapshot is
+// restored before it returns; the rest of the log is replayed while the
+// service serves reads.
+func initializeTransactionLog(c loggerConfig) error {
+	var err error
 
-		select {
-		case err, ok = <-errors:
-		case e, ok = <-events:
+	transact, err = c.newTransactionLogger()
 
-			switch e.EventType {
-			case logger.EventDelete:
-				err = api.Delete(e.Key)
-			case logger.EventPut:
-				err = api.Put(e.Key, e.Value)
-			}
-		}
+	if err != nil {
+		return fmt.Errorf("failed to create transaction logger: %w", err)
 	}
 
-	transact.Run()
+	if r, ok := transact.(logger.Replayer); ok && c.ServeDuringReplay {
+		return replayFromSnapshot(r)
+	}
+	return replayTransactionLog()
+}
 
-	return err
+// compactPeriodically snapshots the store into the transaction log every
+// interval.
+func compactPeriodically(c logger.Compactor, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
+	for range ticker.C {
+		err := c.Compact(snapshotEvents)
+		if errors.Is(err, logger.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slogger.Error("transaction log compaction failed", "error", err)
+		}
+	}
 }
 
 // keyValuePutHandler expects to be called with a PUT request for
-// the "/v1/key/{key}"
+// the "/v1/key/{key}". An optional TTL is taken from the X-Kvs-Ttl header
+// or the "ttl" query parameter. If-Match and If-None-Match make the write
+// conditional on the key's ETag; the new ETag is returned.
 func keyValuePutHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
 
-	value, err := ioutil.ReadAll(r.Body)
-	defer r.Body.Close()
+	expiry, err := requestExpiry(r)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	precondition, conditional, err := writePrecondition(r, key)
 
 	if err != nil {
-		http.Error(w,
-			err.Error(),
-			http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	err = api.Put(key, string(value))
+	// Read one byte more than allowed so that putKey sees oversized values.
+	value, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(api.MaxValueSize)+1))
+	defer r.Body.Close()
 
 	if err != nil {
-		http.Error(w,
-			err.Error(),
-			http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	transact.WritePut(key, string(value))
+	version, err := putKey(r.Context(), key, string(value), expiry, precondition, conditional)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
+	w.Header().Set("ETag", etag(version))
 	w.WriteHeader(http.StatusCreated)
 }
 
-// keyValueGetHandler expects to be called with a PUT request for
-// the "/v1/key/{key}"
+// keyValue is the JSON representation of a key, for clients accepting
+// application/json rather than the raw value.
+type keyValue struct {
+	Key     string     `json:"key"`
+	Value   string     `json:"value"`
+	Version uint64     `json:"version"`
+	Expiry  *time.Time `json:"expiry,omitempty"`
+}
+
+// keyValueGetHandler expects to be called with a GET request for
+// the "/v1/key/{key}". The TTL remaining, if any, is returned in the
+// X-Kvs-Ttl header and the key's version as its ETag. The body is the raw
+// value, or a keyValue if the Accept header prefers application/json.
 func keyValueGetHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
 
-	value, err := api.Get(key)
+	w.Header().Add("Vary", "Accept")
+
+	mediaType := negotiate(r, octetType, textType, jsonType)
+
+	if mediaType == "" {
+		writeError(w, r, api.Errorf(api.CodeNotAcceptable,
+			"values are available as %s or %s", octetType, jsonType))
+		return
+	}
+
+	if err := api.ValidateKey(key); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	entry, err := lookupKey(r.Context(), key)
 
 	if err != nil {
-		http.Error(w,
-			err.Error(),
-			http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Write([]byte(value))
+	w.Header().Set("ETag", etag(entry.Version))
+	setTTLHeader(w, entry.Expiry)
+
+	if match := r.Header.Get("If-None-Match"); match != "" && etagsMatch(match, entry.Version) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if mediaType != jsonType {
+		w.Write([]byte(entry.Value))
+		return
+	}
+
+	kv := keyValue{Key: key, Value: entry.Value, Version: entry.Version}
+	if !entry.Expiry.IsZero() {
+		kv.Expiry = &entry.Expiry
+	}
+
+	w.Header().Set("Content-Type", jsonType)
+	json.NewEncoder(w).Encode(kv)
 }
 
+// keyValueDeleteHandler expects to be called with a DELETE request for
+// the "/v1/key/{key}". If-Match makes the delete conditional on the key's
+// ETag.
 func keyValueDeleteHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
 
-	err := api.Delete(key)
+	precondition, conditional, err := writePrecondition(r, key)
 
 	if err != nil {
-		http.Error(w,
-			err.Error(),
-			http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	transact.WriteDelete(key)
+	_, err = deleteKey(r.Context(), key, precondition, conditional)
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
 func main() {
+	cfg, err := loadConfig(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fatal("cannot load configuration", err)
+	}
+	startLogging(cfg.Logging)
+	cfg.apply()
+
+	var tlsConfig *tls.Config
+	if cfg.TLS.CertFile != "" {
+		if tlsConfig, err = startTLS(cfg.TLS); err != nil {
+			fatal("cannot start tls", err)
+		}
+	}
 
-	err := initializeTransactionLog()
+	if err = startAuth(cfg); err != nil {
+		fatal("cannot start authentication", err)
+	}
 
+	stopTracing, err := startTracing(cfg.Tracing)
 	if err != nil {
-		log.Fatal(err)
+		fatal("cannot start tracing", err)
+	}
+
+	store = api.NewShardedStore(storeShards)
+	go api.Reap(context.Background(), store, reapInterval)
+
+	switch {
+	case clusterParams.ID != "":
+		if clusterParams.Dir == "" {
+			clusterParams.Dir = defaultRaftDir(clusterParams.ID)
+		}
+		if clusterParams.URL == "" {
+			clusterParams.URL = defaultNodeURL(cfg.Listen, cfg.TLS.CertFile != "")
+		}
+		if err := startCluster(store); err != nil {
+			fatal("cannot start cluster node", err)
+		}
+	case leader != "":
+		startFollower(context.Background())
+	default:
+		if err := initializeTransactionLog(cfg.Logger); err != nil {
+			fatal("cannot initialize transaction log", err)
+		}
+	}
+
+	if len(cfg.Partition.Nodes) > 0 {
+		self := cfg.Partition.Self
+		if self == "" {
+			self = defaultNodeURL(cfg.Listen, cfg.TLS.CertFile != "")
+		}
+		startPartitions(self, cfg.Partition.Nodes, cfg.Partition.VNodes)
 	}
 
 	r := mux.NewRouter()
 
+	// Register keyValueBatchHandler as the handler function for POST
+	// requests matching "/v1/_batch", applying several writes atomically.
+	r.HandleFunc("/v1/_batch", partitionedBatch(leaderOnly(writable(keyValueBatchHandler)))).Methods("POST")
+
+	// Register keyValueWatchHandler as the handler function for GET
+	// requests matching "/v1/_watch", streaming changes to keys.
+	r.HandleFunc("/v1/_watch", requires(auth.Read, prefixResource, keyValueWatchHandler)).Methods("GET")
+
+	// Register the replication stream that followers read the changes
+	// from. Followers serve it too, so they can be chained.
+	r.HandleFunc(replication.Path,
+		requires(auth.Read, allResource, replication.Handler(loggedStore{store}, feed, writeError))).Methods("GET")
+
+	if ring, _ := currentRing(); ring != nil {
+		// Register the partition ring handlers before "/v1/{key}", which
+		// would match them: show the ring, change it and receive the keys
+		// this node took over.
+		r.HandleFunc("/v1/_ring", requires(auth.Read, allResource, ringGetHandler)).Methods("GET")
+		r.HandleFunc("/v1/_ring", requires(auth.Admin, allResource, ringPutHandler)).Methods("PUT")
+		r.HandleFunc(partition.TransferPath, requires(auth.Admin, allResource,
+			leaderOnly(writable(partition.TransferHandler(acceptTransfer, writeError))))).Methods("POST")
+	}
+
 	// Register keyValuePutHandler as the handler function for PUT
 	// requests matching "/v1/{key}"
-	r.HandleFunc("/v1/{key}", keyValuePutHandler).Methods("PUT")
+	r.HandleFunc("/v1/{key}", requires(auth.Write, keyResource,
+		partitioned(leaderOnly(writable(keyValuePutHandler))))).Methods("PUT")
 
 	// Register keyValueGetHandler as the handler function for GET
 	// requests matching "/v1/{key}"
-	r.HandleFunc("/v1/{key}", keyValueGetHandler).Methods("GET")
+	r.HandleFunc("/v1/{key}", requires(auth.Read, keyResource,
+		partitioned(keyValueGetHandler))).Methods("GET")
 
 	// Register keyValueGetHandler as the handler function for DELETE
 	// requests matching "/v1/{key}"
-	r.HandleFunc("/v1/{key}", keyValueDeleteHandler).Methods("DELETE")
+	r.HandleFunc("/v1/{key}", requires(auth.Delete, keyResource,
+		partitioned(leaderOnly(writable(keyValueDeleteHandler))))).Methods("DELETE")
+
+	// Register keyValueListHandler as the handler function for GET
+	// requests matching "/v1", listing keys in order.
+	r.HandleFunc("/v1", requires(auth.Read, prefixResource, keyValueListHandler)).Methods("GET")
+
+	if node != nil {
+		// Register the cluster membership handlers: list members, add a
+		// voter and remove a member.
+		r.HandleFunc("/v1/_cluster/members",
+			requires(auth.Read, allResource, clusterMembersHandler)).Methods("GET")
+		r.HandleFunc("/v1/_cluster/members",
+			requires(auth.Admin, allResource, leaderOnly(clusterJoinHandler))).Methods("POST")
+		r.HandleFunc("/v1/_cluster/members/{id}",
+			requires(auth.Admin, allResource, leaderOnly(clusterLeaveHandler))).Methods("DELETE")
+	}
+
+	// Register healthHandler to report whether the service is ready and
+	// whether the transaction log accepts writes.
+	r.HandleFunc("/healthz", healthHandler).Methods("GET")
+
+	// Register metricsHandler to serve the metrics to Prometheus.
+	r.Handle(metricsPath, metricsHandler).Methods("GET")
 
-	log.Fatal(http.ListenAndServe(":8080", r))
+	srv := &http.Server{Addr: cfg.Listen, Handler: instrumented(r, traced(r, logged(r, authenticated(r)))), TLSConfig: tlsConfig}
+
+	// Watch streams never end on their own; close them on shutdown.
+	srv.RegisterOnShutdown(feed.Close)
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			// The certificates come from tlsConfig, which reloads them.
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			fatal("http server failed", err)
+		}
+	}()
+
+	var grpcSrv *grpc.Server
+	if cfg.GRPCListen != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCListen)
+		if err != nil {
+			fatal("cannot listen for grpc", err)
+		}
+
+		grpcSrv = newGRPCServer(tlsConfig)
+		go func() {
+			if err := grpcSrv.Serve(lis); err != nil {
+				fatal("grpc server failed", err)
+			}
+		}()
+	}
+
+	// Stop on SIGTERM (container stop) or SIGINT: finish in-flight requests
+	// first, then close the logger so buffered writes reach the log.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	<-sig
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		slogger.Error("http server shutdown failed", "error", err)
+	}
+
+	if grpcSrv != nil {
+		stopGRPCServer(ctx, grpcSrv)
+	}
+
+	if node != nil {
+		if err := node.Shutdown(); err != nil {
+			slogger.Error("raft shutdown failed", "error", err)
+		}
+	}
+
+	// A follower has no transaction log.
+	if transact != nil {
+		if err := transact.Close(ctx); err != nil {
+			fatal("transaction logger close failed", err)
+		}
+	}
+
+	// Export the spans of the last requests and log writes.
+	if err := stopTracing(ctx); err != nil {
+		slogger.Error("tracing shutdown failed", "error", err)
+	}
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for
+// changes.
+const tlsReloadInterval = 10 * time.Second
+
+// certStore holds the server certificate and the client CAs, reloading
+// them when their files change on disk. New connections use the files
+// last loaded successfully; established ones keep theirs.
+type certStore struct {
+	params tlsConfig
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool // Nil unless ClientCAFile is set.
+	server    *tls.Config
+	stamps    []fileStamp
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// newCertStore loads the files of params.
+func newCertStore(params tlsConfig) (*certStore, error) {
+	s := &certStore{params: params}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// files returns the files s loads.
+func (s *certStore) files() []string {
+	files := []string{s.params.CertFile, s.params.KeyFile}
+	if s.params.ClientCAFile != "" {
+		files = append(files, s.params.ClientCAFile)
+	}
+	return files
+}
+
+// stat returns the current stamps of the files.
+func (s *certStore) stat() ([]fileStamp, error) {
+	var stamps []fileStamp
+	for _, f := range s.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, fileStamp{fi.ModTime(), fi.Size()})
+	}
+	return stamps, nil
+}
+
+// load reads the files and swaps them in if they are valid.
+func (s *certStore) load() error {
+	stamps, err := s.stat()
+	if err != nil {
+		return fmt.Errorf("cannot load tls files: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.params.CertFile, s.params.KeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load tls certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if s.params.ClientCAFile != "" {
+		pem, err := os.ReadFile(s.params.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("cannot load client CAs: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in client CA file %s", s.params.ClientCAFile)
+		}
+	}
+
+	server := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    clientCAs,
+	}
+	if clientCAs != nil {
+		server.ClientAuth = tls.RequireAndVerifyClientCert
+		if s.params.ClientAuth == "optional" {
+			server.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	s.mu.Lock()
+	s.cert, s.clientCAs, s.server, s.stamps = &cert, clientCAs, server, stamps
+	s.mu.Unlock()
+	return nil
+}
+
+// changed reports whether a file changed since it was last loaded.
+func (s *certStore) changed() bool {
+	stamps, err := s.stat()
+	if err != nil {
+		return false // Mid-rotation; try again later.
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i := range stamps {
+		if stamps[i] != s.stamps[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the files whenever they change, until ctx is done.
+func (s *certStore) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !s.changed() {
+			continue
+		}
+		if err := s.load(); err != nil {
+			slogger.Error("tls reload failed; keeping the previous certificates", "error", err)
+			continue
+		}
+		slogger.Info("tls certificates reloaded", "cert", s.params.CertFile)
+	}
+}
+
+// serverConfig returns the TLS configuration of the servers, which picks
+// up reloaded files for every new connection.
+func (s *certStore) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+			return s.server, nil
+		},
+	}
+}
+
+// clientConfig returns the TLS configuration of requests to other nodes.
+// They present the server certificate, which nodes with mutual TLS require,
+// and, if client CAs are set, trust only them, assuming that the nodes of a
+// deployment share a CA.
+func (s *certStore) clientConfig() *tls.Config {
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+			return s.cert, nil
+		},
+	}
+
+	if s.params.ClientCAFile != "" {
+		// Verify against the current pool rather than one fixed now, so
+		// that reloaded CAs apply.
+		c.InsecureSkipVerify = true
+		c.VerifyConnection = s.verifyPeer
+	}
+	return c
+}
+
+// verifyPeer verifies the certificate chain of a node against the client
+// CAs.
+func (s *certStore) verifyPeer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("node presented no certificate")
+	}
+
+	s.mu.RLock()
+	roots := s.clientCAs
+	s.mu.RUnlock()
+
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// peerClient makes the requests to other nodes: forwarding, replication,
+// joining a cluster and passing on the partition ring.
+var peerClient = http.DefaultClient
+
+// startTLS loads the TLS files of c, keeps reloading them and makes
+// requests to other nodes use TLS. It returns the server configuration.
+func startTLS(c tlsConfig) (*tls.Config, error) {
+	certs, err := newCertStore(c)
+	if err != nil {
+		return nil, err
+	}
+	go certs.watch(context.Background(), tlsReloadInterval)
+
+	peerClient = &http.Client{Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     certs.clientConfig(),
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		ForceAttemptHTTP2:   true,
+	}}
+
+	return certs.serverConfig(), nil
+}
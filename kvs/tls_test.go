@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloud-native-go/kvs/auth"
+)
+
+// testCA is a throwaway certificate authority.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var serial int64
+
+func newTestCA(t *testing.T, name string) *testCA {
+	ca := &testCA{}
+	ca.cert, ca.pem, ca.key = ca.issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return ca
+}
+
+// issue signs template, self-signing it if ca has no certificate yet.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (*x509.Certificate, []byte, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial++
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parent, signer := template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), key
+}
+
+// keyPair issues a certificate for name, usable by servers on localhost and
+// by clients, and returns it with its key in PEM.
+func (ca *testCA) keyPair(t *testing.T, name string) (certPEM, keyPEM []byte) {
+	t.Helper()
+
+	_, certPEM, key := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name, Organization: []string{"Example"}},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	})
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPEM, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+// certificate issues a certificate for name as a tls.Certificate.
+func (ca *testCA) certificate(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+
+	cert, err := tls.X509KeyPair(ca.keyPair(t, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// writeFile writes data to path and moves its modification time on, so
+// that a reload notices the change even on coarse file system clocks.
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	mtime := time.Now().Add(time.Duration(serial) * time.Second)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tlsFiles writes the certificate of a server called name and, if
+// clientCA is set, the client CAs to a temporary directory.
+func tlsFiles(t *testing.T, ca *testCA, name string, clientCA *testCA) tlsConfig {
+	dir := t.TempDir()
+	c := tlsConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+
+	certPEM, keyPEM := ca.keyPair(t, name)
+	writeFile(t, c.CertFile, certPEM)
+	writeFile(t, c.KeyFile, keyPEM)
+	if clientCA != nil {
+		c.ClientCAFile = filepath.Join(dir, "client-ca.pem")
+		writeFile(t, c.ClientCAFile, clientCA.pem)
+	}
+	return c
+}
+
+// serveTLS starts a server with the certificates of c. It answers with the
+// principal of the client certificate, if any.
+func serveTLS(t *testing.T, c tlsConfig) (*httptest.Server, *certStore) {
+	t.Helper()
+
+	certs, err := newCertStore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := auth.NewCertAuthenticator().Authenticate(auth.FromRequest(r))
+		fmt.Fprint(w, principal)
+	}))
+	srv.TLS = certs.serverConfig()
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0) // Refused handshakes.
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, certs
+}
+
+// get requests url with a client trusting ca and presenting certs, even
+// if the server asks for another CA, and returns the server certificate's
+// name and the body.
+func get(url string, ca *testCA, certs ...tls.Certificate) (server, body string, err error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if len(certs) == 0 {
+				return &tls.Certificate{}, nil
+			}
+			return &certs[0], nil
+		}}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	return resp.TLS.PeerCertificates[0].Subject.CommonName, string(b), err
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	srv, _ := serveTLS(t, tlsFiles(t, ca, "node", nil))
+
+	server, principal, err := get(srv.URL, ca)
+	if err != nil || server != "node" || principal != "" {
+		t.Errorf("GET = %q, %q, %v", server, principal, err)
+	}
+
+	// A client trusting another CA refuses the server.
+	if _, _, err = get(srv.URL, newTestCA(t, "other")); err == nil {
+		t.Error("client trusted a server certificate from an unknown CA")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca, clientCA, unknownCA := newTestCA(t, "ca"), newTestCA(t, "clients"), newTestCA(t, "unknown")
+	known := clientCA.certificate(t, "reader")
+	unknown := unknownCA.certificate(t, "reader")
+
+	tests := []struct {
+		name       string
+		clientAuth string
+		certs      []tls.Certificate
+		principal  string // The principal identified, if the request is accepted.
+		ok         bool
+	}{
+		{"known client", "", []tls.Certificate{known}, "CN=reader,O=Example", true},
+		{"unknown client", "", []tls.Certificate{unknown}, "", false},
+		{"no certificate", "", nil, "", false},
+		{"optional, known client", "optional", []tls.Certificate{known}, "CN=reader,O=Example", true},
+		{"optional, unknown client", "optional", []tls.Certificate{unknown}, "", false},
+		{"optional, no certificate", "optional", nil, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tlsFiles(t, ca, "node", clientCA)
+			c.ClientAuth = tt.clientAuth
+			srv, _ := serveTLS(t, c)
+
+			_, principal, err := get(srv.URL, ca, tt.certs...)
+			if (err == nil) != tt.ok || principal != tt.principal {
+				t.Errorf("GET = %q, %v, want principal %q, accepted %v", principal, err, tt.principal, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	ca, clientCA, newClientCA := newTestCA(t, "ca"), newTestCA(t, "clients"), newTestCA(t, "new clients")
+	c := tlsFiles(t, ca, "old", clientCA)
+	srv, certs := serveTLS(t, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go certs.watch(ctx, 5*time.Millisecond)
+
+	// waitForServer waits until new connections get the certificate name.
+	waitForServer := func(name string, client tls.Certificate) {
+		t.Helper()
+
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+			server, _, err := get(srv.URL, ca, client)
+			if err == nil && server == name {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("server presents %q (%v), want %q", server, err, name)
+			}
+		}
+	}
+
+	oldClient := clientCA.certificate(t, "client")
+	waitForServer("old", oldClient)
+
+	// Rotate the server certificate and the client CAs.
+	certPEM, keyPEM := ca.keyPair(t, "new")
+	writeFile(t, c.KeyFile, keyPEM)
+	writeFile(t, c.CertFile, certPEM)
+	writeFile(t, c.ClientCAFile, newClientCA.pem)
+
+	newClient := newClientCA.certificate(t, "client")
+	waitForServer("new", newClient)
+	if _, _, err := get(srv.URL, ca, oldClient); err == nil {
+		t.Error("client of a replaced CA accepted")
+	}
+
+	// Broken files are not loaded; the server keeps the last good ones.
+	writeFile(t, c.CertFile, []byte("not a certificate"))
+	if !certs.changed() {
+		t.Fatal("rewritten certificate not noticed")
+	}
+	if err := certs.load(); err == nil {
+		t.Fatal("broken certificate loaded")
+	}
+	if server, _, err := get(srv.URL, ca, newClient); err != nil || server != "new" {
+		t.Errorf("after a failed reload: %q, %v", server, err)
+	}
+}
+
+func TestPeerClientVerifiesNodes(t *testing.T) {
+	ca, otherCA := newTestCA(t, "ca"), newTestCA(t, "other")
+
+	// Nodes of a deployment share a CA, which signs their certificates and
+	// which they trust for clients.
+	self, err := newCertStore(tlsFiles(t, ca, "self", ca))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: self.clientConfig()}}
+
+	tests := []struct {
+		name string
+		ca   *testCA // The CA of the node called.
+		ok   bool
+	}{
+		{"node of the deployment", ca, true},
+		{"foreign node", otherCA, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := serveTLS(t, tlsFiles(t, tt.ca, "peer", tt.ca))
+
+			resp, err := client.Get(srv.URL)
+			if (err == nil) != tt.ok {
+				t.Fatalf("GET = %v, accepted %v", err, tt.ok)
+			}
+			if err != nil {
+				return
+			}
+			defer resp.Body.Close()
+
+			// The node presents its own certificate as a client.
+			b, _ := ioutil.ReadAll(resp.Body)
+			if string(b) != "CN=self,O=Example" {
+				t.Errorf("called as %q", b)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// tracer creates the spans of the service. It comes from the global tracer
+// provider, which startTracing sets.
+var tracer = otel.Tracer("github.com/cloud-native-go/kvs")
+
+// startTracing propagates W3C trace context from requests into the spans
+// of the service and on to other nodes, and exports the spans to the
+// exporter c selects. It returns a function flushing the spans not yet
+// exported.
+func startTracing(c tracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	base := peerClient.Transport
+	peerClient = &http.Client{Transport: &tracingTransport{base: base}}
+
+	exp, err := newSpanExporter(c)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create span exporter: %w", err)
+	}
+	if exp == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	tp := newTracerProvider(exp, c)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+// newSpanExporter returns the exporter c selects, or nil if spans are not
+// exported.
+func newSpanExporter(c tracingConfig) (sdktrace.SpanExporter, error) {
+	switch c.Exporter {
+	case "stdout":
+		return stdouttrace.New()
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if c.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(c.Endpoint))
+		}
+		return otlptracehttp.New(context.Background(), opts...)
+	default:
+		return nil, nil
+	}
+}
+
+// newTracerProvider returns a tracer provider exporting the spans it
+// samples to exp. Tests can pass an in-memory exporter, such as the one
+// of go.opentelemetry.io/otel/sdk/trace/tracetest.
+func newTracerProvider(exp sdktrace.SpanExporter, c tracingConfig) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", c.ServiceName))))
+}
+
+// traced wraps h, which is r with its middleware, to run every request in
+// a server span, a child of the trace context the client sent.
+func traced(r *mux.Router, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(),
+			propagation.HeaderCarrier(req.Header))
+
+		route, _ := matchRoute(r, req)
+		ctx, span := tracer.Start(ctx, req.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", req.URL.Path)))
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, req.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.status))
+		if sw.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
+
+// tracingTransport passes the trace context of requests to other nodes on.
+type tracingTransport struct {
+	base http.RoundTripper // http.DefaultTransport if nil.
+}
+
+func (t *tracingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	r = r.Clone(r.Context())
+	otel.GetTextMapPropagator().Inject(r.Context(), propagation.HeaderCarrier(r.Header))
+	return base.RoundTrip(r)
+}
+
+// startSpan starts the span of an operation of the service, a child of the
+// span of ctx.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span. Errors the client caused, such as a missing key, are
+// recorded as attributes; the others mark the span as failed.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		code := api.Code(err)
+		span.SetAttributes(attribute.String("kvs.error_code", string(code)))
+		if code == api.CodeInternal || code == api.CodeUnavailable {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	span.End()
+}
+
+// keyAttribute labels a span with the key it is about.
+func keyAttribute(key string) attribute.KeyValue {
+	return attribute.String("kvs.key", key)
+}
+
+// lookupKey returns the entry of key in the store.
+func lookupKey(ctx context.Context, key string) (api.Entry, error) {
+	_, span := startSpan(ctx, "store.lookup", keyAttribute(key))
+	entry, err := store.Lookup(key)
+	endSpan(span, err)
+	return entry, err
+}
+
+// metadataCarrier reads and writes trace context in gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) { metadata.MD(c).Set(key, value) }
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startGRPCSpan starts the server span of a gRPC call, a child of the trace
+// context the client sent.
+func startGRPCSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+
+	return tracer.Start(ctx, method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.method", method)))
+}
+
+// endGRPCSpan ends the span of a gRPC call, recording the status it
+// returned. As with HTTP, only server errors mark the span as failed.
+func endGRPCSpan(span trace.Span, err error) {
+	s := status.Convert(err)
+	span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(s.Code())))
+
+	if grpcServerError(s.Code()) {
+		span.SetStatus(codes.Error, s.Message())
+	}
+	span.End()
+}
+
+// grpcServerError reports whether code blames the server rather than the
+// client.
+func grpcServerError(code grpccodes.Code) bool {
+	switch code {
+	case grpccodes.Unknown, grpccodes.Internal, grpccodes.Unavailable,
+		grpccodes.DataLoss, grpccodes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// traceUnaryInterceptor runs unary gRPC calls in a server span.
+func traceUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	ctx, span := startGRPCSpan(ctx, info.FullMethod)
+	defer func() { endGRPCSpan(span, err) }()
+
+	return handler(ctx, req)
+}
+
+// traceStreamInterceptor runs streaming gRPC calls in a server span.
+func traceStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx, span := startGRPCSpan(ss.Context(), info.FullMethod)
+	defer func() { endGRPCSpan(span, err) }()
+
+	return handler(srv, &contextStream{ss, ctx})
+}
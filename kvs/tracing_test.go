@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// spans records the spans of the service once useTracing has run. The
+	// global tracer provider can only be set once for the tracers already
+	// created, so all tests share it.
+	spans         = tracetest.NewInMemoryExporter()
+	traceProvider *sdktrace.TracerProvider
+	tracingOnce   sync.Once
+)
+
+// useTracing records every span in spans, which it empties. Spans of
+// earlier tests still batched are flushed first, so they are dropped too.
+func useTracing(t *testing.T) {
+	tracingOnce.Do(func() {
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+		traceProvider = newTracerProvider(spans, tracingConfig{SampleRatio: 1, ServiceName: "kvs"})
+		otel.SetTracerProvider(traceProvider)
+	})
+	if err := traceProvider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	spans.Reset()
+}
+
+// recorded returns the spans ended so far by name, failing if a name
+// occurs more than once.
+func recorded(t *testing.T) map[string]tracetest.SpanStub {
+	t.Helper()
+
+	if err := traceProvider.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]tracetest.SpanStub)
+	for _, s := range spans.GetSpans() {
+		if _, ok := byName[s.Name]; ok {
+			t.Fatalf("more than one %q span", s.Name)
+		}
+		byName[s.Name] = s
+	}
+	return byName
+}
+
+// attr returns the value of the attribute key of s.
+func attr(s tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTraceWrites(t *testing.T) {
+	tests := []struct {
+		method, target, body string
+		handler              http.HandlerFunc
+		route, storeSpan     string
+		events               int64
+	}{
+		{http.MethodPut, "/v1/k", "v", keyValuePutHandler, "/v1/{key}", "store.put", 1},
+		{http.MethodDelete, "/v1/k", "", keyValueDeleteHandler, "/v1/{key}", "store.delete", 1},
+		{http.MethodPost, "/v1/_batch",
+			`{"operations": [{"op": "put", "key": "a", "value": "1"}, {"op": "put", "key": "b", "value": "2"}]}`,
+			keyValueBatchHandler, "/v1/_batch", "store.apply", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			useFileLog(t)
+			store.Put("k", "v")
+			useTracing(t)
+
+			r := mux.NewRouter()
+			r.HandleFunc(tt.route, tt.handler).Methods(tt.method)
+
+			// The client's trace context.
+			client := trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID:    trace.TraceID{1, 2, 3},
+				SpanID:     trace.SpanID{4, 5, 6},
+				TraceFlags: trace.FlagsSampled,
+				Remote:     true,
+			})
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			otel.GetTextMapPropagator().Inject(trace.ContextWithRemoteSpanContext(context.Background(), client),
+				propagation.HeaderCarrier(req.Header))
+
+			w := httptest.NewRecorder()
+			traced(r, r).ServeHTTP(w, req)
+			if w.Code >= http.StatusBadRequest {
+				t.Fatalf("%s %s: %d %s", tt.method, tt.target, w.Code, w.Body)
+			}
+
+			s := recorded(t)
+			server, ok := s[tt.method+" "+tt.route]
+			if !ok {
+				t.Fatalf("no server span among %v", s)
+			}
+			if !server.Parent.Equal(client) || server.SpanKind != trace.SpanKindServer {
+				t.Errorf("server span is a %v child of %v, want a server child of the client's span",
+					server.SpanKind, server.Parent.SpanID())
+			}
+
+			// The store operation and the log append are children of the
+			// request's span.
+			for _, name := range []string{tt.storeSpan, "log.append"} {
+				if span := s[name]; span.Parent.SpanID() != server.SpanContext.SpanID() ||
+					span.SpanContext.TraceID() != client.TraceID() {
+					t.Errorf("%s span %+v is not a child of the request's span", name, span.Parent)
+				}
+			}
+			if n := attr(s["log.append"], "kvs.log.events").AsInt64(); n != tt.events {
+				t.Errorf("log.append of %d events, want %d", n, tt.events)
+			}
+
+			// The log write starts a trace of its own, linked to the append.
+			write := s["log.write"]
+			if write.Parent.IsValid() || write.SpanContext.TraceID() == client.TraceID() {
+				t.Errorf("log.write span in the trace of the request")
+			}
+			if len(write.Links) != 1 || !write.Links[0].SpanContext.Equal(s["log.append"].SpanContext) {
+				t.Errorf("log.write span links %+v, want the log.append span", write.Links)
+			}
+		})
+	}
+}
+
+func TestTracePropagatesToPeers(t *testing.T) {
+	useTracing(t)
+
+	var traceparent string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	}))
+	defer peer.Close()
+
+	ctx, span := startSpan(context.Background(), "forward")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, peer.URL, nil)
+	resp, err := (&http.Client{Transport: &tracingTransport{}}).Do(req)
+	span.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if want := span.SpanContext().TraceID().String(); !strings.Contains(traceparent, want) {
+		t.Errorf("peer received traceparent %q, want trace %s", traceparent, want)
+	}
+	if req.Header.Get("traceparent") != "" {
+		t.Error("the request of the caller was modified")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/logger"
+)
+
+// ttlHeader carries a key's time to live: on PUT requests it sets the TTL,
+// on GET responses it reports the TTL remaining, in whole seconds. PUT also
+// accepts the TTL as the "ttl" query parameter.
+const ttlHeader = "X-Kvs-Ttl"
+
+// reapInterval is how often expired keys are removed from the store.
+const reapInterval = time.Minute
+
+// requestExpiry returns the expiry requested by a PUT request, or the zero
+// time if it did not set a TTL. The TTL is either a number of seconds or a
+// duration such as "90s" or "1h30m".
+func requestExpiry(r *http.Request) (time.Time, error) {
+	ttl := r.Header.Get(ttlHeader)
+	if ttl == "" {
+		ttl = r.URL.Query().Get("ttl")
+	}
+	if ttl == "" {
+		return time.Time{}, nil
+	}
+
+	return parseTTL(ttl)
+}
+
+// parseTTL returns the expiry for a TTL given as a number of seconds or as a
+// duration.
+func parseTTL(ttl string) (time.Time, error) {
+	d, err := time.ParseDuration(ttl)
+	if seconds, serr := strconv.ParseUint(ttl, 10, 32); serr == nil {
+		d, err = time.Duration(seconds)*time.Second, nil
+	}
+	if err != nil || d <= 0 {
+		return time.Time{}, api.Errorf(api.CodeInvalidRequest,
+			"invalid ttl %q: must be a positive duration", ttl)
+	}
+
+	return time.Now().Add(d), nil
+}
+
+// setTTLHeader reports the time left until expiry, rounded up to whole
+// seconds, if the key expires at all.
+func setTTLHeader(w http.ResponseWriter, expiry time.Time) {
+	if expiry.IsZero() {
+		return
+	}
+
+	seconds := math.Ceil(time.Until(expiry).Seconds())
+	w.Header().Set(ttlHeader, strconv.FormatFloat(seconds, 'f', 0, 64))
+}
+
+// snapshotEvents returns the store contents as events for log compaction.
+func snapshotEvents() []logger.Event {
+	snapshot := store.Snapshot()
+
+	events := make([]logger.Event, 0, len(snapshot))
+	for k, e := range snapshot {
+		events = append(events, logger.Event{EventType: logger.EventPut,
+			Key: k, Value: e.Value, Expiry: e.Expiry, Version: e.Version})
+	}
+	return events
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/gorilla/mux"
+)
+
+func TestParseTTL(t *testing.T) {
+	tests := []struct {
+		ttl  string
+		want time.Duration // Zero if ttl is invalid.
+	}{
+		{"60", time.Minute},
+		{"1", time.Second},
+		{"90s", 90 * time.Second},
+		{"1h30m", 90 * time.Minute},
+		{"250ms", 250 * time.Millisecond},
+		{"0", 0},
+		{"0s", 0},
+		{"-5s", 0},
+		{"-5", 0},
+		{"1.5", 0},
+		{"4294967296", 0}, // More seconds than parseTTL takes.
+		{"soon", 0},
+		{" 60", 0},
+	}
+
+	for _, tt := range tests {
+		before := time.Now()
+		expiry, err := parseTTL(tt.ttl)
+		after := time.Now()
+
+		if tt.want == 0 {
+			if api.Code(err) != api.CodeInvalidRequest {
+				t.Errorf("parseTTL(%q) = %v, %v, want an invalid request", tt.ttl, expiry, err)
+			}
+			continue
+		}
+		if err != nil || expiry.Before(before.Add(tt.want)) || expiry.After(after.Add(tt.want)) {
+			t.Errorf("parseTTL(%q) = %v, %v, want %v from now", tt.ttl, expiry, err, tt.want)
+		}
+	}
+}
+
+// putRequest returns a PUT request of value to key.
+func putRequest(target, key, value string) *http.Request {
+	r := httptest.NewRequest(http.MethodPut, target, strings.NewReader(value))
+	return mux.SetURLVars(r, map[string]string{"key": key})
+}
+
+func TestPutTTL(t *testing.T) {
+	tests := []struct {
+		name, target, header string
+		want                 time.Duration // Zero for no expiry.
+		status               int
+	}{
+		{"no ttl", "/v1/key", "", 0, http.StatusCreated},
+		{"header in seconds", "/v1/key", "60", time.Minute, http.StatusCreated},
+		{"header as duration", "/v1/key", "1h", time.Hour, http.StatusCreated},
+		{"query", "/v1/key?ttl=2m", "", 2 * time.Minute, http.StatusCreated},
+		{"header over query", "/v1/key?ttl=2m", "30", 30 * time.Second, http.StatusCreated},
+		{"zero", "/v1/key?ttl=0", "", 0, http.StatusBadRequest},
+		{"negative", "/v1/key", "-1m", 0, http.StatusBadRequest},
+		{"not a number", "/v1/key", "forever", 0, http.StatusBadRequest},
+		{"bad query, good header", "/v1/key?ttl=forever", "10", 10 * time.Second, http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFileLog(t)
+
+			r := putRequest(tt.target, "key", "value")
+			if tt.header != "" {
+				r.Header.Set(ttlHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			start := time.Now()
+			keyValuePutHandler(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			e, err := store.Lookup("key")
+			if tt.status != http.StatusCreated {
+				var resp errorResponse
+				json.Unmarshal(w.Body.Bytes(), &resp)
+				if resp.Error.Code != api.CodeInvalidRequest || err != api.ErrorNoSuchKey {
+					t.Errorf("rejected with %+v, store holds %+v, %v", resp.Error, e, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == 0 && !e.Expiry.IsZero() {
+				t.Errorf("key expires at %v, want never", e.Expiry)
+			}
+			if d := e.Expiry.Sub(start); tt.want != 0 && (d < tt.want || d > tt.want+time.Second) {
+				t.Errorf("key expires in %v, want %v", d, tt.want)
+			}
+
+			// GET reports the TTL left, in whole seconds.
+			w = httptest.NewRecorder()
+			keyValueGetHandler(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/v1/key", nil),
+				map[string]string{"key": "key"}))
+			want := ""
+			if tt.want != 0 {
+				want = strconv.Itoa(int(tt.want / time.Second))
+			}
+			if got := w.Header().Get(ttlHeader); got != want {
+				t.Errorf("GET reports ttl %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestExpiredKeysDisappear(t *testing.T) {
+	useFileLog(t)
+
+	for _, key := range []string{"short", "long"} {
+		r := putRequest("/v1/"+key, key, "value")
+		r.Header.Set(ttlHeader, map[string]string{"short": "10ms", "long": "1h"}[key])
+		keyValuePutHandler(httptest.NewRecorder(), r)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	keyValueGetHandler(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/v1/short", nil),
+		map[string]string{"key": "short"}))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET of an expired key: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	if l := listPage(t, nil); len(l.Keys) != 1 || l.Keys[0].Key != "long" {
+		t.Errorf("listed %+v, want only long", l.Keys)
+	}
+
+	events := snapshotEvents()
+	if len(events) != 1 || events[0].Key != "long" || events[0].Expiry.IsZero() {
+		t.Errorf("compaction snapshot %+v, want only long with its expiry", events)
+	}
+}
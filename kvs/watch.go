@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/logger"
+)
+
+// watchHistory is how many changes the feed keeps for watchers resuming a
+// stream.
+var watchHistory = 10000
+
+// watchKeepAlive is how often an idle stream sends a comment, so that
+// proxies do not time it out.
+const watchKeepAlive = 15 * time.Second
+
+// feed distributes the changes persisted by the transaction logger to
+// watchers.
+var feed *api.Feed
+
+// publishChanges passes events just persisted by the transaction logger to
+// the feed.
+func publishChanges(events []logger.Event) {
+	changes := make([]api.Change, len(events))
+	for i, e := range events {
+		changes[i] = api.Change{Sequence: e.Sequence, Type: api.OpPut, Key: e.Key,
+			Entry: api.Entry{Value: e.Value, Expiry: e.Expiry, Version: e.Version}}
+		if e.EventType == logger.EventDelete {
+			changes[i].Type = api.OpDelete
+		}
+	}
+	feed.Publish(changes)
+}
+
+// watchedChange is the data of a server-sent event.
+type watchedChange struct {
+	Key     string     `json:"key"`
+	Value   *string    `json:"value,omitempty"`
+	Expiry  *time.Time `json:"expiry,omitempty"`
+	Version uint64     `json:"version"`
+}
+
+// keyValueWatchHandler expects to be called with a GET request for
+// "/v1/_watch" and streams the changes to keys starting with the "prefix"
+// query parameter as server-sent events: "put" or "delete" events whose id
+// is the change's sequence number and its index among the changes sharing
+// it, as "sequence.index", and whose data is JSON.
+//
+// A client reconnecting with the Last-Event-ID header, or the "after" query
+// parameter, first receives the changes it missed since that event, or
+// since all changes of a plain sequence number, or 410 Gone if they are no
+// longer available. Keys that expire
+// are not changes and send no event.
+func keyValueWatchHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, errors.New("streaming unsupported"))
+		return
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+
+	after := r.Header.Get("Last-Event-ID")
+	if after == "" {
+		after = r.URL.Query().Get("after")
+	}
+
+	var changes <-chan api.Change
+	if after == "" {
+		changes = feed.Watch(r.Context(), prefix)
+	} else {
+		sequence, index, err := parseEventID(after)
+
+		if err != nil {
+			writeError(w, r, api.Errorf(api.CodeInvalidRequest, "invalid event id %q", after))
+			return
+		}
+
+		if index < 0 {
+			changes, err = feed.WatchFrom(r.Context(), prefix, sequence)
+		} else {
+			changes, err = feed.WatchAfter(r.Context(), prefix, sequence, index)
+		}
+
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case c, ok := <-changes:
+			if !ok {
+				return
+			}
+			if err := writeChange(w, c); err != nil {
+				return
+			}
+			// Flush once the changes already waiting are written.
+			if len(changes) == 0 {
+				flusher.Flush()
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// writeChange writes c as a server-sent event.
+func writeChange(w http.ResponseWriter, c api.Change) error {
+	data := watchedChange{Key: c.Key, Version: c.Version}
+	event := "delete"
+	if c.Type == api.OpPut {
+		event, data.Value = "put", &c.Value
+		if !c.Expiry.IsZero() {
+			data.Expiry = &c.Expiry
+		}
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d.%d\nevent: %s\ndata: %s\n\n", c.Sequence, c.Index, event, b)
+	return err
+}
+
+// parseEventID parses an event id written by writeChange, or a plain
+// sequence number, for which it returns index -1.
+func parseEventID(id string) (uint64, int, error) {
+	seq, idx, dotted := strings.Cut(id, ".")
+
+	sequence, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil || !dotted {
+		return sequence, -1, err
+	}
+
+	index, err := strconv.Atoi(idx)
+	if err == nil && index < 0 {
+		err = fmt.Errorf("negative index %d", index)
+	}
+	return sequence, index, err
+}
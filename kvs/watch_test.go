@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/logger"
+)
+
+func TestParseEventID(t *testing.T) {
+	tests := []struct {
+		id       string
+		sequence uint64
+		index    int
+		ok       bool
+	}{
+		{"17", 17, -1, true},
+		{"17.0", 17, 0, true},
+		{"17.3", 17, 3, true},
+		{"17.", 0, 0, false},
+		{"17.-1", 0, 0, false},
+		{".3", 0, 0, false},
+		{"x", 0, 0, false},
+	}
+
+	for _, tt := range tests {
+		sequence, index, err := parseEventID(tt.id)
+		if (err == nil) != tt.ok || (tt.ok && (sequence != tt.sequence || index != tt.index)) {
+			t.Errorf("parseEventID(%q) = %d, %d, %v", tt.id, sequence, index, err)
+		}
+	}
+}
+
+// TestWatchResumesWithinBatch resumes a watch from the id of an event in
+// the middle of a batch and expects the rest of the batch.
+func TestWatchResumesWithinBatch(t *testing.T) {
+	old := feed
+	feed = api.NewFeed(watchHistory, 0)
+	defer func() { feed = old }()
+
+	publishChanges([]logger.Event{{Sequence: 1, EventType: logger.EventPut, Key: "a"}})
+	publishChanges([]logger.Event{
+		{Sequence: 2, EventType: logger.EventPut, Key: "b"},
+		{Sequence: 2, EventType: logger.EventDelete, Key: "a"},
+		{Sequence: 2, EventType: logger.EventPut, Key: "c"},
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(keyValueWatchHandler))
+	defer srv.Close()
+
+	tests := []struct {
+		lastEventID string
+		want        []string
+	}{
+		{"1.0", []string{"2.0", "2.1", "2.2"}},
+		{"2.0", []string{"2.1", "2.2"}},
+		{"2.1", []string{"2.2"}},
+		{"1", []string{"2.0", "2.1", "2.2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.lastEventID, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+			req.Header.Set("Last-Event-ID", tt.lastEventID)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			var ids []string
+			scanner := bufio.NewScanner(resp.Body)
+			for len(ids) < len(tt.want) && scanner.Scan() {
+				if id := strings.TrimPrefix(scanner.Text(), "id: "); id != scanner.Text() {
+					ids = append(ids, id)
+				}
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("resuming after %s sent %v, want %v", tt.lastEventID, ids, tt.want)
+			}
+		})
+	}
+}
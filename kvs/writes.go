@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/logger"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// notPersisted reports that the transaction log failed to persist a write.
+func notPersisted(err error) error {
+	return api.Errorf(api.CodeUnavailable, "write not persisted: %w", err)
+}
+
+// keyLocks serialize the writes to each key from the store to the
+// transaction log, so the log, and the followers and watchers fed from it,
+// see them in the order the store applied them. Keys share locks by hash.
+var keyLocks [1024]sync.Mutex
+
+// lockKeys locks the locks of keys, in index order so that concurrent
+// batches cannot deadlock, and returns a function unlocking them.
+func lockKeys(keys ...string) (unlock func()) {
+	locks := make([]int, 0, len(keys))
+	for _, k := range keys {
+		h := fnv.New32a()
+		h.Write([]byte(k))
+		locks = append(locks, int(h.Sum32()%uint32(len(keyLocks))))
+	}
+	sort.Ints(locks)
+
+	var held []int
+	for i, l := range locks {
+		if i == 0 || l != locks[i-1] {
+			keyLocks[l].Lock()
+			held = append(held, l)
+		}
+	}
+
+	return func() {
+		for _, l := range held {
+			keyLocks[l].Unlock()
+		}
+	}
+}
+
+// lockAllKeys locks every key lock, so that no write is between the store
+// and the transaction log, and returns a function unlocking them.
+func lockAllKeys() (unlock func()) {
+	for i := range keyLocks {
+		keyLocks[i].Lock()
+	}
+	return func() {
+		for i := range keyLocks {
+			keyLocks[i].Unlock()
+		}
+	}
+}
+
+// loggedStore is a store whose snapshots hold only writes that reached the
+// transaction log, never one that a failure to log it may still undo.
+type loggedStore struct {
+	api.Store
+}
+
+// Snapshot returns a copy of the store taken while no write is in flight.
+func (s loggedStore) Snapshot() map[string]api.Entry {
+	unlock := lockAllKeys()
+	defer unlock()
+	return s.Store.Snapshot()
+}
+
+// priorEntries holds the entries keys had before a write, nil for keys
+// that did not exist, so the write can be undone if the transaction log
+// fails to persist it. The keys must be locked with lockKeys.
+type priorEntries map[string]*api.Entry
+
+func lookupPrior(keys ...string) priorEntries {
+	prior := make(priorEntries, len(keys))
+	for _, k := range keys {
+		if _, ok := prior[k]; ok {
+			continue
+		}
+		if e, err := store.Lookup(k); err == nil {
+			prior[k] = &e
+		} else {
+			prior[k] = nil
+		}
+	}
+	return prior
+}
+
+// undo puts the keys back the way they were after the transaction log
+// failed with err to persist a write to them. A write whose caller gave up
+// waiting for the log once it was queued may still be persisted, so it is
+// kept.
+func (p priorEntries) undo(err error) {
+	abandoned := errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+	if abandoned && !errors.Is(err, logger.ErrNotQueued) {
+		return
+	}
+
+	for k, e := range p {
+		if e != nil {
+			store.Restore(k, *e)
+		} else {
+			store.RestoreDelete(k, api.NoVersion)
+		}
+	}
+}
+
+// putKey writes the value of key to the store and the transaction log. If
+// conditional is set, the key must be at version, as with CompareAndSwap.
+// The HTTP and gRPC frontends share it. A write the log fails to persist is
+// undone.
+func putKey(ctx context.Context, key, value string, expiry time.Time, version uint64, conditional bool) (uint64, error) {
+	if err := api.ValidateKey(key); err != nil {
+		return 0, err
+	}
+	if err := api.ValidateValue(value); err != nil {
+		return 0, err
+	}
+
+	unlock := lockKeys(key)
+	defer unlock()
+	prior := lookupPrior(key)
+
+	_, span := startSpan(ctx, "store.put", keyAttribute(key))
+	var err error
+	if conditional {
+		version, err = store.CompareAndSwap(key, version, value, expiry)
+	} else {
+		version, err = store.PutWithExpiry(key, value, expiry)
+	}
+	endSpan(span, err)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = transact.WritePut(ctx, key, value, expiry, version); err != nil {
+		prior.undo(err)
+		return 0, notPersisted(err)
+	}
+	return version, nil
+}
+
+// deleteKey deletes key from the store and logs the delete, undoing it if
+// the log fails to persist it.
+func deleteKey(ctx context.Context, key string, version uint64, conditional bool) (uint64, error) {
+	if err := api.ValidateKey(key); err != nil {
+		return 0, err
+	}
+
+	unlock := lockKeys(key)
+	defer unlock()
+	prior := lookupPrior(key)
+
+	_, span := startSpan(ctx, "store.delete", keyAttribute(key))
+	var err error
+	if conditional {
+		version, err = store.CompareAndDelete(key, version)
+	} else {
+		version, err = store.Delete(key)
+	}
+	endSpan(span, err)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = transact.WriteDelete(ctx, key, version); err != nil {
+		prior.undo(err)
+		return 0, notPersisted(err)
+	}
+	recordDelete(key)
+	return version, nil
+}
+
+// applyBatch applies ops to the store atomically and logs them as one
+// unit, undoing them if the log fails to persist them.
+func applyBatch(ctx context.Context, ops []api.Op) ([]uint64, error) {
+	for i, op := range ops {
+		if err := api.ValidateKey(op.Key); err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+		if err := api.ValidateValue(op.Value); err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+	unlock := lockKeys(keys...)
+	defer unlock()
+	prior := lookupPrior(keys...)
+
+	_, span := startSpan(ctx, "store.apply", attribute.Int("kvs.batch.operations", len(ops)))
+	versions, err := store.Apply(ops)
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]logger.Event, len(ops))
+	for i, op := range ops {
+		events[i] = logger.Event{EventType: logger.EventPut, Key: op.Key,
+			Value: op.Value, Expiry: op.Expiry, Version: versions[i]}
+		if op.Type == api.OpDelete {
+			events[i].EventType = logger.EventDelete
+		}
+	}
+
+	if err = transact.WriteBatch(ctx, events); err != nil {
+		prior.undo(err)
+		return nil, notPersisted(err)
+	}
+	for _, op := range ops {
+		if op.Type == api.OpDelete {
+			recordDelete(op.Key)
+		}
+	}
+	return versions, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloud-native-go/kvs/api"
+	"github.com/cloud-native-go/kvs/logger"
+)
+
+// useFileLog points the store and the transaction log at fresh ones, the
+// log in a temporary directory, for the duration of the test, and returns
+// the path of the log.
+func useFileLog(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "transaction.log")
+	tl, err := logger.NewFileTransactionLogger(path, logger.CommitParams{Durability: logger.DurabilitySync})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl.Run()
+
+	oldStore, oldTransact := store, transact
+	store, transact = api.NewShardedStore(storeShards), tl
+	t.Cleanup(func() {
+		tl.Close(context.Background())
+		store, transact = oldStore, oldTransact
+	})
+	return path
+}
+
+// replayInto replays the log at path into a fresh store and returns it.
+func replayInto(t *testing.T, path string) api.Store {
+	t.Helper()
+
+	tl, err := logger.NewFileTransactionLogger(path, logger.CommitParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tl.Close(context.Background())
+
+	replayed := api.NewShardedStore(storeShards)
+	events, errs := tl.ReadEvents()
+	for e := range events {
+		if e.EventType == logger.EventDelete {
+			replayed.RestoreDelete(e.Key, e.Version)
+		} else {
+			replayed.Restore(e.Key, api.Entry{Value: e.Value, Expiry: e.Expiry, Version: e.Version})
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return replayed
+}
+
+// slowLog delays logging the writes of value slow.
+type slowLog struct {
+	logger.TransactionLogger
+	slow string
+}
+
+func (l slowLog) WritePut(ctx context.Context, key, value string, expiry time.Time, version uint64) error {
+	if value == l.slow {
+		time.Sleep(20 * time.Millisecond)
+	}
+	return l.TransactionLogger.WritePut(ctx, key, value, expiry, version)
+}
+
+// TestWritesLoggedInStoreOrder checks that a write to a key cannot reach the
+// log ahead of an earlier write to it that is slow to log.
+func TestWritesLoggedInStoreOrder(t *testing.T) {
+	path := useFileLog(t)
+	transact = slowLog{transact, "first"}
+	ctx := context.Background()
+
+	done := make(chan error)
+	go func() {
+		_, err := putKey(ctx, "k", "first", time.Time{}, 0, false)
+		done <- err
+	}()
+	for v, _ := store.Get("k"); v != "first"; v, _ = store.Get("k") {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := putKey(ctx, "k", "second", time.Time{}, 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := store.Lookup("k")
+	got, err := replayInto(t, path).Lookup("k")
+	if err != nil || got != want {
+		t.Errorf("replayed %+v (%v), want %+v", got, err, want)
+	}
+}
+
+// TestConcurrentWritesReplay races writes to the same keys and checks
+// that replaying the log ends on the state the store ended on.
+func TestConcurrentWritesReplay(t *testing.T) {
+	path := useFileLog(t)
+	ctx := context.Background()
+	keys := []string{"a", "b", "c"}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := keys[(w+i)%len(keys)]
+				var err error
+				switch i % 5 {
+				case 3:
+					_, err = deleteKey(ctx, key, 0, false)
+				case 4:
+					_, err = applyBatch(ctx, []api.Op{
+						{Type: api.OpPut, Key: keys[0], Value: fmt.Sprint(w, i)},
+						{Type: api.OpPut, Key: keys[2], Value: fmt.Sprint(w, i)},
+					})
+				default:
+					_, err = putKey(ctx, key, fmt.Sprint(w, i), time.Time{}, 0, false)
+				}
+				if err != nil && api.Code(err) != api.CodeNotFound {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	replayed := replayInto(t, path)
+	for _, k := range keys {
+		want, wantErr := store.Lookup(k)
+		got, gotErr := replayed.Lookup(k)
+		if got != want || (gotErr == nil) != (wantErr == nil) {
+			t.Errorf("key %q replayed as %+v (%v), want %+v (%v)", k, got, gotErr, want, wantErr)
+		}
+	}
+}
+
+// failingLog fails every write with err.
+type failingLog struct {
+	logger.TransactionLogger
+	err error
+}
+
+func (l failingLog) WritePut(context.Context, string, string, time.Time, uint64) error {
+	return l.err
+}
+
+func (l failingLog) WriteDelete(context.Context, string, uint64) error {
+	return l.err
+}
+
+func (l failingLog) WriteBatch(context.Context, []logger.Event) error {
+	return l.err
+}
+
+func TestFailedWritesUndone(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		write func() error
+	}{
+		{"put existing", func() error {
+			_, err := putKey(ctx, "a", "changed", time.Time{}, 0, false)
+			return err
+		}},
+		{"put new", func() error {
+			_, err := putKey(ctx, "new", "value", time.Time{}, 0, false)
+			return err
+		}},
+		{"delete", func() error {
+			_, err := deleteKey(ctx, "a", 0, false)
+			return err
+		}},
+		{"batch", func() error {
+			_, err := applyBatch(ctx, []api.Op{
+				{Type: api.OpPut, Key: "a", Value: "x"},
+				{Type: api.OpDelete, Key: "b"},
+				{Type: api.OpPut, Key: "new", Value: "y"},
+				{Type: api.OpPut, Key: "a", Value: "z"},
+			})
+			return err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFileLog(t)
+			putKey(ctx, "a", "1", time.Time{}, 0, false)
+			putKey(ctx, "b", "2", time.Time{}, 0, false)
+			want := store.Snapshot()
+
+			transact = failingLog{transact, logger.ErrClosed}
+			if err := tt.write(); api.Code(err) != api.CodeUnavailable {
+				t.Fatalf("write = %v, want it reported unavailable", err)
+			}
+			if got := store.Snapshot(); !reflect.DeepEqual(got, want) {
+				t.Errorf("store holds %v after the failed write, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAbandonedWriteKept(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		kept bool
+	}{
+		// The log may still persist a write whose caller stopped waiting.
+		{"queued", context.Canceled, true},
+		{"queued, timed out", context.DeadlineExceeded, true},
+		// It never persists one that was not queued.
+		{"not queued", fmt.Errorf("%w: %w", logger.ErrNotQueued, context.Canceled), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFileLog(t)
+			transact = failingLog{transact, tt.err}
+
+			if _, err := putKey(context.Background(), "a", "1", time.Time{}, 0, false); err == nil {
+				t.Fatal("write succeeded")
+			}
+			if _, err := store.Get("a"); (err == nil) != tt.kept {
+				t.Errorf("Get() = %v, want the write kept %v", err, tt.kept)
+			}
+		})
+	}
+}
+
+func TestReplicationSnapshotWaitsForLog(t *testing.T) {
+	path := useFileLog(t)
+	transact = slowLog{transact, "slow"}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		putKey(context.Background(), "k", "slow", time.Time{}, 0, false)
+	}()
+	defer func() { <-done }()
+	for v, _ := store.Get("k"); v != "slow"; v, _ = store.Get("k") {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The write is in the store but not yet logged; the snapshot waits
+	// for it, so it never holds a write that may be undone.
+	snapshot := loggedStore{store}.Snapshot()
+	if v, _ := replayInto(t, path).Get("k"); v != "slow" {
+		t.Error("snapshot taken while a write was in flight")
+	}
+	if snapshot["k"].Value != "slow" {
+		t.Errorf("snapshot holds %+v", snapshot["k"])
+	}
+}
@@ -22,7 +22,7 @@ func emulateTransientError(ctx context.Context) (string, error) {
 }
 
 func main() {
-	r := retry.Retry(emulateTransientError, 5, 2*time.Second)
+	r := retry.Retry(emulateTransientError, 5, 2*time.Second, nil)
 	res, err := r(context.Background())
 	fmt.Println(res, err)
 }
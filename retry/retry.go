@@ -2,7 +2,8 @@ package retry
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
 	"time"
 )
 
@@ -11,18 +12,48 @@ import (
 // Effector is the function that interacts with the potentially failing service.
 type Effector func(context.Context) (string, error)
 
+// permanentError is an error that is not worth retrying.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that Retry gives up at once rather than retrying,
+// returning err itself.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
 // Retry function, which wraps the Effector function(the potentially failing method)
 // and adds the retry logic.
 // Retry function accepts Effector and returns a closure with the same function signature as Effector.
-func Retry(effector Effector, retries int, delay time.Duration) Effector {
+// Failed attempts are logged to logger, or to slog.Default() if it is nil.
+func Retry(effector Effector, retries int, delay time.Duration, logger *slog.Logger) Effector {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
 	return func(ctx context.Context) (string, error) {
 		for r := 0; ; r++ {
+			start := time.Now()
 			response, err := effector(ctx)
-			if err == nil || r >= retries {
+			if err == nil {
+				return response, nil
+			}
+			var p permanentError
+			if errors.As(err, &p) {
+				return response, p.err
+			}
+			if r >= retries {
+				logger.WarnContext(ctx, "attempt failed; giving up",
+					"attempt", r+1, "duration", time.Since(start), "error", err)
 				return response, err
 			}
 
-			log.Printf("Attempt %d failed; retrying in %v", r+1, delay)
+			logger.WarnContext(ctx, "attempt failed; retrying",
+				"attempt", r+1, "duration", time.Since(start), "delay", delay, "error", err)
 
 			select {
 			case <-time.After(delay):
@@ -2,6 +2,7 @@ package throttle
 
 import (
 	"context"
+	"log/slog"
 	"time"
 )
 
@@ -16,7 +17,12 @@ type Effector func(context.Context) (string, error)
 // it checks whether it has any remaining tokens. If yes, it decrements the token count
 // by one and triggers effector. If not, last recorded result is replayed.
 // Tokens are added at a rate of refill tokens every duration d.
-func Throttle(e Effector, max uint, refill uint, d time.Duration) Effector {
+// Throttled calls are logged to logger, or to slog.Default() if it is nil.
+func Throttle(e Effector, max uint, refill uint, d time.Duration, logger *slog.Logger) Effector {
+	if logger == nil {
+		logger = slog.Default()
+	}
+
 	var ticker *time.Ticker = nil
 	var tokens uint = max
 
@@ -51,6 +57,9 @@ func Throttle(e Effector, max uint, refill uint, d time.Duration) Effector {
 		if tokens > 0 {
 			tokens--
 			lastReturnString, lastReturnError = e(ctx)
+		} else {
+			logger.DebugContext(ctx, "throttled; replaying the last result",
+				"refill", refill, "interval", d)
 		}
 
 		return lastReturnString, lastReturnError